@@ -17,7 +17,6 @@ import (
 
 	"github.com/kr/text"
 	vcs2 "github.com/shurcooL/go/vcs"
-	"sourcegraph.com/sourcegraph/go-diff/diff"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 	//_ "sourcegraph.com/sourcegraph/go-vcs/vcs/git"
 	_ "sourcegraph.com/sourcegraph/go-vcs/vcs/gitcmd"
@@ -141,6 +140,23 @@ func main() {
 		fmt.Printf("# Revspec %q resolves to commit %s:\n", revspec, commitID)
 		printCommit(commit)
 
+		if lister, ok := repo.(vcs.CommitFilesLister); ok {
+			all, err := lister.CommitFiles(commitID, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, files := range all {
+				if files.Parent == "" {
+					fmt.Printf("# Files (%d total):\n", len(files.Files))
+				} else {
+					fmt.Printf("# Files changed from parent %s (%d total):\n", files.Parent, len(files.Files))
+				}
+				for _, f := range files.Files {
+					printChangedFile(f)
+				}
+			}
+		}
+
 	case "grep":
 		if len(args) != 2 {
 			log.Fatal("grep takes 2 arguments.")
@@ -329,31 +345,26 @@ func main() {
 		case "diff":
 			fmt.Println(vdiff.Raw)
 		case "diffstat":
-			pdiff, err := diff.ParseMultiFileDiff([]byte(vdiff.Raw))
-			if err != nil {
-				log.Fatal(err)
-			}
-			for _, fdiff := range pdiff {
-				var name string
-				if fdiff.NewName == "/dev/null" {
-					name = fdiff.OrigName
-				} else {
-					name = fdiff.NewName
+			for _, fdiff := range vdiff.Files {
+				name := fdiff.NewPath
+				if fdiff.ChangeType == vcs.FileChangeType_DELETED {
+					name = fdiff.OrigPath
 				}
 				fmt.Printf("%-50s    ", name)
-				st := fdiff.Stat()
-				const w = 30
-				total := st.Added + st.Changed + st.Deleted
-				if st.Added > 0 {
-					st.Added = (st.Added*w)/total + 1
+				if fdiff.Binary {
+					fmt.Println("Bin")
+					continue
 				}
-				if st.Changed > 0 {
-					st.Changed = (st.Changed*w)/total + 1
+				const w = 30
+				added, deleted := fdiff.Added, fdiff.Deleted
+				total := added + deleted
+				if added > 0 {
+					added = (added*w)/total + 1
 				}
-				if st.Deleted > 0 {
-					st.Deleted = (st.Deleted*w)/total + 1
+				if deleted > 0 {
+					deleted = (deleted*w)/total + 1
 				}
-				fmt.Print(strings.Repeat("+", int(st.Added)), strings.Repeat("Δ", int(st.Changed)), strings.Repeat("-", int(st.Deleted)), "\n")
+				fmt.Print(strings.Repeat("+", int(added)), strings.Repeat("-", int(deleted)), "\n")
 			}
 		}
 
@@ -505,6 +516,29 @@ func printCommit(c *vcs.Commit) {
 	fmt.Printf("%s\n%s <%s> at %v\n%s\n\n", c.ID, c.Author.Name, c.Author.Email, c.Author.Date.Time(), text.Indent(c.Message, "\t"))
 }
 
+// printChangedFile prints f like `git diff-tree --name-status` with
+// the line counts from `--numstat`.
+func printChangedFile(f *vcs.ChangedFile) {
+	status := map[vcs.FileChangeType]string{
+		vcs.FileChangeType_ADDED:   "A",
+		vcs.FileChangeType_DELETED: "D",
+		vcs.FileChangeType_RENAMED: "R",
+		vcs.FileChangeType_COPIED:  "C",
+	}[f.ChangeType]
+	if status == "" {
+		status = "M"
+	}
+	counts := "-\t-"
+	if !f.Binary {
+		counts = fmt.Sprintf("%d\t%d", f.Added, f.Deleted)
+	}
+	name := f.Path
+	if f.OrigPath != "" {
+		name = f.OrigPath + " => " + f.Path
+	}
+	fmt.Printf("%s\t%s\t%s\n", status, counts, name)
+}
+
 func printHunk(h *vcs.Hunk) {
 	fmt.Printf("L%d-%d b%d-%d\t%s\t%v\n", h.StartLine, h.EndLine, h.StartByte, h.EndByte, h.CommitID, h.Author)
 }
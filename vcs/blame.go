@@ -0,0 +1,26 @@
+package vcs
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// ParseBlameIgnoreRevs parses the contents of a file that lists commits
+// to ignore when blaming, in the format of `git blame
+// --ignore-revs-file`: one commit ID per line, with blank lines and "#"
+// comments skipped.
+func ParseBlameIgnoreRevs(data []byte) []CommitID {
+	var revs []CommitID
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			revs = append(revs, CommitID(line))
+		}
+	}
+	return revs
+}
@@ -1,6 +1,7 @@
 package vcs_test
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -48,11 +49,15 @@ func TestRepository_BlameFile(t *testing.T) {
 			wantHunks: []*vcs.Hunk{
 				{
 					StartLine: 1, EndLine: 2, StartByte: 0, EndByte: 6, CommitID: "e6093374dcf5725d8517db0dccbbf69df65dbde0",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Author:    vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Committer: &vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Summary:   "foo", OrigPath: "f", OrigStartLine: 1,
 				},
 				{
 					StartLine: 2, EndLine: 3, StartByte: 6, EndByte: 12, CommitID: "fad406f4fe02c358a09df0d03ec7a36c2c8a20f1",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Author:    vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Committer: &vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Summary:   "foo", OrigPath: "f", OrigStartLine: 2,
 				},
 			},
 		},
@@ -65,11 +70,16 @@ func TestRepository_BlameFile(t *testing.T) {
 			wantHunks: []*vcs.Hunk{
 				{
 					StartLine: 1, EndLine: 2, StartByte: 0, EndByte: 6, CommitID: "e6093374dcf5725d8517db0dccbbf69df65dbde0",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Author:    vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Committer: &vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Summary:   "foo", OrigPath: "f", OrigStartLine: 1,
 				},
 				{
 					StartLine: 2, EndLine: 3, StartByte: 6, EndByte: 12, CommitID: "fad406f4fe02c358a09df0d03ec7a36c2c8a20f1",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Author:    vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Committer: &vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+					Summary:   "foo", OrigPath: "f", OrigStartLine: 2,
+					PreviousCommitID: "e6093374dcf5725d8517db0dccbbf69df65dbde0", PreviousPath: "f",
 				},
 			},
 		},
@@ -82,11 +92,32 @@ func TestRepository_BlameFile(t *testing.T) {
 			wantHunks: []*vcs.Hunk{
 				{
 					StartLine: 1, EndLine: 2, StartByte: 0, EndByte: 6, CommitID: "f1f126ec4cf9398d85e8dac873afc3f9b174b1d6",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Author:  vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Summary: "foo", OrigPath: "f", OrigStartLine: 1,
 				},
 				{
 					StartLine: 2, EndLine: 3, StartByte: 6, EndByte: 12, CommitID: "63e47acf80095270f4e2b81e8cc01a89416c0cf3",
-					Author: vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Author:  vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Summary: "foo", OrigPath: "f", OrigStartLine: 2,
+				},
+			},
+		},
+		"hg native": {
+			repo: makeHgRepositoryNative(t, hgCommands...),
+			path: "f",
+			opt: &vcs.BlameOptions{
+				NewestCommit: "tip",
+			},
+			wantHunks: []*vcs.Hunk{
+				{
+					StartLine: 1, EndLine: 2, StartByte: 0, EndByte: 6, CommitID: "f1f126ec4cf9398d85e8dac873afc3f9b174b1d6",
+					Author:  vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Summary: "foo", OrigPath: "f", OrigStartLine: 1,
+				},
+				{
+					StartLine: 2, EndLine: 3, StartByte: 6, EndByte: 12, CommitID: "63e47acf80095270f4e2b81e8cc01a89416c0cf3",
+					Author:  vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
+					Summary: "foo", OrigPath: "f", OrigStartLine: 2,
 				},
 			},
 		},
@@ -111,3 +142,430 @@ func TestRepository_BlameFile(t *testing.T) {
 		}
 	}
 }
+
+func TestRepository_BlameFile_oldestCommit(t *testing.T) {
+	t.Parallel()
+
+	// The 2nd commit (OldestCommit) adds a line before the lines from
+	// the 1st commit, and the 3rd commit removes it again.
+	cmds := []string{
+		"printf 'line1\\nline2\\n' > f",
+		"git add f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"printf 'line0\\nline1\\nline2\\n' > f",
+		"GIT_COMMITTER_NAME=c GIT_COMMITTER_EMAIL=c@c.com GIT_COMMITTER_DATE=2006-01-02T15:04:07Z git commit -am bar --author='b <b@b.com>' --date 2006-01-02T15:04:06Z",
+		"printf 'line1\\nline2\\nline3\\n' > f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -am foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	hgCommands := []string{
+		"printf 'line1\\nline2\\n' > f",
+		"touch --date=2006-01-02T15:04:05Z f || touch -t " + times[0] + " f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"printf 'line0\\nline1\\nline2\\n' > f",
+		"touch --date=2006-01-02T15:04:05Z f || touch -t " + times[0] + " f",
+		"hg commit -m bar --date '2006-12-06 13:18:30 UTC' --user 'b <b@b.com>'",
+		"printf 'line1\\nline2\\nline3\\n' > f",
+		"touch --date=2006-01-02T15:04:05Z f || touch -t " + times[0] + " f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	gitAuthor := vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")}
+	gitCommitter := &gitAuthor
+	gitOldestAuthor := vcs.Signature{Name: "b", Email: "b@b.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")}
+	gitOldestCommitter := &vcs.Signature{Name: "c", Email: "c@c.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:07Z")}
+	hgAuthor := vcs.Signature{Name: "a", Email: "a@a.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")}
+	hgOldestAuthor := vcs.Signature{Name: "b", Email: "b@b.com", Date: mustParseTime(time.RFC3339, "2006-12-06T13:18:30Z")}
+
+	// The lines from the 1st commit are attributed to the 2nd commit,
+	// with their position in it and without a previous commit. Hunks
+	// with an empty CommitID are expected to be from the newest
+	// commit, and CommitIDs equal to OldestCommit are resolved.
+	tests := map[string]struct {
+		repo interface {
+			vcs.Blamer
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+		opt *vcs.BlameOptions
+
+		wantHunks []*vcs.Hunk
+	}{
+		"git libgit2": {
+			repo: makeGitRepositoryLibGit2(t, cmds...),
+			opt:  &vcs.BlameOptions{NewestCommit: "master", OldestCommit: "master~1"},
+			wantHunks: []*vcs.Hunk{
+				{StartLine: 1, EndLine: 3, StartByte: 0, EndByte: 12, CommitID: "master~1", Author: gitOldestAuthor, Committer: gitOldestCommitter, Summary: "bar", OrigPath: "f", OrigStartLine: 2},
+				{StartLine: 3, EndLine: 4, StartByte: 12, EndByte: 18, Author: gitAuthor, Committer: gitCommitter, Summary: "foo", OrigPath: "f", OrigStartLine: 3},
+			},
+		},
+		"git cmd": {
+			repo: makeGitRepositoryCmd(t, cmds...),
+			opt:  &vcs.BlameOptions{NewestCommit: "master", OldestCommit: "master~1"},
+			wantHunks: []*vcs.Hunk{
+				{StartLine: 1, EndLine: 3, StartByte: 0, EndByte: 12, CommitID: "master~1", Author: gitOldestAuthor, Committer: gitOldestCommitter, Summary: "bar", OrigPath: "f", OrigStartLine: 2},
+				{StartLine: 3, EndLine: 4, StartByte: 12, EndByte: 18, Author: gitAuthor, Committer: gitCommitter, Summary: "foo", OrigPath: "f", OrigStartLine: 3, PreviousCommitID: "master~1", PreviousPath: "f"},
+			},
+		},
+		"hg cmd": {
+			repo: makeHgRepositoryCmd(t, hgCommands...),
+			opt:  &vcs.BlameOptions{NewestCommit: "tip", OldestCommit: "1"},
+			wantHunks: []*vcs.Hunk{
+				{StartLine: 1, EndLine: 3, StartByte: 0, EndByte: 12, CommitID: "1", Author: hgOldestAuthor, Summary: "bar", OrigPath: "f", OrigStartLine: 2},
+				{StartLine: 3, EndLine: 4, StartByte: 12, EndByte: 18, Author: hgAuthor, Summary: "foo", OrigPath: "f", OrigStartLine: 3},
+			},
+		},
+		"hg native": {
+			repo: makeHgRepositoryNative(t, hgCommands...),
+			opt:  &vcs.BlameOptions{NewestCommit: "tip", OldestCommit: "1"},
+			wantHunks: []*vcs.Hunk{
+				{StartLine: 1, EndLine: 3, StartByte: 0, EndByte: 12, CommitID: "1", Author: hgOldestAuthor, Summary: "bar", OrigPath: "f", OrigStartLine: 2},
+				{StartLine: 3, EndLine: 4, StartByte: 12, EndByte: 18, Author: hgAuthor, Summary: "foo", OrigPath: "f", OrigStartLine: 3},
+			},
+		},
+	}
+
+	for label, test := range tests {
+		newestCommitID, err := test.repo.ResolveRevision(string(test.opt.NewestCommit))
+		if err != nil {
+			t.Errorf("%s: ResolveRevision(%q) on base: %s", label, test.opt.NewestCommit, err)
+			continue
+		}
+		oldestCommitID, err := test.repo.ResolveRevision(string(test.opt.OldestCommit))
+		if err != nil {
+			t.Errorf("%s: ResolveRevision(%q) on base: %s", label, test.opt.OldestCommit, err)
+			continue
+		}
+		for _, hunk := range test.wantHunks {
+			if hunk.CommitID == "" {
+				hunk.CommitID = newestCommitID
+			}
+			if hunk.CommitID == test.opt.OldestCommit {
+				hunk.CommitID = oldestCommitID
+			}
+			if hunk.PreviousCommitID == test.opt.OldestCommit {
+				hunk.PreviousCommitID = oldestCommitID
+			}
+		}
+
+		test.opt.NewestCommit = newestCommitID
+		test.opt.OldestCommit = oldestCommitID
+		hunks, err := test.repo.BlameFile("f", test.opt)
+		if err != nil {
+			t.Errorf("%s: BlameFile(f, %+v): %s", label, test.opt, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(hunks, test.wantHunks) {
+			t.Errorf("%s: hunks != wantHunks\n\nhunks ==========\n%s\n\nwantHunks ==========\n%s", label, asJSON(hunks), asJSON(test.wantHunks))
+		}
+	}
+}
+
+func TestRepository_BlameFile_ignore(t *testing.T) {
+	t.Parallel()
+
+	// c2 only changes whitespace, and c3 is listed in
+	// .git-blame-ignore-revs (added in c4).
+	gitCommands := []string{
+		"printf 'a\\nb\\n' > f",
+		"git add f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m c1 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c1",
+		"printf 'a\\n  b\\n' > f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -am c2 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c2",
+		"printf 'A\\n  b\\n' > f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -am c3 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c3",
+		"(echo '# reformat'; git rev-parse c3) > .git-blame-ignore-revs",
+		"git add .git-blame-ignore-revs",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m c4 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c4",
+	}
+	hgCommands := []string{
+		"printf 'a\\nb\\n' > f",
+		"hg add f",
+		"hg commit -m c1 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c1",
+		"printf 'a\\n  b\\n' > f",
+		"hg commit -m c2 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c2",
+		"printf 'A\\n  b\\n' > f",
+		"hg commit -m c3 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c3",
+		"(echo '# reformat'; hg log -r c3 --template '{node}\\n') > .git-blame-ignore-revs",
+		"hg add .git-blame-ignore-revs",
+		"hg commit -m c4 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c4",
+	}
+	type blamer interface {
+		vcs.Blamer
+		ResolveRevision(spec string) (vcs.CommitID, error)
+	}
+	repos := map[string]blamer{
+		"git libgit2": makeGitRepositoryLibGit2(t, gitCommands...),
+		"git cmd":     makeGitRepositoryCmd(t, gitCommands...),
+		"hg cmd":      makeHgRepositoryCmd(t, hgCommands...),
+		"hg native":   makeHgRepositoryNative(t, hgCommands...),
+	}
+	tests := map[string]struct {
+		opt       vcs.BlameOptions
+		ignoreRev string // a revision to add to opt.IgnoreRevs
+
+		wantHunks []string
+	}{
+		"default": {
+			wantHunks: []string{"1-2 c3", "2-3 c1"},
+		},
+		"NoIgnoreWhitespace": {
+			opt:       vcs.BlameOptions{NoIgnoreWhitespace: true},
+			wantHunks: []string{"1-2 c3", "2-3 c2"},
+		},
+		"IgnoreRevs": {
+			opt:       vcs.BlameOptions{NoIgnoreWhitespace: true},
+			ignoreRev: "c3",
+			wantHunks: []string{"1-2 c1", "2-3 c2"},
+		},
+		"IgnoreRevsFile": {
+			opt:       vcs.BlameOptions{NoIgnoreWhitespace: true, IgnoreRevsFile: ".git-blame-ignore-revs"},
+			wantHunks: []string{"1-2 c1", "2-3 c2"},
+		},
+		"IgnoreRevsFile nonexistent": {
+			opt:       vcs.BlameOptions{NoIgnoreWhitespace: true, IgnoreRevsFile: "doesntexist"},
+			wantHunks: []string{"1-2 c3", "2-3 c2"},
+		},
+	}
+
+	for repoLabel, repo := range repos {
+		revNames := map[vcs.CommitID]string{}
+		revs := map[string]vcs.CommitID{}
+		for _, name := range []string{"c1", "c2", "c3", "c4"} {
+			id, err := repo.ResolveRevision(name)
+			if err != nil {
+				t.Fatalf("%s: ResolveRevision(%q): %s", repoLabel, name, err)
+			}
+			revNames[id], revs[name] = name, id
+		}
+
+		for label, test := range tests {
+			label = repoLabel + ": " + label
+			opt := test.opt
+			opt.NewestCommit = revs["c4"]
+			if test.ignoreRev != "" {
+				opt.IgnoreRevs = []vcs.CommitID{revs[test.ignoreRev]}
+			}
+			hunks, err := repo.BlameFile("f", &opt)
+			if err != nil {
+				t.Errorf("%s: BlameFile(f, %+v): %s", label, opt, err)
+				continue
+			}
+
+			var got []string
+			for _, hunk := range hunks {
+				got = append(got, fmt.Sprintf("%d-%d %s", hunk.StartLine, hunk.EndLine, revNames[hunk.CommitID]))
+			}
+			if !reflect.DeepEqual(got, test.wantHunks) {
+				t.Errorf("%s: got hunks %q, want %q", label, got, test.wantHunks)
+			}
+		}
+	}
+}
+
+func TestRepository_BlameFile_detectCopies(t *testing.T) {
+	t.Parallel()
+
+	// c2 swaps the lines of f, and c3 moves the first line of f to a
+	// new file g.
+	cmds := []string{
+		"printf 'the first line is long enough to be detected when it is moved or copied\\nthe second line is long enough to be detected when it is moved or copied\\n' > f",
+		"git add f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m c1 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c1",
+		"printf 'the second line is long enough to be detected when it is moved or copied\\nthe first line is long enough to be detected when it is moved or copied\\n' > f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -am c2 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c2",
+		"printf 'the second line is long enough to be detected when it is moved or copied\\n' > f",
+		"printf 'the first line is long enough to be detected when it is moved or copied\\n' > g",
+		"git add g",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -am c3 --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag c3",
+	}
+	type blamer interface {
+		vcs.Blamer
+		ResolveRevision(spec string) (vcs.CommitID, error)
+	}
+	repos := map[string]blamer{
+		"git libgit2": makeGitRepositoryLibGit2(t, cmds...),
+		"git cmd":     makeGitRepositoryCmd(t, cmds...),
+	}
+	tests := map[string]struct {
+		path string
+		at   string
+		opt  vcs.BlameOptions
+
+		// The hunks' lines, commits, and original paths and lines.
+		wantHunks []string
+	}{
+		"f": {
+			path:      "f",
+			at:        "c2",
+			wantHunks: []string{"1-2 c1 f:2", "2-3 c2 f:2"},
+		},
+		"f DetectMoves": {
+			path:      "f",
+			at:        "c2",
+			opt:       vcs.BlameOptions{DetectMoves: true},
+			wantHunks: []string{"1-2 c1 f:2", "2-3 c1 f:1"},
+		},
+		"g": {
+			path:      "g",
+			at:        "c3",
+			wantHunks: []string{"1-2 c3 g:1"},
+		},
+		"g DetectCopies": {
+			path:      "g",
+			at:        "c3",
+			opt:       vcs.BlameOptions{DetectCopies: true},
+			wantHunks: []string{"1-2 c1 f:1"},
+		},
+	}
+
+	for repoLabel, repo := range repos {
+		revNames := map[vcs.CommitID]string{}
+		revs := map[string]vcs.CommitID{}
+		for _, name := range []string{"c1", "c2", "c3"} {
+			id, err := repo.ResolveRevision(name)
+			if err != nil {
+				t.Fatalf("%s: ResolveRevision(%q): %s", repoLabel, name, err)
+			}
+			revNames[id], revs[name] = name, id
+		}
+
+		for label, test := range tests {
+			label = repoLabel + ": " + label
+			opt := test.opt
+			opt.NewestCommit = revs[test.at]
+			hunks, err := repo.BlameFile(test.path, &opt)
+			if err != nil {
+				t.Errorf("%s: BlameFile(%s, %+v): %s", label, test.path, opt, err)
+				continue
+			}
+
+			var got []string
+			for _, hunk := range hunks {
+				got = append(got, fmt.Sprintf("%d-%d %s %s:%d", hunk.StartLine, hunk.EndLine, revNames[hunk.CommitID], hunk.OrigPath, hunk.OrigStartLine))
+			}
+			if !reflect.DeepEqual(got, test.wantHunks) {
+				t.Errorf("%s: got hunks %q, want %q", label, got, test.wantHunks)
+			}
+		}
+	}
+}
+
+func TestRepository_BlameFile_hgCopies(t *testing.T) {
+	t.Parallel()
+
+	// c2 renames f to g, c3 copies g to h (and changes both), and c5
+	// merges c3 into c4, which also changed g.
+	hgCommands := []string{
+		"printf 'a\\nb\\nc\\n' > f",
+		"hg add f",
+		"hg commit -m c1 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c1",
+		"hg mv f g",
+		"printf 'a\\nB\\nc\\n' > g",
+		"hg commit -m c2 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c2",
+		"hg copy g h",
+		"printf 'a\\nB\\nc\\ny\\n' > g",
+		"printf 'a\\nB\\nc\\nd\\n' > h",
+		"hg commit -m c3 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c3",
+		"hg update -q c2",
+		"printf 'x\\na\\nB\\nc\\n' > g",
+		"hg commit -m c4 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c4",
+		"hg merge -q --tool=internal:merge c3",
+		"hg commit -m c5 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg tag -l c5",
+	}
+	type blamer interface {
+		vcs.Blamer
+		ResolveRevision(spec string) (vcs.CommitID, error)
+	}
+	repos := map[string]blamer{
+		"hg cmd":    makeHgRepositoryCmd(t, hgCommands...),
+		"hg native": makeHgRepositoryNative(t, hgCommands...),
+	}
+	tests := map[string]struct {
+		path   string
+		at     string
+		oldest string
+
+		// The hunks' lines, commits, and original paths and lines.
+		wantHunks []string
+	}{
+		"renamed": {
+			path:      "g",
+			at:        "c2",
+			wantHunks: []string{"1-2 c1 f:1", "2-3 c2 g:2", "3-4 c1 f:3"},
+		},
+		"copied": {
+			path:      "h",
+			at:        "c3",
+			wantHunks: []string{"1-2 c1 f:1", "2-3 c2 g:2", "3-4 c1 f:3", "4-5 c3 h:4"},
+		},
+		"merged": {
+			path:      "g",
+			at:        "c5",
+			wantHunks: []string{"1-2 c4 g:1", "2-3 c1 f:1", "3-4 c2 g:2", "4-5 c1 f:3", "5-6 c3 g:4"},
+		},
+		"merged OldestCommit": {
+			path:      "g",
+			at:        "c5",
+			oldest:    "c2",
+			wantHunks: []string{"1-2 c4 g:1", "2-5 c2 g:1", "5-6 c3 g:4"},
+		},
+	}
+
+	// The hunks returned by each repository, to check that the native
+	// implementation agrees with `hg annotate`.
+	allHunks := map[string]map[string][]*vcs.Hunk{}
+	for repoLabel, repo := range repos {
+		revNames := map[vcs.CommitID]string{}
+		revs := map[string]vcs.CommitID{}
+		for _, name := range []string{"c1", "c2", "c3", "c4", "c5"} {
+			id, err := repo.ResolveRevision(name)
+			if err != nil {
+				t.Fatalf("%s: ResolveRevision(%q): %s", repoLabel, name, err)
+			}
+			revNames[id], revs[name] = name, id
+		}
+
+		for label, test := range tests {
+			opt := vcs.BlameOptions{NewestCommit: revs[test.at], OldestCommit: revs[test.oldest]}
+			hunks, err := repo.BlameFile(test.path, &opt)
+			if err != nil {
+				t.Errorf("%s: %s: BlameFile(%s, %+v): %s", repoLabel, label, test.path, opt, err)
+				continue
+			}
+			if allHunks[label] == nil {
+				allHunks[label] = map[string][]*vcs.Hunk{}
+			}
+			allHunks[label][repoLabel] = hunks
+
+			var got []string
+			for _, hunk := range hunks {
+				got = append(got, fmt.Sprintf("%d-%d %s %s:%d", hunk.StartLine, hunk.EndLine, revNames[hunk.CommitID], hunk.OrigPath, hunk.OrigStartLine))
+			}
+			if !reflect.DeepEqual(got, test.wantHunks) {
+				t.Errorf("%s: %s: got hunks %q, want %q", repoLabel, label, got, test.wantHunks)
+			}
+		}
+	}
+
+	for label, hunks := range allHunks {
+		if native, cmd := hunks["hg native"], hunks["hg cmd"]; native != nil && cmd != nil && !reflect.DeepEqual(native, cmd) {
+			t.Errorf("%s: hg native hunks != hg cmd hunks\n\nhg native ==========\n%s\n\nhg cmd ==========\n%s", label, asJSON(native), asJSON(cmd))
+		}
+	}
+}
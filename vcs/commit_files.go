@@ -0,0 +1,22 @@
+package vcs
+
+// A CommitFilesLister is a repository that can list the files that a
+// commit changed, without the caller having to diff the commit
+// against its parents.
+type CommitFilesLister interface {
+	// CommitFiles returns the files that the commit changed compared
+	// with each of its parents, in the order of its parents. A root
+	// commit is compared with an empty tree, and a merge commit has
+	// an entry for each parent. Renames are always detected.
+	CommitFiles(id CommitID, opt *CommitFilesOptions) ([]*CommitFiles, error)
+}
+
+// CommitFilesOptions configures (CommitFilesLister).CommitFiles. A
+// nil *CommitFilesOptions uses the defaults.
+type CommitFilesOptions struct {
+	// DetectCopies is whether to report files that were copied from
+	// another file that the commit changed as COPIED (like `git
+	// diff-tree -C`). hg records copies when they are made, so they
+	// are always reported for hg repositories.
+	DetectCopies bool
+}
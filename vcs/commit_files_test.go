@@ -0,0 +1,215 @@
+package vcs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestCommitFilesLister_CommitFiles(t *testing.T) {
+	t.Parallel()
+
+	gitCommit := "GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z"
+	gitCommands := []string{
+		"printf 'a\\nb\\nc\\n' > f",
+		"echo g > g",
+		"printf 'a\\0b' > bin",
+		"git add -A",
+		gitCommit,
+		"git tag root",
+		"printf 'a\\nB\\nc\\nd\\n' > f",
+		"git mv g h",
+		"git rm -q bin",
+		"echo k > k",
+		"git add -A",
+		gitCommit,
+		"git tag second",
+		"git checkout -q -b b root",
+		"echo l > l",
+		"git add l",
+		gitCommit,
+		"git checkout -q master",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z GIT_AUTHOR_NAME=a GIT_AUTHOR_EMAIL=a@a.com git merge -q --no-ff -m merge b",
+		"git tag merge",
+	}
+	hgCommit := "hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'"
+	hgCommands := []string{
+		"printf 'a\\nb\\nc\\n' > f",
+		"echo g > g",
+		"hg add f g",
+		hgCommit,
+		"printf 'a\\nB\\nc\\nd\\n' > f",
+		"hg mv g h",
+		"echo k > k",
+		"hg add k",
+		hgCommit,
+	}
+
+	// The Parent fields are revspecs, which are resolved during the
+	// test.
+	gitWant := map[string][]*vcs.CommitFiles{
+		"root": {{
+			Files: []*vcs.ChangedFile{
+				{Path: "bin", ChangeType: vcs.FileChangeType_ADDED, Binary: true},
+				{Path: "f", ChangeType: vcs.FileChangeType_ADDED, Added: 3},
+				{Path: "g", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+			},
+		}},
+		"second": {{
+			Parent: "root",
+			Files: []*vcs.ChangedFile{
+				{Path: "bin", ChangeType: vcs.FileChangeType_DELETED, Binary: true},
+				{Path: "f", ChangeType: vcs.FileChangeType_MODIFIED, Added: 2, Deleted: 1},
+				{Path: "h", OrigPath: "g", ChangeType: vcs.FileChangeType_RENAMED},
+				{Path: "k", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+			},
+		}},
+		"merge": {
+			{
+				Parent: "second",
+				Files: []*vcs.ChangedFile{
+					{Path: "l", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+				},
+			},
+			{
+				Parent: "b",
+				Files: []*vcs.ChangedFile{
+					{Path: "bin", ChangeType: vcs.FileChangeType_DELETED, Binary: true},
+					{Path: "f", ChangeType: vcs.FileChangeType_MODIFIED, Added: 2, Deleted: 1},
+					{Path: "h", OrigPath: "g", ChangeType: vcs.FileChangeType_RENAMED},
+					{Path: "k", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+				},
+			},
+		},
+	}
+	hgWant := map[string][]*vcs.CommitFiles{
+		"0": {{
+			Files: []*vcs.ChangedFile{
+				{Path: "f", ChangeType: vcs.FileChangeType_ADDED, Added: 3},
+				{Path: "g", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+			},
+		}},
+		"1": {{
+			Parent: "0",
+			Files: []*vcs.ChangedFile{
+				{Path: "f", ChangeType: vcs.FileChangeType_MODIFIED, Added: 2, Deleted: 1},
+				{Path: "h", OrigPath: "g", ChangeType: vcs.FileChangeType_RENAMED},
+				{Path: "k", ChangeType: vcs.FileChangeType_ADDED, Added: 1},
+			},
+		}},
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.CommitFilesLister
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+		want map[string][]*vcs.CommitFiles // revspec -> files
+	}{
+		"git libgit2": {
+			repo: makeGitRepositoryLibGit2(t, gitCommands...),
+			want: gitWant,
+		},
+		"git cmd": {
+			repo: makeGitRepositoryCmd(t, gitCommands...),
+			want: gitWant,
+		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			want: gitWant,
+		},
+		"hg native": {
+			repo: makeHgRepositoryNative(t, hgCommands...),
+			want: hgWant,
+		},
+		"hg cmd": {
+			repo: makeHgRepositoryCmd(t, hgCommands...),
+			want: hgWant,
+		},
+	}
+
+	for label, test := range tests {
+		for rev, want := range test.want {
+			commitID, err := test.repo.ResolveRevision(rev)
+			if err != nil {
+				t.Errorf("%s: ResolveRevision(%q): %s", label, rev, err)
+				continue
+			}
+
+			var wantFiles []*vcs.CommitFiles
+			for _, files := range want {
+				files := *files
+				if files.Parent != "" {
+					files.Parent, err = test.repo.ResolveRevision(string(files.Parent))
+					if err != nil {
+						t.Fatalf("%s: ResolveRevision(%q): %s", label, files.Parent, err)
+					}
+				}
+				wantFiles = append(wantFiles, &files)
+			}
+
+			files, err := test.repo.CommitFiles(commitID, nil)
+			if err != nil {
+				t.Errorf("%s: CommitFiles(%q): %s", label, rev, err)
+				continue
+			}
+			if !reflect.DeepEqual(files, wantFiles) {
+				t.Errorf("%s: CommitFiles(%q): got %s, want %s", label, rev, asJSON(files), asJSON(wantFiles))
+			}
+		}
+
+		if _, err := test.repo.CommitFiles(nonexistentCommitID, nil); err != vcs.ErrCommitNotFound {
+			t.Errorf("%s: CommitFiles with bad commit ID: want ErrCommitNotFound, got %v", label, err)
+		}
+	}
+}
+
+func TestCommitFilesLister_CommitFiles_detectCopies(t *testing.T) {
+	t.Parallel()
+
+	cmds := []string{
+		"seq 1 10 > f",
+		"git add f",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"cp f g",
+		"echo 11 >> f",
+		"git add f g",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.CommitFilesLister
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+	}{
+		"git libgit2": {repo: makeGitRepositoryLibGit2(t, cmds...)},
+		"git cmd":     {repo: makeGitRepositoryCmd(t, cmds...)},
+	}
+
+	for label, test := range tests {
+		commitID, err := test.repo.ResolveRevision("master")
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+
+		for _, detectCopies := range []bool{false, true} {
+			files, err := test.repo.CommitFiles(commitID, &vcs.CommitFilesOptions{DetectCopies: detectCopies})
+			if err != nil {
+				t.Errorf("%s: CommitFiles(DetectCopies=%v): %s", label, detectCopies, err)
+				continue
+			}
+
+			want := []*vcs.ChangedFile{
+				{Path: "f", ChangeType: vcs.FileChangeType_MODIFIED, Added: 1},
+				{Path: "g", ChangeType: vcs.FileChangeType_ADDED, Added: 10},
+			}
+			if detectCopies {
+				want[1] = &vcs.ChangedFile{Path: "g", OrigPath: "f", ChangeType: vcs.FileChangeType_COPIED}
+			}
+			if len(files) != 1 || !reflect.DeepEqual(files[0].Files, want) {
+				t.Errorf("%s: CommitFiles(DetectCopies=%v): got %s, want files %s", label, detectCopies, asJSON(files), asJSON(want))
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package vcs
+
+import "os"
+
+// A CommitWriter is a repository that can create new commits.
+type CommitWriter interface {
+	// CreateCommit creates a new commit whose tree is opt.Parent's
+	// tree with opt.Changes applied, and returns the new commit's
+	// ID. It does not use or modify the repository's working tree
+	// (if any).
+	//
+	// If opt.Branch is set, the branch is updated to point to the
+	// new commit. An existing branch is only updated if it points to
+	// opt.Parent (otherwise ErrRefConflict is returned), so that
+	// concurrent writers can't clobber each other's commits; a
+	// nonexistent branch is created.
+	CreateCommit(opt CreateCommitOptions) (CommitID, error)
+}
+
+// CreateCommitOptions describes a commit to create with
+// (CommitWriter).CreateCommit.
+type CreateCommitOptions struct {
+	// Parent is the commit that the new commit is based on. If empty,
+	// a root commit is created, containing only the files in Changes.
+	Parent CommitID
+
+	// Changes are the file additions, modifications, and deletions
+	// to apply to Parent's tree.
+	Changes []FileChange
+
+	// Author is the author of the new commit. If Author.Date is the
+	// zero value, the current time is used.
+	Author Signature
+
+	// Committer is the committer of the new commit. If nil, Author
+	// is used. (Mercurial doesn't distinguish between the author and
+	// committer, so it is ignored by hg repositories.)
+	Committer *Signature
+
+	// Message is the commit message.
+	Message string
+
+	// Branch, if set, is the name of the branch to update to point
+	// to the new commit.
+	Branch string
+}
+
+// A FileChange is a change to a single file in a commit created by
+// (CommitWriter).CreateCommit.
+type FileChange struct {
+	// Path is the slash-separated path of the file, relative to the
+	// repository root. Writing a file replaces a directory at Path
+	// (and everything in it), and a file in place of one of Path's
+	// parent directories.
+	Path string
+
+	// Delete is whether to delete the file. If true, Data and Mode
+	// are ignored.
+	Delete bool
+
+	// Data is the new contents of the file (or, for a symlink, the
+	// path that it points to).
+	Data []byte
+
+	// Mode determines the type of the file: os.ModeSymlink for a
+	// symlink, any of the 0111 bits set for an executable file, and
+	// otherwise a regular file.
+	Mode os.FileMode
+}
@@ -0,0 +1,238 @@
+package vcs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestRepository_CreateCommit(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"echo -n a1 > a",
+		"echo -n x > x",
+		"echo '*.log' > .gitignore",
+		"git add a x .gitignore",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	hgCommands := []string{
+		"echo -n a1 > a",
+		"echo -n x > x",
+		"echo 'glob:*.log' > .hgignore",
+		"hg add a x .hgignore",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.Repository
+			vcs.CommitWriter
+		}
+		branch string
+	}{
+		"git libgit2": {
+			repo:   makeGitRepositoryLibGit2(t, gitCommands...),
+			branch: "master",
+		},
+		"git cmd": {
+			repo:   makeGitRepositoryCmd(t, gitCommands...),
+			branch: "master",
+		},
+		"hg native": {
+			repo:   makeHgRepositoryNative(t, hgCommands...),
+			branch: "default",
+		},
+		"hg cmd": {
+			repo:   makeHgRepositoryCmd(t, hgCommands...),
+			branch: "default",
+		},
+	}
+
+	author := vcs.Signature{Name: "b", Email: "b@b.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")}
+
+	for label, test := range tests {
+		parent, err := test.repo.ResolveBranch(test.branch)
+		if err != nil {
+			t.Errorf("%s: ResolveBranch: %s", label, err)
+			continue
+		}
+
+		opt := vcs.CreateCommitOptions{
+			Parent: parent,
+			Changes: []vcs.FileChange{
+				{Path: "a", Data: []byte("a2")},
+				{Path: "d/e/f", Data: []byte("f"), Mode: 0755},
+				{Path: "x", Delete: true},
+				{Path: "y.log", Data: []byte("y")},
+			},
+			Author:  author,
+			Message: "bar",
+			Branch:  test.branch,
+		}
+		id, err := test.repo.CreateCommit(opt)
+		if err != nil {
+			t.Errorf("%s: CreateCommit: %s", label, err)
+			continue
+		}
+
+		if head, err := test.repo.ResolveBranch(test.branch); err != nil {
+			t.Errorf("%s: ResolveBranch: %s", label, err)
+		} else if head != id {
+			t.Errorf("%s: got branch %q at %s, want %s", label, test.branch, head, id)
+		}
+
+		commit, err := test.repo.GetCommit(id)
+		if err != nil {
+			t.Errorf("%s: GetCommit: %s", label, err)
+			continue
+		}
+		if commit.Message != "bar" {
+			t.Errorf("%s: got commit message %q, want %q", label, commit.Message, "bar")
+		}
+		if commit.Author != author {
+			t.Errorf("%s: got commit author %+v, want %+v", label, commit.Author, author)
+		}
+		if want := []vcs.CommitID{parent}; !reflect.DeepEqual(commit.Parents, want) {
+			t.Errorf("%s: got commit parents %v, want %v", label, commit.Parents, want)
+		}
+
+		fs, err := test.repo.FileSystem(id)
+		if err != nil {
+			t.Errorf("%s: FileSystem: %s", label, err)
+			continue
+		}
+		// Ignored files are committed too.
+		for name, want := range map[string]string{"a": "a2", "d/e/f": "f", "y.log": "y"} {
+			data, err := vfs.ReadFile(fs, name)
+			if err != nil {
+				t.Errorf("%s: fs.ReadFile(%q): %s", label, name, err)
+				continue
+			}
+			if string(data) != want {
+				t.Errorf("%s: got file %q contents %q, want %q", label, name, data, want)
+			}
+		}
+		if _, err := fs.Lstat("x"); !os.IsNotExist(err) {
+			t.Errorf("%s: fs.Lstat(%q): got err %v, want os.IsNotExist", label, "x", err)
+		}
+
+		// Creating another commit on the original parent must not
+		// move the branch, which now points to the new commit.
+		if _, err := test.repo.CreateCommit(opt); err != vcs.ErrRefConflict {
+			t.Errorf("%s: CreateCommit on stale parent: got err %v, want %v", label, err, vcs.ErrRefConflict)
+		}
+		if head, err := test.repo.ResolveBranch(test.branch); err != nil {
+			t.Errorf("%s: ResolveBranch: %s", label, err)
+		} else if head != id {
+			t.Errorf("%s: after stale CreateCommit, got branch %q at %s, want %s", label, test.branch, head, id)
+		}
+
+		// Deleting a nonexistent file is an error.
+		delOpt := vcs.CreateCommitOptions{
+			Parent:  id,
+			Changes: []vcs.FileChange{{Path: "x", Delete: true}},
+			Author:  author,
+			Message: "baz",
+		}
+		if _, err := test.repo.CreateCommit(delOpt); !os.IsNotExist(err) {
+			t.Errorf("%s: CreateCommit deleting nonexistent file: got err %v, want os.IsNotExist", label, err)
+		}
+
+		// A file in the way of a directory is replaced by it, and
+		// vice versa.
+		replaceOpt := vcs.CreateCommitOptions{
+			Parent: id,
+			Changes: []vcs.FileChange{
+				{Path: "a/b", Data: []byte("b")},
+				{Path: "d", Data: []byte("d")},
+			},
+			Author:  author,
+			Message: "qux",
+		}
+		replaceID, err := test.repo.CreateCommit(replaceOpt)
+		if err != nil {
+			t.Errorf("%s: CreateCommit replacing files and directories: %s", label, err)
+			continue
+		}
+		fs, err = test.repo.FileSystem(replaceID)
+		if err != nil {
+			t.Errorf("%s: FileSystem: %s", label, err)
+			continue
+		}
+		for name, want := range map[string]string{"a/b": "b", "d": "d"} {
+			data, err := vfs.ReadFile(fs, name)
+			if err != nil {
+				t.Errorf("%s: after replacing, fs.ReadFile(%q): %s", label, name, err)
+				continue
+			}
+			if string(data) != want {
+				t.Errorf("%s: after replacing, got file %q contents %q, want %q", label, name, data, want)
+			}
+		}
+		if _, err := fs.Lstat("d/e/f"); err == nil {
+			t.Errorf("%s: after replacing, fs.Lstat(%q): got nil error, want error", label, "d/e/f")
+		}
+	}
+}
+
+func TestRepository_CreateCommit_unsafePaths(t *testing.T) {
+	t.Parallel()
+
+	// Changes must not be written outside of the (temporary) working
+	// directory that hg needs to create commits, or to its .hg
+	// directory.
+	outside := makeTmpDir(t, "outside")
+	if err := ioutil.WriteFile(filepath.Join(outside, "y"), []byte("y"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hgCommands := []string{
+		"ln -s " + outside + " lnk",
+		"hg add lnk",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	tests := map[string]interface {
+		vcs.Repository
+		vcs.CommitWriter
+	}{
+		"hg native": makeHgRepositoryNative(t, hgCommands...),
+		"hg cmd":    makeHgRepositoryCmd(t, hgCommands...),
+	}
+
+	changes := map[string][]vcs.FileChange{
+		"hgrc":                {{Path: ".hg/hgrc", Data: []byte("[hooks]\nprecommit = touch " + filepath.Join(outside, "x") + "\n")}},
+		"hgrc uppercase":      {{Path: ".HG/hgrc", Data: []byte("[hooks]\n")}},
+		"through symlink":     {{Path: "lnk/x", Data: []byte("x")}},
+		"delete via symlink":  {{Path: "lnk/y", Delete: true}},
+		"through new symlink": {{Path: "l", Data: []byte(outside), Mode: os.ModeSymlink}, {Path: "l/x", Data: []byte("x")}},
+	}
+
+	for label, repo := range tests {
+		parent, err := repo.ResolveRevision("tip")
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+		for changesLabel, c := range changes {
+			_, err := repo.CreateCommit(vcs.CreateCommitOptions{
+				Parent:  parent,
+				Changes: c,
+				Message: "bar",
+			})
+			if err == nil {
+				t.Errorf("%s: %s: CreateCommit: got nil error, want error", label, changesLabel)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+			t.Errorf("%s: file written outside of the repository (Lstat error %v)", label, err)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "y")); err != nil {
+			t.Errorf("%s: file deleted outside of the repository: %s", label, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package vcs
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// A CommitFilter applies the NoMerges, MergesOnly, Author, Committer,
+// Message, Since and Until CommitsOptions to commits. It is for use by
+// Repository implementations that walk the commit history themselves.
+type CommitFilter struct {
+	opt                        CommitsOptions
+	author, committer, message *regexp.Regexp
+}
+
+// NewCommitFilter returns a filter for opt's criteria. It returns an
+// error if one of opt's regexps or its Order is invalid.
+func NewCommitFilter(opt CommitsOptions) (*CommitFilter, error) {
+	switch opt.Order {
+	case "", DateOrder, AuthorDateOrder, TopoOrder:
+	default:
+		return nil, fmt.Errorf("unrecognized commits order: %q", opt.Order)
+	}
+
+	f := &CommitFilter{opt: opt}
+	var err error
+	if f.author, err = compileCommitRegexp("", opt.Author); err != nil {
+		return nil, err
+	}
+	if f.committer, err = compileCommitRegexp("", opt.Committer); err != nil {
+		return nil, err
+	}
+	// Match the message line by line, like git does.
+	if f.message, err = compileCommitRegexp("(?m)", opt.Message); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compileCommitRegexp compiles the regexp expr (with the flags
+// prefix), or returns nil if expr is empty.
+func compileCommitRegexp(flags, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(flags + expr)
+}
+
+// Match reports whether the commit meets the filter's criteria.
+func (f *CommitFilter) Match(c *Commit) bool {
+	if f.opt.NoMerges && len(c.Parents) > 1 {
+		return false
+	}
+	if f.opt.MergesOnly && len(c.Parents) < 2 {
+		return false
+	}
+
+	committer := c.Committer
+	if committer == nil {
+		committer = &c.Author
+	}
+	if f.author != nil && !f.author.MatchString(c.Author.Name+" <"+c.Author.Email+">") {
+		return false
+	}
+	if f.committer != nil && !f.committer.MatchString(committer.Name+" <"+committer.Email+">") {
+		return false
+	}
+	if f.message != nil && !f.message.MatchString(c.Message) {
+		return false
+	}
+
+	date := committer.Date.Time()
+	if !f.opt.Since.IsZero() && date.Before(f.opt.Since) {
+		return false
+	}
+	if !f.opt.Until.IsZero() && date.After(f.opt.Until) {
+		return false
+	}
+	return true
+}
+
+// SortCommits sorts commits in the order (DateOrder, AuthorDateOrder
+// or TopoOrder) the same way that git does. The commits must be in
+// the VCS's default order, which is used to break ties. If order is
+// "", the commits are left as they are. It is for use by Repository
+// implementations that walk the commit history themselves.
+func SortCommits(commits []*Commit, order string) error {
+	q := &commitSortQueue{commits: commits}
+	switch order {
+	case "":
+		return nil
+	case DateOrder:
+		q.date = func(c *Commit) time.Time {
+			if c.Committer != nil {
+				return c.Committer.Date.Time()
+			}
+			return c.Author.Date.Time()
+		}
+	case AuthorDateOrder:
+		q.date = func(c *Commit) time.Time { return c.Author.Date.Time() }
+	case TopoOrder:
+		// Use a stack, which keeps lines of history together.
+	default:
+		return fmt.Errorf("unrecognized commits order: %q", order)
+	}
+
+	// The indegree of each commit is 1 more than the number of its
+	// children that haven't been output yet, and 0 once it has been
+	// output (like git's sort_in_topological_order).
+	index := make(map[CommitID]int, len(commits))
+	for i, c := range commits {
+		index[c.ID] = i
+	}
+	indegree := make([]int, len(commits))
+	for i := range indegree {
+		indegree[i] = 1
+	}
+	for _, c := range commits {
+		for _, p := range c.Parents {
+			if j, ok := index[p]; ok {
+				indegree[j]++
+			}
+		}
+	}
+
+	// Start with the commits that have no children in the list, in
+	// their original order.
+	for i := range commits {
+		if indegree[i] == 1 {
+			q.put(i)
+		}
+	}
+	if q.date == nil {
+		for i, j := 0, len(q.items)-1; i < j; i, j = i+1, j-1 {
+			q.items[i], q.items[j] = q.items[j], q.items[i]
+		}
+	}
+
+	sorted := make([]*Commit, 0, len(commits))
+	for q.Len() > 0 {
+		i := q.get()
+		for _, p := range commits[i].Parents {
+			j, ok := index[p]
+			if !ok || indegree[j] == 0 {
+				continue
+			}
+			// Output the parent once all of its children have
+			// been output.
+			if indegree[j]--; indegree[j] == 1 {
+				q.put(j)
+			}
+		}
+		indegree[i] = 0
+		sorted = append(sorted, commits[i])
+	}
+	copy(commits, sorted)
+	return nil
+}
+
+// A commitSortQueue is a queue of the indexes of commits to output in
+// SortCommits. If date is nil, it is a stack. Otherwise it outputs the
+// newest commit first, and commits with the same date in the order
+// they were added.
+type commitSortQueue struct {
+	commits []*Commit
+	date    func(*Commit) time.Time
+	items   []commitSortItem
+	n       int // the number of commits added so far
+}
+
+type commitSortItem struct {
+	index int
+	added int
+}
+
+func (q *commitSortQueue) Len() int { return len(q.items) }
+func (q *commitSortQueue) Less(i, j int) bool {
+	ti, tj := q.date(q.commits[q.items[i].index]), q.date(q.commits[q.items[j].index])
+	if !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return q.items[i].added < q.items[j].added
+}
+func (q *commitSortQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *commitSortQueue) Push(x interface{}) { q.items = append(q.items, x.(commitSortItem)) }
+func (q *commitSortQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item
+}
+
+func (q *commitSortQueue) put(i int) {
+	item := commitSortItem{index: i, added: q.n}
+	q.n++
+	if q.date == nil {
+		q.items = append(q.items, item)
+		return
+	}
+	heap.Push(q, item)
+}
+
+func (q *commitSortQueue) get() int {
+	if q.date == nil {
+		item := q.items[len(q.items)-1]
+		q.items = q.items[:len(q.items)-1]
+		return item.index
+	}
+	return heap.Pop(q).(commitSortItem).index
+}
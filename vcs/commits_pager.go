@@ -0,0 +1,317 @@
+package vcs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A CommitsPager is a repository that can list commits a page at a
+// time, resuming each page where the previous one ended instead of
+// walking the earlier commits again (as CommitsOptions.Skip does).
+type CommitsPager interface {
+	// CommitsPage returns the commits selected by opt, like Commits,
+	// along with the cursor of the next page.
+	CommitsPage(opt CommitsOptions) (*CommitsPage, error)
+}
+
+// A CommitsPage is a page of commits returned by
+// (CommitsPager).CommitsPage.
+type CommitsPage struct {
+	Commits []*Commit
+
+	// Total is the total number of commits selected by the options,
+	// on all pages. It is 0 if CommitsOptions.NoTotal is set.
+	Total uint
+
+	// NextCursor is the CommitsOptions.Cursor that gets the next page,
+	// or "" if there are no more commits.
+	NextCursor string
+}
+
+// A CommitsCursor is the position in a list of commits that a page of
+// them ended at. Its String method returns the CommitsOptions.Cursor
+// of the next page. It is for use by CommitsPager implementations.
+type CommitsCursor struct {
+	// Offset is the number of commits before the next page. If the
+	// cursor has no Frontier or After, the next page skips them.
+	Offset uint
+
+	// Frontier, Walked and Date resume a walk of the history in
+	// commit date order (such as git's default order) that a
+	// CommitFrontier tracked. Frontier is the commits that were found
+	// but not yet walked when the page ended. Walked is the walked
+	// commits that the next page's walk can reach again, and Date is
+	// their commit date (that of the last walked commit).
+	Frontier []CommitID
+	Walked   []CommitID
+	Date     int64
+
+	// After is the last commit on the page, for VCSs whose default
+	// order is a fixed order of all of the commits (such as hg's
+	// revision numbers). The next page starts after it.
+	After CommitID
+}
+
+func (c *CommitsCursor) String() string {
+	s := "o=" + strconv.FormatUint(uint64(c.Offset), 10)
+	if len(c.Frontier) > 0 {
+		s += ";f=" + joinCommitIDs(c.Frontier) + ";w=" + joinCommitIDs(c.Walked) + ";d=" + strconv.FormatInt(c.Date, 10)
+	}
+	if c.After != "" {
+		s += ";a=" + string(c.After)
+	}
+	return s
+}
+
+func joinCommitIDs(ids []CommitID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// ParseCommitsCursor parses a cursor returned by the String method of
+// a CommitsCursor.
+func ParseCommitsCursor(s string) (*CommitsCursor, error) {
+	invalid := fmt.Errorf("invalid commits cursor: %q", s)
+	c := &CommitsCursor{}
+	for i, field := range strings.Split(s, ";") {
+		if len(field) < 2 || field[1] != '=' || (i == 0) != (field[0] == 'o') {
+			return nil, invalid
+		}
+		value := field[2:]
+		switch field[0] {
+		case 'o':
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, invalid
+			}
+			c.Offset = uint(n)
+		case 'f', 'w':
+			if value == "" {
+				continue
+			}
+			for _, id := range strings.Split(value, ",") {
+				if !isCommitID(id) {
+					return nil, invalid
+				}
+				if field[0] == 'f' {
+					c.Frontier = append(c.Frontier, CommitID(id))
+				} else {
+					c.Walked = append(c.Walked, CommitID(id))
+				}
+			}
+		case 'd':
+			var err error
+			if c.Date, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, invalid
+			}
+		case 'a':
+			if !isCommitID(value) {
+				return nil, invalid
+			}
+			c.After = CommitID(value)
+		default:
+			return nil, invalid
+		}
+	}
+	return c, nil
+}
+
+// isCommitID reports whether s is a full (40-character hexadecimal)
+// commit ID.
+func isCommitID(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// maxCursorWalked is the maximum number of walked commits (with the
+// same commit date) that a cursor holds. A walk with more uses an
+// offset instead.
+const maxCursorWalked = 100
+
+// A CommitFrontier tracks a walk of the commit history in commit date
+// order (newest first, like git's default order), so that the walk
+// can be resumed from a CommitsCursor. It is for use by CommitsPager
+// implementations.
+//
+// The frontier of the walk is the commits that have been found (as
+// heads, or as parents of walked commits) but not walked yet. Walking
+// from the frontier again walks the rest of the history, but it can
+// also reach commits that were already walked (if a commit's parent
+// was walked first because they have the same commit date). So the
+// frontier is resumed along with those commits, which are skipped.
+// That is only possible if each commit is no newer than the one
+// walked before it, because otherwise any walked commit could be
+// reached again.
+type CommitFrontier struct {
+	firstParent bool
+	found       []CommitID // in the order they were found
+	seen        map[CommitID]bool
+	walked      map[CommitID]bool
+
+	date       int64      // the commit date of the last walked commit
+	dateWalked []CommitID // the walked commits with that date
+	skip       map[CommitID]bool
+	skewed     bool
+}
+
+// NewCommitFrontier returns a frontier for a walk that starts at the
+// heads, or that resumes from cursor (if it is non-nil and has a
+// Frontier). If firstParent is true, only the first parents of walked
+// commits are added to it.
+func NewCommitFrontier(heads []CommitID, cursor *CommitsCursor, firstParent bool) *CommitFrontier {
+	f := &CommitFrontier{
+		firstParent: firstParent,
+		seen:        map[CommitID]bool{},
+		walked:      map[CommitID]bool{},
+		skip:        map[CommitID]bool{},
+		date:        math.MaxInt64,
+	}
+	if cursor != nil && len(cursor.Frontier) > 0 {
+		heads = cursor.Frontier
+		f.date = cursor.Date
+		f.dateWalked = append(f.dateWalked, cursor.Walked...)
+		for _, id := range cursor.Walked {
+			f.skip[id] = true
+		}
+	}
+	for _, id := range heads {
+		f.add(id)
+	}
+	return f
+}
+
+// Heads returns the commits that the walk starts at.
+func (f *CommitFrontier) Heads() []CommitID {
+	var heads []CommitID
+	for _, id := range f.found {
+		if !f.walked[id] {
+			heads = append(heads, id)
+		}
+	}
+	return heads
+}
+
+func (f *CommitFrontier) add(id CommitID) {
+	if id != "" && !f.seen[id] {
+		f.seen[id] = true
+		f.found = append(f.found, id)
+	}
+}
+
+// Walk records that the walk reached c. It returns skip == true if c
+// was already walked on an earlier page, in which case the caller
+// must skip it. It returns ok == false if c is newer than the commit
+// walked before it, in which case the walk can't be resumed from a
+// frontier: the caller must discard a page that it is resuming and
+// get it by skipping the commits on the earlier pages instead.
+func (f *CommitFrontier) Walk(c *Commit) (skip, ok bool) {
+	committer := c.Committer
+	if committer == nil {
+		committer = &c.Author
+	}
+	date := committer.Date.Time().Unix()
+	if date > f.date {
+		f.skewed = true
+		return false, false
+	}
+	if date < f.date {
+		f.date, f.dateWalked = date, nil
+	}
+	if !f.walked[c.ID] {
+		f.walked[c.ID] = true
+		f.dateWalked = append(f.dateWalked, c.ID)
+	}
+
+	parents := c.Parents
+	if f.firstParent && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	for _, p := range parents {
+		f.add(p)
+	}
+	return f.skip[c.ID], true
+}
+
+// Cursor returns the cursor that resumes the walk, where offset is
+// the number of commits before the next page. The cursor only has an
+// Offset if the walk can't be resumed from a frontier.
+func (f *CommitFrontier) Cursor(offset uint) *CommitsCursor {
+	c := &CommitsCursor{Offset: offset}
+	if f.skewed || len(f.dateWalked) > maxCursorWalked {
+		return c
+	}
+	for _, id := range f.found {
+		if !f.walked[id] {
+			c.Frontier = append(c.Frontier, id)
+		}
+	}
+	c.Walked, c.Date = f.dateWalked, f.date
+	return c
+}
+
+// A CommitsTotalCache caches the totals of CommitsOptions, so that a
+// CommitsPager implementation only needs to count the commits for the
+// first page. Only the totals of options whose revs are all full
+// commit IDs (which always select the same commits) are cached.
+type CommitsTotalCache struct {
+	mu     sync.Mutex
+	totals map[string]uint
+}
+
+// maxCachedTotals is the number of totals a CommitsTotalCache holds
+// before it is emptied.
+const maxCachedTotals = 1000
+
+// commitsTotalKey returns the cache key of opt's total, or "" if it
+// can't be cached.
+func commitsTotalKey(opt CommitsOptions) string {
+	for _, id := range append(append([]CommitID{opt.Head, opt.Base}, opt.Heads...), opt.Bases...) {
+		if id != "" && !isCommitID(string(id)) {
+			return ""
+		}
+	}
+	// The options that don't affect the total.
+	opt.N, opt.Skip, opt.Cursor, opt.NoTotal = 0, 0, "", false
+	// Strip the monotonic clock readings from the times.
+	opt.Since, opt.Until = opt.Since.Round(0), opt.Until.Round(0)
+	return fmt.Sprintf("%+v", opt)
+}
+
+// Get returns the cached total of opt, if any.
+func (c *CommitsTotalCache) Get(opt CommitsOptions) (total uint, ok bool) {
+	key := commitsTotalKey(opt)
+	if key == "" {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total, ok = c.totals[key]
+	return total, ok
+}
+
+// Add caches the total of opt.
+func (c *CommitsTotalCache) Add(opt CommitsOptions, total uint) {
+	key := commitsTotalKey(opt)
+	if key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.totals == nil || len(c.totals) >= maxCachedTotals {
+		c.totals = map[string]uint{}
+	}
+	c.totals[key] = total
+}
@@ -0,0 +1,136 @@
+package vcs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestCommitsPager_CommitsPage(t *testing.T) {
+	t.Parallel()
+
+	// The commits all have the same date, so the walk's order depends
+	// on the order that it finds them in.
+	gitCommit := func(msg string) string {
+		return "GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m " + msg + " --author='a <a@a.com>' --date 2006-01-02T15:04:05Z"
+	}
+	gitCommands := []string{
+		gitCommit("1"),
+		"git checkout -q -b b",
+		gitCommit("2"),
+		gitCommit("3"),
+		"git checkout -q master",
+		gitCommit("4"),
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z GIT_AUTHOR_NAME=a GIT_AUTHOR_EMAIL=a@a.com GIT_AUTHOR_DATE=2006-01-02T15:04:05Z git merge -q --no-ff -m 5 b",
+		gitCommit("6"),
+		gitCommit("7"),
+	}
+	hgCommands := []string{"touch f", "hg add f"}
+	for _, msg := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		hgCommands = append(hgCommands, "echo "+msg+" >> f", "hg commit -m "+msg+" --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'")
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.CommitsPager
+			Commits(vcs.CommitsOptions) ([]*vcs.Commit, uint, error)
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+		head string
+	}{
+		"git libgit2": {repo: makeGitRepositoryLibGit2(t, gitCommands...), head: "master"},
+		"git cmd":     {repo: makeGitRepositoryCmd(t, gitCommands...), head: "master"},
+		"git go":      {repo: makeGitRepositoryGo(t, gitCommands...), head: "master"},
+		"hg native":   {repo: makeHgRepositoryNative(t, hgCommands...), head: "tip"},
+		"hg cmd":      {repo: makeHgRepositoryCmd(t, hgCommands...), head: "tip"},
+	}
+
+	for label, test := range tests {
+		head, err := test.repo.ResolveRevision(test.head)
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+
+		for _, opt := range []vcs.CommitsOptions{
+			{Head: head, N: 1},
+			{Head: head, N: 2},
+			{Head: head, N: 2, Skip: 1},
+			{Head: head, N: 3, Order: vcs.TopoOrder},
+			{Head: head, N: 2, Message: "^[1-5]$"},
+		} {
+			all := opt
+			all.N, all.Skip = 0, 0
+			want, wantTotal, err := test.repo.Commits(all)
+			if err != nil {
+				t.Errorf("%s: Commits(%+v): %s", label, all, err)
+				continue
+			}
+			if opt.Skip < uint(len(want)) {
+				want = want[opt.Skip:]
+			}
+
+			var got []*vcs.Commit
+			for i := 0; i < len(want)+1; i++ {
+				page, err := test.repo.CommitsPage(opt)
+				if err != nil {
+					t.Errorf("%s: CommitsPage(%+v): %s", label, opt, err)
+					break
+				}
+				if page.Total != wantTotal {
+					t.Errorf("%s: CommitsPage(%+v): got total %d, want %d", label, opt, page.Total, wantTotal)
+				}
+				if uint(len(page.Commits)) > opt.N {
+					t.Errorf("%s: CommitsPage(%+v): got %d commits, want at most %d", label, opt, len(page.Commits), opt.N)
+				}
+				if opt.Cursor != "" {
+					// Commits also returns the page.
+					commits, _, err := test.repo.Commits(opt)
+					if err != nil {
+						t.Errorf("%s: Commits(%+v): %s", label, opt, err)
+					} else if !reflect.DeepEqual(commits, page.Commits) {
+						t.Errorf("%s: Commits(%+v): got %s, want %s", label, opt, asJSON(commits), asJSON(page.Commits))
+					}
+				}
+				got = append(got, page.Commits...)
+				if page.NextCursor == "" {
+					break
+				}
+				opt.Cursor, opt.Skip = page.NextCursor, 0
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: CommitsPage(%+v): got pages of commits %s, want %s", label, opt, asJSON(got), asJSON(want))
+			}
+		}
+
+		if _, err := test.repo.CommitsPage(vcs.CommitsOptions{Head: head, Cursor: "x"}); err == nil {
+			t.Errorf("%s: CommitsPage with invalid cursor: want error", label)
+		}
+	}
+}
+
+func TestParseCommitsCursor(t *testing.T) {
+	const id1, id2 = "0123456789abcdef0123456789abcdef01234567", "89abcdef0123456789abcdef0123456789abcdef"
+	tests := []*vcs.CommitsCursor{
+		{Offset: 3},
+		{Offset: 3, Frontier: []vcs.CommitID{id1, id2}, Date: 1136214245},
+		{Offset: 3, Frontier: []vcs.CommitID{id1}, Walked: []vcs.CommitID{id2}, Date: 1136214245},
+		{Offset: 3, After: id1},
+	}
+	for _, want := range tests {
+		c, err := vcs.ParseCommitsCursor(want.String())
+		if err != nil {
+			t.Errorf("%q: %s", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%q: got %+v, want %+v", want, c, want)
+		}
+	}
+
+	for _, s := range []string{"", "x", "f=" + id1, "o=1;a=abc", "o=1;f=" + id1 + ";x=1", "o=-1"} {
+		if _, err := vcs.ParseCommitsCursor(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
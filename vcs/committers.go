@@ -0,0 +1,42 @@
+package vcs
+
+import "sort"
+
+// CountCommitters returns the authors of commits with the number of
+// commits by each, ordered by decreasing number of commits (and then
+// by name and email), like `git shortlog -sne`. If n > 0, only the
+// first n are returned. It is for use by Repository implementations
+// that list the commits themselves.
+func CountCommitters(commits []*Commit, n int) []*Committer {
+	type author struct{ name, email string }
+	counts := map[author]int32{}
+	for _, c := range commits {
+		counts[author{c.Author.Name, c.Author.Email}]++
+	}
+
+	committers := make([]*Committer, 0, len(counts))
+	for a, count := range counts {
+		committers = append(committers, &Committer{Name: a.name, Email: a.email, Commits: count})
+	}
+	sort.Sort(committersByCount(committers))
+	if n > 0 && len(committers) > n {
+		committers = committers[:n]
+	}
+	return committers
+}
+
+// committersByCount sorts committers by decreasing number of commits,
+// and then by name and email.
+type committersByCount []*Committer
+
+func (p committersByCount) Len() int { return len(p) }
+func (p committersByCount) Less(i, j int) bool {
+	if p[i].Commits != p[j].Commits {
+		return p[i].Commits > p[j].Commits
+	}
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Email < p[j].Email
+}
+func (p committersByCount) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
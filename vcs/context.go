@@ -0,0 +1,97 @@
+package vcs
+
+import (
+	"context"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// The interfaces in this file are context-accepting variants of
+// Repository and its optional interfaces. Each method behaves like
+// its context-less counterpart, except that implementations abort
+// the operation (killing any VCS subprocesses they started) when ctx
+// is done. An aborted operation returns ctx.Err(), so callers can
+// distinguish cancellation from other failures by comparing the
+// error against context.Canceled or context.DeadlineExceeded.
+
+// A RepositoryContext is a Repository whose methods accept a
+// context.
+type RepositoryContext interface {
+	ResolveRevisionContext(ctx context.Context, spec string) (CommitID, error)
+	ResolveTagContext(ctx context.Context, name string) (CommitID, error)
+	ResolveBranchContext(ctx context.Context, name string) (CommitID, error)
+
+	BranchesContext(context.Context, BranchesOptions) ([]*Branch, error)
+	TagsContext(context.Context) ([]*Tag, error)
+
+	GetCommitContext(context.Context, CommitID) (*Commit, error)
+	CommitsContext(context.Context, CommitsOptions) (commits []*Commit, total uint, err error)
+	CommittersContext(context.Context, CommittersOptions) ([]*Committer, error)
+
+	// FileSystemContext opens the repository file tree at a given
+	// commit ID. The returned file system's operations are bound to
+	// ctx, so it should not be used after ctx is done.
+	FileSystemContext(ctx context.Context, at CommitID) (vfs.FileSystem, error)
+}
+
+// A BlamerContext is a Blamer whose method accepts a context.
+type BlamerContext interface {
+	BlameFileContext(ctx context.Context, path string, opt *BlameOptions) ([]*Hunk, error)
+}
+
+// A DifferContext is a Differ whose method accepts a context.
+type DifferContext interface {
+	DiffContext(ctx context.Context, base, head CommitID, opt *DiffOptions) (*Diff, error)
+}
+
+// A CrossRepoDifferContext is a CrossRepoDiffer whose method accepts
+// a context.
+type CrossRepoDifferContext interface {
+	CrossRepoDiffContext(ctx context.Context, base CommitID, headRepo Repository, head CommitID, opt *DiffOptions) (*Diff, error)
+}
+
+// A MergerContext is a Merger whose method accepts a context.
+type MergerContext interface {
+	MergeBaseContext(context.Context, CommitID, CommitID) (CommitID, error)
+}
+
+// A CrossRepoMergerContext is a CrossRepoMerger whose method accepts
+// a context.
+type CrossRepoMergerContext interface {
+	CrossRepoMergeBaseContext(ctx context.Context, a CommitID, repoB Repository, b CommitID) (CommitID, error)
+}
+
+// A RemoteUpdaterContext is a RemoteUpdater whose method accepts a
+// context.
+type RemoteUpdaterContext interface {
+	UpdateEverythingContext(context.Context, RemoteOpts) (*UpdateResult, error)
+}
+
+// A SearcherContext is a Searcher whose method accepts a context.
+type SearcherContext interface {
+	SearchContext(context.Context, CommitID, SearchOptions) ([]*SearchResult, error)
+}
+
+// A FileListerContext is a FileLister whose method accepts a
+// context.
+type FileListerContext interface {
+	ListFilesContext(context.Context, CommitID) ([]string, error)
+}
+
+// A CommitFilesListerContext is a CommitFilesLister whose method
+// accepts a context.
+type CommitFilesListerContext interface {
+	CommitFilesContext(ctx context.Context, id CommitID, opt *CommitFilesOptions) ([]*CommitFiles, error)
+}
+
+// A CommitsPagerContext is a CommitsPager whose method accepts a
+// context.
+type CommitsPagerContext interface {
+	CommitsPageContext(context.Context, CommitsOptions) (*CommitsPage, error)
+}
+
+// A FileHistoryListerContext is a FileHistoryLister whose method
+// accepts a context.
+type FileHistoryListerContext interface {
+	FileHistoryContext(context.Context, CommitsOptions) ([]*FileCommit, uint, error)
+}
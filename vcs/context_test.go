@@ -0,0 +1,66 @@
+package vcs_test
+
+import (
+	"context"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestRepository_Context_canceled(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	hgCommands := []string{
+		"touch --date=2006-01-02T15:04:05Z f || touch -t " + times[0] + " f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.Repository
+			vcs.RepositoryContext
+		}
+		spec string
+	}{
+		"git libgit2": {
+			repo: makeGitRepositoryLibGit2(t, gitCommands...),
+			spec: "master",
+		},
+		"git cmd": {
+			repo: makeGitRepositoryCmd(t, gitCommands...),
+			spec: "master",
+		},
+		"hg native": {
+			repo: makeHgRepositoryNative(t, hgCommands...),
+			spec: "tip",
+		},
+		"hg cmd": {
+			repo: makeHgRepositoryCmd(t, hgCommands...),
+			spec: "tip",
+		},
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for label, test := range tests {
+		commitID, err := test.repo.ResolveRevisionContext(context.Background(), test.spec)
+		if err != nil {
+			t.Errorf("%s: ResolveRevisionContext: %s", label, err)
+			continue
+		}
+
+		if _, err := test.repo.ResolveRevisionContext(canceled, test.spec); err != context.Canceled {
+			t.Errorf("%s: ResolveRevisionContext: got err %v, want %v", label, err, context.Canceled)
+		}
+		if _, err := test.repo.GetCommitContext(canceled, commitID); err != context.Canceled {
+			t.Errorf("%s: GetCommitContext: got err %v, want %v", label, err, context.Canceled)
+		}
+		if _, _, err := test.repo.CommitsContext(canceled, vcs.CommitsOptions{Head: commitID}); err != context.Canceled {
+			t.Errorf("%s: CommitsContext: got err %v, want %v", label, err, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// A CredentialProvider provides the credentials for communication with
+// remotes. Clone and UpdateEverything ask it for credentials (if
+// RemoteOpts.Credentials is set) when they start and again each time
+// the remote rejects the previous credentials, so that credentials
+// needn't be stored in RemoteOpts and can be rotated.
+//
+// UpdateEverything only asks for the credentials of the repository's
+// default remote ("origin" in git, "default" in hg), and uses them for
+// all of the remotes that it updates.
+type CredentialProvider interface {
+	// Credentials returns the credentials to use for the request. It
+	// returns ErrNoCredentials if it has no (more) credentials for
+	// the remote.
+	Credentials(ctx context.Context, req CredentialRequest) (*Credentials, error)
+}
+
+// CredentialProviderFunc is a func that implements CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context, req CredentialRequest) (*Credentials, error)
+
+// Credentials implements CredentialProvider.
+func (f CredentialProviderFunc) Credentials(ctx context.Context, req CredentialRequest) (*Credentials, error) {
+	return f(ctx, req)
+}
+
+// A CredentialRequest is a request for the credentials for a remote.
+type CredentialRequest struct {
+	URL      string // remote URL
+	Protocol string // "ssh" or "https" (also for HTTP remotes)
+
+	// Attempt is 1 for the first attempt to authenticate with the
+	// remote in an operation, and is incremented each time the remote
+	// rejects the credentials of the previous attempt.
+	Attempt int
+}
+
+// Credentials authenticate with a remote. Their non-empty fields
+// replace the corresponding fields of RemoteOpts.SSH or
+// RemoteOpts.HTTPS (depending on the protocol), whose other fields
+// still apply.
+//
+// Where the implementation supports it, the credentials are never
+// written to disk: gitcmd serves an SSH private key with an in-process
+// ssh agent and passes the HTTPS password to git in its environment.
+// (hgcmd, which only supports HTTPS credentials, writes them to a
+// temporary hg configuration file that only the current user can
+// read.)
+type Credentials struct {
+	Username string `json:",omitempty"` // username (if empty, inferred from URL)
+
+	Password string `json:",omitempty"` // HTTPS password
+	Token    string `json:",omitempty"` // HTTPS bearer token (see HTTPSConfig.Token)
+
+	PrivateKey []byte `json:",omitempty"` // SSH private key (see SSHConfig.PrivateKey)
+	Passphrase []byte `json:",omitempty"` // passphrase of PrivateKey (if it is encrypted)
+}
+
+var (
+	// ErrNoCredentials is returned by a CredentialProvider that has no
+	// (more) credentials for a remote.
+	ErrNoCredentials = errors.New("no credentials for remote")
+)
+
+// MaxCredentialAttempts is the maximum number of times that a remote
+// operation asks its CredentialProvider for credentials.
+const MaxCredentialAttempts = 5
+
+// RemoteProtocol returns the protocol of the remote URL for
+// CredentialRequest.Protocol: "ssh" for SSH URLs (including scp-like
+// "[user@]host:path" URLs), "https" for HTTPS and HTTP URLs, and ""
+// for other URLs (such as local paths).
+func RemoteProtocol(url string) string {
+	if i := strings.Index(url, "://"); i != -1 {
+		switch url[:i] {
+		case "ssh", "git+ssh", "ssh+git":
+			return "ssh"
+		case "https", "http":
+			return "https"
+		}
+		return ""
+	}
+	if i := strings.Index(url, ":"); i > 0 && !strings.Contains(url[:i], "/") {
+		return "ssh"
+	}
+	return ""
+}
+
+// MemoryCredentials is a CredentialProvider that provides credentials
+// stored in memory. It is safe for concurrent use.
+type MemoryCredentials struct {
+	mu    sync.Mutex
+	creds map[string][]*Credentials // remote URL -> credentials to try, in order
+}
+
+// Set sets the credentials for the remote at url (or, if url is "",
+// for remotes that have no credentials of their own). Attempt N uses
+// the Nth credentials, so that later credentials (such as a rotated
+// token) are tried when the remote rejects earlier ones.
+func (m *MemoryCredentials) Set(url string, creds ...*Credentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.creds == nil {
+		m.creds = map[string][]*Credentials{}
+	}
+	if len(creds) == 0 {
+		delete(m.creds, url)
+		return
+	}
+	m.creds[url] = creds
+}
+
+// Credentials implements CredentialProvider.
+func (m *MemoryCredentials) Credentials(ctx context.Context, req CredentialRequest) (*Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	creds, ok := m.creds[req.URL]
+	if !ok {
+		creds = m.creds[""]
+	}
+	if req.Attempt < 1 || req.Attempt > len(creds) {
+		return nil, ErrNoCredentials
+	}
+	return creds[req.Attempt-1], nil
+}
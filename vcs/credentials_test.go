@@ -0,0 +1,72 @@
+package vcs_test
+
+import (
+	"context"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestRemoteProtocol(t *testing.T) {
+	tests := map[string]string{
+		"ssh://git@example.com/a/b":   "ssh",
+		"git+ssh://example.com:2222/": "ssh",
+		"git@example.com:a/b.git":     "ssh",
+		"https://example.com/a/b":     "https",
+		"http://example.com/a/b":      "https",
+		"file:///a/b":                 "",
+		"git://example.com/a/b":       "",
+		"/a/b":                        "",
+		"./a:b":                       "",
+	}
+	for url, want := range tests {
+		if got := vcs.RemoteProtocol(url); got != want {
+			t.Errorf("%s: got protocol %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestMemoryCredentials(t *testing.T) {
+	a := &vcs.Credentials{Token: "a"}
+	b := &vcs.Credentials{Token: "b"}
+	c := &vcs.Credentials{Token: "c"}
+
+	var m vcs.MemoryCredentials
+	m.Set("https://example.com/r", a, b)
+	m.Set("", c)
+
+	tests := []struct {
+		url         string
+		attempt     int
+		want        *vcs.Credentials
+		wantNoCreds bool
+	}{
+		{url: "https://example.com/r", attempt: 1, want: a},
+		{url: "https://example.com/r", attempt: 2, want: b},
+		{url: "https://example.com/r", attempt: 3, wantNoCreds: true},
+		{url: "https://example.com/other", attempt: 1, want: c},
+		{url: "https://example.com/other", attempt: 2, wantNoCreds: true},
+	}
+	for _, test := range tests {
+		creds, err := m.Credentials(context.Background(), vcs.CredentialRequest{URL: test.url, Protocol: "https", Attempt: test.attempt})
+		if test.wantNoCreds {
+			if err != vcs.ErrNoCredentials {
+				t.Errorf("%s attempt %d: got error %v, want ErrNoCredentials", test.url, test.attempt, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s attempt %d: %s", test.url, test.attempt, err)
+			continue
+		}
+		if creds != test.want {
+			t.Errorf("%s attempt %d: got credentials %+v, want %+v", test.url, test.attempt, creds, test.want)
+		}
+	}
+
+	// Setting no credentials removes them.
+	m.Set("https://example.com/r")
+	if creds, err := m.Credentials(context.Background(), vcs.CredentialRequest{URL: "https://example.com/r", Attempt: 1}); err != nil || creds != c {
+		t.Errorf("after removal: got (%+v, %v), want fallback credentials", creds, err)
+	}
+}
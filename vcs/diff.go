@@ -0,0 +1,261 @@
+package vcs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-diff/diff"
+)
+
+// ParseDiff parses raw git-style unified diff output (as produced by
+// `git diff` or `hg diff --git`) into a Diff, populating both its Raw
+// and Files fields. The OrigPrefix and NewPrefix in opt (if any) are
+// stripped from the file paths.
+func ParseDiff(raw []byte, opt *DiffOptions) (*Diff, error) {
+	if opt == nil {
+		opt = &DiffOptions{}
+	}
+	d := &Diff{Raw: string(raw)}
+	for _, section := range splitFileDiffs(raw) {
+		f, err := parseFileDiff(section, opt.OrigPrefix, opt.NewPrefix)
+		if err != nil {
+			return nil, err
+		}
+		d.Files = append(d.Files, f)
+	}
+	return d, nil
+}
+
+var gitDiffHeader = []byte("diff --git ")
+
+// splitFileDiffs splits a multi-file diff into the sections for each
+// file, each starting with a "diff --git" line. Anything preceding
+// the first such line is ignored.
+func splitFileDiffs(raw []byte) [][]byte {
+	var sections [][]byte
+	start := -1
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end == -1 {
+			end = len(raw)
+		} else {
+			end += i + 1
+		}
+		if bytes.HasPrefix(raw[i:], gitDiffHeader) {
+			if start != -1 {
+				sections = append(sections, raw[start:i])
+			}
+			start = i
+		}
+		i = end
+	}
+	if start != -1 {
+		sections = append(sections, raw[start:])
+	}
+	return sections
+}
+
+// parseFileDiff parses the section of a git-style diff that applies
+// to a single file.
+func parseFileDiff(section []byte, origPrefix, newPrefix string) (*FileDiff, error) {
+	f := &FileDiff{}
+
+	var (
+		header            string
+		origName, newName string
+		haveNames         bool
+		added, deleted    bool
+		renamed, copied   bool
+		modeChanged       bool
+		offset            int
+		hunksStart        = len(section)
+	)
+	lines := bytes.SplitAfter(section, []byte{'\n'})
+	for i, lineB := range lines {
+		line := strings.TrimSuffix(string(lineB), "\n")
+		if i == 0 {
+			header = strings.TrimPrefix(line, string(gitDiffHeader))
+			offset += len(lineB)
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			hunksStart = offset
+			break
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "old mode "):
+			f.OrigMode, err = parseGitMode(strings.TrimPrefix(line, "old mode "))
+			modeChanged = true
+		case strings.HasPrefix(line, "new mode "):
+			f.NewMode, err = parseGitMode(strings.TrimPrefix(line, "new mode "))
+			modeChanged = true
+		case strings.HasPrefix(line, "new file mode "):
+			f.NewMode, err = parseGitMode(strings.TrimPrefix(line, "new file mode "))
+			added = true
+		case strings.HasPrefix(line, "deleted file mode "):
+			f.OrigMode, err = parseGitMode(strings.TrimPrefix(line, "deleted file mode "))
+			deleted = true
+		case strings.HasPrefix(line, "rename from "):
+			origName, err = unquotePath(strings.TrimPrefix(line, "rename from "))
+			renamed = true
+		case strings.HasPrefix(line, "rename to "):
+			newName, err = unquotePath(strings.TrimPrefix(line, "rename to "))
+			renamed, haveNames = true, true
+		case strings.HasPrefix(line, "copy from "):
+			origName, err = unquotePath(strings.TrimPrefix(line, "copy from "))
+			copied = true
+		case strings.HasPrefix(line, "copy to "):
+			newName, err = unquotePath(strings.TrimPrefix(line, "copy to "))
+			copied, haveNames = true, true
+		case strings.HasPrefix(line, "index "):
+			// Format: "index ORIG..NEW[ MODE]".
+			fields := strings.Fields(strings.TrimPrefix(line, "index "))
+			if len(fields) == 0 {
+				break
+			}
+			if ids := strings.SplitN(fields[0], "..", 2); len(ids) == 2 {
+				f.OrigBlob, f.NewBlob = nonZeroID(ids[0]), nonZeroID(ids[1])
+			}
+			if len(fields) == 2 {
+				var mode uint32
+				mode, err = parseGitMode(fields[1])
+				f.OrigMode, f.NewMode = mode, mode
+			}
+		case strings.HasPrefix(line, "--- "):
+			origName, err = unquotePath(strings.TrimPrefix(line, "--- "))
+			if origName == "/dev/null" {
+				origName, added = "", true
+			} else {
+				origName = strings.TrimPrefix(origName, origPrefix)
+			}
+		case strings.HasPrefix(line, "+++ "):
+			newName, err = unquotePath(strings.TrimPrefix(line, "+++ "))
+			if newName == "/dev/null" {
+				newName, deleted = "", true
+			} else {
+				newName = strings.TrimPrefix(newName, newPrefix)
+			}
+			haveNames = true
+		case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+			f.Binary = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing diff line %q: %s", line, err)
+		}
+		offset += len(lineB)
+	}
+
+	if !haveNames {
+		// The file has no hunks (e.g., it is binary or only its mode
+		// changed), so its name must be determined from the header,
+		// which looks like "diff --git ORIGPREFIX+NAME NEWPREFIX+NAME".
+		name, err := parseGitDiffHeaderName(header, origPrefix, newPrefix)
+		if err != nil {
+			return nil, err
+		}
+		origName, newName = name, name
+	}
+	if !added {
+		f.OrigPath = origName
+	}
+	if !deleted {
+		f.NewPath = newName
+	}
+
+	if hunksStart < len(section) {
+		hunks, err := diff.ParseHunks(section[hunksStart:])
+		if err != nil {
+			return nil, err
+		}
+		f.Hunks = hunks
+		for _, h := range hunks {
+			for _, line := range bytes.Split(h.Body, []byte{'\n'}) {
+				if len(line) == 0 {
+					continue
+				}
+				switch line[0] {
+				case '+':
+					f.Added++
+				case '-':
+					f.Deleted++
+				}
+			}
+		}
+	}
+
+	switch {
+	case added:
+		f.ChangeType = FileChangeType_ADDED
+	case deleted:
+		f.ChangeType = FileChangeType_DELETED
+	case copied:
+		f.ChangeType = FileChangeType_COPIED
+	case renamed || f.OrigPath != f.NewPath:
+		f.ChangeType = FileChangeType_RENAMED
+	case modeChanged && len(f.Hunks) == 0 && !f.Binary:
+		f.ChangeType = FileChangeType_MODE_CHANGED
+	default:
+		f.ChangeType = FileChangeType_MODIFIED
+	}
+	return f, nil
+}
+
+// parseGitDiffHeaderName returns the file name from a "diff --git"
+// header line (with the "diff --git " prefix removed) for a file
+// whose name is the same on both sides.
+func parseGitDiffHeaderName(header, origPrefix, newPrefix string) (string, error) {
+	if strings.HasPrefix(header, `"`) {
+		// Quoted names: `"ORIG" "NEW"`.
+		end := strings.Index(header[1:], `" `)
+		if end == -1 {
+			return "", fmt.Errorf("bad diff header: %q", header)
+		}
+		name, err := unquotePath(header[:end+2])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimPrefix(name, origPrefix), nil
+	}
+
+	// Unquoted names: "ORIGPREFIX+NAME NEWPREFIX+NAME".
+	if !strings.HasPrefix(header, origPrefix) {
+		return "", fmt.Errorf("bad diff header: %q", header)
+	}
+	rest := header[len(origPrefix):]
+	n := (len(rest) - 1 - len(newPrefix)) / 2
+	if n < 0 || rest[:n] != rest[len(rest)-n:] || rest[n:len(rest)-n] != " "+newPrefix {
+		return "", fmt.Errorf("bad diff header: %q", header)
+	}
+	return rest[:n], nil
+}
+
+// unquotePath unquotes a path that git quoted because it contains
+// unusual characters, and strips any trailing timestamp.
+func unquotePath(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	if i := strings.Index(s, "\t"); i != -1 {
+		s = s[:i]
+	}
+	return s, nil
+}
+
+// parseGitMode parses an octal git file mode, such as "100644".
+func parseGitMode(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	return uint32(n), err
+}
+
+// nonZeroID returns id, or "" if id is the all-zeros ID that git uses
+// to indicate a nonexistent blob.
+func nonZeroID(id string) string {
+	if strings.Trim(id, "0") == "" {
+		return ""
+	}
+	return id
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"testing"
 
+	"sourcegraph.com/sourcegraph/go-diff/diff"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 )
 
@@ -55,6 +56,14 @@ func TestRepository_Diff(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f f\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..c0d0fb45c382919737f8d0c20aaf57cf89b74af8 100644\n--- f\n+++ f\n@@ -1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "c0d0fb45c382919737f8d0c20aaf57cf89b74af8",
+					Hunks: []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added: 1,
+				}},
 			},
 		},
 		"git cmd": {
@@ -62,6 +71,29 @@ func TestRepository_Diff(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f f\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..c0d0fb45c382919737f8d0c20aaf57cf89b74af8 100644\n--- f\n+++ f\n@@ -1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "c0d0fb45c382919737f8d0c20aaf57cf89b74af8",
+					Hunks: []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added: 1,
+				}},
+			},
+		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, cmds...),
+			base: "testbase", head: "testhead",
+			wantDiff: &vcs.Diff{
+				Raw: "diff --git f f\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..c0d0fb45c382919737f8d0c20aaf57cf89b74af8 100644\n--- f\n+++ f\n@@ -1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "c0d0fb45c382919737f8d0c20aaf57cf89b74af8",
+					Hunks: []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added: 1,
+				}},
 			},
 		},
 		"hg cmd": {
@@ -69,6 +101,18 @@ func TestRepository_Diff(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git .hgtags .hgtags\nnew file mode 100644\n--- /dev/null\n+++ .hgtags\n@@ -0,0 +1,1 @@\n+%(baseCommitID) testbase\ndiff --git f f\n--- f\n+++ f\n@@ -1,1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					NewPath:    ".hgtags",
+					ChangeType: vcs.FileChangeType_ADDED,
+					NewMode:    0100644,
+					Hunks:      []*diff.Hunk{{NewStartLine: 1, NewLines: 1, StartPosition: 1, Body: []byte("+%(baseCommitID) testbase\n")}},
+					Added:      1,
+				}, {
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					Hunks:      []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added:      1,
+				}},
 			},
 		},
 	}
@@ -98,6 +142,11 @@ func TestRepository_Diff(t *testing.T) {
 		// wantDiff field doc for more info.
 		test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "%(baseCommitID)", string(baseCommitID), -1)
 		test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "%(headCommitID)", string(headCommitID), -1)
+		for _, f := range test.wantDiff.Files {
+			for _, h := range f.Hunks {
+				h.Body = []byte(strings.Replace(string(h.Body), "%(baseCommitID)", string(baseCommitID), -1))
+			}
+		}
 		if runtime.GOOS == "windows" {
 			test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "/dev/null", `\dev\null`, -1)
 		}
@@ -162,6 +211,12 @@ func TestRepository_Diff_rename(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f g\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..a29bdeb434d874c9b1d8969c40c42161b03fafdc 100644\n--- f\n+++ g\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "g",
+					ChangeType: vcs.FileChangeType_RENAMED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc",
+				}},
 			},
 			opt: opt,
 		},
@@ -170,6 +225,22 @@ func TestRepository_Diff_rename(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f g\nsimilarity index 100%\nrename from f\nrename to g\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "g",
+					ChangeType: vcs.FileChangeType_RENAMED,
+				}},
+			},
+			opt: opt,
+		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, cmds...),
+			base: "testbase", head: "testhead",
+			wantDiff: &vcs.Diff{
+				Raw: "diff --git f g\nsimilarity index 100%\nrename from f\nrename to g\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "g",
+					ChangeType: vcs.FileChangeType_RENAMED,
+				}},
 			},
 			opt: opt,
 		},
@@ -178,6 +249,13 @@ func TestRepository_Diff_rename(t *testing.T) {
 			base: "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git .hgtags .hgtags\nnew file mode 100644\n--- /dev/null\n+++ .hgtags\n@@ -0,0 +1,1 @@\n+f1f126ec4cf9398d85e8dac873afc3f9b174b1d6 testbase\n",
+				Files: []*vcs.FileDiff{{
+					NewPath:    ".hgtags",
+					ChangeType: vcs.FileChangeType_ADDED,
+					NewMode:    0100644,
+					Hunks:      []*diff.Hunk{{NewStartLine: 1, NewLines: 1, StartPosition: 1, Body: []byte("+f1f126ec4cf9398d85e8dac873afc3f9b174b1d6 testbase\n")}},
+					Added:      1,
+				}},
 			},
 			opt: opt,
 		},
@@ -208,6 +286,11 @@ func TestRepository_Diff_rename(t *testing.T) {
 		// wantDiff field doc for more info.
 		test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "%(baseCommitID)", string(baseCommitID), -1)
 		test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "%(headCommitID)", string(headCommitID), -1)
+		for _, f := range test.wantDiff.Files {
+			for _, h := range f.Hunks {
+				h.Body = []byte(strings.Replace(string(h.Body), "%(baseCommitID)", string(baseCommitID), -1))
+			}
+		}
 		if runtime.GOOS == "windows" {
 			test.wantDiff.Raw = strings.Replace(test.wantDiff.Raw, "/dev/null", `\dev\null`, -1)
 		}
@@ -267,6 +350,14 @@ func TestRepository_CrossRepoDiff_git(t *testing.T) {
 			base:     "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f f\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..c0d0fb45c382919737f8d0c20aaf57cf89b74af8 100644\n--- f\n+++ f\n@@ -1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "c0d0fb45c382919737f8d0c20aaf57cf89b74af8",
+					Hunks: []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added: 1,
+				}},
 			},
 		},
 		"git libgit2": {
@@ -275,6 +366,14 @@ func TestRepository_CrossRepoDiff_git(t *testing.T) {
 			base:     "testbase", head: "testhead",
 			wantDiff: &vcs.Diff{
 				Raw: "diff --git f f\nindex a29bdeb434d874c9b1d8969c40c42161b03fafdc..c0d0fb45c382919737f8d0c20aaf57cf89b74af8 100644\n--- f\n+++ f\n@@ -1 +1,2 @@\n line1\n+line2\n",
+				Files: []*vcs.FileDiff{{
+					OrigPath: "f", NewPath: "f",
+					ChangeType: vcs.FileChangeType_MODIFIED,
+					OrigMode:   0100644, NewMode: 0100644,
+					OrigBlob: "a29bdeb434d874c9b1d8969c40c42161b03fafdc", NewBlob: "c0d0fb45c382919737f8d0c20aaf57cf89b74af8",
+					Hunks: []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+					Added: 1,
+				}},
 			},
 		},
 	}
@@ -342,3 +441,136 @@ func TestRepository_CrossRepoDiff_git(t *testing.T) {
 		}
 	}
 }
+
+func TestRepository_CrossRepoDiff_hg(t *testing.T) {
+	t.Parallel()
+
+	// The base changeset is identical in both repos because it has
+	// the same contents, date and author.
+	hgCmdsBase := []string{
+		"echo line1 > f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	hgCmdsHead := append(append([]string(nil), hgCmdsBase...),
+		"echo line2 >> f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	)
+	wantDiff := &vcs.Diff{
+		Raw: "diff --git f f\n--- f\n+++ f\n@@ -1,1 +1,2 @@\n line1\n+line2\n",
+		Files: []*vcs.FileDiff{{
+			OrigPath: "f", NewPath: "f",
+			ChangeType: vcs.FileChangeType_MODIFIED,
+			Hunks:      []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, NewStartLine: 1, NewLines: 2, StartPosition: 1, Body: []byte(" line1\n+line2\n")}},
+			Added:      1,
+		}},
+	}
+	tests := map[string]struct {
+		baseRepo interface {
+			vcs.CrossRepoDiffer
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+		headRepo vcs.Repository
+	}{
+		"hg native": {
+			baseRepo: makeHgRepositoryNative(t, hgCmdsBase...),
+			headRepo: makeHgRepositoryNative(t, hgCmdsHead...),
+		},
+		"hg cmd": {
+			baseRepo: makeHgRepositoryCmd(t, hgCmdsBase...),
+			headRepo: makeHgRepositoryCmd(t, hgCmdsHead...),
+		},
+	}
+
+	for label, test := range tests {
+		baseCommitID, err := test.baseRepo.ResolveRevision("tip")
+		if err != nil {
+			t.Errorf("%s: ResolveRevision on base: %s", label, err)
+			continue
+		}
+
+		headCommitID, err := test.headRepo.ResolveRevision("tip")
+		if err != nil {
+			t.Errorf("%s: ResolveRevision on head: %s", label, err)
+			continue
+		}
+
+		diff, err := test.baseRepo.CrossRepoDiff(baseCommitID, test.headRepo, headCommitID, nil)
+		if err != nil {
+			t.Errorf("%s: CrossRepoDiff(%s, %v, %s): %s", label, baseCommitID, test.headRepo, headCommitID, err)
+			continue
+		}
+		if !reflect.DeepEqual(diff, wantDiff) {
+			t.Errorf("%s: diff != wantDiff\n\ndiff ==========\n%s\n\nwantDiff ==========\n%s", label, asJSON(diff), asJSON(wantDiff))
+		}
+
+		// The head changeset must not have been added to the base repo.
+		if _, err := test.baseRepo.ResolveRevision(string(headCommitID)); err == nil {
+			t.Errorf("%s: CrossRepoDiff added the head changeset to the base repo", label)
+		}
+
+		if _, err := test.baseRepo.CrossRepoDiff(nonexistentCommitID, test.headRepo, headCommitID, nil); err != vcs.ErrCommitNotFound {
+			t.Errorf("%s: CrossRepoDiff with bad base commit ID: want ErrCommitNotFound, got %v", label, err)
+		}
+
+		if _, err := test.baseRepo.CrossRepoDiff(baseCommitID, test.headRepo, nonexistentCommitID, nil); err != vcs.ErrCommitNotFound {
+			t.Errorf("%s: CrossRepoDiff with bad head commit ID: want ErrCommitNotFound, got %v", label, err)
+		}
+	}
+}
+
+func TestParseDiff(t *testing.T) {
+	tests := map[string]struct {
+		raw       string
+		opt       *vcs.DiffOptions
+		wantFiles []*vcs.FileDiff
+	}{
+		"deleted": {
+			raw: "diff --git a/f b/f\ndeleted file mode 100644\nindex 587be6b4c3f93f93c489c0111bba5596147a26cb..0000000000000000000000000000000000000000\n--- a/f\n+++ /dev/null\n@@ -1 +0,0 @@\n-x\n",
+			opt: &vcs.DiffOptions{OrigPrefix: "a/", NewPrefix: "b/"},
+			wantFiles: []*vcs.FileDiff{{
+				OrigPath:   "f",
+				ChangeType: vcs.FileChangeType_DELETED,
+				OrigMode:   0100644,
+				OrigBlob:   "587be6b4c3f93f93c489c0111bba5596147a26cb",
+				Hunks:      []*diff.Hunk{{OrigStartLine: 1, OrigLines: 1, StartPosition: 1, Body: []byte("-x\n")}},
+				Deleted:    1,
+			}},
+		},
+		"binary and mode change": {
+			raw: "diff --git a/b b/b\nindex 8352675d67aed6625ece79af41c27fdb4ee2e867..1592e5c60f1a460928916dc5681fee1a9bd10868 100644\nBinary files a/b and b/b differ\ndiff --git a/m m b/m m\nold mode 100644\nnew mode 100755\n",
+			opt: &vcs.DiffOptions{OrigPrefix: "a/", NewPrefix: "b/"},
+			wantFiles: []*vcs.FileDiff{{
+				OrigPath: "b", NewPath: "b",
+				ChangeType: vcs.FileChangeType_MODIFIED,
+				Binary:     true,
+				OrigMode:   0100644, NewMode: 0100644,
+				OrigBlob: "8352675d67aed6625ece79af41c27fdb4ee2e867", NewBlob: "1592e5c60f1a460928916dc5681fee1a9bd10868",
+			}, {
+				OrigPath: "m m", NewPath: "m m",
+				ChangeType: vcs.FileChangeType_MODE_CHANGED,
+				OrigMode:   0100644, NewMode: 0100755,
+			}},
+		},
+		"copied and quoted": {
+			raw: "diff --git f \"\\303\\251\"\nsimilarity index 100%\ncopy from f\ncopy to \"\\303\\251\"\n",
+			wantFiles: []*vcs.FileDiff{{
+				OrigPath: "f", NewPath: "é",
+				ChangeType: vcs.FileChangeType_COPIED,
+			}},
+		},
+	}
+	for label, test := range tests {
+		d, err := vcs.ParseDiff([]byte(test.raw), test.opt)
+		if err != nil {
+			t.Errorf("%s: ParseDiff: %s", label, err)
+			continue
+		}
+		if d.Raw != test.raw {
+			t.Errorf("%s: got Raw %q, want %q", label, d.Raw, test.raw)
+		}
+		if !reflect.DeepEqual(d.Files, test.wantFiles) {
+			t.Errorf("%s: files != wantFiles\n\nfiles ==========\n%s\n\nwantFiles ==========\n%s", label, asJSON(d.Files), asJSON(test.wantFiles))
+		}
+	}
+}
@@ -4,5 +4,7 @@
 // The vcs package must be used in conjunction with VCS implementation
 // packages. The subpackages git, gitcmd, hg, and hgcmd provide
 // implementations of Git and Mercurial (in both native-Go/Cgo and
-// shell-command variants).
+// shell-command variants). The gitgo subpackage provides a read-only
+// Git implementation in pure Go, which is registered as the "gitgo"
+// VCS type (the git and gitcmd subpackages register "git").
 package vcs // import "sourcegraph.com/sourcegraph/go-vcs/vcs"
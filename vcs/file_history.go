@@ -0,0 +1,20 @@
+package vcs
+
+// A FileHistoryLister is a repository that can list the history of a
+// file, along with the file's path in each commit.
+type FileHistoryLister interface {
+	// FileHistory returns the commits that changed the file at
+	// opt.Path (the same commits that Commits returns for opt), each
+	// with the file's path in the commit, and the total number of
+	// them (unless opt.NoTotal is set). opt.Cursor isn't supported.
+	//
+	// The history is followed through renames like `git log
+	// --follow`: when the walk reaches the commit that added the file
+	// by renaming or copying another file (detected like `git diff
+	// --find-copies-harder`, or as recorded by hg), it continues with
+	// the other file's path. Merge
+	// commits are omitted unless opt.FirstParent is set (in which
+	// case they are compared with their first parent), except in hg,
+	// where a merge that changed the file is included.
+	FileHistory(opt CommitsOptions) ([]*FileCommit, uint, error)
+}
@@ -10,8 +10,11 @@ extern int _govcs_gcrypt_init();
 */
 import "C"
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/user"
 	"strings"
@@ -45,6 +48,13 @@ func init() {
 }
 
 func Clone(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
+	if usesGitcmd(opt.RemoteOpts) {
+		if _, err := gitcmd.Clone(url, dir, opt); err != nil {
+			return nil, err
+		}
+		return Open(dir)
+	}
+
 	clopt := git2go.CloneOptions{Bare: opt.Bare}
 
 	rc, cfs, err := makeRemoteCallbacks(url, opt.RemoteOpts)
@@ -74,6 +84,14 @@ func Clone(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) {
 }
 
 func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
+	return r.UpdateEverythingContext(context.Background(), opt)
+}
+
+func (r *Repository) UpdateEverythingContext(ctx context.Context, opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
+	if usesGitcmd(opt) {
+		return r.Repository.UpdateEverythingContext(ctx, opt)
+	}
+
 	// TODO(sqs): allow use of a remote other than "origin"
 	rm, err := r.u.Remotes.Lookup("origin")
 	if err != nil {
@@ -91,8 +109,19 @@ func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, er
 	if rc != nil {
 		opts.RemoteCallbacks = *rc
 	}
+	// Abort the transfer (at the next progress update) when ctx is
+	// done.
+	opts.RemoteCallbacks.TransferProgressCallback = func(git2go.TransferProgress) git2go.ErrorCode {
+		if ctx.Err() != nil {
+			return git2go.ErrUser
+		}
+		return git2go.ErrOk
+	}
 
 	if err := rm.Fetch([]string{"+refs/*:refs/*"}, &opts, ""); err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, err
 	}
 
@@ -100,6 +129,24 @@ func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, er
 	return nil, nil
 }
 
+// usesGitcmd reports whether opt needs features that libgit2 doesn't
+// support, so that remote operations must be run with gitcmd:
+// authenticating with an ssh agent other than the process's (libssh2
+// only uses the agent of $SSH_AUTH_SOCK), HTTPS settings other than
+// the username and password, and credential providers.
+func usesGitcmd(opt vcs.RemoteOpts) bool {
+	if opt.Credentials != nil {
+		return true
+	}
+	if opt.SSH != nil && (opt.SSH.Agent != nil || opt.SSH.AgentSocket != "") {
+		return true
+	}
+	if h := opt.HTTPS; h != nil {
+		return h.Token != "" || len(h.ExtraHeaders) > 0 || h.ClientCert != nil || h.ClientKey != nil || h.CACerts != nil || h.Proxy != ""
+	}
+	return false
+}
+
 type cleanupFuncs []func() error
 
 func (f cleanupFuncs) run() error {
@@ -113,7 +160,7 @@ func (f cleanupFuncs) run() error {
 
 // makeRemoteCallbacks constructs the remote callbacks for libgit2
 // remote operations. Currently the remote callbacks are trivial
-// (empty) except when using an SSH remote.
+// (empty) except when using an SSH or HTTPS remote.
 //
 // cleanupFuncs's run method should be called when the RemoteCallbacks
 // struct is done being used. It is OK to ignore the error return.
@@ -141,7 +188,11 @@ func makeRemoteCallbacks(url string, opt vcs.RemoteOpts) (rc *git2go.RemoteCallb
 
 			// Derive public key from private key if empty.
 			if opt.SSH.PublicKey == nil {
-				privKey, err := ssh.ParsePrivateKey(opt.SSH.PrivateKey)
+				rawKey, err := sshutil.ParseRawPrivateKey(opt.SSH.PrivateKey, opt.SSH.Passphrase)
+				if err != nil {
+					return nil, cfs, err
+				}
+				privKey, err := ssh.NewSignerFromKey(rawKey)
 				if err != nil {
 					return nil, cfs, err
 				}
@@ -172,7 +223,7 @@ func makeRemoteCallbacks(url string, opt vcs.RemoteOpts) (rc *git2go.RemoteCallb
 					}
 				}
 				if allowedTypes&git2go.CredTypeSshKey != 0 && opt.SSH.PrivateKey != nil {
-					rv, cred := git2go.NewCredSshKey(username, pubkeyFilename, privkeyFilename, "")
+					rv, cred := git2go.NewCredSshKey(username, pubkeyFilename, privkeyFilename, string(opt.SSH.Passphrase))
 					return git2go.ErrorCode(rv), &cred
 				}
 				log.Printf("No authentication available for git URL %q.", url)
@@ -185,7 +236,7 @@ func makeRemoteCallbacks(url string, opt vcs.RemoteOpts) (rc *git2go.RemoteCallb
 				// host keys using known_hosts, but let's ignore valid
 				// so we don't get that behavior unexpectedly.
 
-				if InsecureSkipCheckVerifySSH {
+				if InsecureSkipCheckVerifySSH && opt.SSH.HostKeyPolicy == vcs.HostKeyDefault {
 					return git2go.ErrOk
 				}
 
@@ -193,6 +244,14 @@ func makeRemoteCallbacks(url string, opt vcs.RemoteOpts) (rc *git2go.RemoteCallb
 					return git2go.ErrNotFound
 				}
 
+				if opt.SSH.HostKeyPolicy != vcs.HostKeyDefault {
+					if err := checkHostKeyPolicy(url, opt.SSH, cert); err != nil {
+						log.Printf("Invalid certificate for SSH host %s: %s.", hostname, err)
+						return git2go.ErrGeneric
+					}
+					return git2go.ErrOk
+				}
+
 				if cert.Hostkey.Kind&git2go.HostkeyMD5 > 0 {
 					keys, found := standardKnownHosts.Lookup(hostname)
 					if found {
@@ -210,11 +269,70 @@ func makeRemoteCallbacks(url string, opt vcs.RemoteOpts) (rc *git2go.RemoteCallb
 				return git2go.ErrGeneric
 			}),
 		}
+	} else if opt.HTTPS != nil {
+		rc = &git2go.RemoteCallbacks{
+			CredentialsCallback: git2go.CredentialsCallback(func(url string, usernameFromURL string, allowedTypes git2go.CredType) (git2go.ErrorCode, *git2go.Cred) {
+				if allowedTypes&git2go.CredTypeUserpassPlaintext != 0 {
+					username := usernameFromURL
+					if username == "" {
+						username = opt.HTTPS.User
+					}
+					rv, cred := git2go.NewCredUserpassPlaintext(username, opt.HTTPS.Pass)
+					return git2go.ErrorCode(rv), &cred
+				}
+				log.Printf("No authentication available for git URL %q.", url)
+				rv, cred := git2go.NewCredDefault()
+				return git2go.ErrorCode(rv), &cred
+			}),
+		}
 	}
 
 	return rc, cfs, nil
 }
 
+// checkHostKeyPolicy verifies the host key of the SSH server of the
+// remote at url according to opt's host key policy. libgit2 only
+// provides the host key's fingerprint in cert.
+func checkHostKeyPolicy(url string, opt *vcs.SSHConfig, cert *git2go.Certificate) error {
+	if cert.Hostkey.Kind&git2go.HostkeyMD5 == 0 {
+		return errors.New("no MD5 host key fingerprint")
+	}
+	hostFingerprint := md5String(cert.Hostkey.HashMD5)
+
+	host, port, ok := sshutil.RemoteHost(url)
+	if !ok {
+		return fmt.Errorf("not an SSH URL: %q", url)
+	}
+	hostname := sshutil.KnownHostname(host, port)
+	keys, found, err := sshutil.HostKeys(opt, hostname)
+	if err != nil {
+		return err
+	}
+
+	if !found && opt.HostKeyPolicy == vcs.HostKeyTOFU {
+		// Fetch the host key itself to pass to TrustHostKey. The
+		// fingerprint doesn't say which type of key libssh2
+		// negotiated, so fetch the server's keys of every type.
+		scanned, err := sshutil.ScanHostKeys(net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		for _, key := range scanned {
+			if md5String(md5.Sum(key.Marshal())) == hostFingerprint {
+				return sshutil.CheckHostKey(opt, hostname, key)
+			}
+		}
+		return fmt.Errorf("host key of %s changed between connections", hostname)
+	}
+
+	for _, key := range keys {
+		if md5String(md5.Sum(key.Marshal())) == hostFingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("host key %s doesn't match any known host key for %s", hostFingerprint, hostname)
+}
+
 // InsecureSkipCheckVerifySSH controls whether the client verifies the
 // SSH server's certificate or host key. If InsecureSkipCheckVerifySSH
 // is true, the program is susceptible to a man-in-the-middle
@@ -0,0 +1,155 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	git2go "github.com/libgit2/git2go"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+// CreateBranch implements vcs.RefUpdater.
+func (r *Repository) CreateBranch(name string, id vcs.CommitID) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	c, err := r.getCommit(id)
+	if err != nil {
+		return err
+	}
+	defer c.Free()
+
+	b, err := r.u.CreateBranch(name, c, false)
+	if err != nil {
+		if git2go.IsErrorCode(err, git2go.ErrExists) {
+			return vcs.ErrRefConflict
+		}
+		return err
+	}
+	b.Free()
+	return nil
+}
+
+// DeleteBranch implements vcs.RefUpdater.
+func (r *Repository) DeleteBranch(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+	return r.deleteRef("refs/heads/"+name, vcs.ErrBranchNotFound)
+}
+
+// CreateTag implements vcs.RefUpdater.
+func (r *Repository) CreateTag(name string, id vcs.CommitID, opt *vcs.CreateTagOptions) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	c, err := r.getCommit(id)
+	if err != nil {
+		return err
+	}
+	defer c.Free()
+
+	if opt == nil {
+		_, err = r.u.Tags.CreateLightweight(name, c, false)
+	} else {
+		_, err = r.u.Tags.Create(name, c, makeSignature(opt.Tagger), opt.Message)
+	}
+	if git2go.IsErrorCode(err, git2go.ErrExists) {
+		return vcs.ErrRefConflict
+	}
+	return err
+}
+
+// DeleteTag implements vcs.RefUpdater.
+func (r *Repository) DeleteTag(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+	return r.deleteRef("refs/tags/"+name, vcs.ErrTagNotFound)
+}
+
+// UpdateRef implements vcs.RefUpdater. libgit2 checks that the ref
+// still has the value that was read when it updates or deletes the
+// ref, so the compare-and-swap is also safe with respect to other
+// processes modifying the repository.
+func (r *Repository) UpdateRef(name string, old, new vcs.CommitID) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	if !strings.HasPrefix(name, "refs/") {
+		return fmt.Errorf("invalid git ref name %q", name)
+	}
+
+	var newOID *git2go.Oid
+	if new != "" {
+		var err error
+		if newOID, err = git2go.NewOid(string(new)); err != nil {
+			return err
+		}
+	}
+
+	if old == "" {
+		if new == "" {
+			return errors.New("git update ref: old and new values are both empty")
+		}
+		ref, err := r.u.References.Create(name, newOID, false, "")
+		if err != nil {
+			if git2go.IsErrorCode(err, git2go.ErrExists) {
+				return vcs.ErrRefConflict
+			}
+			return err
+		}
+		ref.Free()
+		return nil
+	}
+
+	ref, err := r.u.References.Lookup(name)
+	if err != nil {
+		if git2go.IsErrorCode(err, git2go.ErrNotFound) {
+			return vcs.ErrRefConflict
+		}
+		return err
+	}
+	defer ref.Free()
+	if ref.Type() != git2go.ReferenceOid || ref.Target().String() != string(old) {
+		return vcs.ErrRefConflict
+	}
+
+	if new == "" {
+		err = ref.Delete()
+	} else {
+		var newRef *git2go.Reference
+		if newRef, err = ref.SetTarget(newOID, ""); err == nil {
+			newRef.Free()
+		}
+	}
+	if git2go.IsErrorCode(err, git2go.ErrModified) {
+		return vcs.ErrRefConflict
+	}
+	return err
+}
+
+// deleteRef deletes the ref named name, returning notFound if it
+// doesn't exist. The caller must hold r.editLock.
+func (r *Repository) deleteRef(name string, notFound error) error {
+	ref, err := r.u.References.Lookup(name)
+	if err != nil {
+		if git2go.IsErrorCode(err, git2go.ErrNotFound) {
+			return notFound
+		}
+		return err
+	}
+	defer ref.Free()
+	return ref.Delete()
+}
+
+// makeSignature converts sig to a git2go.Signature, using the current
+// time if sig.Date is the zero value.
+func makeSignature(sig vcs.Signature) *git2go.Signature {
+	when := time.Now()
+	if sig.Date != (pbtypes.Timestamp{}) {
+		when = sig.Date.Time()
+	}
+	return &git2go.Signature{Name: sig.Name, Email: sig.Email, When: when}
+}
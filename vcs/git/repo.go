@@ -2,6 +2,7 @@ package git
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -34,6 +35,8 @@ type Repository struct {
 	u *git2go.Repository
 
 	editLock sync.RWMutex // protects ops that change repository data
+
+	totals vcs.CommitsTotalCache
 }
 
 func (r *Repository) String() string {
@@ -68,6 +71,16 @@ func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
 	return vcs.CommitID(o.Id().String()), nil
 }
 
+// ResolveRevisionContext implements vcs.RepositoryContext. libgit2
+// operations run in-process and can't be interrupted, so ctx is only
+// checked before starting them.
+func (r *Repository) ResolveRevisionContext(ctx context.Context, spec string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveRevision(spec)
+}
+
 func (r *Repository) ResolveRef(name string) (vcs.CommitID, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
@@ -101,6 +114,13 @@ func (r *Repository) ResolveBranch(name string) (vcs.CommitID, error) {
 	return vcs.CommitID(b.Target().String()), nil
 }
 
+func (r *Repository) ResolveBranchContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveBranch(name)
+}
+
 func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
@@ -118,13 +138,26 @@ func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
 			break
 		}
 		if ref.IsTag() && ref.Shorthand() == name {
-			return vcs.CommitID(ref.Target().String()), nil
+			// Resolve annotated tags to the commit they point to.
+			c, err := ref.Peel(git2go.ObjectCommit)
+			if err != nil {
+				return "", err
+			}
+			defer c.Free()
+			return vcs.CommitID(c.Id().String()), nil
 		}
 	}
 
 	return "", vcs.ErrTagNotFound
 }
 
+func (r *Repository) ResolveTagContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveTag(name)
+}
+
 func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 	if opt.ContainsCommit != "" {
 		return nil, fmt.Errorf("vcs.BranchesOptions.ContainsCommit option not implemented")
@@ -156,6 +189,13 @@ func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 	return bs, nil
 }
 
+func (r *Repository) BranchesContext(ctx context.Context, opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Branches(opt)
+}
+
 func (r *Repository) Tags() ([]*vcs.Tag, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
@@ -175,7 +215,11 @@ func (r *Repository) Tags() ([]*vcs.Tag, error) {
 			return nil, err
 		}
 		if ref.IsTag() {
-			ts = append(ts, &vcs.Tag{Name: ref.Shorthand(), CommitID: vcs.CommitID(ref.Target().String())})
+			tag, err := r.makeTag(ref)
+			if err != nil {
+				return nil, err
+			}
+			ts = append(ts, tag)
 		}
 	}
 
@@ -183,6 +227,57 @@ func (r *Repository) Tags() ([]*vcs.Tag, error) {
 	return ts, nil
 }
 
+// makeTag returns the tag that the tag ref points to. The caller
+// must hold r.editLock.
+func (r *Repository) makeTag(ref *git2go.Reference) (*vcs.Tag, error) {
+	tag := &vcs.Tag{Name: ref.Shorthand()}
+
+	obj, err := r.u.Lookup(ref.Target())
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Free()
+
+	targetType := obj.Type()
+	if t, ok := obj.(*git2go.Tag); ok {
+		tag.Annotated = true
+		tag.ObjectID = t.Id().String()
+		if tagger := t.Tagger(); tagger != nil {
+			tag.Tagger = &vcs.Signature{Name: tagger.Name, Email: tagger.Email, Date: pbtypes.NewTimestamp(tagger.When)}
+		}
+		tag.Message, tag.Signature = internal.SplitTagSignature(t.Message())
+		tag.Message = strings.TrimSuffix(tag.Message, "\n")
+		targetType = t.TargetType()
+	}
+
+	switch targetType {
+	case git2go.ObjectCommit:
+		tag.TargetType = vcs.ObjectType_COMMIT
+	case git2go.ObjectTree:
+		tag.TargetType = vcs.ObjectType_TREE
+	case git2go.ObjectBlob:
+		tag.TargetType = vcs.ObjectType_BLOB
+	case git2go.ObjectTag:
+		tag.TargetType = vcs.ObjectType_TAG
+	default:
+		return nil, fmt.Errorf("unexpected git object type %s for tag %q", targetType, tag.Name)
+	}
+
+	// Peel the tag to find the commit it points to (if any).
+	if c, err := obj.Peel(git2go.ObjectCommit); err == nil {
+		tag.CommitID = vcs.CommitID(c.Id().String())
+		c.Free()
+	}
+	return tag, nil
+}
+
+func (r *Repository) TagsContext(ctx context.Context) ([]*vcs.Tag, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Tags()
+}
+
 // getCommit finds and returns the raw git2go Commit. The caller is
 // responsible for freeing it (c.Free()).
 func (r *Repository) getCommit(id vcs.CommitID) (*git2go.Commit, error) {
@@ -213,7 +308,41 @@ func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
 	return r.makeCommit(c), nil
 }
 
+func (r *Repository) GetCommitContext(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.GetCommit(id)
+}
+
 func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	return r.CommitsContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Cursor != "" {
+		page, err := r.CommitsPageContext(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Commits, page.Total, nil
+	}
+	return r.commits(ctx, opt)
+}
+
+// commits returns the commits selected by opt, ignoring opt.Cursor.
+func (r *Repository) commits(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Path != "" {
+		// Following renames is not implemented in libgit2 yet, so
+		// call gitcmd.
+		return r.Repository.CommitsContext(ctx, opt)
+	}
+
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
@@ -224,40 +353,44 @@ func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error
 	defer walk.Free()
 
 	walk.Sorting(git2go.SortTime)
-
-	oid, err := git2go.NewOid(string(opt.Head))
-	if err != nil {
-		return nil, 0, err
-	}
-	if err := walk.Push(oid); err != nil {
-		if git2go.IsErrorCode(err, git2go.ErrNotFound) {
-			return nil, 0, vcs.ErrCommitNotFound
-		}
-		return nil, 0, err
+	if opt.FirstParent {
+		walk.SimplifyFirstParent()
 	}
 
-	if opt.Base != "" {
-		baseOID, err := git2go.NewOid(string(opt.Base))
-		if err != nil {
+	for _, head := range append([]vcs.CommitID{opt.Head}, opt.Heads...) {
+		if err := walkCommitID(walk.Push, head); err != nil {
 			return nil, 0, err
 		}
-		if err := walk.Hide(baseOID); err != nil {
-			if git2go.IsErrorCode(err, git2go.ErrNotFound) {
-				return nil, 0, vcs.ErrCommitNotFound
-			}
+	}
+	for _, base := range append([]vcs.CommitID{opt.Base}, opt.Bases...) {
+		if base == "" {
+			continue
+		}
+		if err := walkCommitID(walk.Hide, base); err != nil {
 			return nil, 0, err
 		}
 	}
 
+	// The commits must all be walked before they can be sorted, so
+	// only skip and limit them while walking if there's no Order.
+	sorted := opt.Order != ""
+
 	var commits []*vcs.Commit
 	total := uint(0)
 	err = walk.Iterate(func(c *git2go.Commit) bool {
-		if total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N) {
-			commits = append(commits, r.makeCommit(c))
+		if ctx.Err() != nil {
+			return false
+		}
+		vc := r.makeCommit(c)
+		if !filter.Match(vc) {
+			return true
+		}
+		if sorted || (total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N)) {
+			commits = append(commits, vc)
 		}
 		total++
 		// If we want total, keep going until the end.
-		if !opt.NoTotal {
+		if !opt.NoTotal || sorted {
 			return true
 		}
 		// Otherwise return once N has been satisfied.
@@ -266,6 +399,24 @@ func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error
 	if err != nil {
 		return nil, 0, err
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if sorted {
+		if err := vcs.SortCommits(commits, opt.Order); err != nil {
+			return nil, 0, err
+		}
+		if opt.Skip >= uint(len(commits)) {
+			commits = nil
+		} else {
+			commits = commits[opt.Skip:]
+		}
+		if opt.N != 0 && uint(len(commits)) > opt.N {
+			commits = commits[:opt.N]
+		}
+	}
+
 	if opt.NoTotal {
 		total = 0
 	}
@@ -273,6 +424,160 @@ func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error
 	return commits, total, nil
 }
 
+func (r *Repository) CommitsPage(opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	return r.CommitsPageContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsPageContext(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	var cursor *vcs.CommitsCursor
+	if opt.Cursor != "" {
+		var err error
+		if cursor, err = vcs.ParseCommitsCursor(opt.Cursor); err != nil {
+			return nil, err
+		}
+		if cursor.After != "" || (opt.Order != "" && len(cursor.Frontier) > 0) {
+			return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+		}
+	}
+	if opt.Order != "" || (cursor != nil && len(cursor.Frontier) == 0) {
+		// Sorting the commits requires walking all of them, so skip
+		// the earlier pages' commits.
+		var offset uint
+		if cursor != nil {
+			offset = cursor.Offset
+		}
+		return r.commitsPageAtOffset(ctx, opt, offset)
+	}
+
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, err
+	}
+	frontier := vcs.NewCommitFrontier(append([]vcs.CommitID{opt.Head}, opt.Heads...), cursor, opt.FirstParent)
+	page := &vcs.CommitsPage{}
+	var offset uint // the number of matching commits before the next page
+	if cursor != nil {
+		offset = cursor.Offset
+	}
+	skip := opt.Skip
+	skewed := false
+	err = func() error {
+		r.editLock.RLock()
+		defer r.editLock.RUnlock()
+
+		walk, err := r.u.Walk()
+		if err != nil {
+			return err
+		}
+		defer walk.Free()
+
+		walk.Sorting(git2go.SortTime)
+		if opt.FirstParent {
+			walk.SimplifyFirstParent()
+		}
+		for _, head := range frontier.Heads() {
+			if err := walkCommitID(walk.Push, head); err != nil {
+				return err
+			}
+		}
+		for _, base := range append([]vcs.CommitID{opt.Base}, opt.Bases...) {
+			if base == "" {
+				continue
+			}
+			if err := walkCommitID(walk.Hide, base); err != nil {
+				return err
+			}
+		}
+
+		return walk.Iterate(func(c *git2go.Commit) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			vc := r.makeCommit(c)
+			match := filter.Match(vc)
+			if match && opt.N != 0 && uint(len(page.Commits)) == opt.N {
+				// There are more commits after this page, which
+				// start with this one.
+				page.NextCursor = frontier.Cursor(offset).String()
+				return false
+			}
+			walked, ok := frontier.Walk(vc)
+			if !ok && cursor != nil {
+				// The commit dates are skewed, so this walk may
+				// return commits that were on earlier pages.
+				skewed = true
+				return false
+			}
+			if !match || walked {
+				return true
+			}
+			offset++
+			if skip > 0 {
+				skip--
+				return true
+			}
+			page.Commits = append(page.Commits, vc)
+			return true
+		})
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if skewed {
+		return r.commitsPageAtOffset(ctx, opt, cursor.Offset)
+	}
+
+	if !opt.NoTotal {
+		if total, ok := r.totals.Get(opt); ok {
+			page.Total = total
+		} else {
+			countOpt := opt
+			countOpt.N, countOpt.Skip, countOpt.Cursor = 1, 0, ""
+			if _, page.Total, err = r.commits(ctx, countOpt); err != nil {
+				return nil, err
+			}
+			r.totals.Add(opt, page.Total)
+		}
+	}
+	return page, nil
+}
+
+// commitsPageAtOffset returns the page of commits that starts after
+// the first offset commits (and opt.Skip more), by walking all of the
+// earlier commits again.
+func (r *Repository) commitsPageAtOffset(ctx context.Context, opt vcs.CommitsOptions, offset uint) (*vcs.CommitsPage, error) {
+	pageOpt := opt
+	pageOpt.Cursor, pageOpt.Skip = "", offset+opt.Skip
+	commits, total, err := r.commits(ctx, pageOpt)
+	if err != nil {
+		return nil, err
+	}
+	page := &vcs.CommitsPage{Commits: commits, Total: total}
+	if opt.N != 0 && uint(len(commits)) == opt.N {
+		page.NextCursor = (&vcs.CommitsCursor{Offset: pageOpt.Skip + opt.N}).String()
+	}
+	return page, nil
+}
+
+// walkCommitID calls fn (the revwalk's Push or Hide method) with the
+// OID of id.
+func walkCommitID(fn func(*git2go.Oid) error, id vcs.CommitID) error {
+	oid, err := git2go.NewOid(string(id))
+	if err != nil {
+		return err
+	}
+	if err := fn(oid); err != nil {
+		if git2go.IsErrorCode(err, git2go.ErrNotFound) {
+			return vcs.ErrCommitNotFound
+		}
+		return err
+	}
+	return nil
+}
+
 func (r *Repository) makeCommit(c *git2go.Commit) *vcs.Commit {
 	var parents []vcs.CommitID
 	if pc := c.ParentCount(); pc > 0 {
@@ -303,6 +608,13 @@ func init() {
 	defaultDiffOptions.IdAbbrev = 40
 }
 
+func (r *Repository) CrossRepoDiffContext(ctx context.Context, base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.CrossRepoDiff(base, headRepo, head, opt)
+}
+
 func (r *Repository) CrossRepoDiff(base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (diff *vcs.Diff, err error) {
 	// libgit2 Repository inherits GitRootDir and CrossRepo from its
 	// embedded gitcmd.Repository.
@@ -354,6 +666,13 @@ func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.D
 	return r.diffHoldingEditLock(base, head, opt)
 }
 
+func (r *Repository) DiffContext(ctx context.Context, base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Diff(base, head, opt)
+}
+
 // diffHoldingLock performs a diff. It must be called while holding
 // r.editLock (either as a reader or writer).
 func (r *Repository) diffHoldingEditLock(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
@@ -414,8 +733,7 @@ func (r *Repository) diffHoldingEditLock(base, head vcs.CommitID, opt *vcs.DiffO
 		}
 	}
 
-	diff := &vcs.Diff{}
-
+	var raw bytes.Buffer
 	ndeltas, err := gdiff.NumDeltas()
 	if err != nil {
 		return nil, err
@@ -432,15 +750,144 @@ func (r *Repository) diffHoldingEditLock(base, head vcs.CommitID, opt *vcs.DiffO
 			return nil, err
 		}
 
-		diff.Raw += patchStr
+		raw.WriteString(patchStr)
 	}
-	return diff, nil
+	return vcs.ParseDiff(raw.Bytes(), opt)
+}
+
+func (r *Repository) CommitFiles(id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	r.editLock.RLock()
+	defer r.editLock.RUnlock()
+
+	if opt == nil {
+		opt = &vcs.CommitFilesOptions{}
+	}
+
+	c, err := r.getCommit(id)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Free()
+	tree, err := r.u.LookupTree(c.TreeId())
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	if c.ParentCount() == 0 {
+		// Compare a root commit with an empty tree.
+		files, err := r.changedFiles(nil, tree, opt)
+		if err != nil {
+			return nil, err
+		}
+		return []*vcs.CommitFiles{{Files: files}}, nil
+	}
+
+	all := make([]*vcs.CommitFiles, c.ParentCount())
+	for i := range all {
+		parent := c.Parent(uint(i))
+		if parent == nil {
+			return nil, fmt.Errorf("git commit %s has no parent %d", id, i)
+		}
+		defer parent.Free()
+		parentTree, err := r.u.LookupTree(parent.TreeId())
+		if err != nil {
+			return nil, err
+		}
+		defer parentTree.Free()
+
+		files, err := r.changedFiles(parentTree, tree, opt)
+		if err != nil {
+			return nil, err
+		}
+		all[i] = &vcs.CommitFiles{Parent: vcs.CommitID(parent.Id().String()), Files: files}
+	}
+	return all, nil
+}
+
+func (r *Repository) CommitFilesContext(ctx context.Context, id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.CommitFiles(id, opt)
+}
+
+// changedFiles returns the files that differ between the trees (the
+// old one of which may be nil), with their added and deleted line
+// counts. It must be called while holding r.editLock (either as a
+// reader or writer).
+func (r *Repository) changedFiles(oldTree, newTree *git2go.Tree, opt *vcs.CommitFilesOptions) ([]*vcs.ChangedFile, error) {
+	gopt := defaultDiffOptions
+	gopt.Flags |= git2go.DiffIncludeTypeChange
+	gdiff, err := r.u.DiffTreeToTree(oldTree, newTree, &gopt)
+	if err != nil {
+		return nil, err
+	}
+	defer gdiff.Free()
+
+	findOpts, err := git2go.DefaultDiffFindOptions()
+	if err != nil {
+		return nil, err
+	}
+	findOpts.Flags = git2go.DiffFindRenames
+	if opt.DetectCopies {
+		findOpts.Flags |= git2go.DiffFindCopies
+	}
+	if err := gdiff.FindSimilar(&findOpts); err != nil {
+		return nil, err
+	}
+
+	var files []*vcs.ChangedFile
+	err = gdiff.ForEach(func(delta git2go.DiffDelta, progress float64) (git2go.DiffForEachHunkCallback, error) {
+		f := &vcs.ChangedFile{
+			Path:   delta.NewFile.Path,
+			Binary: delta.Flags&git2go.DiffFlagBinary != 0,
+		}
+		switch delta.Status {
+		case git2go.DeltaAdded:
+			f.ChangeType = vcs.FileChangeType_ADDED
+		case git2go.DeltaDeleted:
+			f.ChangeType = vcs.FileChangeType_DELETED
+			f.Path = delta.OldFile.Path
+		case git2go.DeltaRenamed:
+			f.ChangeType = vcs.FileChangeType_RENAMED
+			f.OrigPath = delta.OldFile.Path
+		case git2go.DeltaCopied:
+			f.ChangeType = vcs.FileChangeType_COPIED
+			f.OrigPath = delta.OldFile.Path
+		default:
+			f.ChangeType = vcs.FileChangeType_MODIFIED
+		}
+		files = append(files, f)
+
+		return func(git2go.DiffHunk) (git2go.DiffForEachLineCallback, error) {
+			return func(line git2go.DiffLine) error {
+				switch line.Origin {
+				case git2go.DiffLineAddition:
+					f.Added++
+				case git2go.DiffLineDeletion:
+					f.Deleted++
+				}
+				return nil
+			}, nil
+		}, nil
+	}, git2go.DiffDetailLines)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
 func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
+	if opt == nil || !opt.NoIgnoreWhitespace || opt.DetectMoves || opt.DetectCopies || len(opt.IgnoreRevs) > 0 || opt.IgnoreRevsFile != "" {
+		// Not implemented in libgit2 yet (including ignoring
+		// whitespace, which is the default), so call gitcmd.
+		return r.Repository.BlameFile(path, opt)
+	}
+
 	gopt := git2go.BlameOptions{}
 	if opt != nil {
 		var err error
@@ -477,6 +924,7 @@ func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk,
 	}
 	lines := bytes.SplitAfter(b, []byte{'\n'})
 
+	commits := map[string]*git2go.Commit{}
 	byteOffset := 0
 	hunks := make([]*vcs.Hunk, blame.HunkCount())
 	for i := 0; i < len(hunks); i++ {
@@ -491,6 +939,16 @@ func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk,
 		}
 		endByteOffset := byteOffset + hunkBytes
 
+		commit, ok := commits[hunk.FinalCommitId.String()]
+		if !ok {
+			commit, err = r.u.LookupCommit(hunk.FinalCommitId)
+			if err != nil {
+				return nil, err
+			}
+			defer commit.Free()
+			commits[hunk.FinalCommitId.String()] = commit
+		}
+
 		hunks[i] = &vcs.Hunk{
 			StartLine: int(hunk.FinalStartLineNumber),
 			EndLine:   int(hunk.FinalStartLineNumber + hunk.LinesInHunk),
@@ -502,6 +960,14 @@ func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk,
 				Email: hunk.FinalSignature.Email,
 				Date:  pbtypes.NewTimestamp(hunk.FinalSignature.When.In(time.UTC)),
 			},
+			Committer: &vcs.Signature{
+				Name:  commit.Committer().Name,
+				Email: commit.Committer().Email,
+				Date:  pbtypes.NewTimestamp(commit.Committer().When.In(time.UTC)),
+			},
+			Summary:       commit.Summary(),
+			OrigPath:      hunk.OrigPath,
+			OrigStartLine: int(hunk.OrigStartLineNumber),
 		}
 		byteOffset = endByteOffset
 		lines = lines[hunk.LinesInHunk:]
@@ -510,12 +976,26 @@ func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk,
 	return hunks, nil
 }
 
+func (r *Repository) BlameFileContext(ctx context.Context, path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.BlameFile(path, opt)
+}
+
 func (r *Repository) MergeBase(a, b vcs.CommitID) (vcs.CommitID, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 	return r.mergeBaseHoldingEditLock(a, b)
 }
 
+func (r *Repository) MergeBaseContext(ctx context.Context, a, b vcs.CommitID) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.MergeBase(a, b)
+}
+
 // mergeBaseHoldingEditLock performs a merge-base. Callers must hold
 // the r.editLock (either as a reader or writer).
 func (r *Repository) mergeBaseHoldingEditLock(a, b vcs.CommitID) (vcs.CommitID, error) {
@@ -561,6 +1041,13 @@ func (r *Repository) CrossRepoMergeBase(a vcs.CommitID, repoB vcs.Repository, b
 	return r.mergeBaseHoldingEditLock(a, b)
 }
 
+func (r *Repository) CrossRepoMergeBaseContext(ctx context.Context, a vcs.CommitID, repoB vcs.Repository, b vcs.CommitID) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.CrossRepoMergeBase(a, repoB, b)
+}
+
 // TODO(sqs): implement Search using libgit2 (currently falls back to
 // gitcmd impl in embedded struct).
 
@@ -581,6 +1068,13 @@ func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
 	return &gitFSLibGit2{r.Dir, c.Id(), at, tree, r.u, &r.editLock}, nil
 }
 
+func (r *Repository) FileSystemContext(ctx context.Context, at vcs.CommitID) (vfs.FileSystem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.FileSystem(at)
+}
+
 type gitFSLibGit2 struct {
 	dir  string
 	oid  *git2go.Oid
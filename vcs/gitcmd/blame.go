@@ -0,0 +1,240 @@
+package gitcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	return r.BlameFileContext(context.Background(), path, opt)
+}
+
+func (r *Repository) BlameFileContext(ctx context.Context, path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	r.editLock.RLock()
+	defer r.editLock.RUnlock()
+
+	if opt == nil {
+		opt = &vcs.BlameOptions{}
+	}
+	if err := checkSpecArgSafety(string(opt.NewestCommit)); err != nil {
+		return nil, err
+	}
+	if err := checkSpecArgSafety(string(opt.OldestCommit)); err != nil {
+		return nil, err
+	}
+
+	args := []string{"blame", "--porcelain"}
+	if !opt.NoIgnoreWhitespace {
+		args = append(args, "-w")
+	}
+	if opt.DetectMoves {
+		args = append(args, "-M")
+	}
+	if opt.DetectCopies {
+		args = append(args, "-C")
+	}
+	ignoreRevs := opt.IgnoreRevs
+	if opt.IgnoreRevsFile != "" {
+		revs, err := r.readBlameIgnoreRevsFile(ctx, opt.NewestCommit, opt.IgnoreRevsFile)
+		if err != nil {
+			return nil, err
+		}
+		ignoreRevs = append(ignoreRevs[:len(ignoreRevs):len(ignoreRevs)], revs...)
+	}
+	for _, rev := range ignoreRevs {
+		if err := checkSpecArgSafety(string(rev)); err != nil {
+			return nil, err
+		}
+		args = append(args, "--ignore-rev="+string(rev))
+	}
+	if opt.StartLine != 0 || opt.EndLine != 0 {
+		args = append(args, fmt.Sprintf("-L%d,%d", opt.StartLine, opt.EndLine))
+	}
+	if opt.OldestCommit != "" {
+		// Lines from OldestCommit and its ancestors are attributed
+		// to OldestCommit (as a boundary commit).
+		args = append(args, string(opt.OldestCommit)+".."+string(opt.NewestCommit))
+	} else {
+		args = append(args, string(opt.NewestCommit))
+	}
+	args = append(args, "--", filepath.ToSlash(path))
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("exec `git blame` failed: %s. Output was:\n\n%s", err, out)
+	}
+	if len(out) < 1 {
+		// go 1.8.5 changed the behavior of `git blame` on empty files.
+		// previously, it returned a boundary commit. now, it returns nothing.
+		// TODO(sqs) TODO(beyang): make `git blame` return the boundary commit
+		// on an empty file somehow, or come up with some other workaround.
+		st, err := os.Stat(filepath.Join(r.Dir, path))
+		if err == nil && st.Size() == 0 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Expected git output of length at least 1")
+	}
+	return parseBlamePorcelain(out)
+}
+
+// readBlameIgnoreRevsFile returns the commits listed in the file
+// name at the given commit (or HEAD), or none if the file doesn't
+// exist. The caller must hold r.editLock.
+func (r *Repository) readBlameIgnoreRevsFile(ctx context.Context, at vcs.CommitID, name string) ([]vcs.CommitID, error) {
+	if at == "" {
+		at = "HEAD"
+	}
+	fs := &gitFSCmd{ctx: ctx, dir: r.Dir, at: at, repo: r, repoEditLock: &r.editLock}
+	data, err := fs.readFileBytes(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return vcs.ParseBlameIgnoreRevs(data), nil
+}
+
+// blameCommit is the information about a commit in the output of `git
+// blame --porcelain`. It is only printed the first time the commit
+// appears, so it is kept for the commit's later hunks.
+type blameCommit struct {
+	author, committer vcs.Signature
+	summary           string
+	filename          string
+	previousCommitID  vcs.CommitID
+	previousPath      string
+}
+
+// parseBlamePorcelain parses the output of `git blame --porcelain`.
+//
+// Each line of the file is described by a header ("COMMIT ORIG-LINE
+// FINAL-LINE", followed by the number of lines in the hunk if it is
+// the hunk's first line), the information about COMMIT (as "KEY
+// VALUE" lines), and the line's contents prefixed by a tab.
+func parseBlamePorcelain(out []byte) ([]*vcs.Hunk, error) {
+	commits := make(map[string]*blameCommit)
+	hunks := make([]*vcs.Hunk, 0)
+	var hunk *vcs.Hunk
+	byteOffset := 0
+	remainingLines := strings.Split(string(out[:len(out)-1]), "\n")
+	for len(remainingLines) > 0 {
+		header := strings.Split(remainingLines[0], " ")
+		if len(header) != 3 && len(header) != 4 {
+			return nil, fmt.Errorf("unexpected git blame header line: %q", remainingLines[0])
+		}
+		commitID := header[0]
+		commit, seen := commits[commitID]
+		if !seen {
+			commit = &blameCommit{}
+			commits[commitID] = commit
+		}
+
+		i := 1
+		sawFilename, sawPrevious := false, false
+		for ; i < len(remainingLines) && !strings.HasPrefix(remainingLines[i], "\t"); i++ {
+			line := remainingLines[i]
+			key, value := line, ""
+			if j := strings.Index(line, " "); j != -1 {
+				key, value = line[:j], line[j+1:]
+			}
+			switch key {
+			case "author":
+				commit.author.Name = value
+			case "author-mail":
+				commit.author.Email = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+			case "author-time":
+				t, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to parse author-time %q", line)
+				}
+				commit.author.Date = pbtypes.NewTimestamp(time.Unix(t, 0).In(time.UTC))
+			case "committer":
+				commit.committer.Name = value
+			case "committer-mail":
+				commit.committer.Email = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+			case "committer-time":
+				t, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to parse committer-time %q", line)
+				}
+				commit.committer.Date = pbtypes.NewTimestamp(time.Unix(t, 0).In(time.UTC))
+			case "summary":
+				commit.summary = value
+			case "previous":
+				sawPrevious = true
+				parts := strings.SplitN(value, " ", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("Failed to parse previous %q", line)
+				}
+				commit.previousCommitID, commit.previousPath = vcs.CommitID(parts[0]), unquoteBlamePath(parts[1])
+			case "filename":
+				sawFilename = true
+				commit.filename = unquoteBlamePath(value)
+			}
+		}
+		if sawFilename && !sawPrevious {
+			// The previous commit is printed along with the
+			// filename (which can differ between a commit's hunks
+			// if it touched more than one path).
+			commit.previousCommitID, commit.previousPath = "", ""
+		}
+
+		if len(header) == 4 {
+			origLine, _ := strconv.Atoi(header[1])
+			lineNoCur, _ := strconv.Atoi(header[2])
+			nLines, _ := strconv.Atoi(header[3])
+			committer := commit.committer
+			hunk = &vcs.Hunk{
+				StartLine:        lineNoCur,
+				EndLine:          lineNoCur + nLines,
+				StartByte:        byteOffset,
+				EndByte:          byteOffset,
+				CommitID:         vcs.CommitID(commitID),
+				Author:           commit.author,
+				Committer:        &committer,
+				Summary:          commit.summary,
+				OrigPath:         commit.filename,
+				OrigStartLine:    origLine,
+				PreviousCommitID: commit.previousCommitID,
+				PreviousPath:     commit.previousPath,
+			}
+			hunks = append(hunks, hunk)
+		} else if hunk == nil {
+			return nil, fmt.Errorf("unexpected git blame header line before first hunk: %q", remainingLines[0])
+		}
+
+		if i == len(remainingLines) {
+			// Older versions of git print a boundary commit with no
+			// lines for an empty file.
+			break
+		}
+		byteOffset += len(remainingLines[i]) // the tab stands in for the newline
+		hunk.EndByte = byteOffset
+		remainingLines = remainingLines[i+1:]
+	}
+	return hunks, nil
+}
+
+// unquoteBlamePath returns the path that git printed in its quoted
+// form (used for paths with special characters).
+func unquoteBlamePath(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if p, err := strconv.Unquote(s); err == nil {
+			return p
+		}
+	}
+	return s
+}
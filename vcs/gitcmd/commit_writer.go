@@ -0,0 +1,260 @@
+package gitcmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+// CreateCommit implements vcs.CommitWriter. It uses git plumbing
+// commands (hash-object, mktree, commit-tree and update-ref), so it
+// doesn't need or touch a working tree.
+func (r *Repository) CreateCommit(opt vcs.CreateCommitOptions) (vcs.CommitID, error) {
+	if err := checkSpecArgSafety(string(opt.Parent)); err != nil {
+		return "", err
+	}
+	if err := checkSpecArgSafety(opt.Branch); err != nil {
+		return "", err
+	}
+
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	root := &gitTree{}
+	if opt.Parent != "" {
+		var err error
+		if root, err = r.readTree(string(opt.Parent) + "^{tree}"); err != nil {
+			return "", err
+		}
+	}
+	for _, c := range opt.Changes {
+		if err := r.applyFileChange(root, c); err != nil {
+			return "", err
+		}
+	}
+	treeID, err := r.writeTree(root)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", treeID}
+	if opt.Parent != "" {
+		args = append(args, "-p", string(opt.Parent))
+	}
+	committer := opt.Committer
+	if committer == nil {
+		committer = &opt.Author
+	}
+	env := environ(os.Environ())
+	env = append(env, signatureEnv("AUTHOR", opt.Author)...)
+	env = append(env, signatureEnv("COMMITTER", *committer)...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(opt.Message)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("exec `git commit-tree` failed: %s. Output was:\n\n%s", err, out)
+	}
+	id := vcs.CommitID(bytes.TrimSpace(out))
+
+	if opt.Branch != "" {
+		if err := r.updateBranchForCommit(opt.Branch, id, opt.Parent); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// updateBranchForCommit points branch at id, if branch is currently
+// at parent or doesn't exist. The caller must hold r.editLock.
+func (r *Repository) updateBranchForCommit(branch string, id, parent vcs.CommitID) error {
+	ref := "refs/heads/" + branch
+	cur, err := r.refTarget(ref)
+	if err != nil {
+		return err
+	}
+
+	// An empty old value means that the ref must not exist.
+	var old vcs.CommitID
+	if cur != "" {
+		old = parent
+	}
+	return r.updateRef(ref, old, id)
+}
+
+// signatureEnv returns the environment variables that set the git
+// author or committer (depending on who) to sig.
+func signatureEnv(who string, sig vcs.Signature) []string {
+	env := []string{
+		"GIT_" + who + "_NAME=" + sig.Name,
+		"GIT_" + who + "_EMAIL=" + sig.Email,
+	}
+	if sig.Date != (pbtypes.Timestamp{}) {
+		env = append(env, fmt.Sprintf("GIT_%s_DATE=%d +0000", who, sig.Date.Seconds))
+	}
+	return env
+}
+
+// A gitTree is a git tree that is being modified in memory.
+type gitTree struct {
+	entries  map[string]gitTreeEntry // unmodified entries and new blobs
+	subtrees map[string]*gitTree     // modified subtrees
+}
+
+type gitTreeEntry struct {
+	mode, typ, id string
+}
+
+// readTree reads the tree identified by treeish. The caller must
+// hold r.editLock.
+func (r *Repository) readTree(treeish string) (*gitTree, error) {
+	cmd := exec.Command("git", "ls-tree", "-z", treeish)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.TrimSpace(out)
+		if bytes.Contains(out, []byte("Not a valid object name")) {
+			return nil, vcs.ErrCommitNotFound
+		}
+		return nil, fmt.Errorf("exec `git ls-tree` failed: %s. Output was:\n\n%s", err, out)
+	}
+
+	t := &gitTree{entries: map[string]gitTreeEntry{}, subtrees: map[string]*gitTree{}}
+	for _, line := range bytes.Split(out, []byte{'\x00'}) {
+		if len(line) == 0 {
+			continue
+		}
+		// Format: "MODE TYPE ID\tNAME".
+		tab := bytes.IndexByte(line, '\t')
+		if tab == -1 {
+			return nil, fmt.Errorf("invalid `git ls-tree` output: %q", out)
+		}
+		fields := strings.Fields(string(line[:tab]))
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid `git ls-tree` output: %q", out)
+		}
+		t.entries[string(line[tab+1:])] = gitTreeEntry{mode: fields[0], typ: fields[1], id: fields[2]}
+	}
+	return t, nil
+}
+
+// applyFileChange applies c to the tree rooted at root. The caller
+// must hold r.editLock.
+func (r *Repository) applyFileChange(root *gitTree, c vcs.FileChange) error {
+	if !internal.IsCleanRelPath(c.Path) {
+		return fmt.Errorf("invalid file path %q", c.Path)
+	}
+
+	// Walk (and load, if necessary) the subtrees leading to the file.
+	t := root
+	names := strings.Split(c.Path, "/")
+	for _, name := range names[:len(names)-1] {
+		sub, ok := t.subtrees[name]
+		if !ok {
+			if e, ok := t.entries[name]; ok && e.typ == "tree" {
+				var err error
+				if sub, err = r.readTree(e.id); err != nil {
+					return err
+				}
+			} else if c.Delete {
+				return &os.PathError{Op: "delete", Path: c.Path, Err: os.ErrNotExist}
+			} else {
+				sub = &gitTree{}
+			}
+			delete(t.entries, name)
+			if t.subtrees == nil {
+				t.subtrees = map[string]*gitTree{}
+			}
+			t.subtrees[name] = sub
+		}
+		t = sub
+	}
+
+	name := names[len(names)-1]
+	if c.Delete {
+		_, isEntry := t.entries[name]
+		_, isSubtree := t.subtrees[name]
+		if !isEntry && !isSubtree {
+			return &os.PathError{Op: "delete", Path: c.Path, Err: os.ErrNotExist}
+		}
+		delete(t.entries, name)
+		delete(t.subtrees, name)
+		return nil
+	}
+
+	cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+	cmd.Dir = r.Dir
+	cmd.Stdin = bytes.NewReader(c.Data)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec `git hash-object` failed: %s. Output was:\n\n%s", err, out)
+	}
+
+	mode := "100644"
+	if c.Mode&os.ModeSymlink != 0 {
+		mode = "120000"
+	} else if c.Mode&0111 != 0 {
+		mode = "100755"
+	}
+	delete(t.subtrees, name)
+	if t.entries == nil {
+		t.entries = map[string]gitTreeEntry{}
+	}
+	t.entries[name] = gitTreeEntry{mode: mode, typ: "blob", id: string(bytes.TrimSpace(out))}
+	return nil
+}
+
+// writeTree writes t and its modified subtrees to the object store
+// and returns t's ID. Subtrees that end up empty are omitted (git
+// doesn't track empty directories). The caller must hold
+// r.editLock.
+func (r *Repository) writeTree(t *gitTree) (string, error) {
+	entries := make(map[string]gitTreeEntry, len(t.entries)+len(t.subtrees))
+	for name, e := range t.entries {
+		entries[name] = e
+	}
+	for name, sub := range t.subtrees {
+		if len(sub.entries) == 0 && len(sub.subtrees) == 0 {
+			continue
+		}
+		id, err := r.writeTree(sub)
+		if err != nil {
+			return "", err
+		}
+		if id == emptyTreeID {
+			continue
+		}
+		entries[name] = gitTreeEntry{mode: "040000", typ: "tree", id: id}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var in bytes.Buffer
+	for _, name := range names {
+		e := entries[name]
+		fmt.Fprintf(&in, "%s %s %s\t%s\x00", e.mode, e.typ, e.id, name)
+	}
+
+	cmd := exec.Command("git", "mktree", "-z")
+	cmd.Dir = r.Dir
+	cmd.Stdin = &in
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("exec `git mktree` failed: %s. Output was:\n\n%s", err, out)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// emptyTreeID is the ID of the empty git tree.
+const emptyTreeID = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
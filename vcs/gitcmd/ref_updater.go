@@ -0,0 +1,158 @@
+package gitcmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// CreateBranch implements vcs.RefUpdater.
+func (r *Repository) CreateBranch(name string, id vcs.CommitID) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	if err := r.checkCommitExists(id); err != nil {
+		return err
+	}
+	return r.updateRef("refs/heads/"+name, "", id)
+}
+
+// DeleteBranch implements vcs.RefUpdater.
+func (r *Repository) DeleteBranch(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+	return r.deleteRef("refs/heads/"+name, vcs.ErrBranchNotFound)
+}
+
+// CreateTag implements vcs.RefUpdater.
+func (r *Repository) CreateTag(name string, id vcs.CommitID, opt *vcs.CreateTagOptions) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	if err := r.checkCommitExists(id); err != nil {
+		return err
+	}
+	if opt == nil {
+		return r.updateRef("refs/tags/"+name, "", id)
+	}
+
+	if err := checkSpecArgSafety(name); err != nil {
+		return err
+	}
+	// git uses the committer identity as the tagger.
+	cmd := exec.Command("git", "tag", "--annotate", "--cleanup=verbatim", "--file=-", name, string(id))
+	cmd.Dir = r.Dir
+	cmd.Env = append(environ(os.Environ()), signatureEnv("COMMITTER", opt.Tagger)...)
+	cmd.Stdin = strings.NewReader(opt.Message)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if cur, _ := r.refTarget("refs/tags/" + name); cur != "" {
+			return vcs.ErrRefConflict
+		}
+		return fmt.Errorf("exec `git tag` failed: %s. Output was:\n\n%s", err, out)
+	}
+	return nil
+}
+
+// DeleteTag implements vcs.RefUpdater.
+func (r *Repository) DeleteTag(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+	return r.deleteRef("refs/tags/"+name, vcs.ErrTagNotFound)
+}
+
+// UpdateRef implements vcs.RefUpdater. The compare-and-swap is
+// performed by `git update-ref`, so it is also safe with respect to
+// other processes modifying the repository.
+func (r *Repository) UpdateRef(name string, old, new vcs.CommitID) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+	return r.updateRef(name, old, new)
+}
+
+// updateRef is like UpdateRef, but the caller must hold r.editLock.
+func (r *Repository) updateRef(name string, old, new vcs.CommitID) error {
+	for _, arg := range []string{name, string(old), string(new)} {
+		if err := checkSpecArgSafety(arg); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command("git", "check-ref-format", name)
+	cmd.Dir = r.Dir
+	if err := cmd.Run(); err != nil || !strings.HasPrefix(name, "refs/") {
+		return fmt.Errorf("invalid git ref name %q", name)
+	}
+
+	var args []string
+	switch {
+	case new != "":
+		// An empty old value makes git check that the ref doesn't
+		// exist.
+		args = []string{"update-ref", name, string(new), string(old)}
+	case old != "":
+		args = []string{"update-ref", "-d", name, string(old)}
+	default:
+		return errors.New("git update ref: old and new values are both empty")
+	}
+	cmd = exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		// Distinguish a failed compare-and-swap from other errors
+		// (such as new not being a valid object).
+		if cur, err := r.refTarget(name); err == nil && cur != old {
+			return vcs.ErrRefConflict
+		}
+		return fmt.Errorf("exec `git update-ref` failed: %s. Output was:\n\n%s", err, out)
+	}
+	return nil
+}
+
+// deleteRef deletes the ref named name, returning notFound if it
+// doesn't exist. The caller must hold r.editLock.
+func (r *Repository) deleteRef(name string, notFound error) error {
+	if err := checkSpecArgSafety(name); err != nil {
+		return err
+	}
+	cur, err := r.refTarget(name)
+	if err != nil {
+		return err
+	}
+	if cur == "" {
+		return notFound
+	}
+	return r.updateRef(name, cur, "")
+}
+
+// refTarget returns the object ID that the ref named name points to
+// (without peeling tags), or "" if the ref doesn't exist. The caller
+// must hold r.editLock.
+func (r *Repository) refTarget(name string) (vcs.CommitID, error) {
+	cmd := exec.Command("git", "show-ref", "--verify", "--hash", "--", name)
+	cmd.Dir = r.Dir
+	stdout, stderr, err := dividedOutput(cmd)
+	if err != nil {
+		if bytes.Contains(stderr, []byte("not a valid ref")) {
+			return "", nil
+		}
+		return "", fmt.Errorf("exec `git show-ref` failed: %s. Stderr was:\n\n%s", err, stderr)
+	}
+	return vcs.CommitID(bytes.TrimSpace(stdout)), nil
+}
+
+// checkCommitExists returns vcs.ErrCommitNotFound if id isn't a
+// commit in the repository. The caller must hold r.editLock.
+func (r *Repository) checkCommitExists(id vcs.CommitID) error {
+	if err := checkSpecArgSafety(string(id)); err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "cat-file", "-e", string(id)+"^{commit}")
+	cmd.Dir = r.Dir
+	if err := cmd.Run(); err != nil {
+		return vcs.ErrCommitNotFound
+	}
+	return nil
+}
@@ -3,12 +3,14 @@ package gitcmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -23,6 +25,7 @@ import (
 
 	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+	sshutil "sourcegraph.com/sourcegraph/go-vcs/vcs/ssh"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/util"
 	"sourcegraph.com/sqs/pbtypes"
 
@@ -48,6 +51,8 @@ type Repository struct {
 	Dir string
 
 	editLock sync.RWMutex // protects ops that change repository data
+
+	totals vcs.CommitsTotalCache
 }
 
 func (r *Repository) RepoDir() string {
@@ -86,47 +91,28 @@ func Clone(url, dir string, opt vcs.CloneOpt) (*Repository, error) {
 		args = append(args, "--mirror")
 	}
 	args = append(args, "--", url, filepath.ToSlash(dir))
-	cmd := exec.Command("git", args...)
 
-	if opt.SSH != nil {
-		gitSSHWrapper, gitSSHWrapperDir, keyFile, err := makeGitSSHWrapper(opt.SSH.PrivateKey)
-		defer func() {
-			if keyFile != "" {
-				if err := os.Remove(keyFile); err != nil {
-					log.Fatalf("Error removing SSH key file %s: %s.", keyFile, err)
-				}
-			}
-		}()
+	err := internal.RetryWithCredentials(context.Background(), url, opt.RemoteOpts, func(creds *vcs.Credentials) error {
+		ropt, err := withCredentials(opt.RemoteOpts, url, creds)
 		if err != nil {
-			return nil, err
-		}
-		defer os.Remove(gitSSHWrapper)
-		if gitSSHWrapperDir != "" {
-			defer os.RemoveAll(gitSSHWrapperDir)
+			return err
 		}
-		cmd.Env = []string{"GIT_SSH=" + gitSSHWrapper}
-	}
-
-	if opt.HTTPS != nil {
-		env := environ(os.Environ())
-		env.Unset("GIT_TERMINAL_PROMPT")
-
-		gitPassHelper, gitPassHelperDir, err := makeGitPassHelper(opt.HTTPS.Pass)
+		env, cleanup, err := remoteEnv(ropt, []string{url})
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer os.Remove(gitPassHelper)
-		if gitPassHelperDir != "" {
-			defer os.RemoveAll(gitPassHelperDir)
-		}
-		env = append(env, "GIT_ASKPASS="+gitPassHelper)
+		defer cleanup()
 
+		cmd := exec.Command("git", args...)
 		cmd.Env = env
-	}
-
-	out, err := cmd.CombinedOutput()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec `git clone` failed: %s. Output was:\n\n%s", err, out)
+		}
+		return nil
+	}, isAuthFailure)
 	if err != nil {
-		return nil, fmt.Errorf("exec `git clone` failed: %s. Output was:\n\n%s", err, out)
+		return nil, err
 	}
 	return Open(dir)
 }
@@ -150,6 +136,10 @@ func dividedOutput(c *exec.Cmd) (stdout []byte, stderr []byte, err error) {
 }
 
 func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
+	return r.ResolveRevisionContext(context.Background(), spec)
+}
+
+func (r *Repository) ResolveRevisionContext(ctx context.Context, spec string) (vcs.CommitID, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
@@ -157,10 +147,13 @@ func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
 		return "", err
 	}
 
-	cmd := exec.Command("git", "rev-parse", spec+"^0")
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", spec+"^0")
 	cmd.Dir = r.Dir
 	stdout, stderr, err := dividedOutput(cmd)
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		if bytes.Contains(stderr, []byte("unknown revision")) {
 			return "", vcs.ErrRevisionNotFound
 		}
@@ -170,27 +163,39 @@ func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
 }
 
 func (r *Repository) ResolveRef(name string) (vcs.CommitID, error) {
-	commitID, err := r.ResolveRevision(name)
+	return r.ResolveRefContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveRefContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevisionContext(ctx, name)
 	if err == vcs.ErrRevisionNotFound {
 		return "", vcs.ErrRefNotFound
 	}
-	return commitID, nil
+	return commitID, err
 }
 
 func (r *Repository) ResolveBranch(name string) (vcs.CommitID, error) {
-	commitID, err := r.ResolveRevision(name)
+	return r.ResolveBranchContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveBranchContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevisionContext(ctx, name)
 	if err == vcs.ErrRevisionNotFound {
 		return "", vcs.ErrBranchNotFound
 	}
-	return commitID, nil
+	return commitID, err
 }
 
 func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
-	commitID, err := r.ResolveRevision(name)
+	return r.ResolveTagContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveTagContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevisionContext(ctx, name)
 	if err == vcs.ErrRevisionNotFound {
 		return "", vcs.ErrTagNotFound
 	}
-	return commitID, nil
+	return commitID, err
 }
 
 // branchFilter is a filter for branch names.
@@ -216,26 +221,30 @@ func (f branchFilter) add(list []string) {
 }
 
 func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	return r.BranchesContext(context.Background(), opt)
+}
+
+func (r *Repository) BranchesContext(ctx context.Context, opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
 	f := make(branchFilter)
 	if opt.MergedInto != "" {
-		b, err := r.branches("--merged", opt.MergedInto)
+		b, err := r.branches(ctx, "--merged", opt.MergedInto)
 		if err != nil {
 			return nil, err
 		}
 		f.add(b)
 	}
 	if opt.ContainsCommit != "" {
-		b, err := r.branches("--contains=" + opt.ContainsCommit)
+		b, err := r.branches(ctx, "--contains="+opt.ContainsCommit)
 		if err != nil {
 			return nil, err
 		}
 		f.add(b)
 	}
 
-	refs, err := r.showRef("--heads")
+	refs, err := r.showRef(ctx, "--heads")
 	if err != nil {
 		return nil, err
 	}
@@ -250,13 +259,13 @@ func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 
 		branch := &vcs.Branch{Name: name, Head: id}
 		if opt.IncludeCommit {
-			branch.Commit, err = r.getCommit(id)
+			branch.Commit, err = r.getCommit(ctx, id)
 			if err != nil {
 				return nil, err
 			}
 		}
 		if opt.BehindAheadBranch != "" {
-			branch.Counts, err = r.branchesBehindAhead(name, opt.BehindAheadBranch)
+			branch.Counts, err = r.branchesBehindAhead(ctx, name, opt.BehindAheadBranch)
 			if err != nil {
 				return nil, err
 			}
@@ -268,11 +277,14 @@ func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 
 // branches runs the `git branch` command followed by the given arguments and
 // returns the list of branches if successful.
-func (r *Repository) branches(args ...string) ([]string, error) {
-	cmd := exec.Command("git", append([]string{"branch"}, args...)...)
+func (r *Repository) branches(ctx context.Context, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"branch"}, args...)...)
 	cmd.Dir = r.Dir
 	out, err := cmd.Output()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("exec %v in %s failed: %v (output follows)\n\n%s", cmd.Args, cmd.Dir, err, out)
 	}
 	lines := strings.Split(string(out), "\n")
@@ -285,7 +297,7 @@ func (r *Repository) branches(args ...string) ([]string, error) {
 }
 
 // branchesBehindAhead returns the behind/ahead commit counts information for branch, against base branch.
-func (r *Repository) branchesBehindAhead(branch, base string) (*vcs.BehindAhead, error) {
+func (r *Repository) branchesBehindAhead(ctx context.Context, branch, base string) (*vcs.BehindAhead, error) {
 	if err := checkSpecArgSafety(branch); err != nil {
 		return nil, err
 	}
@@ -293,10 +305,13 @@ func (r *Repository) branchesBehindAhead(branch, base string) (*vcs.BehindAhead,
 		return nil, err
 	}
 
-	cmd := exec.Command("git", "rev-list", "--count", "--left-right", fmt.Sprintf("refs/heads/%s...refs/heads/%s", base, branch))
+	cmd := exec.CommandContext(ctx, "git", "rev-list", "--count", "--left-right", fmt.Sprintf("refs/heads/%s...refs/heads/%s", base, branch))
 	cmd.Dir = r.Dir
 	out, err := cmd.Output()
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
 		return nil, err
 	}
 	behindAhead := strings.Split(strings.TrimSuffix(string(out), "\n"), "\t")
@@ -312,35 +327,112 @@ func (r *Repository) branchesBehindAhead(branch, base string) (*vcs.BehindAhead,
 }
 
 func (r *Repository) Tags() ([]*vcs.Tag, error) {
+	return r.TagsContext(context.Background())
+}
+
+func (r *Repository) TagsContext(ctx context.Context) ([]*vcs.Tag, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
-	refs, err := r.showRef("--tags")
+	// Each tag is printed as NUL-terminated fields followed by a
+	// newline. The "*" fields are those of the object that a tag
+	// object points to.
+	const numFields = 9
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--format=%(refname)%00%(objectname)%00%(objecttype)%00%(*objectname)%00%(*objecttype)%00%(taggername)%00%(taggeremail)%00%(taggerdate:raw)%00%(contents)%00", "refs/tags/")
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, err
-	}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("exec `git for-each-ref` failed: %s. Output was:\n\n%s", err, out)
+	}
+
+	fields := bytes.Split(out, []byte{'\x00'})
+	fields = fields[:len(fields)-1] // remove trailing newline after the last field
+	if len(fields)%numFields != 0 {
+		return nil, fmt.Errorf("unexpected number of fields (%d) in `git for-each-ref` output", len(fields))
+	}
+	tags := make([]*vcs.Tag, 0, len(fields)/numFields)
+	for i := 0; i < len(fields); i += numFields {
+		f := fields[i : i+numFields]
+		refName := string(bytes.TrimPrefix(f[0], []byte{'\n'}))
+		tag := &vcs.Tag{Name: strings.TrimPrefix(refName, "refs/tags/")}
+
+		targetID, targetType := string(f[1]), string(f[2])
+		if targetType == "tag" {
+			tag.Annotated = true
+			tag.ObjectID = targetID
+			targetID, targetType = string(f[3]), string(f[4])
+			if len(f[5]) > 0 {
+				date, err := parseRawDate(string(f[7]))
+				if err != nil {
+					return nil, err
+				}
+				tag.Tagger = &vcs.Signature{
+					Name:  string(f[5]),
+					Email: strings.TrimSuffix(strings.TrimPrefix(string(f[6]), "<"), ">"),
+					Date:  date,
+				}
+			}
+			tag.Message, tag.Signature = internal.SplitTagSignature(string(f[8]))
+			tag.Message = strings.TrimSuffix(tag.Message, "\n")
+		}
 
-	tags := make([]*vcs.Tag, len(refs))
-	for i, ref := range refs {
-		tags[i] = &vcs.Tag{
-			Name:     strings.TrimPrefix(ref[1], "refs/tags/"),
-			CommitID: vcs.CommitID(ref[0]),
+		switch targetType {
+		case "commit":
+			tag.TargetType = vcs.ObjectType_COMMIT
+			tag.CommitID = vcs.CommitID(targetID)
+		case "tree":
+			tag.TargetType = vcs.ObjectType_TREE
+		case "blob":
+			tag.TargetType = vcs.ObjectType_BLOB
+		case "tag":
+			// The tag points to another tag, so peel it (which
+			// for-each-ref only does one level of).
+			tag.TargetType = vcs.ObjectType_TAG
+			cmd := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", refName+"^{commit}")
+			cmd.Dir = r.Dir
+			if out, err := cmd.Output(); err == nil {
+				tag.CommitID = vcs.CommitID(bytes.TrimSpace(out))
+			}
+		default:
+			return nil, fmt.Errorf("unexpected git object type %q for tag %q", targetType, tag.Name)
 		}
+		tags = append(tags, tag)
 	}
+	sort.Sort(vcs.Tags(tags))
 	return tags, nil
 }
 
+// parseRawDate parses a git date in "raw" format (e.g.,
+// "1136214245 +0000").
+func parseRawDate(s string) (pbtypes.Timestamp, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return pbtypes.Timestamp{}, fmt.Errorf("invalid git date %q", s)
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return pbtypes.Timestamp{}, fmt.Errorf("invalid git date %q: %s", s, err)
+	}
+	return pbtypes.NewTimestamp(time.Unix(sec, 0)), nil
+}
+
 type byteSlices [][]byte
 
 func (p byteSlices) Len() int           { return len(p) }
 func (p byteSlices) Less(i, j int) bool { return bytes.Compare(p[i], p[j]) < 0 }
 func (p byteSlices) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
-func (r *Repository) showRef(arg string) ([][2]string, error) {
-	cmd := exec.Command("git", "show-ref", arg)
+func (r *Repository) showRef(ctx context.Context, arg string) ([][2]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "show-ref", arg)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		// Exit status of 1 and no output means there were no
 		// results. This is not a fatal error.
 		if exitStatus(err) == 1 && len(out) == 0 {
@@ -379,12 +471,12 @@ func exitStatus(err error) int {
 }
 
 // getCommit returns the commit with the given id. The caller must be holding r.editLock.
-func (r *Repository) getCommit(id vcs.CommitID) (*vcs.Commit, error) {
+func (r *Repository) getCommit(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
 	if err := checkSpecArgSafety(string(id)); err != nil {
 		return nil, err
 	}
 
-	commits, _, err := r.commitLog(vcs.CommitsOptions{Head: id, N: 1, NoTotal: true})
+	commits, _, err := r.commitLog(ctx, vcs.CommitsOptions{Head: id, N: 1, NoTotal: true})
 	if err != nil {
 		return nil, err
 	}
@@ -397,24 +489,241 @@ func (r *Repository) getCommit(id vcs.CommitID) (*vcs.Commit, error) {
 }
 
 func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
+	return r.GetCommitContext(context.Background(), id)
+}
+
+func (r *Repository) GetCommitContext(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
-	return r.getCommit(id)
+	return r.getCommit(ctx, id)
 }
 
 func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	return r.CommitsContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
-	if err := checkSpecArgSafety(string(opt.Head)); err != nil {
-		return nil, 0, err
+	for _, spec := range commitsOptionsRevs(opt) {
+		if err := checkSpecArgSafety(string(spec)); err != nil {
+			return nil, 0, err
+		}
 	}
-	if err := checkSpecArgSafety(string(opt.Base)); err != nil {
-		return nil, 0, err
+
+	if opt.Cursor != "" {
+		page, err := r.commitsPage(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Commits, page.Total, nil
+	}
+	return r.commitLog(ctx, opt)
+}
+
+func (r *Repository) CommitsPage(opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	return r.CommitsPageContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsPageContext(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	r.editLock.RLock()
+	defer r.editLock.RUnlock()
+
+	for _, spec := range commitsOptionsRevs(opt) {
+		if err := checkSpecArgSafety(string(spec)); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.commitsPage(ctx, opt)
+}
+
+// commitsPage returns a page of commits, resuming the walk of the
+// history from the frontier in opt.Cursor (if any).
+//
+// The caller is responsible for doing checkSpecArgSafety on the revs in opt.
+func (r *Repository) commitsPage(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	var cursor *vcs.CommitsCursor
+	if opt.Cursor != "" {
+		var err error
+		if cursor, err = vcs.ParseCommitsCursor(opt.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sorting the commits requires walking all of them, and the walk
+	// of `git log --follow` can't be resumed. Nor can a walk with
+	// --since and bases, because git hides the parents of the
+	// commits older than --since (even if they are reachable from
+	// newer commits).
+	hasBases := opt.Base != "" || len(opt.Bases) > 0
+	if opt.Order != "" || opt.Path != "" || (!opt.Since.IsZero() && hasBases) {
+		var offset uint
+		if cursor != nil {
+			if len(cursor.Frontier) > 0 || cursor.After != "" {
+				return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+			}
+			offset = cursor.Offset
+		}
+		return r.commitsPageAtOffset(ctx, opt, offset)
+	}
+	if cursor != nil && cursor.After != "" {
+		return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+	}
+	if cursor != nil && len(cursor.Frontier) == 0 {
+		// The walk couldn't be resumed from a frontier.
+		return r.commitsPageAtOffset(ctx, opt, cursor.Offset)
+	}
+
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, err
+	}
+	frontier := vcs.NewCommitFrontier(append([]vcs.CommitID{opt.Head}, opt.Heads...), cursor, opt.FirstParent)
+	heads := frontier.Heads()
+
+	// Walk the history with only the options that affect the walk,
+	// and filter the walked commits here, so that the frontier of the
+	// walk is known. --since affects the walk, because git doesn't
+	// walk past commits older than it.
+	walkOpt := vcs.CommitsOptions{
+		Head:        heads[0],
+		Heads:       heads[1:],
+		Base:        opt.Base,
+		Bases:       opt.Bases,
+		FirstParent: opt.FirstParent,
+		Since:       opt.Since,
+	}
+	selectArgs, err := commitsSelectArgs(walkOpt)
+	if err != nil {
+		return nil, err
+	}
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(walkCtx, "git", append([]string{"log", commitLogFormat}, selectArgs...)...)
+	cmd.Dir = r.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
 	}
 
-	return r.commitLog(opt)
+	page := &vcs.CommitsPage{}
+	var offset uint // the number of matching commits before the next page
+	if cursor != nil {
+		offset = cursor.Offset
+	}
+	skip := opt.Skip
+	stopped := false
+	br := bufio.NewReader(stdout)
+	for {
+		c, err := readLogCommit(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cancel()
+			cmd.Wait()
+			return nil, err
+		}
+		match := filter.Match(c)
+		if match && opt.N != 0 && uint(len(page.Commits)) == opt.N {
+			// There are more commits after this page, which start
+			// with this one.
+			stopped = true
+			break
+		}
+		walked, ok := frontier.Walk(c)
+		if !ok && cursor != nil {
+			// The commit dates are skewed, so this walk may return
+			// commits that were on earlier pages.
+			cancel()
+			cmd.Wait()
+			return r.commitsPageAtOffset(ctx, opt, cursor.Offset)
+		}
+		if !match || walked {
+			continue
+		}
+		offset++
+		if skip > 0 {
+			skip--
+			continue
+		}
+		page.Commits = append(page.Commits, c)
+	}
+	if stopped {
+		// Stop the walk early.
+		cancel()
+		cmd.Wait()
+		page.NextCursor = frontier.Cursor(offset).String()
+	} else if err := cmd.Wait(); err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		errOut := bytes.TrimSpace(stderr.Bytes())
+		for _, rev := range append(heads, commitsOptionsRevs(opt)...) {
+			if rev != "" && isBadObjectErr(string(errOut), string(rev)) {
+				return nil, vcs.ErrCommitNotFound
+			}
+		}
+		return nil, fmt.Errorf("exec `git log` failed: %s. Output was:\n\n%s", err, errOut)
+	}
+
+	if !opt.NoTotal {
+		totalOpt := opt
+		totalOpt.Cursor = ""
+		selectArgs, err := commitsSelectArgs(totalOpt)
+		if err != nil {
+			return nil, err
+		}
+		if page.Total, err = r.countCommits(ctx, totalOpt, selectArgs); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// commitsPageAtOffset returns the page of commits that starts after
+// the first offset commits (and opt.Skip more), by walking all of the
+// earlier commits again.
+//
+// The caller is responsible for doing checkSpecArgSafety on the revs in opt.
+func (r *Repository) commitsPageAtOffset(ctx context.Context, opt vcs.CommitsOptions, offset uint) (*vcs.CommitsPage, error) {
+	// Skip the commits here, because `git log --follow --skip`
+	// doesn't skip the right commits.
+	skip := offset + opt.Skip
+	pageOpt := opt
+	pageOpt.Cursor, pageOpt.Skip = "", 0
+	if opt.N != 0 {
+		pageOpt.N = skip + opt.N
+	}
+	commits, total, err := r.commitLog(ctx, pageOpt)
+	if err != nil {
+		return nil, err
+	}
+	if skip >= uint(len(commits)) {
+		commits = nil
+	} else {
+		commits = commits[skip:]
+	}
+	page := &vcs.CommitsPage{Commits: commits, Total: total}
+	if opt.N != 0 && uint(len(commits)) == opt.N {
+		page.NextCursor = (&vcs.CommitsCursor{Offset: skip + opt.N}).String()
+	}
+	return page, nil
+}
+
+// commitsOptionsRevs returns all of the revs in opt (Head, Heads,
+// Base and Bases).
+func commitsOptionsRevs(opt vcs.CommitsOptions) []vcs.CommitID {
+	revs := append([]vcs.CommitID{opt.Head}, opt.Heads...)
+	return append(append(revs, opt.Base), opt.Bases...)
 }
 
 func isBadObjectErr(output, obj string) bool {
@@ -428,9 +737,21 @@ func isInvalidRevisionRangeError(output, obj string) bool {
 // commitLog returns a list of commits, and total number of commits
 // starting from Head until Base or beginning of branch (unless NoTotal is true).
 //
-// The caller is responsible for doing checkSpecArgSafety on opt.Head and opt.Base.
-func (r *Repository) commitLog(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
-	args := []string{"log", `--format=format:%H%x00%aN%x00%aE%x00%at%x00%cN%x00%cE%x00%ct%x00%B%x00%P%x00`}
+// The caller is responsible for doing checkSpecArgSafety on the revs in opt.
+func (r *Repository) commitLog(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Path != "" {
+		fileCommits, total, err := r.fileLog(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		commits := make([]*vcs.Commit, len(fileCommits))
+		for i, fc := range fileCommits {
+			commits[i] = fc.Commit
+		}
+		return commits, total, nil
+	}
+
+	args := []string{"log", commitLogFormat}
 	if opt.N != 0 {
 		args = append(args, "-n", strconv.FormatUint(uint64(opt.N), 10))
 	}
@@ -438,91 +759,328 @@ func (r *Repository) commitLog(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, err
 		args = append(args, "--skip="+strconv.FormatUint(uint64(opt.Skip), 10))
 	}
 
-	if opt.Path != "" {
-		args = append(args, "--follow")
-	}
-
-	// Range
-	rng := string(opt.Head)
-	if opt.Base != "" {
-		rng += "..." + string(opt.Base)
-	}
-	args = append(args, rng)
-
-	if opt.Path != "" {
-		args = append(args, "--", opt.Path)
+	// The args that select the commits, which are also used to count
+	// them (because the order affects which commits --since omits).
+	selectArgs, err := commitsSelectArgs(opt)
+	if err != nil {
+		return nil, 0, err
 	}
+	args = append(args, selectArgs...)
 
-	cmd := exec.Command("git", args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
 		out = bytes.TrimSpace(out)
-		if isBadObjectErr(string(out), string(opt.Head)) {
-			return nil, 0, vcs.ErrCommitNotFound
+		for _, rev := range commitsOptionsRevs(opt) {
+			if rev != "" && isBadObjectErr(string(out), string(rev)) {
+				return nil, 0, vcs.ErrCommitNotFound
+			}
 		}
 		return nil, 0, fmt.Errorf("exec `git log` failed: %s. Output was:\n\n%s", err, out)
 	}
 
-	const partsPerCommit = 9 // number of \x00-separated fields per commit
 	allParts := bytes.Split(out, []byte{'\x00'})
-	numCommits := len(allParts) / partsPerCommit
+	numCommits := len(allParts) / partsPerLogCommit
 	commits := make([]*vcs.Commit, numCommits)
 	for i := 0; i < numCommits; i++ {
-		parts := allParts[partsPerCommit*i : partsPerCommit*(i+1)]
-
-		// log outputs are newline separated, so all but the 1st commit ID part
-		// has an erroneous leading newline.
-		parts[0] = bytes.TrimPrefix(parts[0], []byte{'\n'})
+		commits[i], err = parseLogCommit(allParts[partsPerLogCommit*i : partsPerLogCommit*(i+1)])
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 
-		authorTime, err := strconv.ParseInt(string(parts[3]), 10, 64)
+	// Count commits.
+	var total uint
+	if !opt.NoTotal {
+		total, err = r.countCommits(ctx, opt, selectArgs)
 		if err != nil {
-			return nil, 0, fmt.Errorf("parsing git commit author time: %s", err)
+			return nil, 0, err
+		}
+	}
+
+	return commits, total, nil
+}
+
+func (r *Repository) FileHistory(opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	return r.FileHistoryContext(context.Background(), opt)
+}
+
+func (r *Repository) FileHistoryContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	if opt.Path == "" {
+		return nil, 0, errors.New("file history requires a path")
+	}
+	if opt.Cursor != "" {
+		return nil, 0, errors.New("file history doesn't support cursors")
+	}
+
+	r.editLock.RLock()
+	defer r.editLock.RUnlock()
+
+	for _, spec := range commitsOptionsRevs(opt) {
+		if err := checkSpecArgSafety(string(spec)); err != nil {
+			return nil, 0, err
+		}
+	}
+	return r.fileLog(ctx, opt)
+}
+
+// fileLog returns the history of the file or directory at opt.Path,
+// following renames, and the total number of commits in it (unless
+// opt.NoTotal is true).
+//
+// The caller is responsible for doing checkSpecArgSafety on the revs in opt.
+func (r *Repository) fileLog(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	// The path is literal (not a glob), and the root commit is
+	// always shown (regardless of log.showRoot).
+	args := []string{"--literal-pathspecs", "log", commitLogFormat, "--follow", "--root", "--name-status", "-z"}
+
+	// `git log --follow --skip` doesn't skip the right commits, and
+	// `git rev-list` can't count the commits with --follow, so all of
+	// them are listed (unless the total isn't needed), and skipped
+	// and counted here.
+	if opt.NoTotal && opt.N != 0 {
+		args = append(args, "-n", strconv.FormatUint(uint64(opt.Skip+opt.N), 10))
+	}
+	selectArgs, err := commitsSelectArgs(opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	args = append(args, selectArgs...)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		out = bytes.TrimSpace(out)
+		for _, rev := range commitsOptionsRevs(opt) {
+			if rev != "" && isBadObjectErr(string(out), string(rev)) {
+				return nil, 0, vcs.ErrCommitNotFound
+			}
+		}
+		return nil, 0, fmt.Errorf("exec `git log --follow` failed: %s. Output was:\n\n%s", err, out)
+	}
+
+	var history []*vcs.FileCommit
+	path := opt.Path // the followed path
+	br := bufio.NewReader(bytes.NewReader(out))
+	for {
+		c, err := readLogCommit(br)
+		if err == io.EOF {
+			break
 		}
-		committerTime, err := strconv.ParseInt(string(parts[6]), 10, 64)
 		if err != nil {
-			return nil, 0, fmt.Errorf("parsing git commit committer time: %s", err)
+			return nil, 0, err
 		}
+		fc := &vcs.FileCommit{Commit: c, Path: path}
 
-		var parents []vcs.CommitID
-		if parentPart := parts[8]; len(parentPart) > 0 {
-			parentIDs := bytes.Split(parentPart, []byte{' '})
-			parents = make([]vcs.CommitID, len(parentIDs))
-			for i, id := range parentIDs {
-				parents[i] = vcs.CommitID(id)
+		// Read the commit's changes to the file, which are
+		// followed by an empty field (or the end of the output).
+		for {
+			status, err := br.ReadBytes('\x00')
+			if err == io.EOF && len(status) == 0 {
+				break
+			} else if err != nil {
+				return nil, 0, err
+			}
+			status = bytes.TrimPrefix(status[:len(status)-1], []byte{'\n'})
+			if len(status) == 0 {
+				break
+			}
+			paths := make([]string, 1)
+			if status[0] == 'R' || status[0] == 'C' {
+				paths = make([]string, 2)
+			}
+			for i := range paths {
+				p, err := br.ReadBytes('\x00')
+				if err != nil {
+					return nil, 0, err
+				}
+				paths[i] = string(p[:len(p)-1])
+			}
+			if (status[0] == 'R' || status[0] == 'C') && paths[1] == path {
+				// The file was renamed or copied, so the older
+				// commits have the other file's path.
+				path = paths[0]
 			}
 		}
+		history = append(history, fc)
+	}
+
+	total := uint(len(history))
+	if opt.NoTotal {
+		total = 0
+	}
+	if opt.Skip >= uint(len(history)) {
+		history = nil
+	} else {
+		history = history[opt.Skip:]
+	}
+	if opt.N != 0 && uint(len(history)) > opt.N {
+		history = history[:opt.N]
+	}
+	return history, total, nil
+}
 
-		commits[i] = &vcs.Commit{
-			ID:        vcs.CommitID(parts[0]),
-			Author:    vcs.Signature{string(parts[1]), string(parts[2]), pbtypes.NewTimestamp(time.Unix(authorTime, 0))},
-			Committer: &vcs.Signature{string(parts[4]), string(parts[5]), pbtypes.NewTimestamp(time.Unix(committerTime, 0))},
-			Message:   string(bytes.TrimSuffix(parts[7], []byte{'\n'})),
-			Parents:   parents,
+// commitLogFormat is the `git log` format of the commits that
+// parseLogCommit parses.
+const commitLogFormat = `--format=format:%H%x00%aN%x00%aE%x00%at%x00%cN%x00%cE%x00%ct%x00%B%x00%P%x00`
+
+const partsPerLogCommit = 9 // number of \x00-separated fields per commit
+
+// parseLogCommit parses the \x00-separated fields of a commit in the
+// commitLogFormat.
+func parseLogCommit(parts [][]byte) (*vcs.Commit, error) {
+	// log outputs are newline separated, so all but the 1st commit ID part
+	// has an erroneous leading newline.
+	parts[0] = bytes.TrimPrefix(parts[0], []byte{'\n'})
+
+	authorTime, err := strconv.ParseInt(string(parts[3]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing git commit author time: %s", err)
+	}
+	committerTime, err := strconv.ParseInt(string(parts[6]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing git commit committer time: %s", err)
+	}
+
+	var parents []vcs.CommitID
+	if parentPart := parts[8]; len(parentPart) > 0 {
+		parentIDs := bytes.Split(parentPart, []byte{' '})
+		parents = make([]vcs.CommitID, len(parentIDs))
+		for i, id := range parentIDs {
+			parents[i] = vcs.CommitID(id)
 		}
 	}
 
-	// Count commits.
-	var total uint
-	if !opt.NoTotal {
-		cmd = exec.Command("git", "rev-list", "--count", rng)
-		if opt.Path != "" {
-			// This doesn't include --follow flag because rev-list doesn't support it, so the number may be slightly off.
-			cmd.Args = append(cmd.Args, "--", opt.Path)
+	return &vcs.Commit{
+		ID:        vcs.CommitID(parts[0]),
+		Author:    vcs.Signature{string(parts[1]), string(parts[2]), pbtypes.NewTimestamp(time.Unix(authorTime, 0))},
+		Committer: &vcs.Signature{string(parts[4]), string(parts[5]), pbtypes.NewTimestamp(time.Unix(committerTime, 0))},
+		Message:   string(bytes.TrimSuffix(parts[7], []byte{'\n'})),
+		Parents:   parents,
+	}, nil
+}
+
+// readLogCommit reads and parses the next commit in the
+// commitLogFormat from r. It returns io.EOF if there are no more
+// commits.
+func readLogCommit(r *bufio.Reader) (*vcs.Commit, error) {
+	parts := make([][]byte, partsPerLogCommit)
+	for i := range parts {
+		part, err := r.ReadBytes('\x00')
+		if err == io.EOF && i == 0 && len(bytes.TrimSpace(part)) == 0 {
+			return nil, io.EOF
 		}
-		cmd.Dir = r.Dir
-		out, err = cmd.CombinedOutput()
 		if err != nil {
-			return nil, 0, fmt.Errorf("exec `git rev-list --count` failed: %s. Output was:\n\n%s", err, out)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
-		out = bytes.TrimSpace(out)
-		total, err = parseUint(string(out))
-		if err != nil {
-			return nil, 0, err
+		parts[i] = part[:len(part)-1]
+	}
+	return parseLogCommit(parts)
+}
+
+// countCommits returns the number of commits selected by selectArgs
+// (from commitsSelectArgs(opt)), which is cached if possible.
+func (r *Repository) countCommits(ctx context.Context, opt vcs.CommitsOptions, selectArgs []string) (uint, error) {
+	if total, ok := r.totals.Get(opt); ok {
+		return total, nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"rev-list", "--count"}, selectArgs...)...)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("exec `git rev-list --count` failed: %s. Output was:\n\n%s", err, out)
+	}
+	out = bytes.TrimSpace(out)
+	total, err := parseUint(string(out))
+	if err != nil {
+		return 0, err
+	}
+	r.totals.Add(opt, total)
+	return total, nil
+}
+
+// commitsSelectArgs returns the `git log` or `git rev-list` args that
+// select the commits described by opt, in its order.
+func commitsSelectArgs(opt vcs.CommitsOptions) ([]string, error) {
+	var args []string
+	switch opt.Order {
+	case "":
+	case vcs.DateOrder:
+		args = append(args, "--date-order")
+	case vcs.AuthorDateOrder:
+		args = append(args, "--author-date-order")
+	case vcs.TopoOrder:
+		args = append(args, "--topo-order")
+	default:
+		return nil, fmt.Errorf("unrecognized commits order: %q", opt.Order)
+	}
+	if opt.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	if opt.NoMerges {
+		args = append(args, "--no-merges")
+	}
+	if opt.MergesOnly {
+		args = append(args, "--merges")
+	}
+	if opt.Author != "" || opt.Committer != "" || opt.Message != "" {
+		args = append(args, "--extended-regexp")
+		if opt.Author != "" {
+			args = append(args, "--author="+opt.Author)
+		}
+		if opt.Committer != "" {
+			args = append(args, "--committer="+opt.Committer)
+		}
+		if opt.Message != "" {
+			args = append(args, "--grep="+opt.Message)
 		}
 	}
+	if !opt.Since.IsZero() {
+		// Commit times are in seconds, so round up.
+		since := opt.Since.Unix()
+		if opt.Since.Nanosecond() != 0 {
+			since++
+		}
+		args = append(args, "--since=@"+strconv.FormatInt(since, 10))
+	}
+	if !opt.Until.IsZero() {
+		args = append(args, "--until=@"+strconv.FormatInt(opt.Until.Unix(), 10))
+	}
 
-	return commits, total, nil
+	// Revs
+	args = append(args, string(opt.Head))
+	for _, head := range opt.Heads {
+		args = append(args, string(head))
+	}
+	if opt.Base != "" || len(opt.Bases) > 0 {
+		args = append(args, "--not")
+		if opt.Base != "" {
+			args = append(args, string(opt.Base))
+		}
+		for _, base := range opt.Bases {
+			args = append(args, string(base))
+		}
+	}
+
+	if opt.Path != "" {
+		args = append(args, "--", opt.Path)
+	}
+	return args, nil
 }
 
 func parseUint(s string) (uint, error) {
@@ -531,6 +1089,10 @@ func parseUint(s string) (uint, error) {
 }
 
 func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	return r.DiffContext(context.Background(), base, head, opt)
+}
+
+func (r *Repository) DiffContext(ctx context.Context, base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
@@ -557,22 +1119,180 @@ func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.D
 	}
 
 	args = append(args, rng, "--")
-	cmd := exec.Command("git", args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
 	if opt != nil {
 		cmd.Args = append(cmd.Args, opt.Paths...)
 	}
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		out = bytes.TrimSpace(out)
 		if isBadObjectErr(string(out), string(base)) || isBadObjectErr(string(out), string(head)) || isInvalidRevisionRangeError(string(out), string(base)) || isInvalidRevisionRangeError(string(out), string(head)) {
 			return nil, vcs.ErrCommitNotFound
 		}
 		return nil, fmt.Errorf("exec `git diff` failed: %s. Output was:\n\n%s", err, out)
 	}
-	return &vcs.Diff{
-		Raw: string(out),
-	}, nil
+	return vcs.ParseDiff(out, opt)
+}
+
+func (r *Repository) CommitFiles(id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	return r.CommitFilesContext(context.Background(), id, opt)
+}
+
+func (r *Repository) CommitFilesContext(ctx context.Context, id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	if err := checkSpecArgSafety(string(id)); err != nil {
+		return nil, err
+	}
+
+	r.editLock.RLock()
+	defer r.editLock.RUnlock()
+
+	if opt == nil {
+		opt = &vcs.CommitFilesOptions{}
+	}
+	diffArgs := []string{"-r", "-z", "--raw", "--numstat", "-M"}
+	if opt.DetectCopies {
+		diffArgs = append(diffArgs, "-C")
+	}
+
+	// The header (printed first, with the -z terminator) lists the
+	// commit's parents. A merge commit's files aren't listed, because
+	// `git diff-tree -m` omits the header of a parent that the commit
+	// doesn't differ from, so each parent is diffed separately below.
+	args := append([]string{"diff-tree", "--root", "--always", "--format=%P"}, diffArgs...)
+	out, err := r.diffTree(ctx, append(args, string(id), "--"), id)
+	if err != nil {
+		return nil, err
+	}
+	header, out := out, nil
+	if i := bytes.IndexByte(header, 0); i != -1 {
+		header, out = header[:i], bytes.TrimPrefix(header[i+1:], []byte("\n"))
+	}
+	parents := strings.Fields(string(header))
+
+	if len(parents) <= 1 {
+		files, err := parseDiffTreeFiles(out)
+		if err != nil {
+			return nil, err
+		}
+		all := []*vcs.CommitFiles{{Files: files}}
+		if len(parents) == 1 {
+			all[0].Parent = vcs.CommitID(parents[0])
+		}
+		return all, nil
+	}
+
+	all := make([]*vcs.CommitFiles, len(parents))
+	for i, parent := range parents {
+		args := append([]string{"diff-tree"}, diffArgs...)
+		out, err := r.diffTree(ctx, append(args, parent, string(id), "--"), id)
+		if err != nil {
+			return nil, err
+		}
+		files, err := parseDiffTreeFiles(out)
+		if err != nil {
+			return nil, err
+		}
+		all[i] = &vcs.CommitFiles{Parent: vcs.CommitID(parent), Files: files}
+	}
+	return all, nil
+}
+
+// diffTree runs `git diff-tree` with args and returns its output.
+func (r *Repository) diffTree(ctx context.Context, args []string, id vcs.CommitID) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		errOut := bytes.TrimSpace(stderr.Bytes())
+		if isBadObjectErr(string(errOut), string(id)) || bytes.Contains(errOut, []byte("unknown revision")) {
+			return nil, vcs.ErrCommitNotFound
+		}
+		return nil, fmt.Errorf("exec `git diff-tree` failed: %s. Output was:\n\n%s", err, errOut)
+	}
+	return out, nil
+}
+
+// parseDiffTreeFiles parses the output of `git diff-tree -z --raw
+// --numstat`, which has a raw entry for each file and then a numstat
+// entry for each file in the same order.
+func parseDiffTreeFiles(out []byte) ([]*vcs.ChangedFile, error) {
+	if len(out) == 0 {
+		return nil, nil
+	}
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	var files []*vcs.ChangedFile
+	numstat := 0 // the index in files of the next numstat entry
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case strings.HasPrefix(field, ":"):
+			// A raw entry: ":srcmode dstmode srcblob dstblob status",
+			// then the path (or the source and destination paths for
+			// a rename or copy).
+			raw := strings.Fields(field)
+			if len(raw) != 5 || i+1 >= len(fields) {
+				return nil, fmt.Errorf("invalid diff-tree raw entry: %q", field)
+			}
+			f := &vcs.ChangedFile{Path: fields[i+1]}
+			i++
+			switch raw[4][0] {
+			case 'A':
+				f.ChangeType = vcs.FileChangeType_ADDED
+			case 'D':
+				f.ChangeType = vcs.FileChangeType_DELETED
+			case 'R', 'C':
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("invalid diff-tree raw entry: %q", field)
+				}
+				f.OrigPath, f.Path = f.Path, fields[i+1]
+				i++
+				f.ChangeType = vcs.FileChangeType_RENAMED
+				if raw[4][0] == 'C' {
+					f.ChangeType = vcs.FileChangeType_COPIED
+				}
+			default:
+				f.ChangeType = vcs.FileChangeType_MODIFIED
+			}
+			files = append(files, f)
+
+		default:
+			// A numstat entry: "added\tdeleted\tpath", or with an
+			// empty path followed by the source and destination paths
+			// for a rename or copy. Binary files have "-" counts.
+			stat := strings.SplitN(field, "\t", 3)
+			if len(stat) != 3 || numstat >= len(files) {
+				return nil, fmt.Errorf("invalid diff-tree numstat entry: %q", field)
+			}
+			if stat[2] == "" {
+				i += 2
+			}
+			f := files[numstat]
+			numstat++
+			if stat[0] == "-" {
+				f.Binary = true
+				continue
+			}
+			added, err := strconv.ParseInt(stat[0], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			deleted, err := strconv.ParseInt(stat[1], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			f.Added, f.Deleted = int32(added), int32(deleted)
+		}
+	}
+	return files, nil
 }
 
 // A CrossRepo is a git repository that can be used in cross-repo
@@ -586,6 +1306,10 @@ type CrossRepo interface {
 func (r *Repository) GitRootDir() string { return r.Dir }
 
 func (r *Repository) CrossRepoDiff(base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	return r.CrossRepoDiffContext(context.Background(), base, headRepo, head, opt)
+}
+
+func (r *Repository) CrossRepoDiffContext(ctx context.Context, base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
 	var headDir string // path to head repo on local filesystem
 	if headRepo, ok := headRepo.(CrossRepo); ok {
 		headDir = headRepo.GitRootDir()
@@ -594,232 +1318,123 @@ func (r *Repository) CrossRepoDiff(base vcs.CommitID, headRepo vcs.Repository, h
 	}
 
 	if headDir == r.Dir {
-		return r.Diff(base, head, opt)
+		return r.DiffContext(ctx, base, head, opt)
 	}
 
-	if err := r.fetchRemote(headDir); err != nil {
+	if err := r.fetchRemote(ctx, headDir); err != nil {
 		return nil, err
 	}
 
-	return r.Diff(base, head, opt)
+	return r.DiffContext(ctx, base, head, opt)
 }
 
-func (r *Repository) fetchRemote(repoDir string) error {
+func (r *Repository) fetchRemote(ctx context.Context, repoDir string) error {
 	r.editLock.Lock()
 	defer r.editLock.Unlock()
 
 	name := base64.URLEncoding.EncodeToString([]byte(repoDir))
 
 	// Fetch remote commit data.
-	cmd := exec.Command("git", "fetch", "-v", filepath.ToSlash(repoDir), "+refs/heads/*:refs/remotes/"+name+"/*")
+	cmd := exec.CommandContext(ctx, "git", "fetch", "-v", filepath.ToSlash(repoDir), "+refs/heads/*:refs/remotes/"+name+"/*")
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return fmt.Errorf("exec %v in %s failed: %s. Output was:\n\n%s", cmd.Args, cmd.Dir, err, out)
 	}
 	return nil
 }
 
 func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
+	return r.UpdateEverythingContext(context.Background(), opt)
+}
+
+func (r *Repository) UpdateEverythingContext(ctx context.Context, opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
 	// TODO(sqs): this lock is different from libgit2's lock, but
 	// libgit2 Repositories call this method because of
 	// embedding. Therefore there could be a race condition.
 	r.editLock.Lock()
 	defer r.editLock.Unlock()
 
-	cmd := exec.Command("git", "remote", "update", "--prune")
-	cmd.Dir = r.Dir
-
-	if opt.SSH != nil {
-		gitSSHWrapper, gitSSHWrapperDir, keyFile, err := makeGitSSHWrapper(opt.SSH.PrivateKey)
-		defer func() {
-			if keyFile != "" {
-				if err := os.Remove(keyFile); err != nil {
-					log.Fatalf("Error removing SSH key file %s: %s.", keyFile, err)
-				}
-			}
-		}()
-		if err != nil {
-			return nil, err
-		}
-		defer os.Remove(gitSSHWrapper)
-		if gitSSHWrapperDir != "" {
-			defer os.RemoveAll(gitSSHWrapperDir)
-		}
-		cmd.Env = []string{"GIT_SSH=" + gitSSHWrapper}
-	}
-
-	if opt.HTTPS != nil {
-		env := environ(os.Environ())
-		env.Unset("GIT_TERMINAL_PROMPT")
-
-		gitPassHelper, gitPassHelperDir, err := makeGitPassHelper(opt.HTTPS.Pass)
-		if err != nil {
-			return nil, err
-		}
-		defer os.Remove(gitPassHelper)
-		if gitPassHelperDir != "" {
-			defer os.RemoveAll(gitPassHelperDir)
-		}
-		env = append(env, "GIT_ASKPASS="+gitPassHelper)
-
-		cmd.Env = env
-	}
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("exec `git remote update` failed: %v. Stderr was:\n\n%s", err, stderr.String())
-	}
-	result, err := parseRemoteUpdate(stderr.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("parsing output of `git remote update` failed: %v", err)
-	}
-	return &result, nil
-}
-
-func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
-	r.editLock.RLock()
-	defer r.editLock.RUnlock()
-
-	if opt == nil {
-		opt = &vcs.BlameOptions{}
-	}
-	if opt.OldestCommit != "" {
-		return nil, fmt.Errorf("OldestCommit not implemented")
-	}
-	if err := checkSpecArgSafety(string(opt.NewestCommit)); err != nil {
-		return nil, err
-	}
-	if err := checkSpecArgSafety(string(opt.OldestCommit)); err != nil {
-		return nil, err
-	}
-
-	args := []string{"blame", "-w", "--porcelain"}
-	if opt.StartLine != 0 || opt.EndLine != 0 {
-		args = append(args, fmt.Sprintf("-L%d,%d", opt.StartLine, opt.EndLine))
-	}
-	args = append(args, string(opt.NewestCommit), "--", filepath.ToSlash(path))
-	cmd := exec.Command("git", args...)
-	cmd.Dir = r.Dir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("exec `git blame` failed: %s. Output was:\n\n%s", err, out)
-	}
-	if len(out) < 1 {
-		// go 1.8.5 changed the behavior of `git blame` on empty files.
-		// previously, it returned a boundary commit. now, it returns nothing.
-		// TODO(sqs) TODO(beyang): make `git blame` return the boundary commit
-		// on an empty file somehow, or come up with some other workaround.
-		st, err := os.Stat(filepath.Join(r.Dir, path))
-		if err == nil && st.Size() == 0 {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("Expected git output of length at least 1")
-	}
-
-	commits := make(map[string]vcs.Commit)
-	hunks := make([]*vcs.Hunk, 0)
-	remainingLines := strings.Split(string(out[:len(out)-1]), "\n")
-	byteOffset := 0
-	for len(remainingLines) > 0 {
-		// Consume hunk
-		hunkHeader := strings.Split(remainingLines[0], " ")
-		if len(hunkHeader) != 4 {
-			fmt.Printf("Remaining lines: %+v, %d, '%s'\n", remainingLines, len(remainingLines), remainingLines[0])
-			return nil, fmt.Errorf("Expected at least 4 parts to hunkHeader, but got: '%s'", hunkHeader)
-		}
-		commitID := hunkHeader[0]
-		lineNoCur, _ := strconv.Atoi(hunkHeader[2])
-		nLines, _ := strconv.Atoi(hunkHeader[3])
-		hunk := &vcs.Hunk{
-			CommitID:  vcs.CommitID(commitID),
-			StartLine: int(lineNoCur),
-			EndLine:   int(lineNoCur + nLines),
-			StartByte: byteOffset,
-		}
-
-		if _, in := commits[commitID]; in {
-			// Already seen commit
-			byteOffset += len(remainingLines[1])
-			remainingLines = remainingLines[2:]
-		} else {
-			// New commit
-			author := strings.Join(strings.Split(remainingLines[1], " ")[1:], " ")
-			email := strings.Join(strings.Split(remainingLines[2], " ")[1:], " ")
-			if len(email) >= 2 && email[0] == '<' && email[len(email)-1] == '>' {
-				email = email[1 : len(email)-1]
-			}
-			authorTime, err := strconv.ParseInt(strings.Join(strings.Split(remainingLines[3], " ")[1:], " "), 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to parse author-time %q", remainingLines[3])
-			}
-			summary := strings.Join(strings.Split(remainingLines[9], " ")[1:], " ")
-			commit := vcs.Commit{
-				ID:      vcs.CommitID(commitID),
-				Message: summary,
-				Author: vcs.Signature{
-					Name:  author,
-					Email: email,
-					Date:  pbtypes.NewTimestamp(time.Unix(authorTime, 0).In(time.UTC)),
-				},
-			}
-
-			if len(remainingLines) >= 13 && strings.HasPrefix(remainingLines[10], "previous ") {
-				byteOffset += len(remainingLines[12])
-				remainingLines = remainingLines[13:]
-			} else if len(remainingLines) >= 13 && remainingLines[10] == "boundary" {
-				byteOffset += len(remainingLines[12])
-				remainingLines = remainingLines[13:]
-			} else if len(remainingLines) >= 12 {
-				byteOffset += len(remainingLines[11])
-				remainingLines = remainingLines[12:]
-			} else if len(remainingLines) == 11 {
-				// Empty file
-				remainingLines = remainingLines[11:]
-			} else {
-				return nil, fmt.Errorf("Unexpected number of remaining lines (%d):\n%s", len(remainingLines), "  "+strings.Join(remainingLines, "\n  "))
-			}
-
-			commits[commitID] = commit
+	var urls map[string]string // remote name -> URL
+	if opt.Credentials != nil || (opt.SSH != nil && (opt.SSH.HostKeyPolicy == vcs.HostKeyTOFU || opt.SSH.User != "")) {
+		var err error
+		urls, err = r.remoteURLs(ctx)
+		if err != nil {
+			return nil, err
 		}
+	}
+	var urlList []string
+	for _, url := range urls {
+		urlList = append(urlList, url)
+	}
 
-		if commit, present := commits[commitID]; present {
-			// Should always be present, but check just to avoid
-			// panicking in case of a (somewhat likely) bug in our
-			// git-blame parser above.
-			hunk.CommitID = commit.ID
-			hunk.Author = commit.Author
+	var stderr bytes.Buffer
+	// The credentials for "origin" are used for all remotes (see
+	// vcs.CredentialProvider).
+	//
+	// TODO(sqs): allow use of credentials for remotes other than "origin"
+	err := internal.RetryWithCredentials(ctx, urls["origin"], opt, func(creds *vcs.Credentials) error {
+		ropt, err := withCredentials(opt, urls["origin"], creds)
+		if err != nil {
+			return err
 		}
-
-		// Consume remaining lines in hunk
-		for i := 1; i < nLines; i++ {
-			byteOffset += len(remainingLines[1])
-			remainingLines = remainingLines[2:]
+		env, cleanup, err := remoteEnv(ropt, urlList)
+		if err != nil {
+			return err
 		}
+		defer cleanup()
 
-		hunk.EndByte = byteOffset
-		hunks = append(hunks, hunk)
+		cmd := exec.CommandContext(ctx, "git", "remote", "update", "--prune")
+		cmd.Dir = r.Dir
+		cmd.Env = env
+		stderr.Reset()
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("exec `git remote update` failed: %v. Stderr was:\n\n%s", err, stderr.String())
+		}
+		return nil
+	}, isAuthFailure)
+	if err != nil {
+		return nil, err
 	}
-
-	return hunks, nil
+	result, err := parseRemoteUpdate(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("parsing output of `git remote update` failed: %v", err)
+	}
+	return &result, nil
 }
 
 func (r *Repository) MergeBase(a, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.MergeBaseContext(context.Background(), a, b)
+}
+
+func (r *Repository) MergeBaseContext(ctx context.Context, a, b vcs.CommitID) (vcs.CommitID, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
-	cmd := exec.Command("git", "merge-base", "--", string(a), string(b))
+	cmd := exec.CommandContext(ctx, "git", "merge-base", "--", string(a), string(b))
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		return "", fmt.Errorf("exec %v failed: %s. Output was:\n\n%s", cmd.Args, err, out)
 	}
 	return vcs.CommitID(bytes.TrimSpace(out)), nil
 }
 
 func (r *Repository) CrossRepoMergeBase(a vcs.CommitID, repoB vcs.Repository, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.CrossRepoMergeBaseContext(context.Background(), a, repoB, b)
+}
+
+func (r *Repository) CrossRepoMergeBaseContext(ctx context.Context, a vcs.CommitID, repoB vcs.Repository, b vcs.CommitID) (vcs.CommitID, error) {
 	// libgit2 Repository inherits GitRootDir and CrossRepo from its
 	// embedded gitcmd.Repository.
 
@@ -831,135 +1446,56 @@ func (r *Repository) CrossRepoMergeBase(a vcs.CommitID, repoB vcs.Repository, b
 	}
 
 	if repoBDir != r.Dir {
-		if err := r.fetchRemote(repoBDir); err != nil {
+		if err := r.fetchRemote(ctx, repoBDir); err != nil {
 			return "", err
 		}
 	}
 
-	return r.MergeBase(a, b)
+	return r.MergeBaseContext(ctx, a, b)
 }
 
-func (r *Repository) Search(at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
-	if err := checkSpecArgSafety(string(at)); err != nil {
-		return nil, err
-	}
-
-	var queryType string
-	switch opt.QueryType {
-	case vcs.FixedQuery:
-		queryType = "--fixed-strings"
-	default:
-		return nil, fmt.Errorf("unrecognized QueryType: %q", opt.QueryType)
-	}
-
-	cmd := exec.Command("git", "grep", "--null", "--line-number", "-I", "--no-color", "--context", strconv.Itoa(int(opt.ContextLines)), queryType, "-e", opt.Query, string(at))
-	cmd.Dir = r.Dir
-	cmd.Stderr = os.Stderr
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	defer out.Close()
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
-
-	errc := make(chan error)
-	var res []*vcs.SearchResult
-	go func() {
-		rd := bufio.NewReader(out)
-		var r *vcs.SearchResult
-		addResult := func(rr *vcs.SearchResult) bool {
-			if rr != nil {
-				if opt.Offset == 0 {
-					res = append(res, rr)
-				} else {
-					opt.Offset--
-				}
-				r = nil
-			}
-			// Return true if no more need to be added.
-			return len(res) == int(opt.N)
-		}
-		for {
-			line, err := rd.ReadBytes('\n')
-			if err == io.EOF {
-				// git-grep output ends with a newline, so if we hit EOF, there's nothing left to
-				// read
-				break
-			} else if err != nil {
-				errc <- err
-				return
-			}
-			// line is guaranteed to be '\n' terminated according to the contract of ReadBytes
-			line = line[0 : len(line)-1]
-
-			if bytes.Equal(line, []byte("--")) {
-				// Match separator.
-				if addResult(r) {
-					break
-				}
-			} else {
-				// Match line looks like: "HEAD:filename\x00lineno\x00matchline\n".
-				fileEnd := bytes.Index(line, []byte{'\x00'})
-				file := string(line[len(at)+1 : fileEnd])
-				lineNoStart, lineNoEnd := fileEnd+1, fileEnd+1+bytes.Index(line[fileEnd+1:], []byte{'\x00'})
-				lineNo, err := strconv.Atoi(string(line[lineNoStart:lineNoEnd]))
-				if err != nil {
-					panic("bad line number on line: " + string(line) + ": " + err.Error())
-				}
-				if r == nil || r.File != file {
-					if r != nil {
-						if addResult(r) {
-							break
-						}
-					}
-					r = &vcs.SearchResult{File: file, StartLine: uint32(lineNo)}
-				}
-				r.EndLine = uint32(lineNo)
-				if r.Match != nil {
-					r.Match = append(r.Match, '\n')
-				}
-				r.Match = append(r.Match, line[lineNoEnd+1:]...)
-			}
-		}
-		addResult(r)
-
-		if err := cmd.Process.Kill(); err != nil {
-			if runtime.GOOS != "windows" {
-				errc <- err
-				return
-			}
-		}
-		if err := cmd.Wait(); err != nil {
-			if c := exitStatus(err); c != -1 && c != 1 {
-				// -1 exit code = killed (by cmd.Process.Kill() call
-				// above), 1 exit code means grep had no match (but we
-				// don't translate that to a Go error)
-				errc <- fmt.Errorf("exec %v failed: %s. Output was:\n\n%s", cmd.Args, err, out)
-				return
-			}
-		}
-		errc <- nil
-	}()
-
-	err = <-errc
-	cmd.Process.Kill()
-	return res, err
+func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	return r.CommittersContext(context.Background(), opt)
 }
 
-func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+func (r *Repository) CommittersContext(ctx context.Context, opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
 	r.editLock.RLock()
 	defer r.editLock.RUnlock()
 
 	if opt.Rev == "" {
 		opt.Rev = "HEAD"
 	}
+	if err := checkSpecArgSafety(opt.Rev); err != nil {
+		return nil, err
+	}
+
+	if opt.Path != "" {
+		// `git shortlog` can't follow the file's renames, so count
+		// the commits in its history here.
+		commits, _, err := r.commitLog(ctx, vcs.CommitsOptions{
+			Head:    vcs.CommitID(opt.Rev),
+			Since:   opt.Since,
+			Until:   opt.Until,
+			Path:    opt.Path,
+			NoTotal: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return vcs.CountCommitters(commits, opt.N), nil
+	}
 
-	cmd := exec.Command("git", "shortlog", "-sne", opt.Rev)
+	selectArgs, err := commitsSelectArgs(vcs.CommitsOptions{Head: vcs.CommitID(opt.Rev), Since: opt.Since, Until: opt.Until})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"shortlog", "-sne"}, selectArgs...)...)
 	cmd.Dir = r.Dir
 	out, err := cmd.Output()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("exec `git shortlog -sne` failed: %v", err)
 	}
 	out = bytes.TrimSpace(out)
@@ -988,6 +1524,10 @@ func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, er
 }
 
 func (r *Repository) ListFiles(at vcs.CommitID) ([]string, error) {
+	return r.ListFilesContext(context.Background(), at)
+}
+
+func (r *Repository) ListFilesContext(ctx context.Context, at vcs.CommitID) ([]string, error) {
 	if err := checkSpecArgSafety(string(at)); err != nil {
 		return nil, err
 	}
@@ -998,10 +1538,13 @@ func (r *Repository) ListFiles(at vcs.CommitID) ([]string, error) {
 	if at == "" {
 		at = "HEAD"
 	}
-	cmd := exec.Command("git", "ls-tree", "--full-tree", "-r", "-z", "--name-only", string(at))
+	cmd := exec.CommandContext(ctx, "git", "ls-tree", "--full-tree", "-r", "-z", "--name-only", string(at))
 	cmd.Dir = r.Dir
 	out, err := cmd.Output()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("exec `git ls-tree --full-tree -r -z --name-only %v` failed: %v", at, err)
 	}
 	if len(out) == 0 {
@@ -1012,11 +1555,16 @@ func (r *Repository) ListFiles(at vcs.CommitID) ([]string, error) {
 }
 
 func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
+	return r.FileSystemContext(context.Background(), at)
+}
+
+func (r *Repository) FileSystemContext(ctx context.Context, at vcs.CommitID) (vfs.FileSystem, error) {
 	if err := checkSpecArgSafety(string(at)); err != nil {
 		return nil, err
 	}
 
 	return &gitFSCmd{
+		ctx:          ctx,
 		dir:          r.Dir,
 		at:           at,
 		repo:         r,
@@ -1025,6 +1573,7 @@ func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
 }
 
 type gitFSCmd struct {
+	ctx          context.Context
 	dir          string
 	at           vcs.CommitID
 	repo         *Repository
@@ -1043,10 +1592,13 @@ func (fs *gitFSCmd) Open(name string) (vfs.ReadSeekCloser, error) {
 }
 
 func (fs *gitFSCmd) readFileBytes(name string) ([]byte, error) {
-	cmd := exec.Command("git", "show", string(fs.at)+":"+name)
+	cmd := exec.CommandContext(fs.ctx, "git", "show", string(fs.at)+":"+name)
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		if bytes.Contains(out, []byte("exists on disk, but not in")) || bytes.Contains(out, []byte("does not exist")) {
 			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 		}
@@ -1102,10 +1654,13 @@ func (fs *gitFSCmd) getModTimeFromGitLog(path string) (time.Time, error) {
 	if !SetModTime {
 		return time.Time{}, nil
 	}
-	cmd := exec.Command("git", "log", "-1", "--format=%ad", string(fs.at), "--", filepath.ToSlash(path))
+	cmd := exec.CommandContext(fs.ctx, "git", "log", "-1", "--format=%ad", string(fs.at), "--", filepath.ToSlash(path))
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return time.Time{}, err
+		}
 		return time.Time{}, fmt.Errorf("exec %v failed: %s. Output was:\n\n%s", cmd.Args, err, out)
 	}
 	timeStr := strings.Trim(string(out), "\n")
@@ -1157,10 +1712,13 @@ func (fs *gitFSCmd) lsTree(path string) ([]os.FileInfo, error) {
 		return nil, err
 	}
 
-	cmd := exec.Command("git", "ls-tree", "-z", "--full-name", "--long", string(fs.at), "--", filepath.ToSlash(path))
+	cmd := exec.CommandContext(fs.ctx, "git", "ls-tree", "-z", "--full-name", "--long", string(fs.at), "--", filepath.ToSlash(path))
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		if bytes.Contains(out, []byte("exists on disk, but not in")) {
 			return nil, &os.PathError{Op: "ls-tree", Path: filepath.ToSlash(path), Err: os.ErrNotExist}
 		}
@@ -1232,7 +1790,7 @@ func (fs *gitFSCmd) lsTree(path string) ([]os.FileInfo, error) {
 			}
 		case "commit":
 			mode = mode | vcs.ModeSubmodule
-			cmd := exec.Command("git", "config", "--get", "submodule."+name+".url")
+			cmd := exec.CommandContext(fs.ctx, "git", "config", "--get", "submodule."+name+".url")
 			cmd.Dir = fs.dir
 			url := "" // url is not available if submodules are not initialized
 			if out, err := cmd.Output(); err == nil {
@@ -1268,59 +1826,399 @@ func (fs *gitFSCmd) String() string {
 	return fmt.Sprintf("git repository %s commit %s (cmd)", fs.dir, fs.at)
 }
 
+// remoteEnv returns the environment for a git command that
+// communicates with the remotes at urls according to opt (or nil, to
+// use this process's environment). You should call cleanup after the
+// command exits.
+func remoteEnv(opt vcs.RemoteOpts, urls []string) (env []string, cleanup func(), err error) {
+	var cleanups []func()
+	runCleanups := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			runCleanups()
+		}
+	}()
+
+	if opt.SSH != nil {
+		gitSSHWrapper, gitSSHWrapperDir, keyFile, err := makeGitSSHWrapper(opt.SSH, urls)
+		cleanups = append(cleanups, func() {
+			if keyFile != "" {
+				if err := os.Remove(keyFile); err != nil {
+					log.Fatalf("Error removing SSH key file %s: %s.", keyFile, err)
+				}
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, func() {
+			os.Remove(gitSSHWrapper)
+			if gitSSHWrapperDir != "" {
+				os.RemoveAll(gitSSHWrapperDir)
+			}
+		})
+		env = []string{"GIT_SSH=" + gitSSHWrapper}
+
+		authSock, stopAgent, err := sshAgentSocket(opt.SSH)
+		if err != nil {
+			return nil, nil, err
+		}
+		if stopAgent != nil {
+			cleanups = append(cleanups, func() { stopAgent() })
+		}
+		if authSock != "" {
+			env = append(env, "SSH_AUTH_SOCK="+authSock)
+		}
+	}
+
+	if opt.HTTPS != nil {
+		httpsEnv, httpsCleanup, err := makeGitHTTPSEnv(opt.HTTPS)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, httpsCleanup)
+		env = append(httpsEnv, env...)
+	}
+
+	return env, runCleanups, nil
+}
+
+// withCredentials returns opt with the credentials for the remote at
+// url (if creds is non-nil) in place of those in opt.SSH or
+// opt.HTTPS. Only the fields that creds sets are replaced. An SSH
+// private key is served by an in-process ssh agent, so that it isn't
+// written to disk.
+func withCredentials(opt vcs.RemoteOpts, url string, creds *vcs.Credentials) (vcs.RemoteOpts, error) {
+	if creds == nil {
+		return opt, nil
+	}
+	switch vcs.RemoteProtocol(url) {
+	case "ssh":
+		var c vcs.SSHConfig
+		if opt.SSH != nil {
+			c = *opt.SSH
+		}
+		if creds.Username != "" {
+			c.User = creds.Username
+		}
+		if creds.PrivateKey != nil {
+			a, err := sshutil.NewKeyAgent(creds.PrivateKey, creds.Passphrase)
+			if err != nil {
+				return opt, err
+			}
+			c.PrivateKey, c.PublicKey, c.Passphrase = nil, nil, nil
+			c.Agent, c.AgentSocket = a, ""
+		}
+		opt.SSH = &c
+	case "https":
+		var c vcs.HTTPSConfig
+		if opt.HTTPS != nil {
+			c = *opt.HTTPS
+		}
+		if creds.Username != "" {
+			c.User = creds.Username
+		}
+		if creds.Password != "" {
+			c.Pass = creds.Password
+		}
+		if creds.Token != "" {
+			c.Token = creds.Token
+		}
+		opt.HTTPS = &c
+	}
+	return opt, nil
+}
+
+// isAuthFailure reports whether err (from a git command that
+// communicates with a remote) is because the remote rejected the
+// credentials.
+func isAuthFailure(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"Authentication failed",
+		"Permission denied (",
+		"could not read Username",
+		"could not read Password",
+		"The requested URL returned error: 401",
+		"The requested URL returned error: 403",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
 // makeGitSSHWrapper writes a GIT_SSH wrapper that runs ssh with the
-// private key. You should remove the sshWrapper, sshWrapperDir and
-// the keyFile after using them.
-func makeGitSSHWrapper(privKey []byte) (sshWrapper, sshWrapperDir, keyFile string, err error) {
+// private key (unless it is encrypted; see sshAgentSocket) and that
+// verifies the host keys of the remotes at urls according to opt's
+// host key policy. You should remove the sshWrapper, sshWrapperDir
+// and the keyFile (if any) after using them.
+func makeGitSSHWrapper(opt *vcs.SSHConfig, urls []string) (sshWrapper, sshWrapperDir, keyFile string, err error) {
+	knownHosts, err := sshKnownHosts(opt, urls)
+	if err != nil {
+		return "", "", "", err
+	}
+
 	var otherOpt string
-	if InsecureSkipCheckVerifySSH {
+	if opt.HostKeyPolicy != vcs.HostKeyDefault {
+		otherOpt = "-o StrictHostKeyChecking=yes"
+	} else if InsecureSkipCheckVerifySSH {
 		otherOpt = "-o StrictHostKeyChecking=no"
 	}
+	if opt.User != "" && !anyRemoteUser(urls) {
+		// ssh -l overrides the user in the remote URL, which takes
+		// precedence (as in libgit2), so opt.User is only passed to
+		// ssh if no remote URL has a user.
+		if !isSafeSSHUser(opt.User) {
+			return "", "", "", fmt.Errorf("invalid ssh user %q", opt.User)
+		}
+		otherOpt += " -l " + opt.User
+	}
 
-	kf, err := ioutil.TempFile("", "go-vcs-gitcmd-key")
-	if err != nil {
-		return "", "", "", err
+	if opt.PrivateKey != nil && !sshutil.IsEncryptedPrivateKey(opt.PrivateKey) {
+		kf, err := ioutil.TempFile("", "go-vcs-gitcmd-key")
+		if err != nil {
+			return "", "", "", err
+		}
+		keyFile = kf.Name()
+		err = internal.WriteFileWithPermissions(keyFile, opt.PrivateKey, 0600)
+		if err != nil {
+			return "", "", keyFile, err
+		}
+	}
+
+	tmpFile, tmpFileDir, err := gitSSHWrapper(keyFile, otherOpt, knownHosts)
+	return tmpFile, tmpFileDir, keyFile, err
+}
+
+// anyRemoteUser reports whether any of the remote URLs has a user.
+func anyRemoteUser(urls []string) bool {
+	for _, url := range urls {
+		if sshutil.RemoteUser(url) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isSafeSSHUser reports whether user can be passed to ssh in the
+// GIT_SSH wrapper script without quoting.
+func isSafeSSHUser(user string) bool {
+	for _, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			return false
+		}
+	}
+	return !strings.HasPrefix(user, "-")
+}
+
+// sshKnownHosts returns the contents of the known_hosts file that ssh
+// should verify the host keys of the remotes at urls with, according
+// to opt's host key policy. If it returns nil, ssh uses the standard
+// known_hosts files.
+//
+// For HostKeyTOFU, the host key of each remote whose host has no
+// known host keys is fetched (and passed to opt.TrustHostKey) before
+// ssh runs; ssh then only accepts that host key.
+func sshKnownHosts(opt *vcs.SSHConfig, urls []string) ([]byte, error) {
+	switch opt.HostKeyPolicy {
+	case vcs.HostKeyKnownHosts:
+		return opt.KnownHosts, nil
+
+	case vcs.HostKeyPinned, vcs.HostKeyTOFU:
+		kh, err := sshutil.PolicyKnownHosts(opt)
+		if err != nil {
+			return nil, err
+		}
+		if opt.HostKeyPolicy == vcs.HostKeyPinned && len(kh) == 0 {
+			return nil, errors.New("no pinned SSH host keys")
+		}
+		if opt.HostKeyPolicy == vcs.HostKeyTOFU {
+			for _, url := range urls {
+				host, port, ok := sshutil.RemoteHost(url)
+				if !ok {
+					continue
+				}
+				hostname := sshutil.KnownHostname(host, port)
+				if kh.IsKnown(hostname) {
+					continue
+				}
+				key, err := sshutil.ScanHostKey(net.JoinHostPort(host, port))
+				if err != nil {
+					return nil, err
+				}
+				if err := sshutil.CheckHostKey(opt, hostname, key); err != nil {
+					return nil, err
+				}
+				kh = append(kh, &sshutil.KnownHost{Hostnames: []string{hostname}, Key: key})
+			}
+		}
+		var buf bytes.Buffer
+		if err := sshutil.WriteKnownHosts(&buf, kh); err != nil {
+			return nil, err
+		}
+		return append([]byte{}, buf.Bytes()...), nil // non-nil even if empty
 	}
-	keyFile = kf.Name()
-	err = internal.WriteFileWithPermissions(keyFile, privKey, 0600)
+	return nil, nil
+}
+
+// remoteURLs returns the URLs of the repository's remotes, keyed by
+// remote name.
+func (r *Repository) remoteURLs(ctx context.Context) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "config", "--get-regexp", `^remote\..*\.url$`)
+	cmd.Dir = r.Dir
+	out, err := cmd.Output()
 	if err != nil {
-		return "", "", keyFile, err
+		if exitStatus(err) == 1 {
+			return nil, nil // no remotes
+		}
+		return nil, fmt.Errorf("exec `git config` failed: %s", err)
+	}
+	urls := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if i := strings.Index(line, " "); i != -1 {
+			name := strings.TrimSuffix(strings.TrimPrefix(line[:i], "remote."), ".url")
+			urls[name] = line[i+1:]
+		}
 	}
+	return urls, nil
+}
 
-	tmpFile, tmpFileDir, err := gitSSHWrapper(keyFile, otherOpt)
-	return tmpFile, tmpFileDir, keyFile, err
+// sshAgentSocket returns the path of the ssh agent socket for ssh to
+// authenticate with (if any). An encrypted private key is decrypted
+// and served by an in-process agent, because ssh can't be given its
+// passphrase non-interactively. If stop is non-nil, it must be called
+// after ssh exits.
+func sshAgentSocket(opt *vcs.SSHConfig) (socket string, stop func() error, err error) {
+	a := opt.Agent
+	if opt.PrivateKey != nil && sshutil.IsEncryptedPrivateKey(opt.PrivateKey) {
+		if a != nil || opt.AgentSocket != "" {
+			return "", nil, errors.New("an encrypted SSH private key can't be used with an ssh agent")
+		}
+		a, err = sshutil.NewKeyAgent(opt.PrivateKey, opt.Passphrase)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if a != nil {
+		return sshutil.ServeAgent(a)
+	}
+	return opt.AgentSocket, nil, nil
 }
 
-// makeGitPassHelper writes a GIT_ASKPASS helper that supplies password over stdout.
-// You should remove the passHelper (and tempDir if any) after using it.
-func makeGitPassHelper(pass string) (passHelper string, tempDir string, err error) {
+// makeGitHTTPSEnv returns the environment for git to communicate with
+// HTTPS remotes according to opt. The password is passed to git's
+// GIT_ASKPASS helper in the environment, and the other settings are
+// passed to git as configuration in the environment, which needs git
+// 2.31 or newer. You should call cleanup after using the
+// environment.
+func makeGitHTTPSEnv(opt *vcs.HTTPSConfig) (env environ, cleanup func(), err error) {
+	var tempDirs []string
+	removeTempDirs := func() {
+		for _, dir := range tempDirs {
+			os.RemoveAll(dir)
+		}
+	}
+	defer func() {
+		if err != nil {
+			removeTempDirs()
+		}
+	}()
 
-	tmpFile, dir, err := internal.ScriptFile("go-vcs-gitcmd-ask")
+	env = environ(os.Environ())
+	env.Unset("GIT_TERMINAL_PROMPT")
+
+	gitPassHelper, gitPassHelperDir, err := makeGitPassHelper()
+	if gitPassHelperDir != "" {
+		tempDirs = append(tempDirs, gitPassHelperDir)
+	}
 	if err != nil {
-		return tmpFile, dir, err
+		return nil, nil, err
+	}
+	env = append(env, "GIT_ASKPASS="+gitPassHelper, gitPasswordEnv+"="+opt.Pass)
+
+	var config [][2]string
+	if opt.User != "" {
+		config = append(config, [2]string{"credential.username", opt.User})
+	}
+	if opt.Token != "" {
+		config = append(config, [2]string{"http.extraHeader", "Authorization: Bearer " + opt.Token})
+	}
+	for _, h := range opt.ExtraHeaders {
+		config = append(config, [2]string{"http.extraHeader", h})
+	}
+	if opt.ClientCert != nil || opt.ClientKey != nil || opt.CACerts != nil {
+		dir, err := ioutil.TempDir("", "go-vcs-gitcmd-tls")
+		if err != nil {
+			return nil, nil, err
+		}
+		tempDirs = append(tempDirs, dir)
+		for _, f := range []struct {
+			key, envVar, name string
+			data              []byte
+		}{
+			{"http.sslCert", "GIT_SSL_CERT", "cert.pem", opt.ClientCert},
+			{"http.sslKey", "GIT_SSL_KEY", "key.pem", opt.ClientKey},
+			{"http.sslCAInfo", "GIT_SSL_CAINFO", "ca.pem", opt.CACerts},
+		} {
+			if f.data == nil {
+				continue
+			}
+			path := filepath.Join(dir, f.name)
+			if err := internal.WriteFileWithPermissions(path, f.data, 0600); err != nil {
+				return nil, nil, err
+			}
+			config = append(config, [2]string{f.key, filepath.ToSlash(path)})
+			env.Unset(f.envVar) // it would override the config
+		}
 	}
+	if opt.Proxy != "" {
+		config = append(config, [2]string{"http.proxy", opt.Proxy})
+	}
+	if len(config) > 0 {
+		// Older versions of git silently ignore configuration in the
+		// environment.
+		if err := checkGitVersion(2, 31); err != nil {
+			return nil, nil, fmt.Errorf("gitcmd: HTTPS settings other than the password need git 2.31 or newer: %s", err)
+		}
+	}
+	env.AddConfig(config...)
+
+	return env, removeTempDirs, nil
+}
 
-	passPath := filepath.Join(dir, "password")
-	err = internal.WriteFileWithPermissions(passPath, []byte(pass), 0600)
+// makeGitPassHelper writes a GIT_ASKPASS helper that supplies the
+// password (from the gitPasswordEnv environment variable, so that it
+// isn't written to disk) over stdout. You should remove the
+// passHelper (and tempDir if any) after using it.
+func makeGitPassHelper() (passHelper string, tempDir string, err error) {
+	tmpFile, dir, err := internal.ScriptFile("go-vcs-gitcmd-ask")
 	if err != nil {
 		return tmpFile, dir, err
 	}
 
 	var script string
-
-	// We assume passPath can be escaped with a simple wrapping of single
-	// quotes. The path is not user controlled so this assumption should
-	// not be violated.
 	if runtime.GOOS == "windows" {
-		script = "@echo off\ntype " + passPath + "\n"
+		// Delayed expansion keeps special characters in the password
+		// from being interpreted.
+		script = "@echo off\nsetlocal EnableDelayedExpansion\necho !" + gitPasswordEnv + "!\n"
 	} else {
-		script = "#!/bin/sh\ncat '" + passPath + "'\n"
+		script = "#!/bin/sh\nprintf '%s\\n' \"$" + gitPasswordEnv + "\"\n"
 	}
 
 	err = internal.WriteFileWithPermissions(tmpFile, []byte(script), 0500)
 	return tmpFile, dir, err
 }
 
+// gitPasswordEnv is the environment variable that the GIT_ASKPASS
+// helper reads the password from.
+const gitPasswordEnv = "GO_VCS_GIT_PASSWORD"
+
 // InsecureSkipCheckVerifySSH controls whether the client verifies the
 // SSH server's certificate or host key. If InsecureSkipCheckVerifySSH
 // is true, the program is susceptible to a man-in-the-middle
@@ -1341,31 +2239,114 @@ func (e *environ) Unset(key string) {
 	}
 }
 
+var (
+	gitVersionOnce sync.Once
+	gitVersion     [2]int // major and minor version
+	gitVersionErr  error
+)
+
+// checkGitVersion returns an error unless the git command's version is
+// at least major.minor. The version is only determined once.
+func checkGitVersion(major, minor int) error {
+	gitVersionOnce.Do(func() {
+		out, err := exec.Command("git", "version").Output()
+		if err != nil {
+			gitVersionErr = fmt.Errorf("exec `git version` failed: %s", err)
+			return
+		}
+		gitVersion, gitVersionErr = parseGitVersion(string(out))
+	})
+	if gitVersionErr != nil {
+		return gitVersionErr
+	}
+	if gitVersion[0] < major || (gitVersion[0] == major && gitVersion[1] < minor) {
+		return fmt.Errorf("git version is %d.%d", gitVersion[0], gitVersion[1])
+	}
+	return nil
+}
+
+// parseGitVersion parses the major and minor version from the output
+// of `git version` (such as "git version 2.39.2" or "git version
+// 2.37.1 (Apple Git-137.1)").
+func parseGitVersion(out string) ([2]int, error) {
+	var v [2]int
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return v, fmt.Errorf("unrecognized `git version` output %q", out)
+	}
+	parts := strings.SplitN(fields[2], ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("unrecognized git version %q", fields[2])
+	}
+	for i := range v {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return v, fmt.Errorf("unrecognized git version %q", fields[2])
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// AddConfig adds git configuration settings (key-value pairs) to the
+// environment, after any that it already has (see GIT_CONFIG_COUNT in
+// git(1)).
+func (e *environ) AddConfig(config ...[2]string) {
+	if len(config) == 0 {
+		return
+	}
+	var n int
+	for _, kv := range *e {
+		if strings.HasPrefix(kv, "GIT_CONFIG_COUNT=") {
+			n, _ = strconv.Atoi(strings.TrimPrefix(kv, "GIT_CONFIG_COUNT="))
+		}
+	}
+	e.Unset("GIT_CONFIG_COUNT")
+	for _, kv := range config {
+		*e = append(*e, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, kv[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, kv[1]))
+		n++
+	}
+	*e = append(*e, fmt.Sprintf("GIT_CONFIG_COUNT=%d", n))
+}
+
 // Makes system-dependent SSH wrapper
-func gitSSHWrapper(keyFile string, otherOpt string) (sshWrapperFile string, tempDir string, err error) {
+func gitSSHWrapper(keyFile string, otherOpt string, knownHosts []byte) (sshWrapperFile string, tempDir string, err error) {
 	// TODO(sqs): encrypt and store the key in the env so that
 	// attackers can't decrypt if they have disk access after our
 	// process dies
 
+	var identityOpt string
+	if keyFile != "" {
+		identityOpt = " -i " + filepath.ToSlash(keyFile)
+	}
+
+	sshWrapperName, tempDir, err := internal.ScriptFile("go-vcs-gitcmd")
+	if err != nil {
+		return sshWrapperName, tempDir, err
+	}
+
+	if knownHosts != nil {
+		knownHostsFile := filepath.Join(tempDir, "known_hosts")
+		if err := internal.WriteFileWithPermissions(knownHostsFile, knownHosts, 0600); err != nil {
+			return sshWrapperName, tempDir, err
+		}
+		otherOpt += " -o UserKnownHostsFile=" + filepath.ToSlash(knownHostsFile) + " -o GlobalKnownHostsFile=" + filepath.ToSlash(os.DevNull)
+	}
+
 	var script string
 
 	if runtime.GOOS == "windows" {
 		script = `
 	@echo off
-	ssh -o ControlMaster=no -o ControlPath=none ` + otherOpt + ` -i ` + filepath.ToSlash(keyFile) + ` "%@"
+	ssh -o ControlMaster=no -o ControlPath=none ` + otherOpt + identityOpt + ` "%@"
 `
 	} else {
 		script = `
 	#!/bin/sh
-	exec /usr/bin/ssh -o ControlMaster=no -o ControlPath=none ` + otherOpt + ` -i ` + filepath.ToSlash(keyFile) + ` "$@"
+	exec /usr/bin/ssh -o ControlMaster=no -o ControlPath=none ` + otherOpt + identityOpt + ` "$@"
 `
 	}
 
-	sshWrapperName, tempDir, err := internal.ScriptFile("go-vcs-gitcmd")
-	if err != nil {
-		return sshWrapperName, tempDir, err
-	}
-
 	err = internal.WriteFileWithPermissions(sshWrapperName, []byte(script), 0500)
 	return sshWrapperName, tempDir, err
 }
@@ -0,0 +1,34 @@
+package gitcmd
+
+import "testing"
+
+func TestParseGitVersion(t *testing.T) {
+	for _, tc := range []struct {
+		out     string
+		want    [2]int
+		wantErr bool
+	}{
+		{out: "git version 2.39.2\n", want: [2]int{2, 39}},
+		{out: "git version 2.37.1 (Apple Git-137.1)\n", want: [2]int{2, 37}},
+		{out: "git version 2.31.0.windows.1\n", want: [2]int{2, 31}},
+		{out: "git version 1.8\n", want: [2]int{1, 8}},
+		{out: "git version 2\n", wantErr: true},
+		{out: "hub version 2.14.2\n", wantErr: true},
+		{out: "", wantErr: true},
+	} {
+		got, err := parseGitVersion(tc.out)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got nil error, want error", tc.out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.out, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.out, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package gitcmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func (r *Repository) Search(at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	return r.SearchContext(context.Background(), at, opt)
+}
+
+func (r *Repository) SearchContext(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	var res []*vcs.SearchResult
+	_, err := r.SearchStream(ctx, at, opt, func(rr *vcs.SearchResult) error {
+		res = append(res, rr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SearchStream implements vcs.StreamSearcher. The results are read
+// from `git grep` as it runs, and it is killed as soon as no more
+// results are needed. The results for each file are passed to fn
+// once git grep has finished searching the file.
+func (r *Repository) SearchStream(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions, fn func(*vcs.SearchResult) error) (*vcs.SearchStats, error) {
+	if err := checkSpecArgSafety(string(at)); err != nil {
+		return nil, err
+	}
+
+	var queryType string
+	switch opt.QueryType {
+	case vcs.FixedQuery:
+		queryType = "--fixed-strings"
+	case vcs.RegexpQuery:
+		queryType = "--basic-regexp"
+	case vcs.ExtendedRegexpQuery:
+		queryType = "--extended-regexp"
+	case vcs.PerlRegexpQuery:
+		queryType = "--perl-regexp"
+	default:
+		return nil, fmt.Errorf("unrecognized QueryType: %q", opt.QueryType)
+	}
+
+	filter, err := vcs.NewSearchResultFilter(opt, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var pathspecs []string
+	for _, glob := range opt.IncludePaths {
+		pathspecs = append(pathspecs, ":(glob)"+glob)
+	}
+	if file := filter.CursorFile(); file != "" && len(opt.IncludePaths) == 0 {
+		// Don't search the files before the cursor again. (If
+		// there are IncludePaths, they can't be combined with these
+		// pathspecs, so filter skips those files instead.)
+		pathspecs, err = r.pathspecsFrom(ctx, at, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(pathspecs) == 0 && len(opt.ExcludePaths) > 0 {
+		// git requires at least one non-exclude pathspec.
+		pathspecs = append(pathspecs, ":(glob)**")
+	}
+	for _, glob := range opt.ExcludePaths {
+		pathspecs = append(pathspecs, ":(glob,exclude)"+glob)
+	}
+
+	// git only reports the positions of matches by highlighting them,
+	// so turn off all other highlighting and highlight matches with
+	// a known escape sequence.
+	args := []string{
+		"-c", "color.grep.context=normal",
+		"-c", "color.grep.filename=normal",
+		"-c", "color.grep.linenumber=normal",
+		"-c", "color.grep.match=reverse",
+		"-c", "color.grep.selected=normal",
+		"-c", "color.grep.separator=normal",
+		"grep", "--null", "--line-number", "-I", "--color=always", "--context", strconv.Itoa(int(opt.ContextLines)), queryType,
+	}
+	if opt.IgnoreCase {
+		args = append(args, "--ignore-case")
+	}
+	if opt.Word {
+		args = append(args, "--word-regexp")
+	}
+	args = append(args, "-e", opt.Query, string(at), "--")
+	args = append(args, pathspecs...)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	offsets := &searchOffsetReader{dir: r.Dir, at: at}
+	defer offsets.close()
+	readErr := readGrepOutput(ctx, out, at, filter, offsets)
+
+	killErr := cmd.Process.Kill()
+	waitErr := cmd.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if killErr != nil && runtime.GOOS != "windows" {
+		return nil, killErr
+	}
+	if waitErr != nil {
+		if c := exitStatus(waitErr); c != -1 && c != 1 {
+			// -1 exit code = killed (by cmd.Process.Kill() call
+			// above), 1 exit code means grep had no match (but we
+			// don't translate that to a Go error)
+			return nil, fmt.Errorf("exec %v failed: %s", cmd.Args, waitErr)
+		}
+	}
+	return filter.Close()
+}
+
+// readGrepOutput parses the output of git grep and adds the results
+// to filter, until there is no more output or filter doesn't need
+// more results.
+func readGrepOutput(ctx context.Context, out io.Reader, at vcs.CommitID, filter *vcs.SearchResultFilter, offsets *searchOffsetReader) error {
+	var r *vcs.SearchResult             // the result being read
+	var fileResults []*vcs.SearchResult // the finished results for r's file
+	addFileResults := func() (bool, error) {
+		if len(fileResults) == 0 {
+			return false, nil
+		}
+		results := fileResults
+		fileResults = nil
+		if err := offsets.set(ctx, results); err != nil {
+			return true, err
+		}
+		for _, rr := range results {
+			if done, err := filter.Add(rr); done || err != nil {
+				return true, err
+			}
+		}
+		return false, nil
+	}
+	endResult := func() {
+		if r != nil {
+			fileResults = append(fileResults, r)
+			r = nil
+		}
+	}
+
+	rd := bufio.NewReader(out)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			// git-grep output ends with a newline, so if we hit EOF, there's nothing left to
+			// read
+			break
+		} else if err != nil {
+			return err
+		}
+		// line is guaranteed to be '\n' terminated according to the contract of ReadBytes
+		line = line[0 : len(line)-1]
+
+		if bytes.Equal(line, []byte("--")) {
+			// Match separator.
+			endResult()
+			continue
+		}
+
+		// Match line looks like: "HEAD:filename\x00lineno\x00matchline\n".
+		fileEnd := bytes.Index(line, []byte{'\x00'})
+		file := string(line[len(at)+1 : fileEnd])
+		lineNoStart, lineNoEnd := fileEnd+1, fileEnd+1+bytes.Index(line[fileEnd+1:], []byte{'\x00'})
+		lineNo, err := strconv.Atoi(string(line[lineNoStart:lineNoEnd]))
+		if err != nil {
+			panic("bad line number on line: " + string(line) + ": " + err.Error())
+		}
+		if filter.SkipFile(file) {
+			continue
+		}
+
+		// git doesn't print a separator between non-adjacent
+		// matches when there are no context lines.
+		if r == nil || r.File != file || uint32(lineNo) != r.EndLine+1 {
+			endResult()
+			if len(fileResults) > 0 && fileResults[0].File != file {
+				if done, err := addFileResults(); done || err != nil {
+					return err
+				}
+			}
+			r = &vcs.SearchResult{File: file, StartLine: uint32(lineNo)}
+		} else {
+			r.Match = append(r.Match, '\n')
+		}
+		r.EndLine = uint32(lineNo)
+
+		// The matches' byte ranges are relative to the start of
+		// r.Match until searchOffsetReader.set is called.
+		text, matches := parseGrepMatchColors(line[lineNoEnd+1:])
+		for _, m := range matches {
+			r.Matches = append(r.Matches, &vcs.SearchMatch{
+				Line:      uint32(lineNo),
+				Column:    uint32(m[0]),
+				StartByte: uint32(len(r.Match) + m[0]),
+				EndByte:   uint32(len(r.Match) + m[1]),
+			})
+		}
+		r.Match = append(r.Match, text...)
+	}
+	endResult()
+	_, err := addFileResults()
+	return err
+}
+
+// The escape sequences that git grep surrounds matches with, given
+// the color.grep.match=reverse config.
+const (
+	grepMatchStart = "\x1b[7m"
+	grepMatchEnd   = "\x1b[m"
+)
+
+// parseGrepMatchColors removes the highlighting of matches from a
+// line of git grep output, and returns the line's text and the byte
+// ranges of the matches in it.
+func parseGrepMatchColors(line []byte) (text []byte, matches [][2]int) {
+	for {
+		i := bytes.Index(line, []byte(grepMatchStart))
+		if i == -1 {
+			break
+		}
+		match := line[i+len(grepMatchStart):]
+		j := bytes.Index(match, []byte(grepMatchEnd))
+		if j == -1 {
+			break
+		}
+		text = append(text, line[:i]...)
+		matches = append(matches, [2]int{len(text), len(text) + j})
+		text = append(text, match[:j]...)
+		line = match[j+len(grepMatchEnd):]
+	}
+	return append(text, line...), matches
+}
+
+// pathspecsFrom returns literal pathspecs that match file and all of
+// the files in the tree of commit at that come after it in byte-wise
+// order (which is the order that git grep searches files in). It
+// lists the entries of each directory that contains file.
+func (r *Repository) pathspecsFrom(ctx context.Context, at vcs.CommitID, file string) ([]string, error) {
+	pathspecs := []string{":(literal)" + file}
+	components := strings.Split(file, "/")
+	dir := ""
+	for i, name := range components {
+		// Compare directories as though they have a trailing slash,
+		// since that's how the paths of the files in them compare.
+		key := name
+		if i < len(components)-1 {
+			key += "/"
+		}
+
+		args := []string{"ls-tree", "-z", string(at)}
+		if dir != "" {
+			args = append(args, "--", dir)
+		}
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = r.Dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("exec `git ls-tree` failed: %s. Output was:\n\n%s", err, out)
+		}
+		for _, entry := range bytes.Split(out, []byte{'\x00'}) {
+			// Each entry looks like "<mode> <type> <object>\t<path>".
+			tab := bytes.IndexByte(entry, '\t')
+			if tab == -1 {
+				continue
+			}
+			path := string(entry[tab+1:])
+			entryKey := strings.TrimPrefix(path, dir)
+			if bytes.Contains(entry[:tab], []byte(" tree ")) {
+				entryKey += "/"
+			}
+			if entryKey > key {
+				pathspecs = append(pathspecs, ":(literal)"+path)
+			}
+		}
+		dir += name + "/"
+	}
+	return pathspecs, nil
+}
+
+// A searchOffsetReader computes the byte offsets of search results,
+// which git grep doesn't report, by reading the files that contain
+// them with a long-running `git cat-file --batch` process.
+type searchOffsetReader struct {
+	dir string
+	at  vcs.CommitID
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// set sets the StartByte and EndByte of each result, and makes the
+// byte ranges of their matches (which must be relative to the start
+// of the result's Match) relative to the start of the file. The
+// results must all be in the same file, in line order.
+func (o *searchOffsetReader) set(ctx context.Context, results []*vcs.SearchResult) error {
+	if o.cmd == nil {
+		o.cmd = exec.CommandContext(ctx, "git", "cat-file", "--batch")
+		o.cmd.Dir = o.dir
+		var err error
+		if o.stdin, err = o.cmd.StdinPipe(); err != nil {
+			return err
+		}
+		stdout, err := o.cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		o.stdout = bufio.NewReader(stdout)
+		if err := o.cmd.Start(); err != nil {
+			return err
+		}
+	}
+
+	name := results[0].File
+	if _, err := fmt.Fprintf(o.stdin, "%s:%s\n", o.at, name); err != nil {
+		return err
+	}
+
+	// The object is output as "<id> <type> <size>\n<contents>\n".
+	header, err := o.stdout.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return fmt.Errorf("exec `git cat-file --batch` failed: unexpected output %q for %s", header, name)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	file := bufio.NewReader(io.LimitReader(o.stdout, size))
+	line, offset := uint32(1), 0
+	for _, r := range results {
+		for line < r.StartLine {
+			l, err := file.ReadSlice('\n')
+			offset += len(l)
+			if err == bufio.ErrBufferFull {
+				continue // the rest of the line is still to be read
+			} else if err != nil {
+				return err
+			}
+			line++
+		}
+		r.StartByte = uint32(offset)
+		r.EndByte = r.StartByte + uint32(len(r.Match))
+		for _, m := range r.Matches {
+			m.StartByte += r.StartByte
+			m.EndByte += r.StartByte
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, file); err != nil {
+		return err
+	}
+	_, err = o.stdout.Discard(1) // trailing newline
+	return err
+}
+
+// close stops the git cat-file process (if it was started).
+func (o *searchOffsetReader) close() {
+	if o.cmd != nil {
+		o.stdin.Close()
+		o.cmd.Wait()
+	}
+}
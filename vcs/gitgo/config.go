@@ -0,0 +1,95 @@
+package gitgo
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// A config is a parsed git config file (such as .git/config or
+// .gitmodules). Keys are of the form "section.key" or
+// "section.subsection.key", where the section and key are lowercase
+// and the subsection is case-sensitive (like `git config --get`). If
+// a key has multiple values, the last one is kept.
+type config map[string]string
+
+// parseConfig parses the git config file. Lines that can't be parsed
+// are skipped, and includes aren't followed.
+func parseConfig(data []byte) config {
+	cfg := config{}
+	var section string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end == -1 {
+				section = ""
+				continue
+			}
+			header := line[1:end]
+			if i := strings.IndexAny(header, " \t"); i != -1 {
+				// [section "subsection"]
+				sub := strings.TrimSpace(header[i:])
+				sub = strings.TrimSuffix(strings.TrimPrefix(sub, `"`), `"`)
+				sub = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(sub)
+				section = strings.ToLower(header[:i]) + "." + sub
+			} else {
+				// [section] or the deprecated [section.subsection]
+				if j := strings.Index(header, "."); j != -1 {
+					section = strings.ToLower(header[:j]) + "." + header[j+1:]
+				} else {
+					section = strings.ToLower(header)
+				}
+			}
+			continue
+		}
+		if section == "" {
+			continue
+		}
+
+		key, value := line, "true" // a key without a value is a boolean true
+		if i := strings.Index(line, "="); i != -1 {
+			key, value = strings.TrimSpace(line[:i]), parseConfigValue(line[i+1:])
+		}
+		cfg[section+"."+strings.ToLower(key)] = value
+	}
+	return cfg
+}
+
+// parseConfigValue parses a config value, which may be (partly)
+// quoted and may be followed by a comment.
+func parseConfigValue(s string) string {
+	var buf bytes.Buffer
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'b':
+				if buf.Len() > 0 {
+					buf.Truncate(buf.Len() - 1)
+				}
+			default:
+				buf.WriteByte(s[i])
+			}
+		case !quoted && (c == '#' || c == ';'):
+			return strings.TrimSpace(buf.String())
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,57 @@
+package gitgo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want config
+	}{
+		{
+			data: "",
+			want: config{},
+		},
+
+		{
+			data: `[core]
+	bare = false
+	# comment
+	IgnoreCase = true ; comment
+[remote "origin"]
+	url = https://example.com/user/repo.git
+[submodule "Sub Mod"]
+	path = sub/mod
+	url = "git@example.com:a/b.git" # comment
+`,
+			want: config{
+				"core.bare":              "false",
+				"core.ignorecase":        "true",
+				"remote.origin.url":      "https://example.com/user/repo.git",
+				"submodule.Sub Mod.path": "sub/mod",
+				"submodule.Sub Mod.url":  "git@example.com:a/b.git",
+			},
+		},
+
+		{
+			data: `[a]
+	x = 1
+	x = 2
+	y = "quoted \"value\"; not a comment"
+	z = a\tb
+`,
+			want: config{
+				"a.x": "2",
+				"a.y": `quoted "value"; not a comment`,
+				"a.z": "a\tb",
+			},
+		},
+	} {
+		got := parseConfig([]byte(tc.data))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %v, want %v", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package gitgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// diffContextLines is the number of unchanged lines shown around
+// changes (like `git diff -U3`).
+const diffContextLines = 3
+
+// A fileChange is a file that differs between two trees. The old or
+// new entry is nil if the file was added or deleted.
+type fileChange struct {
+	oldPath, newPath string
+	old, new         *treeEntry
+	score            int // the similarity of a rename
+}
+
+func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	return r.DiffContext(context.Background(), base, head, opt)
+}
+
+func (r *Repository) DiffContext(ctx context.Context, base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	if opt == nil {
+		opt = &vcs.DiffOptions{}
+	}
+
+	baseID, err := r.resolveCommitsOptionsRev(base)
+	if err != nil {
+		return nil, err
+	}
+	headID, err := r.resolveCommitsOptionsRev(head)
+	if err != nil {
+		return nil, err
+	}
+	if opt.ExcludeReachableFromBoth {
+		// Like "base...head": diff head against the merge base.
+		bases, err := r.mergeBases(ctx, baseID, headID)
+		if err != nil {
+			return nil, err
+		}
+		if len(bases) == 0 {
+			return nil, fmt.Errorf("git commits %s and %s have no merge base", base, head)
+		}
+		baseID = bases[0]
+	}
+	baseCommit, err := r.getCommit(baseID)
+	if err != nil {
+		return nil, err
+	}
+	headCommit, err := r.getCommit(headID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*fileChange
+	err = r.diffTrees(ctx, &baseCommit.tree, &headCommit.tree, "", func(c *fileChange) {
+		if matchPathspecs(opt.Paths, c.newPath) {
+			changes = append(changes, c)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opt.DetectRenames {
+		if changes, err = r.detectRenames(changes); err != nil {
+			return nil, err
+		}
+	}
+
+	var raw bytes.Buffer
+	for _, c := range changes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := r.writeFileDiff(&raw, c, opt.OrigPrefix, opt.NewPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return vcs.ParseDiff(raw.Bytes(), opt)
+}
+
+func (r *Repository) CommitFiles(id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	return r.CommitFilesContext(context.Background(), id, opt)
+}
+
+// CommitFilesContext implements vcs.CommitFilesListerContext. It
+// doesn't detect copies (opt.DetectCopies is ignored).
+func (r *Repository) CommitFilesContext(ctx context.Context, id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	c, err := r.parseCommitID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*vcs.CommitFiles
+	parents := c.parents
+	if len(parents) == 0 {
+		// Compare a root commit with an empty tree.
+		parents = []objectID{{}}
+	}
+	for _, p := range parents {
+		files := &vcs.CommitFiles{}
+		var oldTree *objectID
+		if len(c.parents) > 0 {
+			pc, err := r.getCommit(p)
+			if err != nil {
+				return nil, err
+			}
+			files.Parent = vcs.CommitID(p.String())
+			oldTree = &pc.tree
+		}
+
+		var changes []*fileChange
+		err := r.diffTrees(ctx, oldTree, &c.tree, "", func(fc *fileChange) {
+			// Show a change in a file's type as a single change, like
+			// `git diff-tree --raw` does.
+			if n := len(changes); n > 0 && fc.old == nil && changes[n-1].new == nil && changes[n-1].oldPath == fc.newPath {
+				changes[n-1].new = fc.new
+				return
+			}
+			changes = append(changes, fc)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if changes, err = r.detectRenames(changes); err != nil {
+			return nil, err
+		}
+
+		for _, fc := range changes {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			f, err := r.changedFile(fc)
+			if err != nil {
+				return nil, err
+			}
+			files.Files = append(files.Files, f)
+		}
+		all = append(all, files)
+	}
+	return all, nil
+}
+
+// changedFile returns the file that changed in c, with the number of
+// lines added to and deleted from it (like `git diff --numstat`).
+func (r *Repository) changedFile(c *fileChange) (*vcs.ChangedFile, error) {
+	f := &vcs.ChangedFile{Path: c.newPath}
+	switch {
+	case c.old == nil:
+		f.ChangeType = vcs.FileChangeType_ADDED
+	case c.new == nil:
+		f.ChangeType = vcs.FileChangeType_DELETED
+		f.Path = c.oldPath
+	case c.score > 0:
+		f.ChangeType = vcs.FileChangeType_RENAMED
+		f.OrigPath = c.oldPath
+	default:
+		f.ChangeType = vcs.FileChangeType_MODIFIED
+	}
+	if c.old != nil && c.new != nil && c.old.id == c.new.id {
+		// Only the mode or name changed.
+		return f, nil
+	}
+
+	oldData, err := r.fileContents(c.old)
+	if err != nil {
+		return nil, err
+	}
+	newData, err := r.fileContents(c.new)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(oldData) || isBinary(newData) {
+		f.Binary = true
+		return f, nil
+	}
+	for _, lc := range diffLines(splitLines(oldData), splitLines(newData)).changes() {
+		f.Deleted += int32(lc.n1)
+		f.Added += int32(lc.n2)
+	}
+	return f, nil
+}
+
+// diffTrees calls fn for each file that differs between the trees
+// (either of which may be nil), in the order that git shows them. A
+// change in the type of a file (e.g., from a regular file to a
+// symlink or directory) is shown as a deletion and an addition.
+func (r *Repository) diffTrees(ctx context.Context, oldTree, newTree *objectID, dir string, fn func(*fileChange)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var oldEntries, newEntries []treeEntry
+	var err error
+	if oldTree != nil {
+		if oldEntries, err = r.getTree(*oldTree); err != nil {
+			return err
+		}
+	}
+	if newTree != nil {
+		if newEntries, err = r.getTree(*newTree); err != nil {
+			return err
+		}
+	}
+
+	emit := func(old, new *treeEntry) error {
+		var e *treeEntry
+		if old != nil {
+			e = old
+		} else {
+			e = new
+		}
+		p := dir + e.name
+		oldIsTree := old != nil && old.mode&0170000 == modeTree
+		newIsTree := new != nil && new.mode&0170000 == modeTree
+		if oldIsTree || newIsTree {
+			var oldID, newID *objectID
+			if oldIsTree {
+				oldID = &old.id
+			}
+			if newIsTree {
+				newID = &new.id
+			}
+			return r.diffTrees(ctx, oldID, newID, p+"/", fn)
+		}
+		if old != nil && new != nil && old.mode&0170000 != new.mode&0170000 {
+			fn(&fileChange{oldPath: p, newPath: p, old: old})
+			fn(&fileChange{oldPath: p, newPath: p, new: new})
+			return nil
+		}
+		fn(&fileChange{oldPath: p, newPath: p, old: old, new: new})
+		return nil
+	}
+
+	// Both trees are sorted in git's order, in which directories sort
+	// as though their names end with a slash.
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		var cmp int
+		switch {
+		case i == len(oldEntries):
+			cmp = 1
+		case j == len(newEntries):
+			cmp = -1
+		default:
+			cmp = strings.Compare(treeSortKey(&oldEntries[i]), treeSortKey(&newEntries[j]))
+		}
+
+		switch {
+		case cmp < 0:
+			err = emit(&oldEntries[i], nil)
+			i++
+		case cmp > 0:
+			err = emit(nil, &newEntries[j])
+			j++
+		default:
+			old, new := &oldEntries[i], &newEntries[j]
+			if !sameEntry(old, new) {
+				err = emit(old, new)
+			}
+			i++
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeSortKey returns the key that tree entries are sorted by.
+func treeSortKey(e *treeEntry) string {
+	if e.mode&0170000 == modeTree {
+		return e.name + "/"
+	}
+	return e.name
+}
+
+// matchPathspecs reports whether the path matches any of the
+// pathspecs (or if there are none). A pathspec matches the path
+// itself, the files in it (if it is a directory), or the paths that
+// match it as a glob pattern.
+func matchPathspecs(pathspecs []string, p string) bool {
+	if len(pathspecs) == 0 {
+		return true
+	}
+	for _, spec := range pathspecs {
+		spec = strings.TrimSuffix(strings.TrimPrefix(spec, "./"), "/")
+		if spec == "" || spec == "." || p == spec || strings.HasPrefix(p, spec+"/") {
+			return true
+		}
+		if ok, _ := path.Match(spec, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileDiff writes the diff of a file in the format of `git diff
+// --full-index`.
+func (r *Repository) writeFileDiff(w *bytes.Buffer, c *fileChange, origPrefix, newPrefix string) error {
+	oldName := quotePath(origPrefix + c.oldPath)
+	newName := quotePath(newPrefix + c.newPath)
+	fmt.Fprintf(w, "diff --git %s %s\n", oldName, newName)
+
+	switch {
+	case c.old == nil:
+		fmt.Fprintf(w, "new file mode %06o\n", c.new.mode)
+	case c.new == nil:
+		fmt.Fprintf(w, "deleted file mode %06o\n", c.old.mode)
+	case c.old.mode != c.new.mode:
+		fmt.Fprintf(w, "old mode %06o\n", c.old.mode)
+		fmt.Fprintf(w, "new mode %06o\n", c.new.mode)
+	}
+	if c.score > 0 {
+		fmt.Fprintf(w, "similarity index %d%%\n", c.score*100/maxScore)
+		fmt.Fprintf(w, "rename from %s\n", quotePath(c.oldPath))
+		fmt.Fprintf(w, "rename to %s\n", quotePath(c.newPath))
+	}
+
+	var oldID, newID objectID
+	if c.old != nil {
+		oldID = c.old.id
+	}
+	if c.new != nil {
+		newID = c.new.id
+	}
+	if oldID == newID {
+		// Only the mode or name changed.
+		return nil
+	}
+	fmt.Fprintf(w, "index %s..%s", oldID, newID)
+	if c.old != nil && c.new != nil && c.old.mode == c.new.mode {
+		fmt.Fprintf(w, " %06o", c.old.mode)
+	}
+	w.WriteString("\n")
+
+	oldData, err := r.fileContents(c.old)
+	if err != nil {
+		return err
+	}
+	newData, err := r.fileContents(c.new)
+	if err != nil {
+		return err
+	}
+
+	oldLabel, newLabel := oldName, newName
+	if c.old == nil {
+		oldLabel = "/dev/null"
+	}
+	if c.new == nil {
+		newLabel = "/dev/null"
+	}
+	if isBinary(oldData) || isBinary(newData) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldLabel, newLabel)
+		return nil
+	}
+	if len(oldData) == 0 && len(newData) == 0 {
+		return nil
+	}
+
+	// Like git (and GNU diff), end the file name lines with a tab if
+	// the name contains a space, so that they can be parsed.
+	fmt.Fprintf(w, "--- %s%s\n", oldLabel, nameTerminator(c.oldPath))
+	fmt.Fprintf(w, "+++ %s%s\n", newLabel, nameTerminator(c.newPath))
+	writeHunks(w, splitLines(oldData), splitLines(newData))
+	return nil
+}
+
+func nameTerminator(name string) string {
+	if strings.Contains(name, " ") {
+		return "\t"
+	}
+	return ""
+}
+
+// fileContents returns the contents of the file (or nil if e is nil).
+// The contents of a submodule are a line with its commit ID, as git
+// shows it.
+func (r *Repository) fileContents(e *treeEntry) ([]byte, error) {
+	switch {
+	case e == nil:
+		return nil, nil
+	case e.mode&0170000 == modeGitlink:
+		return []byte("Subproject commit " + e.id.String() + "\n"), nil
+	}
+	return r.getBlob(e.id)
+}
+
+// isBinary reports whether the data looks binary to git (because it
+// has a NUL byte near the start).
+func isBinary(data []byte) bool {
+	const firstFewBytes = 8000
+	if len(data) > firstFewBytes {
+		data = data[:firstFewBytes]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
+
+// writeHunks writes the unified diff hunks of the lines.
+func writeHunks(w *bytes.Buffer, a, b [][]byte) {
+	changes := diffLines(a, b).changes()
+
+	for len(changes) > 0 {
+		// Group the changes that are close enough together to share
+		// context lines.
+		n := 1
+		for n < len(changes) {
+			prev := changes[n-1]
+			if changes[n].i1-(prev.i1+prev.n1) > 2*diffContextLines {
+				break
+			}
+			n++
+		}
+		group := changes[:n]
+		changes = changes[n:]
+
+		first, last := group[0], group[len(group)-1]
+		s1, s2 := max(first.i1-diffContextLines, 0), max(first.i2-diffContextLines, 0)
+		e1, e2 := min(last.i1+last.n1+diffContextLines, len(a)), min(last.i2+last.n2+diffContextLines, len(b))
+
+		w.WriteString("@@ -")
+		writeHunkRange(w, s1, e1-s1)
+		w.WriteString(" +")
+		writeHunkRange(w, s2, e2-s2)
+		w.WriteString(" @@")
+		if funcname := findFuncname(a, s1-1); funcname != "" {
+			w.WriteString(" " + funcname)
+		}
+		w.WriteString("\n")
+
+		i := s1
+		for _, c := range group {
+			for ; i < c.i1; i++ {
+				writeLine(w, ' ', a[i])
+			}
+			for k := c.i1; k < c.i1+c.n1; k++ {
+				writeLine(w, '-', a[k])
+			}
+			for k := c.i2; k < c.i2+c.n2; k++ {
+				writeLine(w, '+', b[k])
+			}
+			i = c.i1 + c.n1
+		}
+		for ; i < e1; i++ {
+			writeLine(w, ' ', a[i])
+		}
+	}
+}
+
+// writeHunkRange writes the 0-indexed start line and number of lines
+// of a hunk as git does: 1-indexed, with the count omitted if it is 1,
+// and the start being the line before the hunk if it is empty.
+func writeHunkRange(w *bytes.Buffer, start, count int) {
+	if count == 0 {
+		fmt.Fprintf(w, "%d,0", start)
+		return
+	}
+	fmt.Fprintf(w, "%d", start+1)
+	if count != 1 {
+		fmt.Fprintf(w, ",%d", count)
+	}
+}
+
+func writeLine(w *bytes.Buffer, prefix byte, line []byte) {
+	w.WriteByte(prefix)
+	w.Write(line)
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		w.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// findFuncname returns the nearest line at or before the given line
+// that looks like the start of a function (with git's default rule:
+// it starts with a letter, "_" or "$"), to show in a hunk header.
+func findFuncname(lines [][]byte, i int) string {
+	const maxLen = 80
+	for ; i >= 0; i-- {
+		line := lines[i]
+		if len(line) == 0 {
+			continue
+		}
+		if c := line[0]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$') {
+			continue
+		}
+		if len(line) > maxLen {
+			line = line[:maxLen]
+		}
+		return string(bytes.TrimRight(line, " \t\n\v\f\r"))
+	}
+	return ""
+}
+
+// quotePath quotes a path in a diff header if it has unusual
+// characters, like git does (with core.quotePath on).
+func quotePath(p string) string {
+	needsQuoting := false
+	for i := 0; i < len(p); i++ {
+		if c := p[i]; c < 0x20 || c == '"' || c == '\\' || c >= 0x7f {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return p
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\v':
+			buf.WriteString(`\v`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&buf, "\\%03o", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,237 @@
+package gitgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/util"
+)
+
+// maxSymlinkDepth is the maximum number of symlinks that Stat follows
+// (like the kernel's limit).
+const maxSymlinkDepth = 40
+
+func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
+	return r.FileSystemContext(context.Background(), at)
+}
+
+func (r *Repository) FileSystemContext(ctx context.Context, at vcs.CommitID) (vfs.FileSystem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id, err := r.resolveCommitsOptionsRev(at)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.getCommit(id)
+	if err != nil {
+		return nil, err
+	}
+	return &gitFSGo{repo: r, at: at, commit: c}, nil
+}
+
+type gitFSGo struct {
+	repo   *Repository
+	at     vcs.CommitID
+	commit *commit
+}
+
+// getEntry returns the tree entry at the path, which must be cleaned
+// and relative to the root of the tree.
+func (fs *gitFSGo) getEntry(op, name string) (*treeEntry, error) {
+	e, err := fs.repo.lookupPath(fs.commit.tree, filepath.ToSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, &os.PathError{Op: op, Path: filepath.ToSlash(name), Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (fs *gitFSGo) readFileBytes(name string) ([]byte, error) {
+	e, err := fs.getEntry("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.objectType() {
+	case objectBlob:
+		return fs.repo.getBlob(e.id)
+	case objectCommit:
+		// Return empty for a submodule for now.
+		return nil, nil
+	}
+	return nil, fmt.Errorf("read unexpected entry type %s (expected blob or submodule(commit))", e.objectType())
+}
+
+func (fs *gitFSGo) Open(name string) (vfs.ReadSeekCloser, error) {
+	name = filepath.Clean(internal.Rel(name))
+	b, err := fs.readFileBytes(name)
+	if err != nil {
+		return nil, err
+	}
+	return util.NopCloser{ReadSeeker: bytes.NewReader(b)}, nil
+}
+
+func (fs *gitFSGo) Lstat(path string) (os.FileInfo, error) {
+	path = filepath.Clean(internal.Rel(path))
+
+	if path == "." {
+		return &util.FileInfo{Mode_: os.ModeDir, ModTime_: fs.modTime()}, nil
+	}
+
+	e, err := fs.getEntry("lstat", path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.makeFileInfo(path, e)
+}
+
+func (fs *gitFSGo) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(internal.Rel(name))
+
+	p := filepath.ToSlash(name)
+	for i := 0; i < maxSymlinkDepth; i++ {
+		fi, err := fs.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			// Use original filename.
+			fi.(*util.FileInfo).Name_ = filepath.Base(name)
+			return fi, nil
+		}
+
+		// Dereference symlink. Relative targets are relative to
+		// the directory containing the symlink.
+		dest := fi.Sys().(vcs.SymlinkInfo).Dest
+		if strings.HasPrefix(dest, "/") {
+			return nil, &os.PathError{Op: "stat", Path: filepath.ToSlash(name), Err: os.ErrNotExist}
+		}
+		p = path.Join(path.Dir(p), dest)
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return nil, &os.PathError{Op: "stat", Path: filepath.ToSlash(name), Err: os.ErrNotExist}
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: filepath.ToSlash(name), Err: fmt.Errorf("too many levels of symbolic links")}
+}
+
+// modTime returns the mtime of the files in the tree, which is the
+// author date of the commit.
+func (fs *gitFSGo) modTime() time.Time {
+	return fs.commit.author.when
+}
+
+func (fs *gitFSGo) makeFileInfo(path string, e *treeEntry) (*util.FileInfo, error) {
+	fi := &util.FileInfo{Name_: e.name, ModTime_: fs.modTime()}
+	switch e.mode & 0170000 {
+	case modeTree:
+		fi.Mode_ = os.ModeDir
+	case modeGitlink:
+		url, err := fs.submoduleURL(filepath.ToSlash(path))
+		if err != nil {
+			return nil, err
+		}
+		fi.Mode_ = vcs.ModeSubmodule
+		fi.Sys_ = vcs.SubmoduleInfo{
+			URL:      url,
+			CommitID: vcs.CommitID(e.id.String()),
+		}
+	case modeSymlink:
+		b, err := fs.repo.getBlob(e.id)
+		if err != nil {
+			return nil, err
+		}
+		fi.Mode_ = os.ModeSymlink
+		fi.Size_ = int64(len(b))
+		fi.Sys_ = vcs.SymlinkInfo{Dest: string(b)}
+	default:
+		_, size, err := fs.repo.objects.readObjectHeader(e.id)
+		if err != nil {
+			return nil, err
+		}
+		if e.mode == modeExecutable {
+			fi.Mode_ |= 0111
+		}
+		fi.Size_ = size
+	}
+	return fi, nil
+}
+
+// submoduleURL returns the URL of the submodule at the path. The URL
+// in the repository's config (which is set when the submodule is
+// initialized) takes precedence over the one in .gitmodules. It is
+// empty if neither has it.
+func (fs *gitFSGo) submoduleURL(path string) (string, error) {
+	var gitmodules config
+	if e, err := fs.repo.lookupPath(fs.commit.tree, ".gitmodules"); err != nil {
+		return "", err
+	} else if e != nil && e.objectType() == objectBlob {
+		data, err := fs.repo.getBlob(e.id)
+		if err != nil {
+			return "", err
+		}
+		gitmodules = parseConfig(data)
+	}
+
+	// Submodules are named in .gitmodules, and the name is usually
+	// (but not necessarily) the path.
+	name := path
+	for key, value := range gitmodules {
+		if strings.HasPrefix(key, "submodule.") && strings.HasSuffix(key, ".path") && value == path {
+			name = strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+			break
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(fs.repo.commonDir, "config"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if url, ok := parseConfig(data)["submodule."+name+".url"]; ok {
+		return url, nil
+	}
+	return gitmodules["submodule."+name+".url"], nil
+}
+
+func (fs *gitFSGo) ReadDir(path string) ([]os.FileInfo, error) {
+	path = filepath.Clean(internal.Rel(path))
+
+	e, err := fs.getEntry("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if e.objectType() != objectTree {
+		return nil, &os.PathError{Op: "readdir", Path: filepath.ToSlash(path), Err: fmt.Errorf("not a directory")}
+	}
+	entries, err := fs.repo.getTree(e.id)
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, len(entries))
+	for i := range entries {
+		fi, err := fs.makeFileInfo(filepath.Join(path, entries[i].name), &entries[i])
+		if err != nil {
+			return nil, err
+		}
+		fis[i] = fi
+	}
+	util.SortFileInfosByName(fis)
+	return fis, nil
+}
+
+func (fs *gitFSGo) String() string {
+	return fmt.Sprintf("git repository %s commit %s (go)", fs.repo.Dir, fs.at)
+}
@@ -0,0 +1,755 @@
+package gitgo
+
+import "bytes"
+
+// splitLines splits data into lines, each including its terminating
+// newline (except possibly the last).
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			i = len(data) - 1
+		}
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// A lineDiff is the result of comparing the lines of two files. The
+// changed lines of each file are those that aren't in the common
+// subsequence that was found.
+type lineDiff struct {
+	a, b       [][]byte // the lines of the files
+	achg, bchg []bool   // whether each line was changed
+
+	// aids and bids are the lines that remain to be compared after
+	// the obviously changed lines are discarded, numbered so that
+	// equal lines have equal numbers (to compare them quickly).
+	// aindex and bindex are the indexes of those lines in a and b.
+	aids, bids     []int
+	aindex, bindex []int
+
+	// fdiag and bdiag are the furthest reaching forward and backward
+	// paths for each diagonal, used by split.
+	fdiag, bdiag []int
+	offset       int
+
+	// maxCost is the number of edits after which split gives up
+	// looking for the optimal midpoint.
+	maxCost int
+}
+
+// These are the constants of git's xdiff that affect which of the
+// (equally long) diffs of two files is found.
+const (
+	maxEqLimit    = 1024 // lines that occur this often are considered for discarding
+	simScanWindow = 100  // the number of lines around a line to look at when discarding it
+	keepDiscRun   = 4    // the proportion of discarded lines that causes a line to be discarded
+	maxCostMin    = 256  // the minimum maxCost
+	heurMinCost   = 256  // the number of edits after which split looks for good snakes
+	snakeCount    = 20   // the length of a good snake
+	kHeur         = 4    // the factor of the edit cost that a good snake must beat
+)
+
+// diffLines computes the changed lines of a and b the same way git's
+// xdiff does (with Myers' diff algorithm and the same heuristics), and
+// then shifts the changed groups of lines to where git would place
+// them.
+func diffLines(a, b [][]byte) *lineDiff {
+	d := &lineDiff{
+		a:    a,
+		b:    b,
+		achg: make([]bool, len(a)),
+		bchg: make([]bool, len(b)),
+	}
+	ids := map[string]int{}
+	var acount, bcount []int // the number of occurrences of each line in each file
+	number := func(lines [][]byte, count *[]int) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[string(line)]
+			if !ok {
+				id = len(ids)
+				ids[string(line)] = id
+				acount = append(acount, 0)
+				bcount = append(bcount, 0)
+			}
+			(*count)[id]++
+			out[i] = id
+		}
+		return out
+	}
+	aids := number(a, &acount)
+	bids := number(b, &bcount)
+
+	// Skip the common prefix and suffix.
+	start := 0
+	for start < len(a) && start < len(b) && aids[start] == bids[start] {
+		start++
+	}
+	aend, bend := len(a), len(b)
+	for aend > start && bend > start && aids[aend-1] == bids[bend-1] {
+		aend--
+		bend--
+	}
+
+	d.aids, d.aindex = cleanupLines(aids, start, aend, bcount, d.achg)
+	d.bids, d.bindex = cleanupLines(bids, start, bend, acount, d.bchg)
+
+	n := len(d.aids) + len(d.bids) + 3
+	d.fdiag, d.bdiag = make([]int, n), make([]int, n)
+	d.offset = len(d.bids) + 1
+	if d.maxCost = bogoSqrt(n); d.maxCost < maxCostMin {
+		d.maxCost = maxCostMin
+	}
+	d.compareSeq(0, len(d.aids), 0, len(d.bids), false)
+	d.fdiag, d.bdiag = nil, nil
+
+	changeCompact(d.a, d.achg, d.bchg)
+	changeCompact(d.b, d.bchg, d.achg)
+	return d
+}
+
+// cleanupLines discards the lines in ids[start:end] that obviously
+// changed: those that aren't in the other file, and those that are in
+// the other file many times but are mostly surrounded by discarded
+// lines. It marks the discarded lines as changed in chg and returns
+// the remaining lines and their indexes (like git's
+// xdl_cleanup_records).
+func cleanupLines(ids []int, start, end int, otherCount []int, chg []bool) (remaining, index []int) {
+	const (
+		noMatch    = 0
+		match      = 1
+		multiMatch = 2
+	)
+	limit := bogoSqrt(len(ids))
+	if limit > maxEqLimit {
+		limit = maxEqLimit
+	}
+	discard := make([]byte, len(ids))
+	for i := start; i < end; i++ {
+		switch n := otherCount[ids[i]]; {
+		case n == 0:
+			discard[i] = noMatch
+		case n >= limit:
+			discard[i] = multiMatch
+		default:
+			discard[i] = match
+		}
+	}
+
+	// cleanMultiMatch reports whether the line i (which occurs many
+	// times in the other file) should be discarded because it's in a
+	// run of lines that are mostly discarded.
+	cleanMultiMatch := func(i int) bool {
+		s, e := start, end-1
+		if i-s > simScanWindow {
+			s = i - simScanWindow
+		}
+		if e-i > simScanWindow {
+			e = i + simScanWindow
+		}
+		var before, after int           // the number of lines without matches
+		multiBefore, multiAfter := 1, 1 // the number of multimatch lines
+		for r := 1; i-r >= s; r++ {
+			if discard[i-r] == noMatch {
+				before++
+			} else if discard[i-r] == multiMatch {
+				multiBefore++
+			} else {
+				break
+			}
+		}
+		if before == 0 {
+			return false
+		}
+		for r := 1; i+r <= e; r++ {
+			if discard[i+r] == noMatch {
+				after++
+			} else if discard[i+r] == multiMatch {
+				multiAfter++
+			} else {
+				break
+			}
+		}
+		if after == 0 {
+			return false
+		}
+		multi, none := multiBefore+multiAfter, before+after
+		return multi*keepDiscRun < multi+none
+	}
+
+	for i := start; i < end; i++ {
+		if discard[i] == match || (discard[i] == multiMatch && !cleanMultiMatch(i)) {
+			remaining = append(remaining, ids[i])
+			index = append(index, i)
+		} else {
+			chg[i] = true
+		}
+	}
+	return remaining, index
+}
+
+// bogoSqrt returns an approximation of the square root of n (like
+// git's xdl_bogosqrt).
+func bogoSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// compareSeq finds the changed lines in aids[xoff:xlim] and
+// bids[yoff:ylim]. If minimal is false, split may use heuristics that
+// find a longer diff faster.
+func (d *lineDiff) compareSeq(xoff, xlim, yoff, ylim int, minimal bool) {
+	// Skip the common prefix and suffix.
+	for xoff < xlim && yoff < ylim && d.aids[xoff] == d.bids[yoff] {
+		xoff++
+		yoff++
+	}
+	for xoff < xlim && yoff < ylim && d.aids[xlim-1] == d.bids[ylim-1] {
+		xlim--
+		ylim--
+	}
+
+	switch {
+	case xoff == xlim:
+		for y := yoff; y < ylim; y++ {
+			d.bchg[d.bindex[y]] = true
+		}
+	case yoff == ylim:
+		for x := xoff; x < xlim; x++ {
+			d.achg[d.aindex[x]] = true
+		}
+	default:
+		s := d.split(xoff, xlim, yoff, ylim, minimal)
+		d.compareSeq(xoff, s.x, yoff, s.y, s.minLow)
+		d.compareSeq(s.x, xlim, s.y, ylim, s.minHigh)
+	}
+}
+
+// A splitPoint is where split divides the lines to compare, and
+// whether the diffs before and after it must be minimal.
+type splitPoint struct {
+	x, y            int
+	minLow, minHigh bool
+}
+
+// split finds the midpoint of the shortest edit script for
+// aids[xoff:xlim] and bids[yoff:ylim] (the "middle snake"), which must
+// not have a common prefix or suffix. Unless minimal is true, it gives
+// up on finding the shortest edit script when that is expensive (like
+// git's xdl_split).
+func (d *lineDiff) split(xoff, xlim, yoff, ylim int, minimal bool) splitPoint {
+	const maxInt = int(^uint(0) >> 1)
+	fd, bd, off := d.fdiag, d.bdiag, d.offset
+
+	dmin, dmax := xoff-ylim, xlim-yoff // the range of diagonals
+	fmid, bmid := xoff-yoff, xlim-ylim // the diagonals that the paths start on
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+	odd := (fmid-bmid)&1 != 0
+
+	fd[off+fmid] = xoff
+	bd[off+bmid] = xlim
+	for cost := 1; ; cost++ {
+		gotSnake := false
+
+		// Extend the forward paths by one edit.
+		if fmin > dmin {
+			fmin--
+			fd[off+fmin-1] = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			fd[off+fmax+1] = -1
+		} else {
+			fmax--
+		}
+		for k := fmax; k >= fmin; k -= 2 {
+			var x int
+			if tlo, thi := fd[off+k-1], fd[off+k+1]; tlo >= thi {
+				x = tlo + 1
+			} else {
+				x = thi
+			}
+			x0 := x
+			y := x - k
+			for x < xlim && y < ylim && d.aids[x] == d.bids[y] {
+				x++
+				y++
+			}
+			if x-x0 > snakeCount {
+				gotSnake = true
+			}
+			fd[off+k] = x
+			if odd && bmin <= k && k <= bmax && bd[off+k] <= x {
+				return splitPoint{x: x, y: y, minLow: true, minHigh: true}
+			}
+		}
+
+		// Extend the backward paths by one edit.
+		if bmin > dmin {
+			bmin--
+			bd[off+bmin-1] = maxInt
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			bd[off+bmax+1] = maxInt
+		} else {
+			bmax--
+		}
+		for k := bmax; k >= bmin; k -= 2 {
+			var x int
+			if tlo, thi := bd[off+k-1], bd[off+k+1]; tlo < thi {
+				x = tlo
+			} else {
+				x = thi - 1
+			}
+			x0 := x
+			y := x - k
+			for x > xoff && y > yoff && d.aids[x-1] == d.bids[y-1] {
+				x--
+				y--
+			}
+			if x0-x > snakeCount {
+				gotSnake = true
+			}
+			bd[off+k] = x
+			if !odd && fmin <= k && k <= fmax && x <= fd[off+k] {
+				return splitPoint{x: x, y: y, minLow: true, minHigh: true}
+			}
+		}
+
+		if minimal {
+			continue
+		}
+
+		// If the edit script is already long and some path has
+		// reached a long snake, split at the one that has gone the
+		// furthest (penalized by how far it is from the middle
+		// diagonal).
+		if gotSnake && cost > heurMinCost {
+			var best int
+			var s splitPoint
+			for k := fmax; k >= fmin; k -= 2 {
+				x := fd[off+k]
+				y := x - k
+				v := (x - xoff) + (y - yoff) - abs(k-fmid)
+				if v > kHeur*cost && v > best && xoff+snakeCount <= x && x < xlim && yoff+snakeCount <= y && y < ylim {
+					for i := 1; d.aids[x-i] == d.bids[y-i]; i++ {
+						if i == snakeCount {
+							best = v
+							s = splitPoint{x: x, y: y, minLow: true}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return s
+			}
+
+			for k := bmax; k >= bmin; k -= 2 {
+				x := bd[off+k]
+				y := x - k
+				v := (xlim - x) + (ylim - y) - abs(k-bmid)
+				if v > kHeur*cost && v > best && xoff < x && x <= xlim-snakeCount && yoff < y && y <= ylim-snakeCount {
+					for i := 0; d.aids[x+i] == d.bids[y+i]; i++ {
+						if i == snakeCount-1 {
+							best = v
+							s = splitPoint{x: x, y: y, minHigh: true}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return s
+			}
+		}
+
+		// If it's taking too long, split at the path that has gone
+		// the furthest.
+		if cost >= d.maxCost {
+			fbest, fbestX := -1, -1
+			for k := fmax; k >= fmin; k -= 2 {
+				x := min(fd[off+k], xlim)
+				y := x - k
+				if ylim < y {
+					x, y = ylim+k, ylim
+				}
+				if fbest < x+y {
+					fbest, fbestX = x+y, x
+				}
+			}
+
+			bbest, bbestX := maxInt, maxInt
+			for k := bmax; k >= bmin; k -= 2 {
+				x := max(xoff, bd[off+k])
+				y := x - k
+				if y < yoff {
+					x, y = yoff+k, yoff
+				}
+				if x+y < bbest {
+					bbest, bbestX = x+y, x
+				}
+			}
+
+			if (xlim+ylim)-bbest < fbest-(xoff+yoff) {
+				return splitPoint{x: fbestX, y: fbest - fbestX, minLow: true}
+			}
+			return splitPoint{x: bbestX, y: bbest - bbestX, minHigh: true}
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// A lineChange is a run of changed lines: a[i1:i1+n1] were replaced by
+// b[i2:i2+n2].
+type lineChange struct {
+	i1, n1, i2, n2 int
+}
+
+// changes returns the runs of changed lines.
+func (d *lineDiff) changes() []lineChange {
+	var changes []lineChange
+	i, j := 0, 0
+	for i < len(d.a) || j < len(d.b) {
+		if (i < len(d.a) && d.achg[i]) || (j < len(d.b) && d.bchg[j]) {
+			c := lineChange{i1: i, i2: j}
+			for i < len(d.a) && d.achg[i] {
+				i++
+			}
+			for j < len(d.b) && d.bchg[j] {
+				j++
+			}
+			c.n1, c.n2 = i-c.i1, j-c.i2
+			changes = append(changes, c)
+			continue
+		}
+		i++
+		j++
+	}
+	return changes
+}
+
+// A lineGroup is a run of changed lines [start, end) in a file, which
+// is empty if start == end. Each group is followed by an unchanged
+// line (or the end of the file), and the n'th group in one file
+// corresponds to the n'th group in the other.
+type lineGroup struct {
+	start, end int
+}
+
+func groupInit(chg []bool) lineGroup {
+	g := lineGroup{}
+	for g.end < len(chg) && chg[g.end] {
+		g.end++
+	}
+	return g
+}
+
+// next moves g to the next group, and reports whether there is one.
+func (g *lineGroup) next(chg []bool) bool {
+	if g.end == len(chg) {
+		return false
+	}
+	g.start = g.end + 1
+	g.end = g.start
+	for g.end < len(chg) && chg[g.end] {
+		g.end++
+	}
+	return true
+}
+
+// previous moves g to the previous group, and reports whether there
+// is one.
+func (g *lineGroup) previous(chg []bool) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	g.start = g.end
+	for g.start > 0 && chg[g.start-1] {
+		g.start--
+	}
+	return true
+}
+
+// slideDown moves the group down by one line (if the line after it is
+// the same as its first line), merging it with the following group if
+// they become adjacent.
+func (g *lineGroup) slideDown(lines [][]byte, chg []bool) bool {
+	if g.end < len(lines) && bytes.Equal(lines[g.start], lines[g.end]) {
+		chg[g.start], chg[g.end] = false, true
+		g.start++
+		g.end++
+		for g.end < len(chg) && chg[g.end] {
+			g.end++
+		}
+		return true
+	}
+	return false
+}
+
+// slideUp moves the group up by one line (if the line before it is
+// the same as its last line), merging it with the preceding group if
+// they become adjacent.
+func (g *lineGroup) slideUp(lines [][]byte, chg []bool) bool {
+	if g.start > 0 && bytes.Equal(lines[g.start-1], lines[g.end-1]) {
+		g.start--
+		g.end--
+		chg[g.start], chg[g.end] = true, false
+		for g.start > 0 && chg[g.start-1] {
+			g.start--
+		}
+		return true
+	}
+	return false
+}
+
+// changeCompact moves the groups of changed lines in a file (which
+// can often be placed in several positions) to where git would put
+// them: as far down as possible, unless they can be aligned with a
+// group of changes in the other file, or the indentation of the
+// surrounding lines suggests a better place (like xdiff's
+// xdl_change_compact with the indent heuristic).
+func changeCompact(lines [][]byte, chg, otherChg []bool) {
+	g, other := groupInit(chg), groupInit(otherChg)
+	for {
+		if g.end != g.start {
+			var groupSize, earliestEnd int
+			endMatchingOther := -1
+			for {
+				groupSize = g.end - g.start
+				endMatchingOther = -1
+
+				// Shift the group up as far as possible.
+				for g.slideUp(lines, chg) {
+					other.previous(otherChg)
+				}
+				earliestEnd = g.end
+				if other.end > other.start {
+					endMatchingOther = g.end
+				}
+
+				// Then down as far as possible.
+				for g.slideDown(lines, chg) {
+					other.next(otherChg)
+					if other.end > other.start {
+						endMatchingOther = g.end
+					}
+				}
+
+				// Repeat if the group was merged with another.
+				if groupSize == g.end-g.start {
+					break
+				}
+			}
+
+			switch {
+			case g.end == earliestEnd:
+				// No shifting was possible.
+			case endMatchingOther != -1:
+				// Align the group with the other file's group.
+				for other.end == other.start {
+					g.slideUp(lines, chg)
+					other.previous(otherChg)
+				}
+			default:
+				// Choose the best position by the indentation
+				// of the lines around it.
+				shift := earliestEnd
+				if g.end-groupSize-1 > shift {
+					shift = g.end - groupSize - 1
+				}
+				if g.end-indentHeuristicMaxSliding > shift {
+					shift = g.end - indentHeuristicMaxSliding
+				}
+				bestShift := -1
+				var bestScore splitScore
+				for ; shift <= g.end; shift++ {
+					var score splitScore
+					score.add(measureSplit(lines, shift))
+					score.add(measureSplit(lines, shift-groupSize))
+					if bestShift == -1 || score.cmp(bestScore) <= 0 {
+						bestScore, bestShift = score, shift
+					}
+				}
+				for g.end > bestShift {
+					g.slideUp(lines, chg)
+					other.previous(otherChg)
+				}
+			}
+		}
+
+		if !g.next(chg) {
+			break
+		}
+		other.next(otherChg)
+	}
+}
+
+// The constants and scoring of xdiff's indent heuristic, which chooses
+// where to place a group of changed lines by how the indentation of
+// the lines around it changes.
+const (
+	maxIndent = 200
+	maxBlanks = 20
+
+	startOfFilePenalty              = 1
+	endOfFilePenalty                = 21
+	totalBlankWeight                = -30
+	postBlankWeight                 = 6
+	relativeIndentPenalty           = -4
+	relativeIndentWithBlankPenalty  = 10
+	relativeOutdentPenalty          = 24
+	relativeOutdentWithBlankPenalty = 17
+	relativeDedentPenalty           = 23
+	relativeDedentWithBlankPenalty  = 17
+	indentWeight                    = 60
+	indentHeuristicMaxSliding       = 100
+)
+
+// getIndent returns the width of the line's indentation, or -1 if the
+// line is blank.
+func getIndent(line []byte) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 8 - n%8
+		case '\n', '\r', '\v', '\f':
+		default:
+			return n
+		}
+		if n >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+// A splitMeasurement describes the lines around a position between
+// lines where a group of changed lines could start or end.
+type splitMeasurement struct {
+	endOfFile  bool
+	indent     int // of the line after the split (or -1 if blank)
+	preBlank   int // the number of blank lines before the split
+	preIndent  int // of the first non-blank line before the split
+	postBlank  int // the number of blank lines after the line after the split
+	postIndent int // of the first non-blank line after those
+}
+
+func measureSplit(lines [][]byte, split int) splitMeasurement {
+	var m splitMeasurement
+	if split >= len(lines) {
+		m.endOfFile = true
+		m.indent = -1
+	} else {
+		m.indent = getIndent(lines[split])
+	}
+
+	m.preIndent = -1
+	for i := split - 1; i >= 0; i-- {
+		if m.preIndent = getIndent(lines[i]); m.preIndent != -1 {
+			break
+		}
+		if m.preBlank++; m.preBlank == maxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+
+	m.postIndent = -1
+	for i := split + 1; i < len(lines); i++ {
+		if m.postIndent = getIndent(lines[i]); m.postIndent != -1 {
+			break
+		}
+		if m.postBlank++; m.postBlank == maxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+func (s *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if m.endOfFile {
+		s.penalty += endOfFilePenalty
+	}
+
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	s.penalty += totalBlankWeight * totalBlank
+	s.penalty += postBlankWeight * postBlank
+
+	indent := m.indent
+	if indent == -1 {
+		indent = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	s.effectiveIndent += indent
+
+	switch {
+	case indent == -1 || m.preIndent == -1 || indent == m.preIndent:
+	case indent > m.preIndent:
+		if anyBlanks {
+			s.penalty += relativeIndentWithBlankPenalty
+		} else {
+			s.penalty += relativeIndentPenalty
+		}
+	case m.postIndent != -1 && m.postIndent > indent:
+		if anyBlanks {
+			s.penalty += relativeOutdentWithBlankPenalty
+		} else {
+			s.penalty += relativeOutdentPenalty
+		}
+	default:
+		if anyBlanks {
+			s.penalty += relativeDedentWithBlankPenalty
+		} else {
+			s.penalty += relativeDedentPenalty
+		}
+	}
+}
+
+// cmp returns a negative number if s is a better split than t (and a
+// positive number if it is worse).
+func (s splitScore) cmp(t splitScore) int {
+	cmpIndents := 0
+	if s.effectiveIndent > t.effectiveIndent {
+		cmpIndents = 1
+	} else if s.effectiveIndent < t.effectiveIndent {
+		cmpIndents = -1
+	}
+	return indentWeight*cmpIndents + (s.penalty - t.penalty)
+}
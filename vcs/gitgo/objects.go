@@ -0,0 +1,658 @@
+package gitgo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An objectID is the SHA-1 hash that identifies a git object.
+type objectID [20]byte
+
+func (id objectID) String() string { return hex.EncodeToString(id[:]) }
+
+// parseObjectID parses a full 40-character hex object ID.
+func parseObjectID(s string) (objectID, bool) {
+	var id objectID
+	if len(s) != 40 {
+		return id, false
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, false
+	}
+	return id, true
+}
+
+// isHex reports whether s consists only of lowercase or uppercase hex
+// digits.
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// objectType is the type of a git object, using the numbering of the
+// packfile format.
+type objectType int8
+
+const (
+	objectCommit objectType = 1
+	objectTree   objectType = 2
+	objectBlob   objectType = 3
+	objectTag    objectType = 4
+
+	// Deltified objects only occur in packfiles.
+	objectOfsDelta objectType = 6
+	objectRefDelta objectType = 7
+)
+
+func (t objectType) String() string {
+	switch t {
+	case objectCommit:
+		return "commit"
+	case objectTree:
+		return "tree"
+	case objectBlob:
+		return "blob"
+	case objectTag:
+		return "tag"
+	case objectOfsDelta:
+		return "ofs-delta"
+	case objectRefDelta:
+		return "ref-delta"
+	}
+	return fmt.Sprintf("objectType(%d)", t)
+}
+
+func parseObjectType(s string) (objectType, error) {
+	switch s {
+	case "commit":
+		return objectCommit, nil
+	case "tree":
+		return objectTree, nil
+	case "blob":
+		return objectBlob, nil
+	case "tag":
+		return objectTag, nil
+	}
+	return 0, fmt.Errorf("unknown git object type %q", s)
+}
+
+// errObjectNotFound is returned when an object isn't in the object
+// database. Callers translate it to the appropriate vcs error.
+var errObjectNotFound = errors.New("git object not found")
+
+// errAmbiguousObjectID is returned when an abbreviated object ID
+// matches more than one object.
+var errAmbiguousObjectID = errors.New("abbreviated git object ID is ambiguous")
+
+// An objectStore reads objects from a repository's object database:
+// loose objects and packfiles in the objects directory and in any
+// alternate object directories. It is safe for concurrent use.
+type objectStore struct {
+	dirs []string // objects dir followed by alternates
+
+	mu    sync.Mutex
+	packs map[string]*packfile // keyed by path of the .pack file
+	order []*packfile          // packs in the order they are searched
+	cache *objectCache
+}
+
+// maxObjectCacheBytes is the total size of the (inflated) objects
+// that an objectStore keeps in memory, mainly so that delta chains
+// don't need to be resolved from scratch for each object.
+const maxObjectCacheBytes = 32 << 20
+
+func newObjectStore(objectsDir string) (*objectStore, error) {
+	dirs, err := readAlternates(objectsDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &objectStore{
+		dirs:  dirs,
+		packs: map[string]*packfile{},
+		cache: newObjectCache(maxObjectCacheBytes),
+	}
+	if err := s.scanPacks(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readAlternates returns dir followed by the object directories
+// listed (recursively) in its info/alternates file.
+func readAlternates(dir string, seen []string) ([]string, error) {
+	for _, d := range seen {
+		if d == dir {
+			return nil, nil
+		}
+	}
+	dirs := []string{dir}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return dirs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		alts, err := readAlternates(filepath.Clean(line), append(seen, dirs...))
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, alts...)
+	}
+	return dirs, nil
+}
+
+// scanPacks adds the packfiles that have been created since it was
+// last called (e.g., by `git gc` or a fetch). Packs that have been
+// deleted are kept open, since objects may still be read from them.
+func (s *objectStore) scanPacks() error {
+	for _, dir := range s.dirs {
+		idxFiles, err := filepath.Glob(filepath.Join(dir, "pack", "pack-*.idx"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(idxFiles)
+		for _, idxFile := range idxFiles {
+			packFile := strings.TrimSuffix(idxFile, ".idx") + ".pack"
+			if _, present := s.packs[packFile]; present {
+				continue
+			}
+			if _, err := os.Stat(packFile); err != nil {
+				// The pack is still being written (or was removed).
+				continue
+			}
+			p, err := openPackfile(packFile, idxFile)
+			if err != nil {
+				return err
+			}
+			s.packs[packFile] = p
+			s.order = append(s.order, p)
+		}
+	}
+	return nil
+}
+
+// readObject returns the type and contents of the object.
+func (s *objectStore) readObject(id objectID) (objectType, []byte, error) {
+	if typ, data, ok := s.cache.get(id); ok {
+		return typ, data, nil
+	}
+	typ, data, err := s.readObjectUncached(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.cache.add(id, typ, data)
+	return typ, data, nil
+}
+
+func (s *objectStore) readObjectUncached(id objectID) (objectType, []byte, error) {
+	for _, dir := range s.dirs {
+		typ, data, err := readLooseObject(dir, id)
+		if err == nil {
+			return typ, data, nil
+		} else if err != errObjectNotFound {
+			return 0, nil, err
+		}
+	}
+
+	for rescanned := false; ; rescanned = true {
+		s.mu.Lock()
+		packs := s.order
+		s.mu.Unlock()
+		for _, p := range packs {
+			if offset, ok := p.idx.find(id); ok {
+				return p.readObjectAt(s, offset)
+			}
+		}
+		if rescanned {
+			return 0, nil, errObjectNotFound
+		}
+		s.mu.Lock()
+		err := s.scanPacks()
+		s.mu.Unlock()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// readObjectHeader returns the type and size of the object without
+// (fully) reading its contents.
+func (s *objectStore) readObjectHeader(id objectID) (objectType, int64, error) {
+	if typ, data, ok := s.cache.get(id); ok {
+		return typ, int64(len(data)), nil
+	}
+	for _, dir := range s.dirs {
+		typ, size, err := readLooseObjectHeader(dir, id)
+		if err == nil {
+			return typ, size, nil
+		} else if err != errObjectNotFound {
+			return 0, 0, err
+		}
+	}
+	s.mu.Lock()
+	packs := s.order
+	s.mu.Unlock()
+	for _, p := range packs {
+		if offset, ok := p.idx.find(id); ok {
+			return p.readObjectHeaderAt(s, offset)
+		}
+	}
+	// Fall back to reading the object, which rescans the packs.
+	typ, data, err := s.readObject(id)
+	return typ, int64(len(data)), err
+}
+
+// hasObject reports whether the object exists.
+func (s *objectStore) hasObject(id objectID) (bool, error) {
+	_, _, err := s.readObjectHeader(id)
+	if err == errObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findObjectsByPrefix returns the IDs of the objects whose hex IDs
+// begin with prefix (which must be lowercase). It stops after finding
+// 2 objects, which is enough to tell that prefix is ambiguous.
+func (s *objectStore) findObjectsByPrefix(prefix string) ([]objectID, error) {
+	var ids []objectID
+	add := func(id objectID) {
+		for _, id2 := range ids {
+			if id2 == id {
+				return
+			}
+		}
+		ids = append(ids, id)
+	}
+
+	if len(prefix) >= 2 {
+		for _, dir := range s.dirs {
+			names, err := readDirNames(filepath.Join(dir, prefix[:2]))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if id, ok := parseObjectID(prefix[:2] + name); ok && strings.HasPrefix(id.String(), prefix) {
+					add(id)
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	err := s.scanPacks()
+	packs := s.order
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		for _, id := range p.idx.findPrefix(prefix, 2) {
+			add(id)
+		}
+		if len(ids) >= 2 {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// readDirNames returns the names of the entries in dir, or none if
+// dir doesn't exist.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+func looseObjectPath(dir string, id objectID) string {
+	s := id.String()
+	return filepath.Join(dir, s[:2], s[2:])
+}
+
+// openLooseObject opens the loose object and reads its header.
+func openLooseObject(dir string, id objectID) (io.ReadCloser, *bufio.Reader, objectType, int64, error) {
+	f, err := os.Open(looseObjectPath(dir, id))
+	if os.IsNotExist(err) {
+		return nil, nil, 0, 0, errObjectNotFound
+	} else if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, 0, fmt.Errorf("reading git object %s: %s", id, err)
+	}
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, 0, fmt.Errorf("reading git object %s header: %s", id, err)
+	}
+	// The header is "TYPE SIZE\x00".
+	parts := strings.SplitN(strings.TrimSuffix(header, "\x00"), " ", 2)
+	if len(parts) != 2 {
+		f.Close()
+		return nil, nil, 0, 0, fmt.Errorf("bad git object %s header %q", id, header)
+	}
+	typ, err := parseObjectType(parts[0])
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, 0, err
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, 0, fmt.Errorf("bad git object %s header %q", id, header)
+	}
+	return f, br, typ, size, nil
+}
+
+func readLooseObject(dir string, id objectID) (objectType, []byte, error) {
+	f, br, typ, size, err := openLooseObject(dir, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return 0, nil, fmt.Errorf("reading git object %s: %s", id, err)
+	}
+	return typ, data, nil
+}
+
+func readLooseObjectHeader(dir string, id objectID) (objectType, int64, error) {
+	f, _, typ, size, err := openLooseObject(dir, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	f.Close()
+	return typ, size, nil
+}
+
+// An objectCache is an LRU cache of objects, limited by their total
+// size.
+type objectCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	lru      *list.List // of *objectCacheEntry, most recently used first
+	entries  map[interface{}]*list.Element
+}
+
+type objectCacheEntry struct {
+	key  interface{}
+	typ  objectType
+	data []byte
+}
+
+func newObjectCache(maxBytes int) *objectCache {
+	return &objectCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[interface{}]*list.Element{},
+	}
+}
+
+// get returns the cached object with the given key (an objectID or a
+// packfile position).
+func (c *objectCache) get(key interface{}) (objectType, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return 0, nil, false
+	}
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*objectCacheEntry)
+	return entry.typ, entry.data, true
+}
+
+func (c *objectCache) add(key interface{}, typ objectType, data []byte) {
+	if len(data) > c.maxBytes/4 {
+		return // too big to be worth evicting everything else for
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, present := c.entries[key]; present {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&objectCacheEntry{key: key, typ: typ, data: data})
+	c.bytes += len(data)
+	for c.bytes > c.maxBytes {
+		e := c.lru.Back()
+		entry := e.Value.(*objectCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.bytes -= len(entry.data)
+	}
+}
+
+// A signature is the author, committer or tagger line of a commit or
+// tag object.
+type signature struct {
+	name, email string
+	when        time.Time
+}
+
+// parseSignature parses a signature of the form "NAME <EMAIL> UNIXTIME
+// TZOFFSET".
+func parseSignature(s string) (signature, error) {
+	var sig signature
+	lt := strings.Index(s, "<")
+	gt := strings.LastIndex(s, ">")
+	if lt == -1 || gt < lt {
+		return sig, fmt.Errorf("bad git signature %q", s)
+	}
+	sig.name = strings.TrimSpace(s[:lt])
+	sig.email = s[lt+1 : gt]
+
+	fields := strings.Fields(s[gt+1:])
+	if len(fields) == 0 {
+		return sig, nil
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig, fmt.Errorf("bad git signature date %q", s)
+	}
+	sig.when = time.Unix(sec, 0)
+	if len(fields) > 1 {
+		if tz, err := strconv.Atoi(fields[1]); err == nil {
+			offset := (tz/100*60 + tz%100) * 60
+			sig.when = sig.when.In(time.FixedZone("", offset))
+		}
+	}
+	return sig, nil
+}
+
+// parseObjectHeaders splits a commit or tag object into its header
+// lines (with continuation lines, such as those of a "gpgsig" header,
+// appended to the header they belong to) and its message.
+func parseObjectHeaders(data []byte) (headers [][2]string, message string) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			i = len(data)
+		}
+		line := string(data[:i])
+		if i < len(data) {
+			i++
+		}
+		data = data[i:]
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' && len(headers) > 0 {
+			headers[len(headers)-1][1] += "\n" + line[1:]
+			continue
+		}
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		headers = append(headers, [2]string{kv[0], kv[1]})
+	}
+	return headers, string(data)
+}
+
+// A commit is a parsed commit object.
+type commit struct {
+	id        objectID
+	tree      objectID
+	parents   []objectID
+	author    signature
+	committer signature
+	message   string
+}
+
+func parseCommit(id objectID, data []byte) (*commit, error) {
+	c := &commit{id: id}
+	headers, message := parseObjectHeaders(data)
+	c.message = message
+	var haveTree bool
+	for _, h := range headers {
+		var err error
+		switch h[0] {
+		case "tree":
+			c.tree, haveTree = parseObjectID(h[1])
+		case "parent":
+			p, ok := parseObjectID(h[1])
+			if !ok {
+				return nil, fmt.Errorf("bad parent %q in git commit %s", h[1], id)
+			}
+			c.parents = append(c.parents, p)
+		case "author":
+			c.author, err = parseSignature(h[1])
+		case "committer":
+			c.committer, err = parseSignature(h[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !haveTree {
+		return nil, fmt.Errorf("git commit %s has no tree", id)
+	}
+	return c, nil
+}
+
+// A tag is a parsed (annotated) tag object.
+type tag struct {
+	id         objectID
+	object     objectID
+	objectType objectType
+	name       string
+	tagger     *signature
+	message    string
+}
+
+func parseTag(id objectID, data []byte) (*tag, error) {
+	t := &tag{id: id}
+	headers, message := parseObjectHeaders(data)
+	t.message = message
+	var haveObject bool
+	for _, h := range headers {
+		var err error
+		switch h[0] {
+		case "object":
+			t.object, haveObject = parseObjectID(h[1])
+		case "type":
+			t.objectType, err = parseObjectType(h[1])
+		case "tag":
+			t.name = h[1]
+		case "tagger":
+			var sig signature
+			sig, err = parseSignature(h[1])
+			t.tagger = &sig
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !haveObject || t.objectType == 0 {
+		return nil, fmt.Errorf("git tag %s has no object or type", id)
+	}
+	return t, nil
+}
+
+// Git file modes of tree entries.
+const (
+	modeTree       = 040000
+	modeBlob       = 0100644
+	modeExecutable = 0100755
+	modeSymlink    = 0120000
+	modeGitlink    = 0160000
+)
+
+// A treeEntry is an entry of a tree object.
+type treeEntry struct {
+	name string
+	mode uint32
+	id   objectID
+}
+
+// objectType returns the type of object that the entry refers to.
+// Gitlinks (submodules) refer to commits in another repository.
+func (e *treeEntry) objectType() objectType {
+	switch e.mode & 0170000 {
+	case modeTree:
+		return objectTree
+	case modeGitlink:
+		return objectCommit
+	}
+	return objectBlob
+}
+
+func parseTree(id objectID, data []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(data) > 0 {
+		// Each entry is "MODE NAME\x00" followed by the raw
+		// 20-byte object ID.
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp == -1 || nul < sp || len(data) < nul+21 {
+			return nil, fmt.Errorf("bad git tree %s", id)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad mode in git tree %s: %s", id, err)
+		}
+		e := treeEntry{name: string(data[sp+1 : nul]), mode: uint32(mode)}
+		copy(e.id[:], data[nul+1:nul+21])
+		entries = append(entries, e)
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,418 @@
+package gitgo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A packIndex is a parsed pack index (.idx) file, which maps object
+// IDs to their offsets in the packfile. Both version 1 and version 2
+// indexes are supported.
+type packIndex struct {
+	version int
+	fanout  [256]uint32 // number of objects whose first ID byte is <= i
+
+	entries   []byte // 4-byte offsets and object IDs (v1 only)
+	ids       []byte // sorted 20-byte object IDs (v2 only)
+	offsets   []byte // 4-byte offsets (v2 only)
+	offsets64 []byte // 8-byte offsets for packs over 2GiB (v2 only)
+}
+
+var packIndexV2Magic = []byte{0xff, 't', 'O', 'c'}
+
+func readPackIndex(path string) (*packIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &packIndex{}
+
+	fanoutStart := 0
+	if bytes.HasPrefix(data, packIndexV2Magic) {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated git pack index %s", path)
+		}
+		idx.version = int(binary.BigEndian.Uint32(data[4:8]))
+		if idx.version != 2 {
+			return nil, fmt.Errorf("unsupported git pack index version %d in %s", idx.version, path)
+		}
+		fanoutStart = 8
+	} else {
+		idx.version = 1
+	}
+	if len(data) < fanoutStart+256*4 {
+		return nil, fmt.Errorf("truncated git pack index %s", path)
+	}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(data[fanoutStart+i*4:])
+	}
+	n := int(idx.fanout[255])
+
+	start := fanoutStart + 256*4
+	if idx.version == 1 {
+		// Each entry is a 4-byte offset followed by the object ID.
+		if len(data) < start+n*24 {
+			return nil, fmt.Errorf("truncated git pack index %s", path)
+		}
+		idx.entries = data[start : start+n*24]
+		return idx, nil
+	}
+
+	// Version 2 has tables of object IDs, CRC32s, offsets and large
+	// offsets.
+	if len(data) < start+n*(20+4+4) {
+		return nil, fmt.Errorf("truncated git pack index %s", path)
+	}
+	idx.ids = data[start : start+n*20]
+	start += n*20 + n*4
+	idx.offsets = data[start : start+n*4]
+	idx.offsets64 = data[start+n*4:]
+	return idx, nil
+}
+
+func (idx *packIndex) len() int { return int(idx.fanout[255]) }
+
+// id returns the i'th object ID in the index.
+func (idx *packIndex) id(i int) []byte {
+	if idx.version == 1 {
+		return idx.entries[i*24+4 : i*24+24]
+	}
+	return idx.ids[i*20 : i*20+20]
+}
+
+// offset returns the packfile offset of the i'th object in the
+// index.
+func (idx *packIndex) offset(i int) (int64, error) {
+	if idx.version == 1 {
+		return int64(binary.BigEndian.Uint32(idx.entries[i*24:])), nil
+	}
+	off := binary.BigEndian.Uint32(idx.offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off), nil
+	}
+	j := int(off&0x7fffffff) * 8
+	if len(idx.offsets64) < j+8 {
+		return 0, errors.New("bad large offset in git pack index")
+	}
+	return int64(binary.BigEndian.Uint64(idx.offsets64[j:])), nil
+}
+
+// bounds returns the range of entries whose IDs start with the byte
+// b.
+func (idx *packIndex) bounds(b byte) (lo, hi int) {
+	if b > 0 {
+		lo = int(idx.fanout[b-1])
+	}
+	return lo, int(idx.fanout[b])
+}
+
+// find returns the packfile offset of the object, if it is in the
+// pack.
+func (idx *packIndex) find(id objectID) (int64, bool) {
+	lo, hi := idx.bounds(id[0])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.id(lo+i), id[:]) >= 0
+	})
+	if i < hi && bytes.Equal(idx.id(i), id[:]) {
+		off, err := idx.offset(i)
+		return off, err == nil
+	}
+	return 0, false
+}
+
+// findPrefix returns up to max IDs of objects in the pack whose hex
+// IDs start with prefix (which must be lowercase).
+func (idx *packIndex) findPrefix(prefix string, max int) []objectID {
+	lo, hi := 0, idx.len()
+	if len(prefix) >= 2 {
+		if b, err := hex.DecodeString(prefix[:2]); err == nil {
+			lo, hi = idx.bounds(b[0])
+		}
+	}
+	var ids []objectID
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return hex.EncodeToString(idx.id(lo+i)) >= prefix
+	})
+	for ; i < hi && len(ids) < max; i++ {
+		var id objectID
+		copy(id[:], idx.id(i))
+		if !strings.HasPrefix(id.String(), prefix) {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// A packfile is a .pack file and its index.
+type packfile struct {
+	path string
+	f    *os.File
+	size int64
+	idx  *packIndex
+}
+
+func openPackfile(packPath, idxPath string) (*packfile, error) {
+	idx, err := readPackIndex(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(packPath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var header [12]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading git pack %s header: %s", packPath, err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		f.Close()
+		return nil, fmt.Errorf("bad git pack %s", packPath)
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); v != 2 && v != 3 {
+		f.Close()
+		return nil, fmt.Errorf("unsupported git pack version %d in %s", v, packPath)
+	}
+	return &packfile{path: packPath, f: f, size: fi.Size(), idx: idx}, nil
+}
+
+// packPosition identifies an object in a pack, for caching delta
+// bases (which may not be looked up by ID).
+type packPosition struct {
+	pack   *packfile
+	offset int64
+}
+
+// entryHeader reads the header of the pack entry at offset. For
+// deltified entries, it returns the offset of the base object
+// (ofs-delta) or its ID (ref-delta). The returned reader is
+// positioned at the entry's compressed data.
+func (p *packfile) entryHeader(offset int64) (typ objectType, size int64, baseOffset int64, baseID objectID, r *bufio.Reader, err error) {
+	if offset < 12 || offset >= p.size {
+		return 0, 0, 0, baseID, nil, fmt.Errorf("bad offset %d in git pack %s", offset, p.path)
+	}
+	r = bufio.NewReader(io.NewSectionReader(p.f, offset, p.size-offset))
+
+	// The type and size are encoded as "1TTTSSSS 1SSSSSSS ...
+	// 0SSSSSSS", with the low bits of the size first.
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, 0, baseID, nil, err
+	}
+	typ = objectType((b >> 4) & 7)
+	size = int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, 0, baseID, nil, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+
+	switch typ {
+	case objectCommit, objectTree, objectBlob, objectTag:
+	case objectOfsDelta:
+		// The base's offset is relative to this entry, in a
+		// big-endian encoding where each continuation adds 1 (so
+		// that there is only one encoding of each value).
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, 0, baseID, nil, err
+		}
+		rel := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = r.ReadByte(); err != nil {
+				return 0, 0, 0, baseID, nil, err
+			}
+			rel = ((rel + 1) << 7) | int64(b&0x7f)
+		}
+		baseOffset = offset - rel
+	case objectRefDelta:
+		if _, err = io.ReadFull(r, baseID[:]); err != nil {
+			return 0, 0, 0, baseID, nil, err
+		}
+	default:
+		return 0, 0, 0, baseID, nil, fmt.Errorf("bad object type %d at offset %d in git pack %s", typ, offset, p.path)
+	}
+	return typ, size, baseOffset, baseID, r, nil
+}
+
+// inflate reads size bytes of zlib-compressed data from r.
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readObjectAt reads the object at the offset, resolving deltas.
+func (p *packfile) readObjectAt(s *objectStore, offset int64) (objectType, []byte, error) {
+	pos := packPosition{p, offset}
+	if typ, data, ok := s.cache.get(pos); ok {
+		return typ, data, nil
+	}
+
+	typ, size, baseOffset, baseID, r, err := p.entryHeader(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := inflate(r, size)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading object at offset %d in git pack %s: %s", offset, p.path, err)
+	}
+
+	if typ == objectOfsDelta || typ == objectRefDelta {
+		var baseType objectType
+		var base []byte
+		if typ == objectOfsDelta {
+			baseType, base, err = p.readObjectAt(s, baseOffset)
+		} else {
+			baseType, base, err = s.readObject(baseID)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if data, err = applyDelta(base, data); err != nil {
+			return 0, nil, fmt.Errorf("resolving delta at offset %d in git pack %s: %s", offset, p.path, err)
+		}
+		typ = baseType
+	}
+
+	s.cache.add(pos, typ, data)
+	return typ, data, nil
+}
+
+// readObjectHeaderAt returns the type and size of the object at the
+// offset. For deltified objects, only the start of the delta (which
+// records the resulting size) is read.
+func (p *packfile) readObjectHeaderAt(s *objectStore, offset int64) (objectType, int64, error) {
+	typ, size, baseOffset, baseID, r, err := p.entryHeader(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch typ {
+	case objectOfsDelta, objectRefDelta:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer zr.Close()
+		br := bufio.NewReader(zr)
+		if _, err := readDeltaSize(br); err != nil {
+			return 0, 0, err
+		}
+		if size, err = readDeltaSize(br); err != nil {
+			return 0, 0, err
+		}
+		var baseType objectType
+		if typ == objectOfsDelta {
+			baseType, _, err = p.readObjectHeaderAt(s, baseOffset)
+		} else {
+			baseType, _, err = s.readObjectHeader(baseID)
+		}
+		return baseType, size, err
+	}
+	return typ, size, nil
+}
+
+// readDeltaSize reads a size in the little-endian base-128 encoding
+// used in delta headers.
+func readDeltaSize(r io.ByteReader) (int64, error) {
+	var size int64
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		size |= int64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return size, nil
+		}
+	}
+}
+
+var errBadDelta = errors.New("bad git delta")
+
+// applyDelta applies a git delta to base. The delta is the base's
+// size and the result's size, followed by instructions to copy a
+// range of the base or to insert new data.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	baseSize, err := readDeltaSize(r)
+	if err != nil || baseSize != int64(len(base)) {
+		return nil, errBadDelta
+	}
+	size, err := readDeltaSize(r)
+	if err != nil {
+		return nil, errBadDelta
+	}
+
+	out := make([]byte, 0, size)
+	for {
+		cmd, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if cmd&0x80 != 0 {
+			// Copy: the low 4 bits say which bytes of the offset
+			// are present, and the next 3 bits the same for the
+			// size.
+			var offset, n uint32
+			for i := uint(0); i < 7; i++ {
+				if cmd&(1<<i) == 0 {
+					continue
+				}
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, errBadDelta
+				}
+				if i < 4 {
+					offset |= uint32(b) << (8 * i)
+				} else {
+					n |= uint32(b) << (8 * (i - 4))
+				}
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if int64(offset)+int64(n) > int64(len(base)) {
+				return nil, errBadDelta
+			}
+			out = append(out, base[offset:offset+n]...)
+		} else if cmd != 0 {
+			// Insert the next cmd bytes.
+			start := len(delta) - r.Len()
+			if r.Len() < int(cmd) {
+				return nil, errBadDelta
+			}
+			out = append(out, delta[start:start+int(cmd)]...)
+			r.Seek(int64(cmd), io.SeekCurrent)
+		} else {
+			return nil, errBadDelta
+		}
+	}
+	if int64(len(out)) != size {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
@@ -0,0 +1,355 @@
+package gitgo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errRefNotFound is returned when a ref doesn't exist. Callers
+// translate it to the appropriate vcs error.
+var errRefNotFound = errors.New("git ref not found")
+
+// maxSymrefDepth is the maximum number of symbolic refs that are
+// followed when resolving a ref (like git's own limit).
+const maxSymrefDepth = 5
+
+// A ref is a named reference and the object it points to.
+type ref struct {
+	name string
+	id   objectID
+}
+
+type refsByName []ref
+
+func (p refsByName) Len() int           { return len(p) }
+func (p refsByName) Less(i, j int) bool { return p[i].name < p[j].name }
+func (p refsByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// refsByID sorts refs by the ID of the object they point to, and then
+// by name.
+type refsByID []ref
+
+func (p refsByID) Len() int { return len(p) }
+func (p refsByID) Less(i, j int) bool {
+	if c := bytes.Compare(p[i].id[:], p[j].id[:]); c != 0 {
+		return c < 0
+	}
+	return p[i].name < p[j].name
+}
+func (p refsByID) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// validRefName reports whether name is a valid ref name (see `git
+// check-ref-format`), allowing one-level names like "HEAD". It also
+// ensures that name can't refer to files outside the repository.
+func validRefName(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") || strings.Contains(name, "@{") || strings.Contains(name, "..") {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) != -1 {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// isPerWorktreeRef reports whether the ref is stored in the git dir
+// of a linked worktree, not the common git dir shared by all
+// worktrees.
+func isPerWorktreeRef(name string) bool {
+	return !strings.HasPrefix(name, "refs/") || strings.HasPrefix(name, "refs/bisect/") || strings.HasPrefix(name, "refs/worktree/") || strings.HasPrefix(name, "refs/rewritten/")
+}
+
+// refDir returns the directory that contains the loose ref (and its
+// reflog).
+func (r *Repository) refDir(name string) string {
+	if isPerWorktreeRef(name) {
+		return r.gitDir
+	}
+	return r.commonDir
+}
+
+// readRef returns the object ID that the ref points to or, if it is
+// a symbolic ref, the name of the ref that it points to.
+func (r *Repository) readRef(name string) (id objectID, symref string, err error) {
+	if !validRefName(name) {
+		return id, "", errRefNotFound
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.refDir(name), filepath.FromSlash(name)))
+	if err == nil {
+		s := strings.TrimSpace(string(data))
+		if strings.HasPrefix(s, "ref:") {
+			return id, strings.TrimSpace(strings.TrimPrefix(s, "ref:")), nil
+		}
+		// Some files (like FETCH_HEAD) have more information
+		// after the object ID.
+		var ok bool
+		if len(s) > 40 {
+			s = s[:40]
+		}
+		if id, ok = parseObjectID(s); !ok {
+			return id, "", fmt.Errorf("bad git ref %s: %q", name, s)
+		}
+		return id, "", nil
+	} else if !os.IsNotExist(err) && !isNotDir(err) {
+		return id, "", err
+	}
+
+	if strings.HasPrefix(name, "refs/") {
+		packed, err := r.readPackedRefs()
+		if err != nil {
+			return id, "", err
+		}
+		if p, ok := packed[name]; ok {
+			return p.id, "", nil
+		}
+	}
+	return id, "", errRefNotFound
+}
+
+// isNotDir reports whether err is the error from opening a path that
+// has a file in place of one of its parent directories (e.g.,
+// "refs/heads/a/b" when "refs/heads/a" is a branch).
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err != nil && strings.Contains(err.Error(), "not a directory")
+}
+
+// resolveRef returns the object ID that the ref points to, following
+// symbolic refs.
+func (r *Repository) resolveRef(name string) (objectID, error) {
+	for i := 0; i < maxSymrefDepth; i++ {
+		id, symref, err := r.readRef(name)
+		if err != nil || symref == "" {
+			return id, err
+		}
+		name = symref
+	}
+	return objectID{}, fmt.Errorf("too many levels of symbolic refs resolving %s", name)
+}
+
+// symbolicRefTarget returns the name of the ref that the symbolic ref
+// points to (after following any chain of symbolic refs), or name
+// itself if it is not a symbolic ref.
+func (r *Repository) symbolicRefTarget(name string) (string, error) {
+	for i := 0; i < maxSymrefDepth; i++ {
+		_, symref, err := r.readRef(name)
+		if err != nil {
+			return "", err
+		}
+		if symref == "" {
+			return name, nil
+		}
+		name = symref
+	}
+	return "", fmt.Errorf("too many levels of symbolic refs resolving %s", name)
+}
+
+// A packedRef is a ref in the packed-refs file, and the object its
+// target peels to (if it is an annotated tag and git recorded it).
+type packedRef struct {
+	id, peeled objectID
+	hasPeeled  bool
+}
+
+// readPackedRefs returns the refs in the packed-refs file. The parsed
+// file is cached until it changes.
+func (r *Repository) readPackedRefs() (map[string]packedRef, error) {
+	path := filepath.Join(r.commonDir, "packed-refs")
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	r.packedRefsMu.Lock()
+	defer r.packedRefsMu.Unlock()
+	if r.packedRefs != nil && fi.ModTime().Equal(r.packedRefsModTime) && fi.Size() == r.packedRefsSize {
+		return r.packedRefs, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := parsePackedRefs(data)
+	if err != nil {
+		return nil, err
+	}
+	r.packedRefs, r.packedRefsModTime, r.packedRefsSize = refs, fi.ModTime(), fi.Size()
+	return refs, nil
+}
+
+// parsePackedRefs parses a packed-refs file, which has an "ID NAME"
+// line for each ref, optionally followed by a "^PEELED-ID" line for
+// annotated tags.
+func parsePackedRefs(data []byte) (map[string]packedRef, error) {
+	refs := map[string]packedRef{}
+	var last string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "^"):
+			p, ok := refs[last]
+			if !ok {
+				return nil, fmt.Errorf("unexpected peeled line in packed-refs: %q", line)
+			}
+			if p.peeled, p.hasPeeled = parseObjectID(line[1:]); !p.hasPeeled {
+				return nil, fmt.Errorf("bad peeled line in packed-refs: %q", line)
+			}
+			refs[last] = p
+		default:
+			parts := strings.SplitN(line, " ", 2)
+			id, ok := parseObjectID(parts[0])
+			if len(parts) != 2 || !ok {
+				return nil, fmt.Errorf("bad line in packed-refs: %q", line)
+			}
+			last = parts[1]
+			refs[last] = packedRef{id: id}
+		}
+	}
+	return refs, s.Err()
+}
+
+// listRefs returns the refs whose names start with prefix (such as
+// "refs/heads/"), sorted by name. Symbolic refs (such as
+// "refs/remotes/origin/HEAD") are resolved, and those that can't be
+// resolved are omitted.
+func (r *Repository) listRefs(prefix string) ([]ref, error) {
+	names := map[string]struct{}{}
+
+	packed, err := r.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	for name := range packed {
+		if strings.HasPrefix(name, prefix) {
+			names[name] = struct{}{}
+		}
+	}
+
+	root := filepath.Join(r.refDir(prefix), filepath.FromSlash(prefix))
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if name := prefix + filepath.ToSlash(rel); validRefName(name) {
+			names[name] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]ref, 0, len(names))
+	for name := range names {
+		id, err := r.resolveRef(name)
+		if err == errRefNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref{name: name, id: id})
+	}
+	sort.Sort(refsByName(refs))
+	return refs, nil
+}
+
+// A reflogEntry is a line of a reflog, recording a change to a ref.
+type reflogEntry struct {
+	old, new  objectID
+	committer signature
+	message   string
+}
+
+// readReflog returns the reflog entries of the ref, oldest first.
+func (r *Repository) readReflog(name string) ([]reflogEntry, error) {
+	if !validRefName(name) {
+		return nil, errRefNotFound
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.refDir(name), "logs", filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, errRefNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Each line is "OLD-ID NEW-ID COMMITTER\tMESSAGE".
+	var entries []reflogEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) < 82 {
+			continue
+		}
+		var e reflogEntry
+		var ok1, ok2 bool
+		e.old, ok1 = parseObjectID(line[:40])
+		e.new, ok2 = parseObjectID(line[41:81])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("bad reflog line for %s: %q", name, line)
+		}
+		rest := line[82:]
+		if i := strings.Index(rest, "\t"); i != -1 {
+			rest, e.message = rest[:i], rest[i+1:]
+		}
+		e.committer, _ = parseSignature(rest)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// reflogValue returns the value that the ref had n changes ago,
+// according to its reflog (like "NAME@{n}"). Like git, it uses the
+// old value of the nth newest entry, so that it is still right if
+// older entries have expired (leaving gaps in the reflog), and
+// "NAME@{0}" is the ref's current value if its reflog is empty.
+func (r *Repository) reflogValue(name string, n int) (objectID, error) {
+	entries, err := r.readReflog(name)
+	if err != nil {
+		return objectID{}, err
+	}
+	if n == 0 {
+		if len(entries) == 0 {
+			return r.resolveRef(name)
+		}
+		return entries[len(entries)-1].new, nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if n > 0 {
+			n--
+		}
+		// Entries that created the ref have no old value.
+		if n == 0 && entries[i].old != (objectID{}) {
+			return entries[i].old, nil
+		}
+	}
+	return objectID{}, errRefNotFound
+}
@@ -0,0 +1,256 @@
+package gitgo
+
+import "sort"
+
+// The scores of file similarity used in rename detection (like git's,
+// where maxScore is 100% similar).
+const (
+	maxScore     = 60000
+	minimumScore = maxScore / 2 // the default for `git diff -M`
+
+	// renameLimit limits the deleted and added files that are
+	// compared when looking for inexact renames (like git's
+	// diff.renameLimit): there may be no more than renameLimit of
+	// one or the other, and no more than renameLimit² pairs of them.
+	renameLimit = 1000
+
+	// candidatesPerDst is the number of the most similar deleted
+	// files that are considered as the source of each added file.
+	candidatesPerDst = 4
+)
+
+// detectRenames pairs the deleted and added files in changes that are
+// renames of each other (like `git diff -M`), replacing each pair
+// with a single rename change at the position of the added file.
+func (r *Repository) detectRenames(changes []*fileChange) ([]*fileChange, error) {
+	var srcs, dsts []*fileChange
+	for _, c := range changes {
+		switch {
+		case c.old != nil && c.new == nil && isRenameCandidate(c.old):
+			srcs = append(srcs, c)
+		case c.old == nil && c.new != nil && isRenameCandidate(c.new):
+			dsts = append(dsts, c)
+		}
+	}
+	if len(srcs) == 0 || len(dsts) == 0 {
+		return changes, nil
+	}
+
+	renamedFrom := map[*fileChange]*fileChange{} // dst -> src
+	used := map[*fileChange]bool{}
+	scores := map[*fileChange]int{}
+
+	// Find the exact renames, preferring sources with the same
+	// basename.
+	for _, dst := range dsts {
+		var best *fileChange
+		for _, src := range srcs {
+			if used[src] || src.old.id != dst.new.id {
+				continue
+			}
+			if best == nil || (baseName(src.oldPath) == baseName(dst.newPath) && baseName(best.oldPath) != baseName(dst.newPath)) {
+				best = src
+			}
+		}
+		if best != nil {
+			used[best] = true
+			renamedFrom[dst] = best
+			scores[dst] = maxScore
+		}
+	}
+
+	// Then the inexact renames of regular files, by their similarity.
+	var remainingSrcs, remainingDsts []*fileChange
+	for _, src := range srcs {
+		if !used[src] && src.old.mode&0170000 == 0100000 {
+			remainingSrcs = append(remainingSrcs, src)
+		}
+	}
+	for _, dst := range dsts {
+		if renamedFrom[dst] == nil && dst.new.mode&0170000 == 0100000 {
+			remainingDsts = append(remainingDsts, dst)
+		}
+	}
+	nsrcs, ndsts := len(remainingSrcs), len(remainingDsts)
+	if nsrcs > 0 && ndsts > 0 && (nsrcs <= renameLimit || ndsts <= renameLimit) && nsrcs*ndsts <= renameLimit*renameLimit {
+		contents := map[objectID]*spanHashes{}
+		load := func(id objectID) (*spanHashes, error) {
+			if h, ok := contents[id]; ok {
+				return h, nil
+			}
+			data, err := r.getBlob(id)
+			if err != nil {
+				return nil, err
+			}
+			h := hashSpans(data)
+			contents[id] = h
+			return h, nil
+		}
+
+		// Like git, only consider the best few sources for each
+		// destination.
+		var candidates []renameCandidate
+		for i, dst := range remainingDsts {
+			dh, err := load(dst.new.id)
+			if err != nil {
+				return nil, err
+			}
+			var best []renameCandidate
+			for j, src := range remainingSrcs {
+				sh, err := load(src.old.id)
+				if err != nil {
+					return nil, err
+				}
+				score := estimateSimilarity(sh, dh)
+				if score < minimumScore {
+					continue
+				}
+				c := renameCandidate{dst: i, src: j, score: score, sameName: baseName(src.oldPath) == baseName(dst.newPath)}
+				if len(best) < candidatesPerDst {
+					best = append(best, c)
+					continue
+				}
+				worst := 0
+				for k := range best {
+					if best[k].less(best[worst]) {
+						worst = k
+					}
+				}
+				if best[worst].less(c) {
+					best[worst] = c
+				}
+			}
+			candidates = append(candidates, best...)
+		}
+		sort.Stable(renameCandidatesByScore(candidates))
+		for _, c := range candidates {
+			dst, src := remainingDsts[c.dst], remainingSrcs[c.src]
+			if used[src] || renamedFrom[dst] != nil {
+				continue
+			}
+			used[src] = true
+			renamedFrom[dst] = src
+			scores[dst] = c.score
+		}
+	}
+
+	if len(renamedFrom) == 0 {
+		return changes, nil
+	}
+	var result []*fileChange
+	for _, c := range changes {
+		if used[c] {
+			continue // replaced by the rename
+		}
+		if src := renamedFrom[c]; src != nil {
+			c = &fileChange{oldPath: src.oldPath, newPath: c.newPath, old: src.old, new: c.new, score: scores[c]}
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// A renameCandidate is a pair of a deleted and an added file (indexes
+// into the lists of each) that are similar enough to be a rename.
+type renameCandidate struct {
+	dst, src int
+	score    int
+	sameName bool // whether the files have the same basename
+}
+
+// less reports whether c is a worse rename than d.
+func (c renameCandidate) less(d renameCandidate) bool {
+	if c.score != d.score {
+		return c.score < d.score
+	}
+	return !c.sameName && d.sameName
+}
+
+type renameCandidatesByScore []renameCandidate
+
+func (p renameCandidatesByScore) Len() int           { return len(p) }
+func (p renameCandidatesByScore) Less(i, j int) bool { return p[j].less(p[i]) }
+func (p renameCandidatesByScore) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// isRenameCandidate reports whether the file can be the source or
+// destination of a rename. Like git, empty files aren't, because
+// they're all the same.
+func isRenameCandidate(e *treeEntry) bool {
+	return e.mode&0170000 != modeGitlink && e.id != emptyBlobID
+}
+
+// emptyBlobID is the ID of the empty blob.
+var emptyBlobID, _ = parseObjectID("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+
+func baseName(p string) string {
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] == '/' {
+			return p[i+1:]
+		}
+	}
+	return p
+}
+
+// spanHashes is a summary of a file's contents for estimating
+// similarity: the number of bytes in the file's lines (or 64-byte
+// chunks of long lines) with each hash (like git's diffcore-delta).
+type spanHashes struct {
+	size   int
+	counts map[uint32]int
+}
+
+const spanHashBase = 107927
+
+func hashSpans(data []byte) *spanHashes {
+	h := &spanHashes{size: len(data), counts: map[uint32]int{}}
+	isText := !isBinary(data)
+	var accum1, accum2 uint32
+	n := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		// Ignore the CR of CRLF in text files.
+		if isText && c == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			continue
+		}
+		old1 := accum1
+		accum1 = (accum1 << 7) ^ (accum2 >> 25)
+		accum2 = (accum2 << 7) ^ (old1 >> 25)
+		accum1 += uint32(c)
+		if n++; n < 64 && c != '\n' {
+			continue
+		}
+		h.counts[(accum1+accum2*0x61)%spanHashBase] += n
+		n, accum1, accum2 = 0, 0, 0
+	}
+	if n > 0 {
+		h.counts[(accum1+accum2*0x61)%spanHashBase] += n
+	}
+	return h
+}
+
+// estimateSimilarity returns the similarity score of the files: the
+// proportion of the larger file's bytes that are also in the other.
+func estimateSimilarity(src, dst *spanHashes) int {
+	maxSize, baseSize := src.size, dst.size
+	if maxSize < baseSize {
+		maxSize, baseSize = baseSize, maxSize
+	}
+	if maxSize == 0 {
+		return 0
+	}
+	// Don't compare files whose sizes are too different to be similar
+	// enough.
+	if maxSize*(maxScore-minimumScore) < (maxSize-baseSize)*maxScore {
+		return 0
+	}
+
+	copied := 0
+	for hash, n := range src.counts {
+		if m := dst.counts[hash]; m < n {
+			copied += m
+		} else {
+			copied += n
+		}
+	}
+	return int(int64(copied) * maxScore / int64(maxSize))
+}
@@ -0,0 +1,884 @@
+// Package gitgo is a git implementation of the vcs interfaces in pure
+// Go. It reads repositories directly from disk (loose objects,
+// packfiles, refs, packed-refs and reflogs) and doesn't need the git
+// binary or libgit2, so programs using it can run where neither is
+// available.
+//
+// It registers itself as the "gitgo" opener, so that vcs.Open("git",
+// dir) keeps returning the (writable) git or gitcmd repositories in
+// programs that also import those packages. Use vcs.Open("gitgo",
+// dir) to open a repository with this implementation.
+//
+// Repositories are read-only: operations that change the repository
+// (such as cloning, updating and writing commits) aren't supported.
+package gitgo // import "sourcegraph.com/sourcegraph/go-vcs/vcs/gitgo"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+func init() {
+	vcs.RegisterOpener("gitgo", func(dir string) (vcs.Repository, error) {
+		return Open(dir)
+	})
+}
+
+type Repository struct {
+	Dir string
+
+	gitDir    string // the git dir (e.g., Dir/.git)
+	commonDir string // the git dir shared by all worktrees (usually gitDir)
+	objects   *objectStore
+
+	packedRefsMu      sync.Mutex // protects the packedRefs cache fields
+	packedRefs        map[string]packedRef
+	packedRefsModTime time.Time
+	packedRefsSize    int64
+
+	totals vcs.CommitsTotalCache
+}
+
+func (r *Repository) RepoDir() string {
+	return r.Dir
+}
+
+func (r *Repository) String() string {
+	return fmt.Sprintf("git (go) repo at %s", r.Dir)
+}
+
+// GitRootDir implements gitcmd.CrossRepo, so that other git
+// repositories can use this one in cross-repo operations.
+func (r *Repository) GitRootDir() string { return r.Dir }
+
+// Open opens the git repository in dir, which is either a working
+// tree (containing a .git directory or file) or a bare repository.
+func Open(dir string) (*Repository, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	commonDir, err := readCommonDir(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	if !isGitDir(gitDir, commonDir) {
+		return nil, &os.PathError{
+			Op:   "Open git repo",
+			Path: dir,
+			Err:  os.ErrNotExist,
+		}
+	}
+
+	objects, err := newObjectStore(filepath.Join(commonDir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{Dir: dir, gitDir: gitDir, commonDir: commonDir, objects: objects}, nil
+}
+
+// findGitDir returns the git dir of the repository in dir.
+func findGitDir(dir string) (string, error) {
+	dotGit := filepath.Join(dir, ".git")
+	fi, err := os.Stat(dotGit)
+	if err == nil && fi.IsDir() {
+		return dotGit, nil
+	}
+	if err == nil {
+		// Submodules and linked worktrees have a .git file that
+		// contains "gitdir: PATH".
+		data, err := ioutil.ReadFile(dotGit)
+		if err != nil {
+			return "", err
+		}
+		s := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(s, "gitdir:") {
+			return "", fmt.Errorf("bad .git file in %s: %q", dir, s)
+		}
+		gitDir := strings.TrimSpace(strings.TrimPrefix(s, "gitdir:"))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(dir, gitDir)
+		}
+		return gitDir, nil
+	}
+	// dir may be a bare repository (or a git dir).
+	return dir, nil
+}
+
+// readCommonDir returns the git dir that the git dir shares refs and
+// objects with (which is only different for linked worktrees).
+func readCommonDir(gitDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if os.IsNotExist(err) {
+		return gitDir, nil
+	} else if err != nil {
+		return "", err
+	}
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return commonDir, nil
+}
+
+// isGitDir reports whether gitDir looks like a git dir (like git's
+// is_git_directory).
+func isGitDir(gitDir, commonDir string) bool {
+	for _, path := range []string{
+		filepath.Join(gitDir, "HEAD"),
+		filepath.Join(commonDir, "objects"),
+		filepath.Join(commonDir, "refs"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveCommit resolves the revision specifier to a commit. It
+// returns errRevisionNotFound if there is no such commit.
+func (r *Repository) resolveCommit(spec string) (*commit, error) {
+	id, err := r.resolveRevision(spec)
+	if err != nil {
+		return nil, r.notFound(err)
+	}
+	c, err := r.peelToCommit(id)
+	if err != nil {
+		return nil, r.notFound(err)
+	}
+	return c, nil
+}
+
+func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
+	return r.ResolveRevisionContext(context.Background(), spec)
+}
+
+func (r *Repository) ResolveRevisionContext(ctx context.Context, spec string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c, err := r.resolveCommit(spec)
+	if err == errRevisionNotFound {
+		return "", vcs.ErrRevisionNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return vcs.CommitID(c.id.String()), nil
+}
+
+// resolveRefCommit returns the commit that the ref (with the full
+// name) points to, after peeling any tags.
+func (r *Repository) resolveRefCommit(ctx context.Context, name string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	id, err := r.resolveRef(name)
+	if err != nil {
+		return "", r.notFound(err)
+	}
+	c, err := r.peelToCommit(id)
+	if err != nil {
+		return "", r.notFound(err)
+	}
+	return vcs.CommitID(c.id.String()), nil
+}
+
+func (r *Repository) ResolveRef(name string) (vcs.CommitID, error) {
+	return r.ResolveRefContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveRefContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.resolveRefCommit(ctx, name)
+	if err == errRevisionNotFound {
+		return "", vcs.ErrRefNotFound
+	}
+	return commitID, err
+}
+
+func (r *Repository) ResolveBranch(name string) (vcs.CommitID, error) {
+	return r.ResolveBranchContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveBranchContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.resolveRefCommit(ctx, "refs/heads/"+name)
+	if err == errRevisionNotFound {
+		return "", vcs.ErrBranchNotFound
+	}
+	return commitID, err
+}
+
+func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
+	return r.ResolveTagContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveTagContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.resolveRefCommit(ctx, "refs/tags/"+name)
+	if err == errRevisionNotFound {
+		return "", vcs.ErrTagNotFound
+	}
+	return commitID, err
+}
+
+func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	return r.BranchesContext(context.Background(), opt)
+}
+
+func (r *Repository) BranchesContext(ctx context.Context, opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	var mergedInto, contains *commit
+	if opt.MergedInto != "" {
+		c, err := r.resolveCommit(opt.MergedInto)
+		if err != nil {
+			return nil, fmt.Errorf("resolving git branch %q: %s", opt.MergedInto, err)
+		}
+		mergedInto = c
+	}
+	if opt.ContainsCommit != "" {
+		c, err := r.resolveCommit(opt.ContainsCommit)
+		if err != nil {
+			return nil, fmt.Errorf("resolving git commit %q: %s", opt.ContainsCommit, err)
+		}
+		contains = c
+	}
+
+	refs, err := r.listRefs("refs/heads/")
+	if err != nil {
+		return nil, err
+	}
+	// List the branches in the same order as gitcmd does (which sorts
+	// the `git show-ref` output lines).
+	sort.Sort(refsByID(refs))
+
+	var branches []*vcs.Branch
+	for _, ref := range refs {
+		name := strings.TrimPrefix(ref.name, "refs/heads/")
+		if mergedInto != nil {
+			merged, err := r.isAncestor(ctx, ref.id, mergedInto.id)
+			if err != nil {
+				return nil, err
+			}
+			if !merged {
+				continue
+			}
+		}
+		if contains != nil {
+			ok, err := r.isAncestor(ctx, contains.id, ref.id)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		branch := &vcs.Branch{Name: name, Head: vcs.CommitID(ref.id.String())}
+		if opt.IncludeCommit {
+			c, err := r.getCommit(ref.id)
+			if err != nil {
+				return nil, err
+			}
+			branch.Commit = makeCommit(c)
+		}
+		if opt.BehindAheadBranch != "" {
+			branch.Counts, err = r.branchesBehindAhead(ctx, ref.id, opt.BehindAheadBranch)
+			if err != nil {
+				return nil, err
+			}
+		}
+		branches = append(branches, branch)
+	}
+	return branches, nil
+}
+
+// branchesBehindAhead returns the behind/ahead commit counts
+// information for the branch (whose head is given), against the base
+// branch.
+func (r *Repository) branchesBehindAhead(ctx context.Context, head objectID, base string) (*vcs.BehindAhead, error) {
+	baseID, err := r.resolveRef("refs/heads/" + base)
+	if err != nil {
+		if err == errRefNotFound {
+			return nil, fmt.Errorf("git branch %q not found", base)
+		}
+		return nil, err
+	}
+
+	count := func(heads, hide objectID) (uint32, error) {
+		var n uint32
+		err := r.walk(ctx, walkOptions{heads: []objectID{heads}, hide: []objectID{hide}}, func(*commit) error {
+			n++
+			return nil
+		})
+		return n, err
+	}
+	behind, err := count(baseID, head)
+	if err != nil {
+		return nil, err
+	}
+	ahead, err := count(head, baseID)
+	if err != nil {
+		return nil, err
+	}
+	return &vcs.BehindAhead{Behind: behind, Ahead: ahead}, nil
+}
+
+func (r *Repository) Tags() ([]*vcs.Tag, error) {
+	return r.TagsContext(context.Background())
+}
+
+func (r *Repository) TagsContext(ctx context.Context) ([]*vcs.Tag, error) {
+	refs, err := r.listRefs("refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]*vcs.Tag, 0, len(refs))
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tag, err := r.makeTag(ref)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	sort.Sort(vcs.Tags(tags))
+	return tags, nil
+}
+
+// makeTag returns the tag that the tag ref points to.
+func (r *Repository) makeTag(ref ref) (*vcs.Tag, error) {
+	tag := &vcs.Tag{Name: strings.TrimPrefix(ref.name, "refs/tags/")}
+
+	typ, data, err := r.objects.readObject(ref.id)
+	if err != nil {
+		return nil, err
+	}
+	targetType := typ
+	if typ == objectTag {
+		t, err := parseTag(ref.id, data)
+		if err != nil {
+			return nil, err
+		}
+		tag.Annotated = true
+		tag.ObjectID = ref.id.String()
+		if t.tagger != nil {
+			tag.Tagger = &vcs.Signature{Name: t.tagger.name, Email: t.tagger.email, Date: pbtypes.NewTimestamp(t.tagger.when)}
+		}
+		tag.Message, tag.Signature = internal.SplitTagSignature(t.message)
+		tag.Message = strings.TrimSuffix(tag.Message, "\n")
+		targetType = t.objectType
+	}
+
+	switch targetType {
+	case objectCommit:
+		tag.TargetType = vcs.ObjectType_COMMIT
+	case objectTree:
+		tag.TargetType = vcs.ObjectType_TREE
+	case objectBlob:
+		tag.TargetType = vcs.ObjectType_BLOB
+	case objectTag:
+		tag.TargetType = vcs.ObjectType_TAG
+	default:
+		return nil, fmt.Errorf("unexpected git object type %s for tag %q", targetType, tag.Name)
+	}
+
+	// Peel the tag to find the commit it points to (if any).
+	if id, err := r.peel(ref.id, "commit"); err == nil {
+		tag.CommitID = vcs.CommitID(id.String())
+	}
+	return tag, nil
+}
+
+// parseCommitID parses the full commit ID. It returns
+// vcs.ErrCommitNotFound if it isn't a valid commit ID or there is no
+// such commit.
+func (r *Repository) parseCommitID(id vcs.CommitID) (*commit, error) {
+	oid, ok := parseObjectID(string(id))
+	if !ok {
+		return nil, vcs.ErrCommitNotFound
+	}
+	c, err := r.getCommit(oid)
+	if err == errObjectNotFound {
+		return nil, vcs.ErrCommitNotFound
+	}
+	return c, err
+}
+
+func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
+	return r.GetCommitContext(context.Background(), id)
+}
+
+func (r *Repository) GetCommitContext(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := r.parseCommitID(id)
+	if err != nil {
+		return nil, err
+	}
+	return makeCommit(c), nil
+}
+
+func makeCommit(c *commit) *vcs.Commit {
+	var parents []vcs.CommitID
+	if len(c.parents) > 0 {
+		parents = make([]vcs.CommitID, len(c.parents))
+		for i, p := range c.parents {
+			parents[i] = vcs.CommitID(p.String())
+		}
+	}
+
+	au, cm := c.author, c.committer
+	return &vcs.Commit{
+		ID:        vcs.CommitID(c.id.String()),
+		Author:    vcs.Signature{Name: au.name, Email: au.email, Date: pbtypes.NewTimestamp(au.when)},
+		Committer: &vcs.Signature{Name: cm.name, Email: cm.email, Date: pbtypes.NewTimestamp(cm.when)},
+		Message:   strings.TrimSuffix(c.message, "\n"),
+		Parents:   parents,
+	}
+}
+
+// resolveCommitsOptionsRev resolves CommitsOptions.Head or Base, which
+// may be a commit ID or another revision specifier.
+func (r *Repository) resolveCommitsOptionsRev(rev vcs.CommitID) (objectID, error) {
+	c, err := r.resolveCommit(string(rev))
+	if err == errRevisionNotFound {
+		return objectID{}, vcs.ErrCommitNotFound
+	} else if err != nil {
+		return objectID{}, err
+	}
+	return c.id, nil
+}
+
+func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	return r.CommitsContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Cursor != "" {
+		page, err := r.CommitsPageContext(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Commits, page.Total, nil
+	}
+	return r.commits(ctx, opt)
+}
+
+// resolveWalkRevs resolves the heads and the bases of opt to start
+// and hide a walk of the commits.
+func (r *Repository) resolveWalkRevs(heads []vcs.CommitID, opt vcs.CommitsOptions) (walkOptions, error) {
+	wopt := walkOptions{firstParent: opt.FirstParent, since: opt.Since}
+	for _, rev := range heads {
+		head, err := r.resolveCommitsOptionsRev(rev)
+		if err != nil {
+			return walkOptions{}, err
+		}
+		wopt.heads = append(wopt.heads, head)
+	}
+	for _, rev := range append([]vcs.CommitID{opt.Base}, opt.Bases...) {
+		if rev == "" {
+			continue
+		}
+		base, err := r.resolveCommitsOptionsRev(rev)
+		if err != nil {
+			return walkOptions{}, err
+		}
+		wopt.hide = append(wopt.hide, base)
+	}
+	return wopt, nil
+}
+
+// commits returns the commits selected by opt, ignoring opt.Cursor.
+func (r *Repository) commits(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Path != "" {
+		history, total, err := r.fileHistory(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		commits := make([]*vcs.Commit, len(history))
+		for i, fc := range history {
+			commits[i] = fc.Commit
+		}
+		return commits, total, nil
+	}
+
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	wopt, err := r.resolveWalkRevs(append([]vcs.CommitID{opt.Head}, opt.Heads...), opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	wopt.until, wopt.order = opt.Until, opt.Order
+
+	var commits []*vcs.Commit
+	total := uint(0)
+	err = r.walk(ctx, wopt, func(c *commit) error {
+		vc := makeCommit(c)
+		if !filter.Match(vc) {
+			return nil
+		}
+		if total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N) {
+			commits = append(commits, vc)
+		}
+		total++
+		// If we want total, keep going until the end. Otherwise
+		// stop once N has been satisfied.
+		if opt.NoTotal && opt.N != 0 && uint(len(commits)) >= opt.N {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if opt.NoTotal {
+		total = 0
+	}
+	return commits, total, nil
+}
+
+func (r *Repository) FileHistory(opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	return r.FileHistoryContext(context.Background(), opt)
+}
+
+func (r *Repository) FileHistoryContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	if opt.Path == "" {
+		return nil, 0, errors.New("file history requires a path")
+	}
+	if opt.Cursor != "" {
+		return nil, 0, errors.New("file history doesn't support cursors")
+	}
+	return r.fileHistory(ctx, opt)
+}
+
+// fileHistory returns the history of the file or directory at
+// opt.Path, following renames like `git log --follow`, and the total
+// number of commits in it (unless opt.NoTotal is true).
+func (r *Repository) fileHistory(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	wopt, err := r.resolveWalkRevs(append([]vcs.CommitID{opt.Head}, opt.Heads...), opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	wopt.until, wopt.order = opt.Until, opt.Order
+
+	var history []*vcs.FileCommit
+	total := uint(0)
+	path := strings.Trim(opt.Path, "/") // the followed path
+	err = r.walk(ctx, wopt, func(c *commit) error {
+		vc := makeCommit(c)
+		if !filter.Match(vc) {
+			return nil
+		}
+		changed, oldPath, err := r.followPath(ctx, c, path, opt.FirstParent)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+		if total >= opt.Skip && (opt.N == 0 || uint(len(history)) < opt.N) {
+			history = append(history, &vcs.FileCommit{Commit: vc, Path: path})
+		}
+		total++
+		path = oldPath
+		if opt.NoTotal && opt.N != 0 && uint(len(history)) >= opt.N {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if opt.NoTotal {
+		total = 0
+	}
+	return history, total, nil
+}
+
+// followPath reports whether c changed the file or directory at path,
+// and returns the path that the older commits have it at: the path
+// of the file that c copied or renamed to path, if any, or else path. Like
+// `git log --follow`, merge commits are only compared with their
+// first parent if firstParent is true, and otherwise they aren't
+// considered to change anything.
+func (r *Repository) followPath(ctx context.Context, c *commit, path string, firstParent bool) (changed bool, oldPath string, err error) {
+	if len(c.parents) > 1 && !firstParent {
+		return false, path, nil
+	}
+	var parentTree *objectID
+	var old *treeEntry
+	if len(c.parents) > 0 {
+		pc, err := r.getCommit(c.parents[0])
+		if err != nil {
+			return false, "", err
+		}
+		parentTree = &pc.tree
+		if old, err = r.lookupPath(pc.tree, path); err != nil {
+			return false, "", err
+		}
+	}
+	new, err := r.lookupPath(c.tree, path)
+	if err != nil {
+		return false, "", err
+	}
+	if sameEntry(old, new) {
+		return false, path, nil
+	}
+	if old != nil || new == nil || new.mode&0170000 == modeTree || parentTree == nil {
+		return true, path, nil
+	}
+
+	// The file was added, so find out whether it was copied or
+	// renamed from any of the parent's files (like git, which finds
+	// copies harder here).
+	var changes []*fileChange
+	err = r.walkTree(*parentTree, "", func(p string, e *treeEntry) error {
+		if e.mode&0170000 != modeTree {
+			changes = append(changes, &fileChange{oldPath: p, newPath: p, old: e})
+		}
+		return nil
+	})
+	if err != nil {
+		return false, "", err
+	}
+	changes = append(changes, &fileChange{oldPath: path, newPath: path, new: new})
+	if changes, err = r.detectRenames(changes); err != nil {
+		return false, "", err
+	}
+	for _, fc := range changes {
+		if fc.newPath == path && fc.score > 0 {
+			return true, fc.oldPath, nil
+		}
+	}
+	return true, path, nil
+}
+
+func (r *Repository) CommitsPage(opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	return r.CommitsPageContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsPageContext(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	var cursor *vcs.CommitsCursor
+	if opt.Cursor != "" {
+		var err error
+		if cursor, err = vcs.ParseCommitsCursor(opt.Cursor); err != nil {
+			return nil, err
+		}
+		if cursor.After != "" {
+			return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+		}
+	}
+
+	// Like gitcmd, only resume walks in the default order, without a
+	// path (whose history is followed through renames), and without
+	// both since and bases (where git hides the history before since).
+	hasBases := opt.Base != "" || len(opt.Bases) > 0
+	if opt.Order != "" || opt.Path != "" || (!opt.Since.IsZero() && hasBases) {
+		var offset uint
+		if cursor != nil {
+			if len(cursor.Frontier) > 0 {
+				return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+			}
+			offset = cursor.Offset
+		}
+		return r.commitsPageAtOffset(ctx, opt, offset)
+	}
+	if cursor != nil && len(cursor.Frontier) == 0 {
+		// The walk couldn't be resumed from a frontier.
+		return r.commitsPageAtOffset(ctx, opt, cursor.Offset)
+	}
+
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, err
+	}
+	frontier := vcs.NewCommitFrontier(append([]vcs.CommitID{opt.Head}, opt.Heads...), cursor, opt.FirstParent)
+	wopt, err := r.resolveWalkRevs(frontier.Heads(), opt)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &vcs.CommitsPage{}
+	var offset uint // the number of matching commits before the next page
+	if cursor != nil {
+		offset = cursor.Offset
+	}
+	skip := opt.Skip
+	skewed := false
+	err = r.walk(ctx, wopt, func(c *commit) error {
+		vc := makeCommit(c)
+		match := filter.Match(vc)
+		if match && opt.N != 0 && uint(len(page.Commits)) == opt.N {
+			// There are more commits after this page, which start
+			// with this one.
+			page.NextCursor = frontier.Cursor(offset).String()
+			return errStopWalk
+		}
+		walked, ok := frontier.Walk(vc)
+		if !ok && cursor != nil {
+			// The commit dates are skewed, so this walk may return
+			// commits that were on earlier pages.
+			skewed = true
+			return errStopWalk
+		}
+		if !match || walked {
+			return nil
+		}
+		offset++
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		page.Commits = append(page.Commits, vc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skewed {
+		return r.commitsPageAtOffset(ctx, opt, cursor.Offset)
+	}
+
+	if !opt.NoTotal {
+		if page.Total, err = r.commitsTotal(ctx, opt); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// commitsPageAtOffset returns the page of commits that starts after
+// the first offset commits (and opt.Skip more), by walking all of the
+// earlier commits again.
+func (r *Repository) commitsPageAtOffset(ctx context.Context, opt vcs.CommitsOptions, offset uint) (*vcs.CommitsPage, error) {
+	pageOpt := opt
+	pageOpt.Cursor, pageOpt.Skip = "", offset+opt.Skip
+	commits, total, err := r.commits(ctx, pageOpt)
+	if err != nil {
+		return nil, err
+	}
+	page := &vcs.CommitsPage{Commits: commits, Total: total}
+	if opt.N != 0 && uint(len(commits)) == opt.N {
+		page.NextCursor = (&vcs.CommitsCursor{Offset: pageOpt.Skip + opt.N}).String()
+	}
+	return page, nil
+}
+
+// commitsTotal returns the total number of commits selected by opt,
+// which is cached.
+func (r *Repository) commitsTotal(ctx context.Context, opt vcs.CommitsOptions) (uint, error) {
+	if total, ok := r.totals.Get(opt); ok {
+		return total, nil
+	}
+	countOpt := opt
+	countOpt.N, countOpt.Skip, countOpt.Cursor = 1, 0, ""
+	_, total, err := r.commits(ctx, countOpt)
+	if err != nil {
+		return 0, err
+	}
+	r.totals.Add(opt, total)
+	return total, nil
+}
+
+func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	return r.CommittersContext(context.Background(), opt)
+}
+
+func (r *Repository) CommittersContext(ctx context.Context, opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	if opt.Rev == "" {
+		opt.Rev = "HEAD"
+	}
+	head, err := r.resolveCommit(opt.Rev)
+	if err == errRevisionNotFound {
+		return nil, vcs.ErrRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Count the commits by each author, like `git shortlog -sne`.
+	commits, _, err := r.commits(ctx, vcs.CommitsOptions{
+		Head:    vcs.CommitID(head.id.String()),
+		Since:   opt.Since,
+		Until:   opt.Until,
+		Path:    opt.Path,
+		NoTotal: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vcs.CountCommitters(commits, opt.N), nil
+}
+
+func (r *Repository) MergeBase(a, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.MergeBaseContext(context.Background(), a, b)
+}
+
+func (r *Repository) MergeBaseContext(ctx context.Context, a, b vcs.CommitID) (vcs.CommitID, error) {
+	ca, err := r.resolveCommitsOptionsRev(a)
+	if err != nil {
+		return "", err
+	}
+	cb, err := r.resolveCommitsOptionsRev(b)
+	if err != nil {
+		return "", err
+	}
+	bases, err := r.mergeBases(ctx, ca, cb)
+	if err != nil {
+		return "", err
+	}
+	if len(bases) == 0 {
+		return "", fmt.Errorf("git commits %s and %s have no merge base", a, b)
+	}
+	return vcs.CommitID(bases[0].String()), nil
+}
+
+func (r *Repository) ListFiles(at vcs.CommitID) ([]string, error) {
+	return r.ListFilesContext(context.Background(), at)
+}
+
+func (r *Repository) ListFilesContext(ctx context.Context, at vcs.CommitID) ([]string, error) {
+	if at == "" {
+		at = "HEAD"
+	}
+	c, err := r.resolveCommit(string(at))
+	if err == errRevisionNotFound {
+		return nil, vcs.ErrRevisionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	err = r.walkTree(c.tree, "", func(path string, e *treeEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if e.mode&0170000 != modeTree {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,227 @@
+package gitgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/gitcmd"
+)
+
+// fixtureCommands create a repository with merges, renames, symlinks,
+// annotated (and nested annotated) tags, and reflogs. The large file
+// "big" is changed slightly in each commit, so that git stores it as
+// a delta chain when it packs the repository.
+var fixtureCommands = []string{
+	"git init",
+	"seq 1 3000 > big",
+	"echo a > a",
+	"ln -s a link",
+	"mkdir -p dir/sub && echo f > dir/sub/f && echo x > dir/x && chmod +x dir/x",
+	"git add -A && " + fixtureCommit + " -m c1",
+	"sed -i 's/^1000$/x/' big && echo a2 > a",
+	"git add -A && " + fixtureCommit + " -m c2",
+	fixtureEnv + "git tag -a -m 'annotated tag' v1",
+	fixtureEnv + "git tag -a -m 'tag of a tag' v1-nested v1",
+	"git tag light",
+	"git checkout -q -b b2",
+	"seq 1 10 >> big && git mv a dir/a",
+	"git add -A && " + fixtureCommit + " -m c3",
+	"sed -i 's/^2000$/y/' big",
+	"git add -A && " + fixtureCommit + " -m c4",
+	"git checkout -q master",
+	"echo f2 >> dir/sub/f && sed -i 's/^10$/z/' big",
+	"git add -A && " + fixtureCommit + " -m c5",
+	fixtureMerge + " --no-ff -m merge b2",
+}
+
+const (
+	fixtureEnv    = "GIT_AUTHOR_NAME=a GIT_AUTHOR_EMAIL=a@a.com GIT_AUTHOR_DATE=2006-01-02T15:04:05Z GIT_COMMITTER_NAME=c GIT_COMMITTER_EMAIL=c@c.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z "
+	fixtureCommit = fixtureEnv + "git commit -q"
+	fixtureMerge  = fixtureEnv + "git merge -q"
+)
+
+// TestRepository_storage checks that repositories stored in various
+// ways (loose objects, packs with OFS_DELTA and REF_DELTA objects,
+// version 1 and 2 pack indexes, packed-refs with peeled tags, and a
+// mix of packed and loose objects and refs) are read the same as by
+// gitcmd.
+func TestRepository_storage(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Parallel()
+
+	tests := map[string][]string{
+		"loose":         nil,
+		"gc aggressive": {"git gc -q --aggressive --prune=now"},
+		"ref deltas":    {"git -c repack.usedeltabaseoffset=false repack -q -adf", "git pack-refs --all"},
+		"pack index v1": {"git -c pack.indexVersion=1 repack -q -adf", "git pack-refs --all"},
+		"packed and loose": {
+			"git gc -q --prune=now",
+			"echo a3 > dir/a && sed -i 's/^20$/w/' big",
+			"git add -A && " + fixtureCommit + " -m c6",
+			fixtureEnv + "git tag -a -m 'loose tag' v2",
+		},
+	}
+	for label, cmds := range tests {
+		dir := makeFixture(t, append(append([]string(nil), fixtureCommands...), cmds...))
+		defer os.RemoveAll(dir)
+
+		gr, err := Open(dir)
+		if err != nil {
+			t.Fatalf("%s: Open: %s", label, err)
+		}
+		cr, err := gitcmd.Open(dir)
+		if err != nil {
+			t.Fatalf("%s: gitcmd.Open: %s", label, err)
+		}
+		compareRepositories(t, label, gr, cr)
+	}
+}
+
+func makeFixture(t *testing.T, cmds []string) string {
+	dir, err := ioutil.TempDir("", "gitgo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range cmds {
+		c := exec.Command("bash", "-c", cmd)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("Command %q failed. Output was:\n\n%s", cmd, out)
+		}
+	}
+	return dir
+}
+
+// compareRepositories checks that gr returns the same refs, commits,
+// trees and blobs as cr.
+func compareRepositories(t *testing.T, label string, gr *Repository, cr *gitcmd.Repository) {
+	branches, err := cr.Branches(vcs.BranchesOptions{})
+	if err != nil {
+		t.Fatalf("%s: gitcmd Branches: %s", label, err)
+	}
+	if got, err := gr.Branches(vcs.BranchesOptions{}); err != nil {
+		t.Errorf("%s: Branches: %s", label, err)
+	} else if !reflect.DeepEqual(got, branches) {
+		t.Errorf("%s: got branches %v, want %v", label, asJSON(got), asJSON(branches))
+	}
+	tags, err := cr.Tags()
+	if err != nil {
+		t.Fatalf("%s: gitcmd Tags: %s", label, err)
+	}
+	if got, err := gr.Tags(); err != nil {
+		t.Errorf("%s: Tags: %s", label, err)
+	} else if !reflect.DeepEqual(got, tags) {
+		t.Errorf("%s: got tags %v, want %v", label, asJSON(got), asJSON(tags))
+	}
+
+	// Resolve the refs, reflog entries and other revisions.
+	revs := []string{"HEAD", "HEAD^2", "HEAD~2", "master@{0}", "master@{1}", "master@{2}", "master@{9}", "b2@{1}", "HEAD@{1}", "HEAD@{3}", "@{1}"}
+	for _, b := range branches {
+		revs = append(revs, b.Name)
+	}
+	for _, tag := range tags {
+		revs = append(revs, tag.Name, tag.Name+"^{commit}")
+	}
+	for _, rev := range revs {
+		want, wantErr := cr.ResolveRevision(rev)
+		got, err := gr.ResolveRevision(rev)
+		if (err != nil) != (wantErr != nil) || got != want {
+			t.Errorf("%s: ResolveRevision(%q): got (%q, %v), want (%q, %v)", label, rev, got, err, want, wantErr)
+		}
+	}
+
+	heads := make([]vcs.CommitID, len(branches))
+	for i, b := range branches {
+		heads[i] = b.Head
+	}
+	commits, _, err := cr.Commits(vcs.CommitsOptions{Head: heads[0], Heads: heads[1:]})
+	if err != nil {
+		t.Fatalf("%s: gitcmd Commits: %s", label, err)
+	}
+	if got, _, err := gr.Commits(vcs.CommitsOptions{Head: heads[0], Heads: heads[1:]}); err != nil {
+		t.Errorf("%s: Commits: %s", label, err)
+	} else if !reflect.DeepEqual(got, commits) {
+		t.Errorf("%s: got commits %v, want %v", label, asJSON(got), asJSON(commits))
+	}
+
+	for _, c := range commits {
+		got, err := gr.GetCommit(c.ID)
+		if err != nil {
+			t.Errorf("%s: GetCommit(%s): %s", label, c.ID, err)
+		} else if !reflect.DeepEqual(got, c) {
+			t.Errorf("%s: GetCommit(%s): got %v, want %v", label, c.ID, asJSON(got), asJSON(c))
+		}
+
+		gfs, err := gr.FileSystem(c.ID)
+		if err != nil {
+			t.Errorf("%s: FileSystem(%s): %s", label, c.ID, err)
+			continue
+		}
+		cfs, err := cr.FileSystem(c.ID)
+		if err != nil {
+			t.Fatalf("%s: gitcmd FileSystem(%s): %s", label, c.ID, err)
+		}
+		compareTrees(t, label+" "+string(c.ID), gfs, cfs, ".")
+	}
+}
+
+// compareTrees checks that the directory dir and its contents are
+// the same in gfs and cfs.
+func compareTrees(t *testing.T, label string, gfs, cfs vfs.FileSystem, dir string) {
+	want, err := cfs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%s: gitcmd ReadDir(%q): %s", label, dir, err)
+	}
+	got, err := gfs.ReadDir(dir)
+	if err != nil {
+		t.Errorf("%s: ReadDir(%q): %s", label, dir, err)
+		return
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: ReadDir(%q): got %d entries, want %d", label, dir, len(got), len(want))
+		return
+	}
+	for i, w := range want {
+		g := got[i]
+		name := path.Join(dir, w.Name())
+		// gitcmd sets other permission bits, so only compare the
+		// file type and whether it is executable.
+		const modeMask = os.ModeType | 0111
+		if g.Name() != w.Name() || g.Mode()&modeMask != w.Mode()&modeMask || (!w.IsDir() && g.Size() != w.Size()) {
+			t.Errorf("%s: %s: got (%q, %v, %d), want (%q, %v, %d)", label, name, g.Name(), g.Mode(), g.Size(), w.Name(), w.Mode(), w.Size())
+			continue
+		}
+		switch {
+		case w.IsDir():
+			compareTrees(t, label, gfs, cfs, name)
+		case w.Mode().IsRegular():
+			wantData, err := vfs.ReadFile(cfs, name)
+			if err != nil {
+				t.Fatalf("%s: gitcmd ReadFile(%q): %s", label, name, err)
+			}
+			if data, err := vfs.ReadFile(gfs, name); err != nil {
+				t.Errorf("%s: ReadFile(%q): %s", label, name, err)
+			} else if string(data) != string(wantData) {
+				t.Errorf("%s: ReadFile(%q): got %q, want %q", label, name, data, wantData)
+			}
+		}
+	}
+}
+
+func asJSON(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
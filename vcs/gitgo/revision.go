@@ -0,0 +1,257 @@
+package gitgo
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errRevisionNotFound is returned when a revision specifier can't be
+// resolved. Callers translate it to the appropriate vcs error.
+var errRevisionNotFound = errors.New("git revision not found")
+
+// minAbbrevLen is the minimum length of an abbreviated object ID.
+const minAbbrevLen = 4
+
+// refDWIMRules are the formats of the full ref names that a short
+// name may refer to, in order of precedence (see `git help
+// revisions`).
+var refDWIMRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// resolveRevision returns the object that the revision specifier
+// refers to. It supports object IDs (full or abbreviated), ref names,
+// "@", reflog entries ("REF@{n}" and "@{n}"), and the "~n", "^n" and
+// "^{TYPE}" suffixes.
+func (r *Repository) resolveRevision(spec string) (objectID, error) {
+	base, suffixes := spec, ""
+	if i := strings.IndexAny(spec, "~^"); i != -1 {
+		base, suffixes = spec[:i], spec[i:]
+	}
+
+	id, err := r.resolveRevisionBase(base)
+	if err != nil {
+		return id, err
+	}
+
+	for suffixes != "" {
+		op := suffixes[0]
+		suffixes = suffixes[1:]
+
+		if op == '^' && strings.HasPrefix(suffixes, "{") {
+			end := strings.Index(suffixes, "}")
+			if end == -1 {
+				return id, errRevisionNotFound
+			}
+			typ := suffixes[1:end]
+			suffixes = suffixes[end+1:]
+			if id, err = r.peel(id, typ); err != nil {
+				return id, err
+			}
+			continue
+		}
+
+		// Parse the optional number after "~" or "^" (which
+		// defaults to 1).
+		n := 1
+		j := 0
+		for j < len(suffixes) && '0' <= suffixes[j] && suffixes[j] <= '9' {
+			j++
+		}
+		if j > 0 {
+			if n, err = strconv.Atoi(suffixes[:j]); err != nil {
+				return id, errRevisionNotFound
+			}
+			suffixes = suffixes[j:]
+		}
+
+		c, err := r.peelToCommit(id)
+		if err != nil {
+			return id, err
+		}
+		switch op {
+		case '^':
+			// "^0" is the commit itself, and "^n" its n'th parent.
+			if n == 0 {
+				id = c.id
+				break
+			}
+			if n > len(c.parents) {
+				return id, errRevisionNotFound
+			}
+			id = c.parents[n-1]
+		case '~':
+			// "~n" is the n'th first-parent ancestor.
+			for ; n > 0; n-- {
+				if len(c.parents) == 0 {
+					return id, errRevisionNotFound
+				}
+				if c, err = r.getCommit(c.parents[0]); err != nil {
+					return id, err
+				}
+			}
+			id = c.id
+		}
+	}
+	return id, nil
+}
+
+// resolveRevisionBase resolves a revision specifier without any "~"
+// or "^" suffixes.
+func (r *Repository) resolveRevisionBase(spec string) (objectID, error) {
+	if spec == "" || spec == "@" {
+		spec = "HEAD"
+	}
+
+	if i := strings.Index(spec, "@{"); i != -1 && strings.HasSuffix(spec, "}") {
+		name, sel := spec[:i], spec[i+2:len(spec)-1]
+		n, err := strconv.Atoi(sel)
+		if err != nil || n < 0 {
+			// Other selectors (dates, "@{upstream}", "@{-1}")
+			// aren't supported.
+			return objectID{}, errRevisionNotFound
+		}
+		if name == "" {
+			// "@{n}" refers to the reflog of the current branch.
+			if name, err = r.symbolicRefTarget("HEAD"); err != nil {
+				return objectID{}, r.notFound(err)
+			}
+		} else if name, err = r.dwimRef(name); err != nil {
+			return objectID{}, r.notFound(err)
+		}
+		id, err := r.reflogValue(name, n)
+		return id, r.notFound(err)
+	}
+
+	if id, ok := parseObjectID(spec); ok {
+		if exists, err := r.objects.hasObject(id); err != nil {
+			return id, err
+		} else if !exists {
+			return id, errRevisionNotFound
+		}
+		return id, nil
+	}
+
+	if name, err := r.dwimRef(spec); err == nil {
+		return r.resolveRef(name)
+	} else if err != errRefNotFound {
+		return objectID{}, err
+	}
+
+	if len(spec) >= minAbbrevLen && len(spec) < 40 && isHex(spec) {
+		ids, err := r.objects.findObjectsByPrefix(strings.ToLower(spec))
+		if err != nil {
+			return objectID{}, err
+		}
+		switch len(ids) {
+		case 0:
+		case 1:
+			return ids[0], nil
+		default:
+			return objectID{}, errAmbiguousObjectID
+		}
+	}
+	return objectID{}, errRevisionNotFound
+}
+
+// dwimRef returns the full name of the ref that the (possibly short)
+// name refers to.
+func (r *Repository) dwimRef(name string) (string, error) {
+	for _, rule := range refDWIMRules {
+		full := fmt.Sprintf(rule, name)
+		if rule == "%s" && !strings.HasPrefix(name, "refs/") && !isPseudoRefName(name) {
+			// Only full ref names and names like HEAD and
+			// FETCH_HEAD are looked up directly in the git dir.
+			continue
+		}
+		if _, err := r.resolveRef(full); err == nil {
+			return full, nil
+		} else if err != errRefNotFound {
+			return "", err
+		}
+	}
+	return "", errRefNotFound
+}
+
+// isPseudoRefName reports whether name looks like HEAD, FETCH_HEAD,
+// ORIG_HEAD, etc.
+func isPseudoRefName(name string) bool {
+	for _, c := range name {
+		if !('A' <= c && c <= 'Z' || c == '_') {
+			return false
+		}
+	}
+	return strings.HasSuffix(name, "HEAD")
+}
+
+// notFound translates errRefNotFound to errRevisionNotFound.
+func (r *Repository) notFound(err error) error {
+	if err == errRefNotFound || err == errObjectNotFound {
+		return errRevisionNotFound
+	}
+	return err
+}
+
+// peel follows tags until it reaches an object of the given type
+// ("commit", "tree", "blob" or "tag"). An empty type follows tags
+// until it reaches a non-tag object, and "object" accepts any object.
+func (r *Repository) peel(id objectID, typ string) (objectID, error) {
+	for {
+		objType, data, err := r.objects.readObject(id)
+		if err != nil {
+			return id, r.notFound(err)
+		}
+		if typ == "object" || objType.String() == typ {
+			return id, nil
+		}
+		switch objType {
+		case objectTag:
+			t, err := parseTag(id, data)
+			if err != nil {
+				return id, err
+			}
+			id = t.object
+		case objectCommit:
+			if typ == "" {
+				return id, nil
+			}
+			if typ != "tree" {
+				return id, r.peelError(id, typ)
+			}
+			c, err := parseCommit(id, data)
+			if err != nil {
+				return id, err
+			}
+			return c.tree, nil
+		default:
+			if typ == "" {
+				return id, nil
+			}
+			return id, r.peelError(id, typ)
+		}
+	}
+}
+
+func (r *Repository) peelError(id objectID, typ string) error {
+	switch typ {
+	case "", "commit", "tree", "blob", "tag":
+		return errRevisionNotFound
+	}
+	return fmt.Errorf("unsupported git object type %q in revision (peeling %s)", typ, id)
+}
+
+// peelToCommit follows tags until it reaches a commit.
+func (r *Repository) peelToCommit(id objectID) (*commit, error) {
+	id, err := r.peel(id, "commit")
+	if err != nil {
+		return nil, err
+	}
+	return r.getCommit(id)
+}
@@ -0,0 +1,110 @@
+package gitgo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// getCommit returns the commit object with the given ID.
+func (r *Repository) getCommit(id objectID) (*commit, error) {
+	typ, data, err := r.objects.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objectCommit {
+		return nil, fmt.Errorf("git object %s is a %s, not a commit", id, typ)
+	}
+	return parseCommit(id, data)
+}
+
+// getTree returns the entries of the tree object with the given ID.
+func (r *Repository) getTree(id objectID) ([]treeEntry, error) {
+	typ, data, err := r.objects.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objectTree {
+		return nil, fmt.Errorf("git object %s is a %s, not a tree", id, typ)
+	}
+	return parseTree(id, data)
+}
+
+// getBlob returns the contents of the blob object with the given ID.
+func (r *Repository) getBlob(id objectID) ([]byte, error) {
+	typ, data, err := r.objects.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objectBlob {
+		return nil, fmt.Errorf("git object %s is a %s, not a blob", id, typ)
+	}
+	return data, nil
+}
+
+// lookupPath returns the entry at the slash-separated path in the
+// tree, or nil if there is no such entry. The root of the tree is the
+// path "" (or ".").
+func (r *Repository) lookupPath(tree objectID, path string) (*treeEntry, error) {
+	path = strings.Trim(path, "/")
+	if path == "" || path == "." {
+		return &treeEntry{mode: modeTree, id: tree}, nil
+	}
+
+	components := strings.Split(path, "/")
+	for i, name := range components {
+		entries, err := r.getTree(tree)
+		if err != nil {
+			return nil, err
+		}
+		var found *treeEntry
+		for j := range entries {
+			if entries[j].name == name {
+				found = &entries[j]
+				break
+			}
+		}
+		if found == nil {
+			return nil, nil
+		}
+		if i == len(components)-1 {
+			return found, nil
+		}
+		if found.mode&0170000 != modeTree {
+			return nil, nil
+		}
+		tree = found.id
+	}
+	panic("unreachable")
+}
+
+// sameEntry reports whether a and b (either of which may be nil) are
+// the same object with the same mode.
+func sameEntry(a, b *treeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.id == b.id && a.mode == b.mode
+}
+
+// walkTree calls fn on each entry in the tree and (recursively) in
+// its subtrees, in tree order. The entry's path is relative to the
+// root of the tree.
+func (r *Repository) walkTree(tree objectID, dir string, fn func(path string, e *treeEntry) error) error {
+	entries, err := r.getTree(tree)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		path := dir + e.name
+		if err := fn(path, e); err != nil {
+			return err
+		}
+		if e.mode&0170000 == modeTree {
+			if err := r.walkTree(e.id, path+"/", fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package gitgo
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"time"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+// A commitQueue is a priority queue of commits, ordered by committer
+// date (newest first) and then by the order in which they were
+// added, like the one that git uses to walk history.
+type commitQueue struct {
+	items []queuedCommit
+	seq   int
+}
+
+type queuedCommit struct {
+	c   *commit
+	seq int
+}
+
+func (q *commitQueue) Len() int { return len(q.items) }
+func (q *commitQueue) Less(i, j int) bool {
+	ti, tj := q.items[i].c.committer.when, q.items[j].c.committer.when
+	if !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return q.items[i].seq < q.items[j].seq
+}
+func (q *commitQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *commitQueue) Push(x interface{}) { q.items = append(q.items, x.(queuedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	x := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return x
+}
+
+func (q *commitQueue) push(c *commit) {
+	q.seq++
+	heap.Push(q, queuedCommit{c: c, seq: q.seq})
+}
+
+func (q *commitQueue) pop() *commit { return heap.Pop(q).(queuedCommit).c }
+
+// peek returns the next commit without removing it from the queue.
+func (q *commitQueue) peek() *commit { return q.items[0].c }
+
+// walkFlags are the flags that are set on commits during a walk.
+type walkFlags uint8
+
+const (
+	seen          walkFlags = 1 << iota // added to the queue
+	uninteresting                       // reachable from a hidden commit
+	parent1                             // reachable from the 1st side (merge bases)
+	parent2                             // reachable from the 2nd side (merge bases)
+	stale                               // reachable from a merge base candidate
+	result                              // a merge base candidate
+)
+
+// walkSlop is how many more uninteresting commits are walked after
+// all of the queued commits are uninteresting and older than the
+// interesting ones, in case commits with skewed dates are still to be
+// found (like git's SLOP).
+const walkSlop = 5
+
+// walkOptions configures a walk of the commit history.
+type walkOptions struct {
+	heads []objectID // walk the commits reachable from these
+	hide  []objectID // but not those reachable from these
+
+	// firstParent only follows the first parent of merge commits
+	// (like `git log --first-parent`).
+	firstParent bool
+
+	// since and until, if set, omit the commits committed before
+	// and after them. The history before since isn't walked.
+	since, until time.Time
+
+	// order, if set, is the vcs.CommitsOptions order of the commits.
+	order string
+}
+
+// errStopWalk is returned by a walk func to stop the walk early.
+var errStopWalk = errors.New("stop walk")
+
+// walk calls fn on each of the commits in the walk, newest first (like
+// `git log`).
+func (r *Repository) walk(ctx context.Context, opt walkOptions, fn func(*commit) error) error {
+	w := &walker{r: r, opt: opt, flags: map[objectID]walkFlags{}}
+	if err := w.init(); err != nil {
+		return err
+	}
+	var err error
+	if len(opt.hide) > 0 || opt.order != "" {
+		err = w.walkLimited(ctx, fn)
+	} else {
+		err = w.walkStreaming(ctx, fn)
+	}
+	if err == errStopWalk {
+		err = nil
+	}
+	return err
+}
+
+type walker struct {
+	r     *Repository
+	opt   walkOptions
+	queue commitQueue
+	flags map[objectID]walkFlags
+}
+
+func (w *walker) init() error {
+	for _, ids := range [][]objectID{w.opt.heads, w.opt.hide} {
+		for _, id := range ids {
+			c, err := w.r.getCommit(id)
+			if err != nil {
+				return err
+			}
+			if w.flags[id]&seen == 0 {
+				w.flags[id] |= seen
+				w.queue.push(c)
+			}
+		}
+	}
+	for _, id := range w.opt.hide {
+		c, err := w.r.getCommit(id)
+		if err != nil {
+			return err
+		}
+		w.markUninteresting(c)
+	}
+	return nil
+}
+
+// queueParents adds the commit's parents to the queue (if they
+// haven't already been added), passing on its uninteresting flag.
+func (w *walker) queueParents(c *commit, parents []objectID) error {
+	hidden := w.flags[c.id]&uninteresting != 0
+	if w.opt.firstParent && !hidden && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	for _, p := range parents {
+		if !hidden && w.flags[p]&seen != 0 {
+			continue
+		}
+		pc, err := w.r.getCommit(p)
+		if err != nil {
+			return err
+		}
+		if hidden {
+			w.markUninteresting(pc)
+		}
+		if w.flags[p]&seen != 0 {
+			continue
+		}
+		w.flags[p] |= seen
+		w.queue.push(pc)
+	}
+	return nil
+}
+
+// markUninteresting marks the commit, its parents and the ancestors
+// of them that have already been walked as uninteresting (like git's
+// mark_parents_uninteresting).
+func (w *walker) markUninteresting(c *commit) {
+	w.flags[c.id] |= uninteresting
+	stack := append([]objectID(nil), c.parents...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w.flags[id]&uninteresting != 0 {
+			continue
+		}
+		w.flags[id] |= uninteresting
+		if w.flags[id]&seen == 0 {
+			continue
+		}
+		// Commits that are still in the queue will pass on the flag
+		// when they're walked, but those already walked won't.
+		if typ, data, err := w.r.objects.readObject(id); err == nil && typ == objectCommit {
+			if c, err := parseCommit(id, data); err == nil {
+				stack = append(stack, c.parents...)
+			}
+		}
+	}
+}
+
+func (w *walker) walkStreaming(ctx context.Context, fn func(*commit) error) error {
+	for w.queue.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := w.queue.pop()
+		if w.tooOld(c) {
+			// Like git, don't walk any further back from here.
+			continue
+		}
+		if err := w.queueParents(c, c.parents); err != nil {
+			return err
+		}
+		if !w.tooNew(c) {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tooOld reports whether c was committed before the walk's since time.
+func (w *walker) tooOld(c *commit) bool {
+	return !w.opt.since.IsZero() && c.committer.when.Before(w.opt.since)
+}
+
+// tooNew reports whether c was committed after the walk's until time.
+func (w *walker) tooNew(c *commit) bool {
+	return !w.opt.until.IsZero() && c.committer.when.After(w.opt.until)
+}
+
+// walkLimited walks the commits when some are hidden or they need to
+// be sorted. The uninteresting commits need to be walked to find out
+// which of the others are reachable from them, so the whole walk is
+// done before fn is called.
+func (w *walker) walkLimited(ctx context.Context, fn func(*commit) error) error {
+	var candidates []*commit
+	var date time.Time // of the last interesting commit
+	slop := walkSlop
+	for w.queue.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := w.queue.pop()
+		if w.tooOld(c) {
+			w.flags[c.id] |= uninteresting
+		}
+		if err := w.queueParents(c, c.parents); err != nil {
+			return err
+		}
+		if w.flags[c.id]&uninteresting != 0 {
+			if slop = w.stillInteresting(date, slop); slop == 0 {
+				break
+			}
+			continue
+		}
+		if w.tooNew(c) {
+			continue
+		}
+		date = c.committer.when
+		candidates = append(candidates, c)
+	}
+
+	if w.opt.order != "" {
+		// Sort the commits (including those that won't be shown,
+		// which may connect the others) like git does.
+		byID := make(map[vcs.CommitID]*commit, len(candidates))
+		sorted := make([]*vcs.Commit, len(candidates))
+		for i, c := range candidates {
+			id := vcs.CommitID(c.id.String())
+			byID[id] = c
+			parents := make([]vcs.CommitID, len(c.parents))
+			for j, p := range c.parents {
+				parents[j] = vcs.CommitID(p.String())
+			}
+			sorted[i] = &vcs.Commit{
+				ID:        id,
+				Author:    vcs.Signature{Date: pbtypes.NewTimestamp(c.author.when)},
+				Committer: &vcs.Signature{Date: pbtypes.NewTimestamp(c.committer.when)},
+				Parents:   parents,
+			}
+		}
+		if err := vcs.SortCommits(sorted, w.opt.order); err != nil {
+			return err
+		}
+		for i, c := range sorted {
+			candidates[i] = byID[c.ID]
+		}
+	}
+
+	for _, c := range candidates {
+		if w.flags[c.id]&uninteresting != 0 {
+			continue
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stillInteresting returns the remaining slop of the walk after an
+// uninteresting commit, which is 0 when the walk can stop (like git's
+// still_interesting). The walk goes on while there are queued commits
+// that are newer than the last interesting commit (at date) or that
+// are interesting themselves.
+func (w *walker) stillInteresting(date time.Time, slop int) int {
+	if w.queue.Len() == 0 {
+		return 0
+	}
+	if !date.IsZero() && !w.queue.peek().committer.when.Before(date) {
+		return walkSlop
+	}
+	for _, item := range w.queue.items {
+		if w.flags[item.c.id]&uninteresting == 0 {
+			return walkSlop
+		}
+	}
+	return slop - 1
+}
+
+// mergeBases returns the best common ancestors of a and b: the common
+// ancestors that aren't ancestors of other common ancestors (like
+// `git merge-base --all`).
+func (r *Repository) mergeBases(ctx context.Context, a, b objectID) ([]objectID, error) {
+	if a == b {
+		return []objectID{a}, nil
+	}
+	bases, _, err := r.paintDownToCommon(ctx, a, []objectID{b})
+	if err != nil || len(bases) <= 1 {
+		return bases, err
+	}
+
+	// Remove the candidates that are ancestors of other candidates.
+	var best []objectID
+	for i, c := range bases {
+		redundant := false
+		for j, other := range bases {
+			if i == j {
+				continue
+			}
+			isAncestor, err := r.isAncestor(ctx, c, other)
+			if err != nil {
+				return nil, err
+			}
+			if isAncestor {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			best = append(best, c)
+		}
+	}
+	return best, nil
+}
+
+// paintDownToCommon walks the history of one and twos, newest first,
+// until it finds the commits that are reachable from both (like git's
+// function of the same name). It returns the common ancestors that
+// were found (which may include some that are ancestors of others)
+// and the walk flags.
+func (r *Repository) paintDownToCommon(ctx context.Context, one objectID, twos []objectID) ([]objectID, map[objectID]walkFlags, error) {
+	flags := map[objectID]walkFlags{}
+	var queue commitQueue
+	add := func(id objectID, f walkFlags) error {
+		c, err := r.getCommit(id)
+		if err != nil {
+			return err
+		}
+		flags[id] |= f
+		queue.push(c)
+		return nil
+	}
+	if err := add(one, parent1); err != nil {
+		return nil, nil, err
+	}
+	for _, two := range twos {
+		if err := add(two, parent2); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var results []objectID
+	for queue.Len() > 0 && !allStale(&queue, flags) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		c := queue.pop()
+		f := flags[c.id] & (parent1 | parent2 | stale)
+		if f == parent1|parent2 {
+			if flags[c.id]&result == 0 {
+				flags[c.id] |= result
+				results = append(results, c.id)
+			}
+			// Its ancestors can't be the best common ancestors.
+			f |= stale
+		}
+		for _, p := range c.parents {
+			if flags[p]&f == f {
+				continue
+			}
+			if err := add(p, f); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Candidates that were later found to be reachable from another
+	// candidate are not merge bases.
+	bases := results[:0]
+	for _, id := range results {
+		if flags[id]&stale == 0 {
+			bases = append(bases, id)
+		}
+	}
+	return bases, flags, nil
+}
+
+func allStale(q *commitQueue, flags map[objectID]walkFlags) bool {
+	for _, item := range q.items {
+		if flags[item.c.id]&stale == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isAncestor reports whether a is an ancestor of (or the same commit
+// as) b.
+func (r *Repository) isAncestor(ctx context.Context, a, b objectID) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+	_, flags, err := r.paintDownToCommon(ctx, a, []objectID{b})
+	if err != nil {
+		return false, err
+	}
+	return flags[a]&parent2 != 0, nil
+}
@@ -0,0 +1,200 @@
+package hg
+
+import "bytes"
+
+// This file is a port of Mercurial's bdiff (mercurial/bdiff.c), the
+// line diff that `hg annotate` uses. Using the same algorithm (instead
+// of another diff with equally minimal but different results) means
+// that lines are attributed to the same changesets as with hg.
+
+// A bdiffBlock is a block of matching lines, a[a1:a2] and b[b1:b2].
+type bdiffBlock struct{ a1, a2, b1, b2 int }
+
+// bdiffLine is a line and its equivalence class (e) and the index of
+// the previous line in b in its equivalence class (n).
+type bdiffLine struct {
+	l    []byte
+	e, n int
+}
+
+// bdiffSplitLines splits text into lines that include their
+// newlines. The last line has no newline if text doesn't end with
+// one.
+func bdiffSplitLines(text []byte) []bdiffLine {
+	var lines []bdiffLine
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		lines = append(lines, bdiffLine{l: text[:i]})
+		text = text[i:]
+	}
+	return lines
+}
+
+// bdiffEquateLines assigns the lines of a and b to equivalence
+// classes. Each line in b points to the previous line in b in its
+// class, and each line in a points to the last line in b in its class
+// (or -1 if there is none or the class is too popular to be worth
+// matching).
+func bdiffEquateLines(a, b []bdiffLine) {
+	type class struct{ pos, len int }
+	var classes []class
+	ids := make(map[string]int, len(b))
+	for i := range b {
+		id, ok := ids[string(b[i].l)]
+		if !ok {
+			id = len(classes)
+			ids[string(b[i].l)] = id
+			classes = append(classes, class{pos: -1})
+		}
+		b[i].n = classes[id].pos
+		b[i].e = id
+		classes[id].pos = i
+		classes[id].len++
+	}
+
+	// Compute the popularity threshold.
+	bn := len(b)
+	var t int
+	if bn >= 31000 {
+		t = bn / 1000
+	} else {
+		t = 1000000 / (bn + 1)
+	}
+
+	for i := range a {
+		id, ok := ids[string(a[i].l)]
+		if !ok {
+			a[i].e, a[i].n = -1, -1
+			continue
+		}
+		a[i].e = id
+		if classes[id].len <= t {
+			a[i].n = classes[id].pos
+		} else {
+			a[i].n = -1 // too popular
+		}
+	}
+}
+
+type bdiffPos struct{ pos, len int }
+
+// bdiffLongestMatch returns the longest match of a[a1:a2] and
+// b[b1:b2], preferring matches closer to the middle to balance the
+// recursion.
+func bdiffLongestMatch(a, b []bdiffLine, pos []bdiffPos, a1, a2, b1, b2 int) (mi, mj, mk int) {
+	mi, mj = a1, b1
+
+	// Window the search on large regions to bound the worst-case
+	// performance.
+	if a2-a1 > 30000 {
+		a1 = a2 - 30000
+	}
+
+	half := (a1 + a2 - 1) / 2
+	bhalf := (b1 + b2 - 1) / 2
+
+	for i := a1; i < a2; i++ {
+		// Skip all lines in b after the current block.
+		j := a[i].n
+		for j >= b2 {
+			j = b[j].n
+		}
+
+		// Loop through all lines matching a[i] in b.
+		for ; j >= b1; j = b[j].n {
+			// Does this extend an earlier match?
+			k := 1
+			for ; j-k >= b1 && i-k >= a1; k++ {
+				// Reached an earlier match?
+				if pos[j-k].pos == i-k {
+					k += pos[j-k].len
+					break
+				}
+				// Previous line mismatch?
+				if a[i-k].e != b[j-k].e {
+					break
+				}
+			}
+
+			pos[j].pos = i
+			pos[j].len = k
+
+			// Best match so far?
+			if k > mk {
+				mi, mj, mk = i, j, k
+			} else if k == mk {
+				if i > mi && i <= half && j > b1 {
+					// Same match, but closer to half.
+					mi, mj = i, j
+				} else if i == mi && (mj > bhalf || i == a1) {
+					// Same i, but best earlier j.
+					mj = j
+				}
+			}
+		}
+	}
+
+	if mk > 0 {
+		mi = mi - mk + 1
+		mj = mj - mk + 1
+	}
+
+	// Expand the match to include subsequent popular lines.
+	for mi+mk < a2 && mj+mk < b2 && a[mi+mk].e == b[mj+mk].e {
+		mk++
+	}
+	return mi, mj, mk
+}
+
+func bdiffRecurse(a, b []bdiffLine, pos []bdiffPos, a1, a2, b1, b2 int, blocks []bdiffBlock) []bdiffBlock {
+	for {
+		// Find the longest match in this chunk, and recurse on the
+		// remaining chunks on either side.
+		i, j, k := bdiffLongestMatch(a, b, pos, a1, a2, b1, b2)
+		if k == 0 {
+			return blocks
+		}
+		blocks = bdiffRecurse(a, b, pos, a1, i, b1, j, blocks)
+		blocks = append(blocks, bdiffBlock{i, i + k, j, j + k})
+		a1, b1 = i+k, j+k
+	}
+}
+
+// bdiffBlocks returns the blocks of matching lines of a and b, ending
+// with an empty block at the end of both (like bdiff.blocks).
+func bdiffBlocks(a, b []byte) []bdiffBlock {
+	al, bl := bdiffSplitLines(a), bdiffSplitLines(b)
+	bdiffEquateLines(al, bl)
+	pos := make([]bdiffPos, len(bl))
+	blocks := bdiffRecurse(al, bl, pos, 0, len(al), 0, len(bl), nil)
+	blocks = append(blocks, bdiffBlock{len(al), len(al), len(bl), len(bl)})
+
+	// Normalize the blocks, pushing each change toward the end.
+	for i := 0; i+1 < len(blocks); i++ {
+		cur, next := &blocks[i], &blocks[i+1]
+		if cur.a2 == next.a1 || cur.b2 == next.b1 {
+			for cur.a2 < len(al) && cur.b2 < len(bl) && next.a1 < next.a2 && next.b1 < next.b2 && bytes.Equal(al[cur.a2].l, bl[cur.b2].l) {
+				cur.a2++
+				next.a1++
+				cur.b2++
+				next.b1++
+			}
+		}
+	}
+	return blocks
+}
+
+// bdiffFixWS removes all of the spaces, tabs, and carriage returns
+// from text, so that diffs of it ignore whitespace.
+func bdiffFixWS(text []byte) []byte {
+	w := make([]byte, 0, len(text))
+	for _, c := range text {
+		if c != ' ' && c != '\t' && c != '\r' {
+			w = append(w, c)
+		}
+	}
+	return w
+}
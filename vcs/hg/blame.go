@@ -0,0 +1,422 @@
+package hg
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	hg_revlog "github.com/beyang/hgo/revlog"
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+)
+
+func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	return r.BlameFileContext(context.Background(), path, opt)
+}
+
+// BlameFileContext implements vcs.BlamerContext. It annotates the
+// file's revlog in memory, in the same way as `hg annotate` (following
+// copies and renames), so the hunks are the same as hgcmd's.
+func (r *Repository) BlameFileContext(ctx context.Context, path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	if opt == nil {
+		opt = &vcs.BlameOptions{}
+	}
+	if opt.DetectMoves || opt.DetectCopies {
+		return nil, fmt.Errorf("BlameOptions.DetectMoves and DetectCopies not implemented for vcs type: hg")
+	}
+
+	s := r.snapshot()
+	newest, err := s.resolveRevision(string(opt.NewestCommit))
+	if err != nil {
+		return nil, err
+	}
+	fs, err := s.fileSystem(newest)
+	if err != nil {
+		return nil, err
+	}
+	path = internal.Rel(path)
+	rec, _, err := fs.getEntry(path)
+	if err != nil {
+		return nil, standardizeHgError(err)
+	}
+
+	ignoreRevs := opt.IgnoreRevs
+	if opt.IgnoreRevsFile != "" {
+		data, err := vfs.ReadFile(fs, opt.IgnoreRevsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ignoreRevs = append(ignoreRevs[:len(ignoreRevs):len(ignoreRevs)], vcs.ParseBlameIgnoreRevs(data)...)
+	}
+	skip := map[int]bool{} // changelog revision numbers
+	for _, rev := range ignoreRevs {
+		// Like hgcmd's `--skip=id(rev)`, ignore unknown revisions.
+		if crec, err := s.getRec(rev); err == nil {
+			skip[crec.FileRev()] = true
+		}
+	}
+
+	a := annotator{s: s, ctx: ctx, ignoreWhitespace: !opt.NoIgnoreWhitespace, skip: skip}
+	lines, err := a.annotate(fileRev{path: path, rec: rec})
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.OldestCommit != "" {
+		oldestID, err := s.resolveRevision(string(opt.OldestCommit))
+		if err != nil {
+			return nil, err
+		}
+		oldest, err := s.getRec(oldestID)
+		if err != nil {
+			return nil, err
+		}
+		oldestFS, err := s.fileSystem(oldestID)
+		if err != nil {
+			return nil, err
+		}
+		boundary := map[vcs.CommitID]bool{}
+		for _, crec := range ancestors([]*hg_revlog.Rec{oldest}, false) {
+			boundary[vcs.CommitID(hex.EncodeToString(crec.Id()))] = true
+		}
+		oldestLines := func(path string) ([]internal.BlameLine, error) {
+			rec, _, err := oldestFS.getEntry(path)
+			if err != nil {
+				if err := standardizeHgError(err); os.IsNotExist(err) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			return a.annotate(fileRev{path: path, rec: rec})
+		}
+		if err := internal.BlameBoundary(lines, path, boundary, oldestID, oldestLines); err != nil {
+			return nil, err
+		}
+	}
+	hunks := internal.BlameHunks(lines)
+
+	commits := map[vcs.CommitID]*vcs.Commit{}
+	for _, hunk := range hunks {
+		c, ok := commits[hunk.CommitID]
+		if !ok {
+			if c, err = s.getCommit(hunk.CommitID); err != nil {
+				return nil, err
+			}
+			commits[hunk.CommitID] = c
+		}
+		hunk.Author = c.Author
+		hunk.Summary = strings.SplitN(c.Message, "\n", 2)[0]
+	}
+	return hunks, nil
+}
+
+// A fileRev is a revision of a file, which is a record in the revlog
+// of its path.
+type fileRev struct {
+	path string
+	rec  *hg_revlog.Rec
+}
+
+func (f fileRev) key() fileRevKey { return fileRevKey{f.path, f.rec.FileRev()} }
+
+type fileRevKey struct {
+	path string
+	rev  int
+}
+
+// annotation is the file revision and line number that each line of
+// a file revision is attributed to.
+type annotation struct {
+	text    []byte
+	lines   [][]byte
+	fileRev []fileRev
+	lineno  []int
+}
+
+// annotator annotates files like Mercurial's dagop.annotate.
+type annotator struct {
+	s                *repoState
+	ctx              context.Context
+	ignoreWhitespace bool
+	skip             map[int]bool // changelog revision numbers to skip
+
+	revlogs map[string]*hg_revlog.Index
+}
+
+// annotate returns the lines of the file revision base and the
+// changesets, paths, and line numbers they are attributed to.
+func (a *annotator) annotate(base fileRev) ([]internal.BlameLine, error) {
+	// The first depth-first search finds the parents of all of the
+	// file revisions and how many children need each one.
+	parents := map[fileRevKey][]fileRev{}
+	needed := map[fileRevKey]int{base.key(): 1}
+	visit := []fileRev{base}
+	for len(visit) > 0 {
+		f := visit[len(visit)-1]
+		visit = visit[:len(visit)-1]
+		if _, ok := parents[f.key()]; ok {
+			continue
+		}
+		pl, err := a.parents(f)
+		if err != nil {
+			return nil, err
+		}
+		parents[f.key()] = pl
+		for _, p := range pl {
+			needed[p.key()]++
+			if _, ok := parents[p.key()]; !ok {
+				visit = append(visit, p)
+			}
+		}
+	}
+
+	// The second one annotates each file revision after all of its
+	// parents, discarding the parents' annotations when they're no
+	// longer needed.
+	hist := map[fileRevKey]*annotation{}
+	visit = append(visit, base)
+	for len(visit) > 0 {
+		if err := a.ctx.Err(); err != nil {
+			return nil, err
+		}
+		f := visit[len(visit)-1]
+		if _, ok := hist[f.key()]; ok {
+			visit = visit[:len(visit)-1]
+			continue
+		}
+		ready := true
+		pl := parents[f.key()]
+		for _, p := range pl {
+			if _, ok := hist[p.key()]; !ok {
+				ready = false
+				visit = append(visit, p)
+			}
+		}
+		if !ready {
+			continue
+		}
+		visit = visit[:len(visit)-1]
+
+		curr, err := a.decorate(f)
+		if err != nil {
+			return nil, err
+		}
+		pa := make([]*annotation, len(pl))
+		for i, p := range pl {
+			pa[i] = hist[p.key()]
+		}
+		a.annotatePair(pa, f, curr, a.skip[int(f.rec.Linkrev)])
+		for _, p := range pl {
+			if needed[p.key()] == 1 {
+				delete(hist, p.key())
+				delete(needed, p.key())
+			} else {
+				needed[p.key()]--
+			}
+		}
+		hist[f.key()] = curr
+		delete(parents, f.key())
+	}
+
+	ann := hist[base.key()]
+	lines := make([]internal.BlameLine, len(ann.lines))
+	for i, line := range ann.lines {
+		lines[i] = internal.BlameLine{
+			CommitID: vcs.CommitID(hex.EncodeToString(a.s.cl.Record(int(ann.fileRev[i].rec.Linkrev)).Id())),
+			Path:     ann.fileRev[i].path,
+			Line:     ann.lineno[i],
+			Text:     line,
+		}
+	}
+	return lines, nil
+}
+
+// decorate returns the annotation of a file revision's lines that
+// attributes them all to it.
+func (a *annotator) decorate(f fileRev) (*annotation, error) {
+	text, _, err := readFileRev(f.rec)
+	if err != nil {
+		return nil, err
+	}
+	lines := bdiffSplitLines(text)
+	ann := &annotation{
+		text:    text,
+		lines:   make([][]byte, len(lines)),
+		fileRev: make([]fileRev, len(lines)),
+		lineno:  make([]int, len(lines)),
+	}
+	for i, line := range lines {
+		ann.lines[i] = line.l
+		ann.fileRev[i] = f
+		ann.lineno[i] = i + 1
+	}
+	return ann, nil
+}
+
+// annotatePair attributes the lines of child that are unchanged from
+// its parents to the parents' lines (preferring the last parent, like
+// hg). If skipChild is true, the changed lines are also attributed to
+// the parents, matching them 1:1 with the lines of each diff hunk (and
+// repeating the hunk's last line if it has fewer lines).
+func (a *annotator) annotatePair(parents []*annotation, childRev fileRev, child *annotation, skipChild bool) {
+	type blocks struct {
+		parent *annotation
+		blocks []bdiffBlock // matching and changed blocks, in order
+	}
+	pblocks := make([]blocks, len(parents))
+	for i, parent := range parents {
+		pblocks[i] = blocks{parent: parent, blocks: a.allBlocks(parent.text, child.text)}
+	}
+	for _, pb := range pblocks {
+		for i, b := range pb.blocks {
+			if i%2 == 1 {
+				copy(child.fileRev[b.b1:b.b2], pb.parent.fileRev[b.a1:b.a2])
+				copy(child.lineno[b.b1:b.b2], pb.parent.lineno[b.a1:b.a2])
+			}
+		}
+	}
+	if !skipChild {
+		return
+	}
+
+	attribute := func(parent *annotation, b bdiffBlock) {
+		for bk := b.b1; bk < b.b2; bk++ {
+			if child.fileRev[bk].key() != childRev.key() {
+				continue
+			}
+			ak := b.a1 + (bk - b.b1)
+			if ak > b.a2-1 {
+				ak = b.a2 - 1
+			}
+			if ak < 0 {
+				// Like a negative index in Python.
+				ak += len(parent.lines)
+			}
+			if ak < 0 {
+				continue
+			}
+			child.fileRev[bk] = parent.fileRev[ak]
+			child.lineno[bk] = parent.lineno[ak]
+		}
+	}
+
+	// First, attribute as many lines as possible without repeating
+	// lines, and then attribute the rest.
+	remaining := make([][]bdiffBlock, len(pblocks))
+	for i := len(pblocks) - 1; i >= 0; i-- {
+		for _, b := range pblocks[i].blocks {
+			if b.a2-b.a1 >= b.b2-b.b1 {
+				attribute(pblocks[i].parent, b)
+			} else {
+				remaining[i] = append(remaining[i], b)
+			}
+		}
+	}
+	for i := len(pblocks) - 1; i >= 0; i-- {
+		for _, b := range remaining[i] {
+			attribute(pblocks[i].parent, b)
+		}
+	}
+}
+
+// allBlocks returns the blocks of parent and child, alternating
+// between changed blocks (which may be empty) and matching blocks,
+// like hg's mdiff.allblocks.
+func (a *annotator) allBlocks(parent, child []byte) []bdiffBlock {
+	if a.ignoreWhitespace {
+		parent, child = bdiffFixWS(parent), bdiffFixWS(child)
+	}
+	matches := bdiffBlocks(parent, child)
+	all := make([]bdiffBlock, 0, 2*len(matches))
+	var prev bdiffBlock
+	for _, m := range matches {
+		all = append(all, bdiffBlock{prev.a2, m.a1, prev.b2, m.b1}, m)
+		prev = m
+	}
+	return all
+}
+
+// parents returns the parents of a file revision. If the file was
+// copied (or renamed) from another file in it, the source file
+// revision is its first parent.
+func (a *annotator) parents(f fileRev) ([]fileRev, error) {
+	var pl []fileRev
+	if p := f.rec.Parent(); p.FileRev() != -1 {
+		pl = append(pl, fileRev{f.path, p})
+	}
+	if f.rec.Parent2Present() {
+		pl = append(pl, fileRev{f.path, f.rec.Parent2()})
+	}
+	if f.rec.Parent().FileRev() != -1 {
+		return pl, nil
+	}
+
+	_, meta, err := readFileRev(f.rec)
+	if err != nil {
+		return nil, err
+	}
+	copyPath, copyRev := meta["copy"], meta["copyrev"]
+	if copyPath == "" || copyRev == "" {
+		return pl, nil
+	}
+	fileLog, err := a.revlog(copyPath)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := hg_revlog.NodeIdRevSpec(copyRev).Lookup(fileLog)
+	if err != nil {
+		return nil, fmt.Errorf("copy source %s@%s of %s: %s", copyPath, copyRev, f.path, err)
+	}
+	return append([]fileRev{{copyPath, rec}}, pl...), nil
+}
+
+func (a *annotator) revlog(path string) (*hg_revlog.Index, error) {
+	if fileLog, ok := a.revlogs[path]; ok {
+		return fileLog, nil
+	}
+	fileLog, err := a.s.st.OpenRevlog(path)
+	if err != nil {
+		return nil, err
+	}
+	if a.revlogs == nil {
+		a.revlogs = map[string]*hg_revlog.Index{}
+	}
+	a.revlogs[path] = fileLog
+	return fileLog, nil
+}
+
+// readFileRev returns the contents of a file revision and its
+// metadata (such as the "copy" and "copyrev" of a copied file).
+func readFileRev(rec *hg_revlog.Rec) (text []byte, meta map[string]string, err error) {
+	fb := hg_revlog.NewFileBuilder()
+	fp, err := fb.PreparePatch(rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fp.Apply(nil); err != nil {
+		return nil, nil, err
+	}
+	text = append([]byte(nil), fb.Bytes()...)
+	header := fp.MetaData
+	if len(header) == 0 && rec.Parent().FileRev() == -1 && bytes.HasPrefix(text, []byte("\x01\n")) {
+		// hgo only splits off the metadata of revisions without
+		// parents, but copies in merges have a second parent.
+		if i := bytes.Index(text[2:], []byte("\x01\n")); i != -1 {
+			header, text = text[:i+4], text[i+4:]
+		}
+	}
+
+	meta = map[string]string{}
+	if len(header) >= 4 {
+		for _, line := range strings.Split(string(header[2:len(header)-2]), "\n") {
+			if i := strings.Index(line, ": "); i != -1 {
+				meta[line[:i]] = line[i+2:]
+			}
+		}
+	}
+	return text, meta, nil
+}
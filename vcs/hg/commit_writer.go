@@ -0,0 +1,17 @@
+package hg
+
+import "sourcegraph.com/sourcegraph/go-vcs/vcs"
+
+// CreateCommit implements vcs.CommitWriter. The commit is created by
+// hgcmd, and then the repository is reloaded so that the new commit
+// is visible to the native implementation.
+func (r *Repository) CreateCommit(opt vcs.CreateCommitOptions) (vcs.CommitID, error) {
+	id, err := r.Repository.CreateCommit(opt)
+	if err != nil {
+		return "", err
+	}
+	if err := r.load(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
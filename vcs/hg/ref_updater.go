@@ -0,0 +1,41 @@
+package hg
+
+import "sourcegraph.com/sourcegraph/go-vcs/vcs"
+
+// The RefUpdater methods are implemented by hgcmd, and then the
+// repository is reloaded so that the changes are visible to the
+// native implementation.
+
+// CreateBranch implements vcs.RefUpdater.
+func (r *Repository) CreateBranch(name string, id vcs.CommitID) error {
+	return r.reloadAfter(r.Repository.CreateBranch(name, id))
+}
+
+// DeleteBranch implements vcs.RefUpdater.
+func (r *Repository) DeleteBranch(name string) error {
+	return r.reloadAfter(r.Repository.DeleteBranch(name))
+}
+
+// CreateTag implements vcs.RefUpdater.
+func (r *Repository) CreateTag(name string, id vcs.CommitID, opt *vcs.CreateTagOptions) error {
+	return r.reloadAfter(r.Repository.CreateTag(name, id, opt))
+}
+
+// DeleteTag implements vcs.RefUpdater.
+func (r *Repository) DeleteTag(name string) error {
+	return r.reloadAfter(r.Repository.DeleteTag(name))
+}
+
+// UpdateRef implements vcs.RefUpdater.
+func (r *Repository) UpdateRef(name string, old, new vcs.CommitID) error {
+	return r.reloadAfter(r.Repository.UpdateRef(name, old, new))
+}
+
+// reloadAfter reloads the repository if err (the result of modifying
+// the repository) is nil, and otherwise returns err.
+func (r *Repository) reloadAfter(err error) error {
+	if err != nil {
+		return err
+	}
+	return r.load()
+}
@@ -2,6 +2,7 @@ package hg
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/beyang/hgo"
@@ -35,52 +37,176 @@ func init() {
 
 type Repository struct {
 	*hgcmd.Repository
+
+	loadMu sync.Mutex   // serializes calls to load
+	mu     sync.RWMutex // protects state
+	state  *repoState
+
+	totals vcs.CommitsTotalCache
+}
+
+// repoState is the repository data read by load. It is never
+// modified after it is created, so the methods that read the
+// repository use the snapshot of it that was current when they were
+// called, and don't see the changes made while they are running.
+type repoState struct {
+	dir         string
 	u           *hgo.Repository
 	st          *hg_store.Store
 	cl          *hg_revlog.Index
 	allTags     *hgo.Tags
 	branchHeads *hgo.BranchHeads
+	bookmarks   map[string]string
+	phases      map[int]int // phase numbers of non-public changesets, by revision number
 }
 
 func Open(dir string) (*Repository, error) {
-	r, err := hgo.OpenRepository(dir)
+	cr, err := hgcmd.Open(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	st := r.NewStore()
+	r := &Repository{Repository: cr}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load (re)reads the changelog, tags, branch heads, bookmarks, and
+// phases from the repository on disk. It must be called after the repository is
+// modified for the changes to be visible.
+func (r *Repository) load() error {
+	// Loads are serialized so that a load that started earlier can't
+	// replace the state read by one that started later.
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+
+	u, err := hgo.OpenRepository(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	st := u.NewStore()
 	cl, err := st.OpenChangeLog()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	globalTags, allTags := r.Tags()
+	globalTags, allTags := u.Tags()
 	globalTags.Sort()
 	allTags.Sort()
 	allTags.Add("tip", cl.Tip().Id().Node())
 
-	bh, err := r.BranchHeads()
+	bh, err := u.BranchHeads()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	cr, err := hgcmd.Open(dir)
+	bookmarks, err := internal.ReadHgRefsFile(filepath.Join(r.Dir, ".hg", "bookmarks"))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &Repository{cr, r, st, cl, allTags, bh}, nil
+	roots, err := internal.ReadHgPhaseRoots(filepath.Join(r.Dir, ".hg", "store", "phaseroots"))
+	if err != nil {
+		return err
+	}
+	phases, err := commitPhases(cl, roots)
+	if err != nil {
+		return err
+	}
+
+	state := &repoState{
+		dir:         r.Dir,
+		u:           u,
+		st:          st,
+		cl:          cl,
+		allTags:     allTags,
+		branchHeads: bh,
+		bookmarks:   bookmarks,
+		phases:      phases,
+	}
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+	return nil
+}
+
+// snapshot returns the current repository state.
+func (r *Repository) snapshot() *repoState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+// hgPhaseNames are the names of hg's phases, by phase number.
+var hgPhaseNames = map[int]string{
+	0:  vcs.PhasePublic,
+	1:  vcs.PhaseDraft,
+	2:  vcs.PhaseSecret,
+	32: "archived",
+	96: "internal",
+}
+
+// commitPhases returns the phase numbers of the changesets that
+// aren't public, by revision number. A changeset's phase is the
+// highest phase of the phase roots that it is or descends from.
+func commitPhases(cl *hg_revlog.Index, roots map[string]int) (map[int]int, error) {
+	phases := map[int]int{}
+	first := -1 // the lowest revision number of a phase root
+	for id, phase := range roots {
+		rec, err := hg_revlog.NodeIdRevSpec(id).Lookup(cl)
+		if err == hg_revlog.ErrRevNotFound {
+			continue // the root was stripped
+		} else if err != nil {
+			return nil, err
+		}
+		rev := rec.FileRev()
+		if phase > phases[rev] {
+			phases[rev] = phase
+		}
+		if first == -1 || rev < first {
+			first = rev
+		}
+	}
+	if first == -1 {
+		return phases, nil
+	}
+
+	// Parents have lower revision numbers than their children, so
+	// the parents' phases are known when their children are reached.
+	for rev := first; rev <= cl.Tip().FileRev(); rev++ {
+		rec := cl.Record(rev)
+		phase := phases[rev]
+		if !rec.IsStartOfBranch() {
+			if p := rec.Parent(); p != nil && phases[p.FileRev()] > phase {
+				phase = phases[p.FileRev()]
+			}
+			if rec.Parent2Present() && phases[rec.Parent2().FileRev()] > phase {
+				phase = phases[rec.Parent2().FileRev()]
+			}
+		}
+		if phase > 0 {
+			phases[rev] = phase
+		}
+	}
+	return phases, nil
 }
 
 func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
-	if id, err := r.ResolveBranch(spec); err == nil {
+	return r.snapshot().resolveRevision(spec)
+}
+
+func (s *repoState) resolveRevision(spec string) (vcs.CommitID, error) {
+	if id, err := s.resolveBranch(spec); err == nil {
 		return id, nil
 	}
-	if id, err := r.ResolveTag(spec); err == nil {
+	if id, err := s.resolveTag(spec); err == nil {
 		return id, nil
 	}
 
-	rec, err := r.parseRevisionSpec(spec).Lookup(r.cl)
+	rec, err := s.parseRevisionSpec(spec).Lookup(s.cl)
 	if err != nil {
 		if err == hg_revlog.ErrRevNotFound || err == hex.ErrLength {
 			return "", vcs.ErrRevisionNotFound
@@ -90,39 +216,92 @@ func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
 	return vcs.CommitID(hex.EncodeToString(rec.Id())), nil
 }
 
+// ResolveRevisionContext implements vcs.RepositoryContext. Native
+// revision resolution is done in memory, so ctx is only checked
+// before starting.
+func (r *Repository) ResolveRevisionContext(ctx context.Context, spec string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveRevision(spec)
+}
+
 func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
-	if id, ok := r.allTags.IdByName[name]; ok {
+	return r.snapshot().resolveTag(name)
+}
+
+func (s *repoState) resolveTag(name string) (vcs.CommitID, error) {
+	if id, ok := s.allTags.IdByName[name]; ok {
 		return vcs.CommitID(id), nil
 	}
 	return "", vcs.ErrTagNotFound
 }
 
+func (r *Repository) ResolveTagContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveTag(name)
+}
+
 func (r *Repository) ResolveBranch(name string) (vcs.CommitID, error) {
-	if id, ok := r.branchHeads.IdByName[name]; ok {
+	return r.snapshot().resolveBranch(name)
+}
+
+func (s *repoState) resolveBranch(name string) (vcs.CommitID, error) {
+	if id, ok := s.branchHeads.IdByName[name]; ok {
+		return vcs.CommitID(id), nil
+	}
+	// Bookmarks are hg's equivalent of git branches (and are what
+	// vcs.RefUpdater creates), so resolve them too.
+	if id, ok := s.bookmarks[name]; ok {
 		return vcs.CommitID(id), nil
 	}
 	return "", vcs.ErrBranchNotFound
 }
 
+func (r *Repository) ResolveBranchContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.ResolveBranch(name)
+}
+
 func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 	if opt.ContainsCommit != "" {
 		return nil, fmt.Errorf("vcs.BranchesOptions.ContainsCommit option not implemented")
 	}
 
-	bs := make([]*vcs.Branch, len(r.branchHeads.IdByName))
+	s := r.snapshot()
+	bs := make([]*vcs.Branch, len(s.branchHeads.IdByName))
 	i := 0
-	for name, id := range r.branchHeads.IdByName {
+	for name, id := range s.branchHeads.IdByName {
 		bs[i] = &vcs.Branch{Name: name, Head: vcs.CommitID(id)}
 		i++
 	}
+	// Bookmarks are hg's equivalent of git branches, so list them
+	// too (unless there's a named branch with the same name).
+	for name, id := range s.bookmarks {
+		if _, ok := s.branchHeads.IdByName[name]; !ok {
+			bs = append(bs, &vcs.Branch{Name: name, Head: vcs.CommitID(id)})
+		}
+	}
 	sort.Sort(vcs.Branches(bs))
 	return bs, nil
 }
 
+func (r *Repository) BranchesContext(ctx context.Context, opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Branches(opt)
+}
+
 func (r *Repository) Tags() ([]*vcs.Tag, error) {
-	ts := make([]*vcs.Tag, len(r.allTags.IdByName))
+	s := r.snapshot()
+	ts := make([]*vcs.Tag, len(s.allTags.IdByName))
 	i := 0
-	for name, id := range r.allTags.IdByName {
+	for name, id := range s.allTags.IdByName {
 		ts[i] = &vcs.Tag{Name: name, CommitID: vcs.CommitID(id)}
 		i++
 	}
@@ -130,8 +309,15 @@ func (r *Repository) Tags() ([]*vcs.Tag, error) {
 	return ts, nil
 }
 
-func (r *Repository) getRec(id vcs.CommitID) (*hg_revlog.Rec, error) {
-	rec, err := hg_revlog.NodeIdRevSpec(id).Lookup(r.cl)
+func (r *Repository) TagsContext(ctx context.Context) ([]*vcs.Tag, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Tags()
+}
+
+func (s *repoState) getRec(id vcs.CommitID) (*hg_revlog.Rec, error) {
+	rec, err := hg_revlog.NodeIdRevSpec(id).Lookup(s.cl)
 	if err == hg_revlog.ErrRevNotFound {
 		err = vcs.ErrCommitNotFound
 	}
@@ -139,50 +325,269 @@ func (r *Repository) getRec(id vcs.CommitID) (*hg_revlog.Rec, error) {
 }
 
 func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
-	rec, err := r.getRec(id)
+	return r.snapshot().getCommit(id)
+}
+
+func (s *repoState) getCommit(id vcs.CommitID) (*vcs.Commit, error) {
+	rec, err := s.getRec(id)
 	if err != nil {
 		return nil, err
 	}
-	return r.makeCommit(rec)
+	return s.makeCommit(rec)
+}
+
+func (r *Repository) GetCommitContext(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.GetCommit(id)
 }
 
 func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
-	rec, err := r.getRec(opt.Head)
+	return r.CommitsContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Path != "" {
+		// Following copies and renames is not implemented natively
+		// yet, so call hgcmd.
+		return r.Repository.CommitsContext(ctx, opt)
+	}
+	if opt.Cursor != "" {
+		page, err := r.CommitsPageContext(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Commits, page.Total, nil
+	}
+	return r.snapshot().commits(ctx, opt, "")
+}
+
+func (r *Repository) CommitsPage(opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	return r.CommitsPageContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsPageContext(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	if opt.Path != "" {
+		// See CommitsContext.
+		return r.Repository.CommitsPageContext(ctx, opt)
+	}
+
+	s := r.snapshot()
+	cursor := &vcs.CommitsCursor{}
+	if opt.Cursor != "" {
+		var err error
+		if cursor, err = vcs.ParseCommitsCursor(opt.Cursor); err != nil {
+			return nil, err
+		}
+		if len(cursor.Frontier) > 0 || (opt.Order != "" && cursor.After != "") {
+			return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+		}
+	}
+
+	if opt.Order != "" {
+		// Sorting the commits requires all of them, so skip the
+		// earlier pages' commits.
+		pageOpt := opt
+		pageOpt.Cursor, pageOpt.Skip = "", cursor.Offset+opt.Skip
+		commits, total, err := s.commits(ctx, pageOpt, "")
+		if err != nil {
+			return nil, err
+		}
+		page := &vcs.CommitsPage{Commits: commits, Total: total}
+		if opt.N != 0 && uint(len(commits)) == opt.N {
+			page.NextCursor = (&vcs.CommitsCursor{Offset: pageOpt.Skip + opt.N}).String()
+		}
+		return page, nil
+	}
+
+	// The next page starts at the revision before the last commit on
+	// this page. Get one more commit to see if there is a next page.
+	pageOpt := opt
+	pageOpt.Cursor, pageOpt.NoTotal = "", true
+	if opt.N != 0 {
+		pageOpt.N = opt.N + 1
+	}
+	commits, _, err := s.commits(ctx, pageOpt, cursor.After)
+	if err != nil {
+		return nil, err
+	}
+	page := &vcs.CommitsPage{Commits: commits}
+	if opt.N != 0 && uint(len(commits)) > opt.N {
+		page.Commits = commits[:opt.N]
+		page.NextCursor = (&vcs.CommitsCursor{
+			Offset: cursor.Offset + opt.Skip + opt.N,
+			After:  commits[opt.N-1].ID,
+		}).String()
+	}
+
+	if !opt.NoTotal {
+		if total, ok := r.totals.Get(opt); ok {
+			page.Total = total
+		} else {
+			countOpt := opt
+			countOpt.N, countOpt.Skip, countOpt.Cursor = 1, 0, ""
+			if _, page.Total, err = s.commits(ctx, countOpt, ""); err != nil {
+				return nil, err
+			}
+			r.totals.Add(opt, page.Total)
+		}
+	}
+	return page, nil
+}
+
+func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	return r.CommittersContext(context.Background(), opt)
+}
+
+func (r *Repository) CommittersContext(ctx context.Context, opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	if opt.Rev == "" {
+		opt.Rev = "tip"
+	}
+	head, err := r.ResolveRevisionContext(ctx, opt.Rev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the commits by each author, like `git shortlog -sne`.
+	commits, _, err := r.CommitsContext(ctx, vcs.CommitsOptions{
+		Head:    head,
+		Since:   opt.Since,
+		Until:   opt.Until,
+		Path:    opt.Path,
+		NoTotal: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vcs.CountCommitters(commits, opt.N), nil
+}
+
+// commits returns the commits selected by opt (ignoring opt.Cursor),
+// starting after the commit after (if set) in revision order.
+func (s *repoState) commits(ctx context.Context, opt vcs.CommitsOptions, after vcs.CommitID) ([]*vcs.Commit, uint, error) {
+	filter, err := vcs.NewCommitFilter(opt)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	var heads, bases []*hg_revlog.Rec
+	for _, id := range append([]vcs.CommitID{opt.Head}, opt.Heads...) {
+		rec, err := s.getRec(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		heads = append(heads, rec)
+	}
+	for _, id := range append([]vcs.CommitID{opt.Base}, opt.Bases...) {
+		if id == "" {
+			continue
+		}
+		rec, err := s.getRec(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		bases = append(bases, rec)
+	}
+
+	// Select the ancestors of the heads that aren't ancestors of the
+	// bases, newest (highest revision number) first, like `hg log`.
+	recs := ancestors(heads, opt.FirstParent)
+	for rev := range ancestors(bases, false) {
+		delete(recs, rev)
+	}
+	before := -1 // if set, only the revisions before it are selected
+	if after != "" {
+		rec, err := s.getRec(after)
+		if err != nil {
+			return nil, 0, err
+		}
+		before = rec.FileRev()
+	}
+	revs := make([]int, 0, len(recs))
+	for rev := range recs {
+		if before == -1 || rev < before {
+			revs = append(revs, rev)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(revs)))
+
+	// The commits must all be read before they can be filtered or
+	// sorted, but otherwise only those in the page are needed.
+	sorted := opt.Order != ""
+	filtered := sorted || opt.NoMerges || opt.MergesOnly || opt.Author != "" || opt.Committer != "" || opt.Message != "" || !opt.Since.IsZero() || !opt.Until.IsZero()
+
 	var commits []*vcs.Commit
 	total := uint(0)
-	for ; ; rec = rec.Prev() {
-		if total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N) {
-			c, err := r.makeCommit(rec)
+	for _, rev := range revs {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if !sorted && opt.NoTotal && opt.N != 0 && uint(len(commits)) >= opt.N {
+			break
+		}
+		if filtered || (total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N)) {
+			c, err := s.makeCommit(recs[rev])
 			if err != nil {
 				return nil, 0, err
 			}
-			commits = append(commits, c)
+			if !filter.Match(c) {
+				continue
+			}
+			if sorted || (total >= opt.Skip && (opt.N == 0 || uint(len(commits)) < opt.N)) {
+				commits = append(commits, c)
+			}
 		}
 		total++
+	}
 
-		if rec.IsStartOfBranch() {
-			break
+	if sorted {
+		if err := vcs.SortCommits(commits, opt.Order); err != nil {
+			return nil, 0, err
 		}
-		// If we want total, keep going until the end.
-		if !opt.NoTotal {
-			continue
+		if opt.Skip >= uint(len(commits)) {
+			commits = nil
+		} else {
+			commits = commits[opt.Skip:]
 		}
-		// Otherwise return once N has been satisfied.
-		if opt.N != 0 && uint(len(commits)) >= opt.N {
-			break
+		if opt.N != 0 && uint(len(commits)) > opt.N {
+			commits = commits[:opt.N]
 		}
 	}
+
 	if opt.NoTotal {
 		total = 0
 	}
 	return commits, total, nil
 }
 
-func (r *Repository) makeCommit(rec *hg_revlog.Rec) (*vcs.Commit, error) {
+// ancestors returns the records of recs and their ancestors (only
+// following first parents if firstParent is true), keyed by revision
+// number.
+func ancestors(recs []*hg_revlog.Rec, firstParent bool) map[int]*hg_revlog.Rec {
+	seen := map[int]*hg_revlog.Rec{}
+	stack := append([]*hg_revlog.Rec(nil), recs...)
+	for len(stack) > 0 {
+		rec := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[rec.FileRev()]; ok {
+			continue
+		}
+		seen[rec.FileRev()] = rec
+		if rec.IsStartOfBranch() {
+			continue
+		}
+		if p := rec.Parent(); p != nil {
+			stack = append(stack, p)
+		}
+		if !firstParent && rec.Parent2Present() {
+			stack = append(stack, rec.Parent2())
+		}
+	}
+	return seen
+}
+
+func (s *repoState) makeCommit(rec *hg_revlog.Rec) (*vcs.Commit, error) {
 	fb := hg_revlog.NewFileBuilder()
 	ce, err := hg_changelog.BuildEntry(rec, fb)
 	if err != nil {
@@ -215,43 +620,141 @@ func (r *Repository) makeCommit(rec *hg_revlog.Rec) (*vcs.Commit, error) {
 		Author:  vcs.Signature{addr.Name, addr.Address, pbtypes.NewTimestamp(ce.Date)},
 		Message: ce.Comment,
 		Parents: parents,
+		Phase:   hgPhaseNames[s.phases[rec.FileRev()]],
 	}, nil
 }
 
+func (r *Repository) Search(at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	return r.SearchContext(context.Background(), at, opt)
+}
+
+func (r *Repository) SearchContext(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	var res []*vcs.SearchResult
+	_, err := r.SearchStream(ctx, at, opt, func(sr *vcs.SearchResult) error {
+		res = append(res, sr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SearchStream implements vcs.StreamSearcher. The files are listed
+// from the commit's manifest and read from their revlogs directly,
+// which is faster than walking the commit's FileSystem.
+func (r *Repository) SearchStream(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions, fn func(*vcs.SearchResult) error) (*vcs.SearchStats, error) {
+	fs, err := r.snapshot().fileSystem(at)
+	if err != nil {
+		return nil, err
+	}
+	m, err := fs.getManifest(fs.at)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like SearchFileSystem, only search regular files (not
+	// symlinks).
+	files := make([]string, 0, len(m))
+	ents := make(map[string]*hg_store.ManifestEnt, len(m))
+	for i := range m {
+		if e := &m[i]; !e.IsLink() {
+			files = append(files, e.FileName)
+			ents[e.FileName] = e
+		}
+	}
+	readFile := func(path string) ([]byte, error) {
+		fileLog, err := fs.st.OpenRevlog(path)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := fs.fileRec(fileLog, ents[path])
+		if err != nil {
+			return nil, err
+		}
+		return fs.readFile(rec)
+	}
+	return vcs.SearchFiles(ctx, files, readFile, opt, fn)
+}
+
+func (r *Repository) ListFiles(at vcs.CommitID) ([]string, error) {
+	return r.ListFilesContext(context.Background(), at)
+}
+
+// ListFilesContext implements vcs.FileListerContext. The files are
+// listed from the commit's manifest, which (unlike git trees) doesn't
+// contain directories.
+func (r *Repository) ListFilesContext(ctx context.Context, at vcs.CommitID) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := r.snapshot()
+	id, err := s.resolveRevision(string(at))
+	if err != nil {
+		return nil, err
+	}
+	fs, err := s.fileSystem(id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := fs.getManifest(fs.at)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, len(m))
+	for i, e := range m {
+		files[i] = e.FileName
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
 func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
-	rec, err := r.getRec(at)
+	return r.snapshot().fileSystem(at)
+}
+
+func (s *repoState) fileSystem(at vcs.CommitID) (*hgFSNative, error) {
+	rec, err := s.getRec(at)
 	if err != nil {
 		return nil, err
 	}
 
 	return &hgFSNative{
-		dir:  r.Dir,
+		dir:  s.dir,
 		at:   hg_revlog.FileRevSpec(rec.FileRev()),
-		repo: r.u,
-		st:   r.st,
-		cl:   r.cl,
+		repo: s.u,
+		st:   s.st,
+		cl:   s.cl,
 		fb:   hg_revlog.NewFileBuilder(),
 	}, nil
 }
 
-func (r *Repository) parseRevisionSpec(s string) hg_revlog.RevisionSpec {
-	if s == "" {
-		s = "tip"
+func (r *Repository) FileSystemContext(ctx context.Context, at vcs.CommitID) (vfs.FileSystem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.FileSystem(at)
+}
+
+func (s *repoState) parseRevisionSpec(spec string) hg_revlog.RevisionSpec {
+	if spec == "" {
+		spec = "tip"
 		// TODO(sqs): determine per-repository default branch name (not always "default"?)
 	}
-	if s == "tip" {
+	if spec == "tip" {
 		return hg_revlog.TipRevSpec{}
 	}
-	if s == "null" {
+	if spec == "null" {
 		return hg_revlog.NullRevSpec{}
 	}
-	if id, ok := r.allTags.IdByName[s]; ok {
-		s = id
-	} else if i, err := strconv.Atoi(s); err == nil {
+	if id, ok := s.allTags.IdByName[spec]; ok {
+		spec = id
+	} else if i, err := strconv.Atoi(spec); err == nil {
 		return hg_revlog.FileRevSpec(i)
 	}
 
-	return hg_revlog.NodeIdRevSpec(s)
+	return hg_revlog.NodeIdRevSpec(spec)
 }
 
 type hgFSNative struct {
@@ -312,10 +815,20 @@ func (fs *hgFSNative) getEntry(path string) (*hg_revlog.Rec, *hg_store.ManifestE
 		return nil, nil, err
 	}
 
+	rec, err := fs.fileRec(fileLog, ent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, ent, nil
+}
+
+// fileRec returns the record in the file's revlog for the manifest
+// entry.
+func (fs *hgFSNative) fileRec(fileLog *hg_revlog.Index, ent *hg_store.ManifestEnt) (*hg_revlog.Rec, error) {
 	// Lookup record in revlog
 	entId, err := ent.Id()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	linkRevSpec := hg_revlog.LinkRevSpec{
 		Rev: int(fs.at),
@@ -350,11 +863,11 @@ func (fs *hgFSNative) getEntry(path string) (*hg_revlog.Rec, *hg_store.ManifestE
 		linkRevSpec.FindPresent = nil
 		rec, err = linkRevSpec.Lookup(fileLog)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 	if rec.FileRev() == -1 {
-		return nil, nil, hg_revlog.ErrRevisionNotFound
+		return nil, hg_revlog.ErrRevisionNotFound
 	}
 
 	if int(rec.Linkrev) == int(fs.at) {
@@ -362,16 +875,16 @@ func (fs *hgFSNative) getEntry(path string) (*hg_revlog.Rec, *hg_store.ManifestE
 		// used as a sign that the file exists. (TODO(sqs): original comments
 		// say maybe this means the file is NOT existent yet? the word "not" is
 		// not there but that seems to be a mistake.)
-		return rec, ent, nil
+		return rec, nil
 	}
 
 	if !rec.IsLeaf() {
 		// There are other records that have the current record as a parent.
 		// This means, the file was existent, no need to check the manifest.
-		return rec, ent, nil
+		return rec, nil
 	}
 
-	return rec, ent, nil
+	return rec, nil
 }
 
 func (fs *hgFSNative) Open(name string) (vfs.ReadSeekCloser, error) {
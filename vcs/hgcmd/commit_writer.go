@@ -0,0 +1,276 @@
+package hgcmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+// CreateCommit implements vcs.CommitWriter. Mercurial can't create
+// commits without a working directory, so the commit is made in a
+// temporary working directory that shares this repository's store
+// (using the share extension bundled with hg). The repository's own
+// working directory is not touched.
+//
+// As with the RefUpdater methods, opt.Branch refers to a bookmark,
+// which is created or moved (with the same compare-and-swap as
+// UpdateRef) to point to the new commit. If there is no such bookmark
+// but there is a named branch with that name, the new commit is made
+// on the named branch if opt.Parent is its head.
+//
+// Like gitcmd, a file that is in the way of a changed file's parent
+// directory is replaced by the directory (and vice versa). Paths in
+// the .hg directory and paths that go through a symbolic link are
+// rejected.
+func (r *Repository) CreateCommit(opt vcs.CreateCommitOptions) (vcs.CommitID, error) {
+	for _, c := range opt.Changes {
+		if !internal.IsCleanRelPath(c.Path) {
+			return "", fmt.Errorf("invalid file path %q", c.Path)
+		}
+		if first := strings.SplitN(c.Path, "/", 2)[0]; strings.EqualFold(first, ".hg") {
+			return "", fmt.Errorf("invalid file path %q (in the .hg directory)", c.Path)
+		}
+	}
+
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	var setBookmark bool
+	if opt.Branch != "" {
+		bookmarks, err := r.bookmarks()
+		if err != nil {
+			return "", err
+		}
+		if head, ok := bookmarks[opt.Branch]; ok {
+			if head != opt.Parent {
+				return "", vcs.ErrRefConflict
+			}
+			setBookmark = true
+		} else {
+			head, err := r.namedBranchHead(opt.Branch)
+			if err == vcs.ErrBranchNotFound {
+				setBookmark = true
+			} else if err != nil {
+				return "", err
+			} else if head != opt.Parent {
+				return "", vcs.ErrRefConflict
+			}
+		}
+	}
+
+	rev := string(opt.Parent)
+	if rev == "" {
+		rev = "null"
+	}
+	wd, done, err := r.tempWorkingDir(rev)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	// Only the changed paths are added and removed, so that (unlike
+	// `hg addremove`) written files are committed even if they match
+	// .hgignore.
+	var added, removed []string
+	for _, c := range opt.Changes {
+		replaced, err := writeFileChange(wd, c)
+		if err != nil {
+			return "", err
+		}
+		// Even a written path may have been a directory whose files
+		// were removed.
+		removed = append(append(removed, replaced...), c.Path)
+		if !c.Delete {
+			added = append(added, c.Path)
+		}
+	}
+	if len(removed) > 0 {
+		// Find the tracked files that the changes removed.
+		out, err := runHg(wd, append([]string{"status", "--deleted", "--no-status", "--print0", "--"}, hgPathPatterns(removed)...)...)
+		if err != nil {
+			return "", err
+		}
+		var missing []string
+		for _, name := range bytes.Split(out, []byte{0}) {
+			if len(name) > 0 {
+				missing = append(missing, string(name))
+			}
+		}
+		if len(missing) > 0 {
+			if _, err := runHg(wd, append([]string{"remove", "--after", "--"}, hgPathPatterns(missing)...)...); err != nil {
+				return "", err
+			}
+		}
+	}
+	if len(added) > 0 {
+		if _, err := runHg(wd, append([]string{"add", "--"}, hgPathPatterns(added)...)...); err != nil {
+			return "", err
+		}
+	}
+
+	args := append([]string{"commit", "--config", "ui.allowemptycommit=True", "--message", opt.Message}, signatureArgs(opt.Author)...)
+	if _, err := runHg(wd, args...); err != nil {
+		return "", err
+	}
+
+	out, err := runHg(wd, "log", "--rev=.", "--template={node}")
+	if err != nil {
+		return "", err
+	}
+	id := vcs.CommitID(bytes.TrimSpace(out))
+
+	if setBookmark {
+		if _, err := runHg(r.Dir, "bookmark", "--force", "--rev="+string(id), "--", opt.Branch); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// namedBranchHead returns the head of the named branch, or
+// vcs.ErrBranchNotFound if there is no such named branch (or it is
+// closed).
+func (r *Repository) namedBranchHead(name string) (vcs.CommitID, error) {
+	refs, err := r.execAndParseCols(context.Background(), "branches")
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if ref[1] == name {
+			return vcs.CommitID(ref[0]), nil
+		}
+	}
+	return "", vcs.ErrBranchNotFound
+}
+
+// tempWorkingDir creates a temporary working directory that shares
+// this repository's store, and updates it to rev. The caller must
+// call done to remove the working directory when finished with it.
+func (r *Repository) tempWorkingDir(rev string) (wd string, done func(), err error) {
+	tmpDir, err := ioutil.TempDir("", "go-vcs-hg-wd")
+	if err != nil {
+		return "", nil, err
+	}
+	done = func() { os.RemoveAll(tmpDir) }
+	wd = filepath.Join(tmpDir, "wd")
+
+	if _, err := runHg(tmpDir, "--config", "extensions.share=", "share", "--noupdate", r.Dir, wd); err != nil {
+		done()
+		return "", nil, err
+	}
+	if out, err := runHg(wd, "update", "--clean", "--rev="+rev); err != nil {
+		done()
+		if isUnknownRevisionError(string(bytes.TrimSpace(out)), rev) {
+			return "", nil, vcs.ErrCommitNotFound
+		}
+		return "", nil, err
+	}
+	return wd, done, nil
+}
+
+// signatureArgs returns the hg command-line arguments that set the
+// user and (unless it's the zero value) date to sig.
+func signatureArgs(sig vcs.Signature) []string {
+	args := []string{"--user", fmt.Sprintf("%s <%s>", sig.Name, sig.Email)}
+	if sig.Date != (pbtypes.Timestamp{}) {
+		args = append(args, "--date", fmt.Sprintf("%d 0", sig.Date.Seconds))
+	}
+	return args
+}
+
+// runHg runs hg with args in dir and returns its combined output.
+func runHg(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("hg", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("exec `hg %s` failed: %s. Output was:\n\n%s", args[0], err, out)
+	}
+	return out, nil
+}
+
+// hgPathPatterns returns hg file patterns that match exactly the
+// given paths (relative to the repository root), so that paths that
+// look like patterns aren't interpreted as such.
+func hgPathPatterns(paths []string) []string {
+	pats := make([]string, len(paths))
+	for i, p := range paths {
+		pats[i] = "path:" + p
+	}
+	return pats
+}
+
+// writeFileChange applies c to the working directory wd. It returns
+// the paths of the files that were removed because they were in the
+// way of c.Path's parent directories.
+//
+// It refuses to follow symbolic links in c.Path's parent directories,
+// which could otherwise be used to write outside of wd.
+func writeFileChange(wd string, c vcs.FileChange) (replaced []string, err error) {
+	names := strings.Split(c.Path, "/")
+	dir := wd
+	for i, name := range names[:len(names)-1] {
+		dir = filepath.Join(dir, name)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if c.Delete {
+				return nil, &os.PathError{Op: "delete", Path: c.Path, Err: os.ErrNotExist}
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			return nil, fmt.Errorf("invalid file path %q (%s is a symbolic link)", c.Path, strings.Join(names[:i+1], "/"))
+		case fi.IsDir():
+			continue
+		case c.Delete:
+			return nil, &os.PathError{Op: "delete", Path: c.Path, Err: os.ErrNotExist}
+		}
+		// Replace the file with a directory.
+		if err := os.Remove(dir); err != nil {
+			return nil, err
+		}
+		replaced = append(replaced, strings.Join(names[:i+1], "/"))
+		break
+	}
+
+	name := filepath.Join(wd, filepath.FromSlash(c.Path))
+	if c.Delete {
+		if _, err := os.Lstat(name); err != nil {
+			return nil, &os.PathError{Op: "delete", Path: c.Path, Err: os.ErrNotExist}
+		}
+		return nil, os.RemoveAll(name)
+	}
+
+	// Remove whatever is at the path first, because it might be a
+	// symlink or directory.
+	if err := os.RemoveAll(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+	if c.Mode&os.ModeSymlink != 0 {
+		return replaced, os.Symlink(string(c.Data), name)
+	}
+	perm := os.FileMode(0644)
+	if c.Mode&0111 != 0 {
+		perm = 0755
+	}
+	if err := ioutil.WriteFile(name, c.Data, perm); err != nil {
+		return nil, err
+	}
+	// Set the mode explicitly in case it was altered by the umask.
+	return replaced, os.Chmod(name, perm)
+}
@@ -0,0 +1,187 @@
+package hgcmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/internal"
+)
+
+// Mercurial named branches are created by commits and can't be
+// deleted, so the RefUpdater methods operate on bookmarks (hg's
+// equivalent of git branches) instead. UpdateRef only supports
+// "refs/heads/" refs, which refer to bookmarks.
+//
+// Lightweight tags are created as local tags (which are stored in
+// .hg/localtags and aren't versioned), and annotated tags are
+// created as regular (global) tags, which are committed to .hgtags.
+
+// CreateBranch implements vcs.RefUpdater by creating a bookmark.
+func (r *Repository) CreateBranch(name string, id vcs.CommitID) error {
+	return r.UpdateRef("refs/heads/"+name, "", id)
+}
+
+// DeleteBranch implements vcs.RefUpdater by deleting a bookmark.
+func (r *Repository) DeleteBranch(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	bookmarks, err := r.bookmarks()
+	if err != nil {
+		return err
+	}
+	if _, ok := bookmarks[name]; !ok {
+		return vcs.ErrBranchNotFound
+	}
+	_, err = runHg(r.Dir, "bookmark", "--delete", "--", name)
+	return err
+}
+
+// UpdateRef implements vcs.RefUpdater. The compare-and-swap is only
+// atomic with respect to other callers in this process, not other
+// processes that modify the repository's bookmarks.
+func (r *Repository) UpdateRef(name string, old, new vcs.CommitID) error {
+	if !strings.HasPrefix(name, "refs/heads/") {
+		return fmt.Errorf("hg repositories only support updating refs/heads/ refs (bookmarks), not %q", name)
+	}
+	bookmark := strings.TrimPrefix(name, "refs/heads/")
+	if old == "" && new == "" {
+		return errors.New("hg update ref: old and new values are both empty")
+	}
+
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	bookmarks, err := r.bookmarks()
+	if err != nil {
+		return err
+	}
+	if bookmarks[bookmark] != old {
+		return vcs.ErrRefConflict
+	}
+
+	if new == "" {
+		_, err := runHg(r.Dir, "bookmark", "--delete", "--", bookmark)
+		return err
+	}
+	rev := string(new)
+	if out, err := runHg(r.Dir, "bookmark", "--force", "--rev="+rev, "--", bookmark); err != nil {
+		if isUnknownRevisionError(string(bytes.TrimSpace(out)), rev) {
+			return vcs.ErrCommitNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// bookmarks returns a map of bookmark names to the commits they
+// point to. The caller must hold r.editLock.
+func (r *Repository) bookmarks() (map[string]vcs.CommitID, error) {
+	refs, err := internal.ReadHgRefsFile(filepath.Join(r.Dir, ".hg", "bookmarks"))
+	if err != nil {
+		return nil, err
+	}
+	bookmarks := make(map[string]vcs.CommitID, len(refs))
+	for name, id := range refs {
+		bookmarks[name] = vcs.CommitID(id)
+	}
+	return bookmarks, nil
+}
+
+// CreateTag implements vcs.RefUpdater. If opt is nil, a local tag is
+// created; otherwise a global tag is committed (with opt's tagger
+// and message) on top of the head of the tagged commit's branch.
+func (r *Repository) CreateTag(name string, id vcs.CommitID, opt *vcs.CreateTagOptions) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	if _, err := r.tagCommit(name); err == nil {
+		return vcs.ErrRefConflict
+	} else if err != vcs.ErrTagNotFound {
+		return err
+	}
+	commitID, err := r.resolveCommit(id)
+	if err != nil {
+		return err
+	}
+
+	if opt == nil {
+		_, err := runHg(r.Dir, "tag", "--local", "--rev="+string(commitID), "--", name)
+		return err
+	}
+
+	wd, done, err := r.tempWorkingDir(branchHeadRevset(commitID))
+	if err != nil {
+		return err
+	}
+	defer done()
+	args := append([]string{"tag", "--rev=" + string(commitID), "--message", opt.Message}, signatureArgs(opt.Tagger)...)
+	_, err = runHg(wd, append(args, "--", name)...)
+	return err
+}
+
+// DeleteTag implements vcs.RefUpdater. A global tag is removed by
+// committing its removal on top of the head of the tagged commit's
+// branch.
+func (r *Repository) DeleteTag(name string) error {
+	r.editLock.Lock()
+	defer r.editLock.Unlock()
+
+	localTags, err := internal.ReadHgRefsFile(filepath.Join(r.Dir, ".hg", "localtags"))
+	if err != nil {
+		return err
+	}
+	if _, ok := localTags[name]; ok {
+		_, err := runHg(r.Dir, "tag", "--local", "--remove", "--", name)
+		return err
+	}
+
+	commitID, err := r.tagCommit(name)
+	if err != nil {
+		return err
+	}
+	wd, done, err := r.tempWorkingDir(branchHeadRevset(commitID))
+	if err != nil {
+		return err
+	}
+	defer done()
+	_, err = runHg(wd, "tag", "--remove", "--", name)
+	return err
+}
+
+// tagCommit returns the commit that the tag points to, or
+// vcs.ErrTagNotFound if there is no such tag. Unlike ResolveTag, it
+// doesn't resolve other kinds of revisions.
+func (r *Repository) tagCommit(name string) (vcs.CommitID, error) {
+	tags, err := r.Tags()
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag.CommitID, nil
+		}
+	}
+	return "", vcs.ErrTagNotFound
+}
+
+// resolveCommit returns the full ID of the commit identified by id,
+// or vcs.ErrCommitNotFound if there is no such commit.
+func (r *Repository) resolveCommit(id vcs.CommitID) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevision(string(id))
+	if err == vcs.ErrRevisionNotFound {
+		return "", vcs.ErrCommitNotFound
+	}
+	return commitID, err
+}
+
+// branchHeadRevset returns a revset that identifies the head of the
+// named branch that the commit id (which must be a full commit ID)
+// is on.
+func branchHeadRevset(id vcs.CommitID) string {
+	return "max(head() and branch(" + string(id) + "))"
+}
@@ -1,19 +1,24 @@
 package hgcmd
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"sourcegraph.com/sourcegraph/go-diff/diff"
@@ -40,10 +45,28 @@ func CloneHgRepository(url, dir string, opt vcs.CloneOpt) (*Repository, error) {
 		args = append(args, "--noupdate")
 	}
 	args = append(args, "--", url, dir)
-	cmd := exec.Command("hg", args...)
-	out, err := cmd.CombinedOutput()
+
+	err := internal.RetryWithCredentials(context.Background(), url, opt.RemoteOpts, func(creds *vcs.Credentials) error {
+		ropt, err := withCredentials(opt.RemoteOpts, url, creds)
+		if err != nil {
+			return err
+		}
+		env, cleanup, err := hgRemoteEnv(ropt)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		cmd := exec.Command("hg", args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec `hg clone` failed: %s. Output was:\n\n%s", err, out)
+		}
+		return nil
+	}, isAuthFailure)
 	if err != nil {
-		return nil, fmt.Errorf("exec `hg clone` failed: %s. Output was:\n\n%s", err, out)
+		return nil, err
 	}
 	return Open(dir)
 }
@@ -60,11 +83,15 @@ func Open(dir string) (*Repository, error) {
 			Err:  errors.New("Mercurial repository not found."),
 		}
 	}
-	return &Repository{dir}, nil
+	return &Repository{Dir: dir}, nil
 }
 
 type Repository struct {
 	Dir string
+
+	editLock sync.Mutex // serializes ref updates
+
+	totals vcs.CommitsTotalCache
 }
 
 func (r *Repository) RepoDir() string {
@@ -72,10 +99,17 @@ func (r *Repository) RepoDir() string {
 }
 
 func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
-	cmd := exec.Command("hg", "identify", "--debug", "-i", "--rev="+spec)
+	return r.ResolveRevisionContext(context.Background(), spec)
+}
+
+func (r *Repository) ResolveRevisionContext(ctx context.Context, spec string) (vcs.CommitID, error) {
+	cmd := exec.CommandContext(ctx, "hg", "identify", "--debug", "-i", "--rev="+spec)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		out = bytes.TrimSpace(out)
 		if isUnknownRevisionError(string(out), spec) {
 			return "", vcs.ErrRevisionNotFound
@@ -86,43 +120,76 @@ func (r *Repository) ResolveRevision(spec string) (vcs.CommitID, error) {
 }
 
 func (r *Repository) ResolveTag(name string) (vcs.CommitID, error) {
-	commitID, err := r.ResolveRevision(name)
+	return r.ResolveTagContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveTagContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevisionContext(ctx, name)
 	if err == vcs.ErrRevisionNotFound {
 		return "", vcs.ErrTagNotFound
 	}
-	return commitID, nil
+	return commitID, err
 }
 
 func (r *Repository) ResolveBranch(name string) (vcs.CommitID, error) {
-	commitID, err := r.ResolveRevision(name)
+	return r.ResolveBranchContext(context.Background(), name)
+}
+
+func (r *Repository) ResolveBranchContext(ctx context.Context, name string) (vcs.CommitID, error) {
+	commitID, err := r.ResolveRevisionContext(ctx, name)
 	if err == vcs.ErrRevisionNotFound {
 		return "", vcs.ErrBranchNotFound
 	}
-	return commitID, nil
+	return commitID, err
 }
 
 func (r *Repository) Branches(opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
+	return r.BranchesContext(context.Background(), opt)
+}
+
+func (r *Repository) BranchesContext(ctx context.Context, opt vcs.BranchesOptions) ([]*vcs.Branch, error) {
 	if opt.ContainsCommit != "" {
 		return nil, fmt.Errorf("vcs.BranchesOptions.ContainsCommit option not implemented")
 	}
 
-	refs, err := r.execAndParseCols("branches")
+	refs, err := r.execAndParseCols(ctx, "branches")
 	if err != nil {
 		return nil, err
 	}
 
 	branches := make([]*vcs.Branch, len(refs))
+	names := make(map[string]struct{}, len(refs))
 	for i, ref := range refs {
 		branches[i] = &vcs.Branch{
 			Name: ref[1],
 			Head: vcs.CommitID(ref[0]),
 		}
+		names[ref[1]] = struct{}{}
+	}
+
+	// Bookmarks are hg's equivalent of git branches, so list them
+	// too (unless there's a named branch with the same name).
+	r.editLock.Lock()
+	bookmarks, err := r.bookmarks()
+	r.editLock.Unlock()
+	if err != nil {
+		return nil, err
 	}
+	for name, id := range bookmarks {
+		if _, ok := names[name]; !ok {
+			branches = append(branches, &vcs.Branch{Name: name, Head: id})
+		}
+	}
+	sort.Sort(vcs.Branches(branches))
 	return branches, nil
 }
 
 func (r *Repository) Tags() ([]*vcs.Tag, error) {
-	refs, err := r.execAndParseCols("tags")
+	return r.TagsContext(context.Background())
+}
+
+func (r *Repository) TagsContext(ctx context.Context) ([]*vcs.Tag, error) {
+	refs, err := r.execAndParseCols(ctx, "tags")
 	if err != nil {
 		return nil, err
 	}
@@ -143,11 +210,14 @@ func (p byteSlices) Len() int           { return len(p) }
 func (p byteSlices) Less(i, j int) bool { return bytes.Compare(p[i], p[j]) < 0 }
 func (p byteSlices) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
-func (r *Repository) execAndParseCols(subcmd string) ([][2]string, error) {
-	cmd := exec.Command("hg", "-v", "--debug", subcmd)
+func (r *Repository) execAndParseCols(ctx context.Context, subcmd string) ([][2]string, error) {
+	cmd := exec.CommandContext(ctx, "hg", "-v", "--debug", subcmd)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("exec `hg -v --debug %s` failed: %s. Output was:\n\n%s", subcmd, err, out)
 	}
 
@@ -157,6 +227,7 @@ func (r *Repository) execAndParseCols(subcmd string) ([][2]string, error) {
 	refs := make([][2]string, len(lines))
 	for i, line := range lines {
 		line = bytes.TrimSuffix(line, []byte(" (inactive)"))
+		line = bytes.TrimSuffix(line, []byte(" local"))
 
 		// format: "NAME      SEQUENCE:ID" (arbitrary amount of whitespace between NAME and SEQUENCE)
 		if len(line) <= 41 {
@@ -176,7 +247,11 @@ func (r *Repository) execAndParseCols(subcmd string) ([][2]string, error) {
 }
 
 func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
-	commits, _, err := r.commitLog(vcs.CommitsOptions{Head: id, N: 1, NoTotal: true})
+	return r.GetCommitContext(context.Background(), id)
+}
+
+func (r *Repository) GetCommitContext(ctx context.Context, id vcs.CommitID) (*vcs.Commit, error) {
+	commits, _, err := r.commitLog(ctx, vcs.CommitsOptions{Head: id, N: 1, NoTotal: true}, "")
 	if err != nil {
 		return nil, err
 	}
@@ -189,7 +264,86 @@ func (r *Repository) GetCommit(id vcs.CommitID) (*vcs.Commit, error) {
 }
 
 func (r *Repository) Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
-	return r.commitLog(opt)
+	return r.CommitsContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
+	if opt.Cursor != "" {
+		page, err := r.CommitsPageContext(ctx, opt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Commits, page.Total, nil
+	}
+	return r.commitLog(ctx, opt, "")
+}
+
+func (r *Repository) CommitsPage(opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	return r.CommitsPageContext(context.Background(), opt)
+}
+
+func (r *Repository) CommitsPageContext(ctx context.Context, opt vcs.CommitsOptions) (*vcs.CommitsPage, error) {
+	cursor := &vcs.CommitsCursor{}
+	if opt.Cursor != "" {
+		var err error
+		if cursor, err = vcs.ParseCommitsCursor(opt.Cursor); err != nil {
+			return nil, err
+		}
+		if len(cursor.Frontier) > 0 || (opt.Order != "" && cursor.After != "") {
+			return nil, fmt.Errorf("commits cursor %q doesn't match the options", opt.Cursor)
+		}
+	}
+
+	if opt.Order != "" {
+		// Sorting the commits requires all of them, so skip the
+		// earlier pages' commits.
+		pageOpt := opt
+		pageOpt.Cursor, pageOpt.Skip = "", cursor.Offset+opt.Skip
+		commits, total, err := r.commitLog(ctx, pageOpt, "")
+		if err != nil {
+			return nil, err
+		}
+		page := &vcs.CommitsPage{Commits: commits, Total: total}
+		if opt.N != 0 && uint(len(commits)) == opt.N {
+			page.NextCursor = (&vcs.CommitsCursor{Offset: pageOpt.Skip + opt.N}).String()
+		}
+		return page, nil
+	}
+
+	// hg's default order is by revision number, so the next page
+	// starts at the revision before the last commit on this page.
+	// Get one more commit to see if there is a next page.
+	pageOpt := opt
+	pageOpt.Cursor, pageOpt.NoTotal = "", true
+	if opt.N != 0 {
+		pageOpt.N = opt.N + 1
+	}
+	commits, _, err := r.commitLog(ctx, pageOpt, cursor.After)
+	if err != nil {
+		return nil, err
+	}
+	page := &vcs.CommitsPage{Commits: commits}
+	if opt.N != 0 && uint(len(commits)) > opt.N {
+		page.Commits = commits[:opt.N]
+		page.NextCursor = (&vcs.CommitsCursor{
+			Offset: cursor.Offset + opt.Skip + opt.N,
+			After:  commits[opt.N-1].ID,
+		}).String()
+	}
+
+	if !opt.NoTotal {
+		if total, ok := r.totals.Get(opt); ok {
+			page.Total = total
+		} else {
+			countOpt := opt
+			countOpt.N, countOpt.Skip, countOpt.Cursor = 1, 0, ""
+			if _, page.Total, err = r.commitLog(ctx, countOpt, ""); err != nil {
+				return nil, err
+			}
+			r.totals.Add(opt, page.Total)
+		}
+	}
+	return page, nil
 }
 
 var hgNullParentNodeID = []byte("0000000000000000000000000000000000000000")
@@ -198,33 +352,83 @@ func isUnknownRevisionError(output, revSpec string) bool {
 	return output == "abort: unknown revision '"+string(revSpec)+"'!"
 }
 
-func (r *Repository) commitLog(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error) {
-	revSpec := string(opt.Head)
-	if opt.Skip != 0 {
-		revSpec += "~" + strconv.FormatUint(uint64(opt.N), 10)
+// commitLog returns the commits selected by opt (ignoring opt.Cursor),
+// starting after the commit after (if set) in revision order.
+func (r *Repository) commitLog(ctx context.Context, opt vcs.CommitsOptions, after vcs.CommitID) ([]*vcs.Commit, uint, error) {
+	history, total, err := r.fileLog(ctx, opt, after)
+	if err != nil {
+		return nil, 0, err
+	}
+	commits := make([]*vcs.Commit, len(history))
+	for i, fc := range history {
+		commits[i] = fc.Commit
 	}
+	return commits, total, nil
+}
 
-	args := []string{"log", `--template={node}\x00{author|person}\x00{author|email}\x00{date|rfc3339date}\x00{desc}\x00{p1node}\x00{p2node}\x00`}
-	if opt.N != 0 {
-		args = append(args, "--limit", strconv.FormatUint(uint64(opt.N), 10))
+func (r *Repository) FileHistory(opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	return r.FileHistoryContext(context.Background(), opt)
+}
+
+func (r *Repository) FileHistoryContext(ctx context.Context, opt vcs.CommitsOptions) ([]*vcs.FileCommit, uint, error) {
+	if opt.Path == "" {
+		return nil, 0, errors.New("file history requires a path")
+	}
+	if opt.Cursor != "" {
+		return nil, 0, errors.New("file history doesn't support cursors")
+	}
+	return r.fileLog(ctx, opt, "")
+}
+
+// fileLog is like commitLog, but if opt.Path is set, it also returns
+// the path of the file in each commit, following copies and renames
+// like `hg log --follow`.
+func (r *Repository) fileLog(ctx context.Context, opt vcs.CommitsOptions, after vcs.CommitID) ([]*vcs.FileCommit, uint, error) {
+	filter, err := vcs.NewCommitFilter(opt)
+	if err != nil {
+		return nil, 0, err
 	}
-	args = append(args, "--rev="+revSpec+":0")
 
-	cmd := exec.Command("hg", args...)
+	// The revset selects the commits, but hg's regexps and orders
+	// differ from git's, so those are applied here. That requires
+	// all of the commits (not just the first N).
+	revset := commitsRevset(opt, after)
+	filtered := opt.Author != "" || opt.Committer != "" || opt.Message != "" || opt.Order != ""
+
+	// The files that each commit copied (or renamed) and their
+	// sources, which are only needed to follow the path.
+	var copies string
+	if opt.Path != "" {
+		copies = `{file_copies % '{name}\x01{source}\x01'}`
+	}
+	args := []string{"log", `--template={node}\x00{author|person}\x00{author|email}\x00{date|rfc3339date}\x00{desc}\x00{p1node}\x00{p2node}\x00{phase}\x00` + copies + `\x00`}
+	if opt.N != 0 && !filtered {
+		args = append(args, "--limit", strconv.FormatUint(uint64(opt.Skip+opt.N), 10))
+	}
+	args = append(args, "--rev="+revset)
+
+	cmd := exec.CommandContext(ctx, "hg", args...)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
 		out = bytes.TrimSpace(out)
-		if isUnknownRevisionError(string(out), revSpec) {
-			return nil, 0, vcs.ErrCommitNotFound
+		for _, rev := range append(append([]vcs.CommitID{opt.Head, opt.Base, after}, opt.Heads...), opt.Bases...) {
+			if rev != "" && isUnknownRevisionError(string(out), string(rev)) {
+				return nil, 0, vcs.ErrCommitNotFound
+			}
 		}
 		return nil, 0, fmt.Errorf("exec `hg log` failed: %s. Output was:\n\n%s", err, out)
 	}
 
-	const partsPerCommit = 7 // number of \x00-separated fields per commit
+	const partsPerCommit = 9 // number of \x00-separated fields per commit
 	allParts := bytes.Split(out, []byte{'\x00'})
 	numCommits := len(allParts) / partsPerCommit
-	commits := make([]*vcs.Commit, numCommits)
+	commits := make([]*vcs.Commit, 0, numCommits)
+	paths := map[vcs.CommitID]string{}
+	path := opt.Path // the followed path
 	for i := 0; i < numCommits; i++ {
 		parts := allParts[partsPerCommit*i : partsPerCommit*(i+1)]
 		id := vcs.CommitID(parts[0])
@@ -235,86 +439,164 @@ func (r *Repository) commitLog(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, err
 			//return nil, 0, err
 		}
 
-		parents, err := r.getParents(id)
-		if err != nil {
-			return nil, 0, fmt.Errorf("r.GetParents failed: %s. Output was:\n\n%s", err, out)
+		var parents []vcs.CommitID
+		for _, p := range parts[5:7] {
+			if len(p) > 0 && !bytes.Equal(p, hgNullParentNodeID) {
+				parents = append(parents, vcs.CommitID(p))
+			}
 		}
 
-		commits[i] = &vcs.Commit{
+		c := &vcs.Commit{
 			ID:      id,
 			Author:  vcs.Signature{string(parts[1]), string(parts[2]), pbtypes.NewTimestamp(authorTime)},
 			Message: string(parts[4]),
 			Parents: parents,
+			Phase:   string(parts[7]),
+		}
+		if filter.Match(c) {
+			commits = append(commits, c)
+			paths[id] = path
+		}
+
+		// The commits are newest first, so if this one copied the
+		// file from another file, the older ones have the other
+		// file's path (even if this one isn't selected).
+		copied := bytes.Split(parts[8], []byte{'\x01'})
+		for j := 0; j+1 < len(copied); j += 2 {
+			if string(copied[j]) == path {
+				path = string(copied[j+1])
+				break
+			}
 		}
 	}
+	if err := vcs.SortCommits(commits, opt.Order); err != nil {
+		return nil, 0, err
+	}
 
 	// Count commits.
 	var total uint
-	if !opt.NoTotal {
-		cmd = exec.Command("hg", "id", "--num", "--rev="+revSpec)
+	if filtered {
+		total = uint(len(commits))
+	} else if !opt.NoTotal {
+		cmd = exec.CommandContext(ctx, "hg", "log", "--template=.", "--rev="+revset)
 		cmd.Dir = r.Dir
 		out, err = cmd.CombinedOutput()
 		if err != nil {
-			return nil, 0, fmt.Errorf("exec `hg id --num` failed: %s. Output was:\n\n%s", err, out)
-		}
-		out = bytes.TrimSpace(out)
-		total, err = parseUint(string(out))
-		if err != nil {
-			return nil, 0, err
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+			return nil, 0, fmt.Errorf("exec `hg log` failed: %s. Output was:\n\n%s", err, out)
 		}
-		total++ // sequence number is 1 less than total number of commits
-
-		// Add back however many we skipped.
-		total += opt.Skip
+		total = uint(bytes.Count(out, []byte(".")))
+	}
+	if opt.NoTotal {
+		total = 0
 	}
 
-	return commits, total, nil
-}
-
-func parseUint(s string) (uint, error) {
-	n, err := strconv.ParseUint(s, 10, 64)
-	return uint(n), err
+	if opt.Skip >= uint(len(commits)) {
+		commits = nil
+	} else {
+		commits = commits[opt.Skip:]
+	}
+	if opt.N != 0 && uint(len(commits)) > opt.N {
+		commits = commits[:opt.N]
+	}
+	history := make([]*vcs.FileCommit, len(commits))
+	for i, c := range commits {
+		history[i] = &vcs.FileCommit{Commit: c, Path: paths[c.ID]}
+	}
+	return history, total, nil
 }
 
-func (r *Repository) getParents(revSpec vcs.CommitID) ([]vcs.CommitID, error) {
-	var parents []vcs.CommitID
-
-	cmd := exec.Command("hg", "parents", "-r", string(revSpec), "--template",
-		`{node}\x00{author|person}\x00{author|email}\x00{date|rfc3339date}\x00{desc}\x00{p1node}\x00{p2node}\x00`)
-	cmd.Dir = r.Dir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("exec `hg parents` failed: %s. Output was:\n\n%s", err, out)
+// commitsRevset returns the revset that selects the commits described
+// by opt, newest first, that come after the commit after (if set).
+func commitsRevset(opt vcs.CommitsOptions, after vcs.CommitID) string {
+	revs := func(ids []vcs.CommitID) string {
+		var quoted []string
+		for _, id := range ids {
+			if id != "" {
+				quoted = append(quoted, quoteRevsetString(string(id)))
+			}
+		}
+		return strings.Join(quoted, " or ")
 	}
 
-	const partsPerCommit = 7 // number of \x00-separated fields per commit
-	allParts := bytes.Split(out, []byte{'\x00'})
-	numCommits := len(allParts) / partsPerCommit
-	for i := 0; i < numCommits; i++ {
-		parts := allParts[partsPerCommit*i : partsPerCommit*(i+1)]
+	ancestors := "ancestors"
+	if opt.FirstParent {
+		ancestors = "_firstancestors"
+	}
+	revset := ancestors + "(" + revs(append([]vcs.CommitID{opt.Head}, opt.Heads...)) + ")"
+	if bases := revs(append([]vcs.CommitID{opt.Base}, opt.Bases...)); bases != "" {
+		revset = "(" + revset + " - ancestors(" + bases + "))"
+	}
 
-		if p1 := parts[0]; len(p1) > 0 && !bytes.Equal(p1, hgNullParentNodeID) {
-			parents = append(parents, vcs.CommitID(p1))
-		}
-		if p2 := parts[5]; len(p2) > 0 && !bytes.Equal(p2, hgNullParentNodeID) {
-			parents = append(parents, vcs.CommitID(p2))
+	if opt.NoMerges {
+		revset += " and not merge()"
+	}
+	if opt.MergesOnly {
+		revset += " and merge()"
+	}
+	if opt.Path != "" {
+		// The commits that changed the file, following copies and
+		// renames from each head.
+		var follow []string
+		for _, id := range append([]vcs.CommitID{opt.Head}, opt.Heads...) {
+			if id != "" {
+				follow = append(follow, "follow("+quoteRevsetString("path:"+opt.Path)+", "+quoteRevsetString(string(id))+")")
+			}
 		}
-		if p3 := parts[6]; len(p3) > 0 && !bytes.Equal(p3, hgNullParentNodeID) {
-			parents = append(parents, vcs.CommitID(p3))
+		revset += " and (" + strings.Join(follow, " or ") + ")"
+	}
+	// hg's date ranges are inclusive, like git's (and CommitFilter's).
+	if !opt.Since.IsZero() {
+		// Commit times are in seconds, so round up.
+		since := opt.Since.Unix()
+		if opt.Since.Nanosecond() != 0 {
+			since++
 		}
+		revset += fmt.Sprintf(` and date(">%d 0")`, since)
+	}
+	if !opt.Until.IsZero() {
+		revset += fmt.Sprintf(` and date("<%d 0")`, opt.Until.Unix())
+	}
+	if after != "" {
+		// The revisions before it.
+		revset += " and (:" + revs([]vcs.CommitID{after}) + " - " + revs([]vcs.CommitID{after}) + ")"
 	}
+	return "reverse(" + revset + ")"
+}
+
+// quoteRevsetString quotes s as a string in a revset.
+func quoteRevsetString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
 
-	return parents, nil
+func parseUint(s string) (uint, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	return uint(n), err
 }
 
 func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
-	cmd := exec.Command("hg", "-v", "diff", "-p", "--git", "--rev="+string(base), "--rev="+string(head), "--")
+	return r.DiffContext(context.Background(), base, head, opt)
+}
+
+func (r *Repository) DiffContext(ctx context.Context, base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	return r.diff(ctx, "", base, head, opt)
+}
+
+// diff computes the diff between base and head in the repository, or
+// in the repository overlaid with the changesets in bundle (if set).
+func (r *Repository) diff(ctx context.Context, bundle string, base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	cmd := exec.CommandContext(ctx, "hg", r.bundleArgs(bundle, "-v", "diff", "-p", "--git", "--rev="+string(base), "--rev="+string(head), "--")...)
 	if opt != nil {
 		cmd.Args = append(cmd.Args, opt.Paths...)
 	}
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		out = bytes.TrimSpace(out)
 		if isUnknownRevisionError(string(out), string(base)) || isUnknownRevisionError(string(out), string(head)) {
 			return nil, vcs.ErrCommitNotFound
@@ -343,110 +625,786 @@ func (r *Repository) Diff(base, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.D
 		return nil, err
 	}
 
-	return &vcs.Diff{
-		Raw: string(out),
-	}, nil
+	return vcs.ParseDiff(out, opt)
 }
 
-func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
-	if opt.SSH != nil {
-		return nil, fmt.Errorf("hgcmd: ssh remote not supported")
+func (r *Repository) CommitFiles(id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	return r.CommitFilesContext(context.Background(), id, opt)
+}
+
+// CommitFilesContext implements vcs.CommitFilesListerContext. hg
+// records renames and copies when they are made, so they are always
+// reported (and opt.DetectCopies is ignored).
+func (r *Repository) CommitFilesContext(ctx context.Context, id vcs.CommitID, opt *vcs.CommitFilesOptions) ([]*vcs.CommitFiles, error) {
+	commit, err := r.GetCommitContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := commit.Parents
+	if len(parents) == 0 {
+		// Compare a root commit with an empty tree.
+		parents = []vcs.CommitID{""}
+	}
+	all := make([]*vcs.CommitFiles, len(parents))
+	for i, parent := range parents {
+		base := parent
+		if base == "" {
+			base = "null"
+		}
+		d, err := r.DiffContext(ctx, base, commit.ID, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		files := &vcs.CommitFiles{Parent: parent}
+		for _, fd := range d.Files {
+			f := &vcs.ChangedFile{
+				Path:       fd.NewPath,
+				ChangeType: fd.ChangeType,
+				Binary:     fd.Binary,
+				Added:      fd.Added,
+				Deleted:    fd.Deleted,
+			}
+			switch fd.ChangeType {
+			case vcs.FileChangeType_DELETED:
+				f.Path = fd.OrigPath
+			case vcs.FileChangeType_RENAMED, vcs.FileChangeType_COPIED:
+				f.OrigPath = fd.OrigPath
+			case vcs.FileChangeType_MODE_CHANGED:
+				f.ChangeType = vcs.FileChangeType_MODIFIED
+			}
+			files.Files = append(files.Files, f)
+		}
+		all[i] = files
+	}
+	return all, nil
+}
+
+// A CrossRepo is an hg repository that can be used in cross-repo
+// operations (e.g., as the head repository for a cross-repo diff in
+// another hg repository's CrossRepoDiff method, or as the 2nd repo in
+// a CrossRepoMergeBase call).
+type CrossRepo interface {
+	HgRootDir() string // the repo's root directory
+}
+
+func (r *Repository) HgRootDir() string { return r.Dir }
+
+func (r *Repository) CrossRepoDiff(base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	return r.CrossRepoDiffContext(context.Background(), base, headRepo, head, opt)
+}
+
+func (r *Repository) CrossRepoDiffContext(ctx context.Context, base vcs.CommitID, headRepo vcs.Repository, head vcs.CommitID, opt *vcs.DiffOptions) (*vcs.Diff, error) {
+	// The native hg Repository inherits HgRootDir and CrossRepo from
+	// its embedded hgcmd.Repository.
+
+	var headDir string // path to head repo on local filesystem
+	if headRepo, ok := headRepo.(CrossRepo); ok {
+		headDir = headRepo.HgRootDir()
+	} else {
+		return nil, fmt.Errorf("hg cross-repo diff not supported against head repo type %T", headRepo)
 	}
-	cmd := exec.Command("hg", "pull")
+
+	bundle, cleanup, err := r.incoming(ctx, headDir, head)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	return r.diff(ctx, bundle, base, head, opt)
+}
+
+// incoming writes the changesets that are ancestors of rev in the
+// repository at repoDir, but that aren't in r, to a temporary bundle
+// file (using `hg incoming --bundle`). Commands run with the bundle's
+// path in r.bundleArgs see r overlaid with those changesets, without
+// modifying r. If there are no such changesets (or repoDir is r's
+// directory), the bundle's path is empty. The caller must call
+// cleanup when done with the bundle.
+func (r *Repository) incoming(ctx context.Context, repoDir string, rev vcs.CommitID) (bundle string, cleanup func(), err error) {
+	cleanup = func() {}
+	if repoDir == r.Dir {
+		return "", cleanup, nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "go-vcs-hg-incoming")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(tmpDir) }
+	bundle = filepath.Join(tmpDir, "incoming.hg")
+
+	cmd := exec.CommandContext(ctx, "hg", "incoming", "-q", "--bundle", bundle, "--rev", string(rev), "--", repoDir)
 	cmd.Dir = r.Dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("exec `hg pull` failed: %s. Output was:\n\n%s", err, out)
+		cleanup()
+		if err := ctx.Err(); err != nil {
+			return "", func() {}, err
+		}
+		if exitStatus(err) == 1 {
+			// No incoming changesets, so r already has rev.
+			return "", func() {}, nil
+		}
+		out = bytes.TrimSpace(out)
+		if isUnknownRevisionError(string(out), string(rev)) {
+			return "", func() {}, vcs.ErrCommitNotFound
+		}
+		return "", func() {}, fmt.Errorf("exec `hg incoming` failed: %s. Output was:\n\n%s", err, out)
+	}
+	return bundle, cleanup, nil
+}
+
+func exitStatus(err error) int {
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		// There is no platform independent way to retrieve
+		// the exit code, but the following will work on Unix
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 0
+}
+
+// bundleArgs returns the args of an hg command that runs in r (with
+// cmd.Dir set to r.Dir), overlaid with the changesets in bundle if it
+// is not empty.
+func (r *Repository) bundleArgs(bundle string, args ...string) []string {
+	if bundle == "" {
+		return args
+	}
+	return append([]string{"-R", bundle, "--config", "bundle.mainreporoot=" + r.Dir}, args...)
+}
+
+func (r *Repository) MergeBase(a, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.MergeBaseContext(context.Background(), a, b)
+}
+
+func (r *Repository) MergeBaseContext(ctx context.Context, a, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.mergeBase(ctx, "", a, b)
+}
+
+// mergeBase returns the greatest common ancestor of a and b (using the
+// ancestor() revset) in the repository, or in the repository overlaid
+// with the changesets in bundle (if set).
+func (r *Repository) mergeBase(ctx context.Context, bundle string, a, b vcs.CommitID) (vcs.CommitID, error) {
+	revset := "ancestor(" + quoteRevsetString(string(a)) + ", " + quoteRevsetString(string(b)) + ")"
+	cmd := exec.CommandContext(ctx, "hg", r.bundleArgs(bundle, "log", "--rev", revset, "--template", "{node}")...)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		out = bytes.TrimSpace(out)
+		if isUnknownRevisionError(string(out), string(a)) || isUnknownRevisionError(string(out), string(b)) {
+			return "", vcs.ErrCommitNotFound
+		}
+		return "", fmt.Errorf("exec %v failed: %s. Output was:\n\n%s", cmd.Args, err, out)
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 || bytes.Equal(out, hgNullParentNodeID) {
+		return "", fmt.Errorf("hg: no common ancestor of %s and %s", a, b)
+	}
+	return vcs.CommitID(out), nil
+}
+
+func (r *Repository) CrossRepoMergeBase(a vcs.CommitID, repoB vcs.Repository, b vcs.CommitID) (vcs.CommitID, error) {
+	return r.CrossRepoMergeBaseContext(context.Background(), a, repoB, b)
+}
+
+func (r *Repository) CrossRepoMergeBaseContext(ctx context.Context, a vcs.CommitID, repoB vcs.Repository, b vcs.CommitID) (vcs.CommitID, error) {
+	var repoBDir string // path to repo B on local filesystem
+	if repoB, ok := repoB.(CrossRepo); ok {
+		repoBDir = repoB.HgRootDir()
+	} else {
+		return "", fmt.Errorf("hg cross-repo merge-base not supported against repo type %T", repoB)
+	}
+
+	bundle, cleanup, err := r.incoming(ctx, repoBDir, b)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	return r.mergeBase(ctx, bundle, a, b)
+}
+
+func (r *Repository) UpdateEverything(opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
+	return r.UpdateEverythingContext(context.Background(), opt)
+}
+
+func (r *Repository) UpdateEverythingContext(ctx context.Context, opt vcs.RemoteOpts) (*vcs.UpdateResult, error) {
+	var url string
+	if opt.Credentials != nil {
+		cmd := exec.CommandContext(ctx, "hg", "paths", "default")
+		cmd.Dir = r.Dir
+		out, err := cmd.Output()
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("exec `hg paths` failed: %s", err)
+		}
+		url = strings.TrimSpace(string(out))
+	}
+
+	err := internal.RetryWithCredentials(ctx, url, opt, func(creds *vcs.Credentials) error {
+		ropt, err := withCredentials(opt, url, creds)
+		if err != nil {
+			return err
+		}
+		env, cleanup, err := hgRemoteEnv(ropt)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		cmd := exec.CommandContext(ctx, "hg", "pull")
+		cmd.Dir = r.Dir
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("exec `hg pull` failed: %s. Output was:\n\n%s", err, out)
+		}
+		return nil
+	}, isAuthFailure)
+	if err != nil {
+		return nil, err
 	}
 	// TODO: Calculate value of vcs.UpdateResult.
 	return nil, nil
 }
 
+// withCredentials returns opt with the HTTPS credentials for the
+// remote at url (if creds is non-nil) in place of those in opt.HTTPS.
+// Only the fields that creds sets are replaced.
+func withCredentials(opt vcs.RemoteOpts, url string, creds *vcs.Credentials) (vcs.RemoteOpts, error) {
+	if creds == nil {
+		return opt, nil
+	}
+	if vcs.RemoteProtocol(url) != "https" {
+		return opt, fmt.Errorf("hgcmd: credentials for %s remotes not supported", vcs.RemoteProtocol(url))
+	}
+	var c vcs.HTTPSConfig
+	if opt.HTTPS != nil {
+		c = *opt.HTTPS
+	}
+	if creds.Username != "" {
+		c.User = creds.Username
+	}
+	if creds.Password != "" {
+		c.Pass = creds.Password
+	}
+	if creds.Token != "" {
+		c.Token = creds.Token
+	}
+	opt.HTTPS = &c
+	return opt, nil
+}
+
+// isAuthFailure reports whether err (from an hg command that
+// communicates with a remote) is because the remote rejected the
+// credentials.
+func isAuthFailure(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"authorization failed",
+		"authorization required",
+		"HTTP Error 401",
+		"HTTP Error 403",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hgRemoteEnv returns the environment for hg to communicate with the
+// remote according to opt (or nil, to use this process's
+// environment). The settings are written to an hgrc file (readable
+// only by the current user, so that passwords aren't visible in the hg
+// command's arguments) that is read after the usual configuration
+// files. You should call cleanup after hg exits.
+func hgRemoteEnv(opt vcs.RemoteOpts) (env []string, cleanup func(), err error) {
+	cleanup = func() {}
+	if opt.SSH != nil {
+		return nil, nil, fmt.Errorf("hgcmd: ssh remote not supported")
+	}
+	h := opt.HTTPS
+	if h == nil {
+		return nil, cleanup, nil
+	}
+
+	var hgrc bytes.Buffer
+	var configErr error
+	section := func(name string) {
+		fmt.Fprintf(&hgrc, "[%s]\n", name)
+	}
+	config := func(key, value string) {
+		if key == "" || strings.ContainsAny(key, "=[]#;%\r\n") || strings.ContainsAny(value, "\r\n") || strings.TrimSpace(key) != key || strings.TrimSpace(value) != value {
+			configErr = fmt.Errorf("hgcmd: invalid HTTPS setting %q", key)
+		}
+		fmt.Fprintf(&hgrc, "%s = %s\n", key, value)
+	}
+
+	dir, err := ioutil.TempDir("", "go-vcs-hgcmd")
+	if err != nil {
+		return nil, nil, err
+	}
+	removeDir := func() { os.RemoveAll(dir) }
+	defer func() {
+		if err != nil {
+			removeDir()
+		}
+	}()
+
+	clientKey := h.ClientKey
+	if h.ClientCert == nil {
+		clientKey = nil // hg ignores a key without a certificate
+	}
+	files := map[string]string{} // setting -> file
+	for _, f := range []struct {
+		key, name string
+		data      []byte
+	}{
+		{"cert", "cert.pem", h.ClientCert},
+		{"key", "key.pem", clientKey},
+		{"cacerts", "ca.pem", h.CACerts},
+	} {
+		if f.data == nil {
+			continue
+		}
+		path := filepath.Join(dir, f.name)
+		if err := internal.WriteFileWithPermissions(path, f.data, 0600); err != nil {
+			return nil, nil, err
+		}
+		files[f.key] = path
+	}
+
+	if h.User != "" || h.Pass != "" || h.ClientCert != nil {
+		section("auth")
+		config("govcs.prefix", "*")
+		if h.User != "" {
+			config("govcs.username", h.User)
+		}
+		if h.Pass != "" {
+			config("govcs.password", h.Pass)
+		}
+		if files["cert"] != "" {
+			config("govcs.cert", files["cert"])
+		}
+		if files["key"] != "" {
+			config("govcs.key", files["key"])
+		}
+	}
+	if files["cacerts"] != "" {
+		section("web")
+		config("cacerts", files["cacerts"])
+	}
+	if h.Proxy != "" {
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("hgcmd: invalid proxy URL: %s", err)
+		}
+		section("http_proxy")
+		config("host", u.Host)
+		if u.User != nil {
+			config("user", u.User.Username())
+			if pass, ok := u.User.Password(); ok {
+				config("passwd", pass)
+			}
+		}
+	}
+	if h.Token != "" || len(h.ExtraHeaders) > 0 {
+		// hg has no setting for extra headers, so they are added by
+		// an extension.
+		extFile := filepath.Join(dir, "govcsheaders.py")
+		if err := internal.WriteFileWithPermissions(extFile, []byte(hgHeadersExtension), 0600); err != nil {
+			return nil, nil, err
+		}
+		section("extensions")
+		config("govcsheaders", extFile)
+		section("govcs_headers")
+		if h.Token != "" {
+			config("Authorization", "Bearer "+h.Token)
+		}
+		for _, header := range h.ExtraHeaders {
+			i := strings.Index(header, ":")
+			if i <= 0 {
+				return nil, nil, fmt.Errorf("hgcmd: invalid HTTPS extra header %q", header)
+			}
+			config(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+		}
+	}
+	if configErr != nil {
+		return nil, nil, configErr
+	}
+
+	hgrcFile := filepath.Join(dir, "hgrc")
+	if err := internal.WriteFileWithPermissions(hgrcFile, hgrc.Bytes(), 0600); err != nil {
+		return nil, nil, err
+	}
+	env = append(os.Environ(), "HGRCPATH="+strings.Join(append(hgConfigPath(), hgrcFile), string(filepath.ListSeparator)))
+	return env, removeDir, nil
+}
+
+// hgHeadersExtension is an hg extension that adds the HTTP headers in
+// the [govcs_headers] section to hg's requests.
+const hgHeadersExtension = `from mercurial import extensions, pycompat, url
+
+def _opener(orig, ui, *args, **kwargs):
+    o = orig(ui, *args, **kwargs)
+    for name, value in ui.configitems(b'govcs_headers'):
+        o.addheaders.append((pycompat.sysstr(name), pycompat.sysstr(value)))
+    return o
+
+def uisetup(ui):
+    extensions.wrapfunction(url, 'opener', _opener)
+`
+
+// hgConfigPath returns the configuration files that hg reads when
+// HGRCPATH isn't set (or HGRCPATH's files, if it is set), so that they
+// are still read when hgRemoteEnv sets HGRCPATH.
+func hgConfigPath() []string {
+	if p, ok := os.LookupEnv("HGRCPATH"); ok {
+		return filepath.SplitList(p)
+	}
+	var paths []string
+	if runtime.GOOS == "windows" {
+		if home := os.Getenv("USERPROFILE"); home != "" {
+			paths = append(paths, filepath.Join(home, "mercurial.ini"), filepath.Join(home, ".hgrc"))
+		}
+	} else {
+		paths = append(paths, "/etc/mercurial/hgrc", "/etc/mercurial/hgrc.d")
+		home := homeDir()
+		if home != "" {
+			paths = append(paths, filepath.Join(home, ".hgrc"))
+		}
+		if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+			paths = append(paths, filepath.Join(dir, "hg", "hgrc"))
+		} else if home != "" {
+			paths = append(paths, filepath.Join(home, ".config", "hg", "hgrc"))
+		}
+	}
+	var existing []string
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			existing = append(existing, p)
+		}
+	}
+	return existing
+}
+
+// homeDir returns the current user's home directory (like hg, from
+// $HOME if it is set), or "" if it is unknown.
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
 func (r *Repository) BlameFile(path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
+	return r.BlameFileContext(context.Background(), path, opt)
+}
+
+func (r *Repository) BlameFileContext(ctx context.Context, path string, opt *vcs.BlameOptions) ([]*vcs.Hunk, error) {
 	if opt == nil {
 		opt = &vcs.BlameOptions{}
 	}
+	if opt.DetectMoves || opt.DetectCopies {
+		return nil, fmt.Errorf("BlameOptions.DetectMoves and DetectCopies not implemented for vcs type: hg")
+	}
 
-	// TODO(sqs): implement OldestCommit
-	cmd := exec.Command("python", "-", r.Dir, string(opt.NewestCommit), path)
-	cmd.Dir = r.Dir
-	cmd.Stdin = strings.NewReader(hgRepoAnnotatePy)
-	stdout, err := cmd.StdoutPipe()
+	at := opt.NewestCommit
+	if at == "" {
+		at = "tip"
+	}
+	fs, err := r.FileSystemContext(ctx, at)
 	if err != nil {
 		return nil, err
 	}
-	stderr, err := cmd.StderrPipe()
+	ignoreRevs := opt.IgnoreRevs
+	if opt.IgnoreRevsFile != "" {
+		data, err := vfs.ReadFile(fs, opt.IgnoreRevsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ignoreRevs = append(ignoreRevs[:len(ignoreRevs):len(ignoreRevs)], vcs.ParseBlameIgnoreRevs(data)...)
+	}
+
+	lines, err := r.annotate(ctx, path, string(at), opt, ignoreRevs)
 	if err != nil {
 		return nil, err
 	}
 
-	in := bufio.NewReader(stdout)
-	if err := cmd.Start(); err != nil {
+	// The lines' contents are read from the file, because hg's JSON
+	// output doesn't preserve bytes that aren't valid UTF-8.
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
 		return nil, err
 	}
+	texts := bytes.SplitAfter(data, []byte("\n"))
+	if len(texts) > 0 && len(texts[len(texts)-1]) == 0 {
+		texts = texts[:len(texts)-1]
+	}
+	if len(texts) != len(lines) {
+		return nil, fmt.Errorf("`hg annotate` returned %d lines, want %d", len(lines), len(texts))
+	}
+	for i := range lines {
+		lines[i].Text = texts[i]
+	}
 
-	var data struct {
-		Commits map[string]struct {
-			Author     struct{ Name, Email string }
-			AuthorDate time.Time
-		}
-		Hunks map[string][]struct {
-			CommitID           string
-			StartLine, EndLine int
-			StartByte, EndByte int
-		}
-	}
-	jsonErr := json.NewDecoder(in).Decode(&data)
-	errOut, _ := ioutil.ReadAll(stderr)
-	if jsonErr != nil {
-		cmd.Wait()
-		return nil, fmt.Errorf("%s (stderr: %s)", jsonErr, errOut)
-	}
-	if err := cmd.Wait(); err != nil {
-		return nil, fmt.Errorf("%s (stderr: %s)", err, errOut)
-	}
-
-	hunks := make([]*vcs.Hunk, len(data.Hunks[path]))
-	for i, hunk := range data.Hunks[path] {
-		c := data.Commits[hunk.CommitID]
-		hunks[i] = &vcs.Hunk{
-			StartLine: hunk.StartLine,
-			EndLine:   hunk.EndLine,
-			StartByte: hunk.StartByte,
-			EndByte:   hunk.EndByte,
-			CommitID:  vcs.CommitID(hunk.CommitID),
-			Author: vcs.Signature{
-				Name:  c.Author.Name,
-				Email: c.Author.Email,
-				Date:  pbtypes.NewTimestamp(c.AuthorDate.In(time.UTC)),
-			},
+	if opt.OldestCommit != "" {
+		if err := r.blameBoundary(ctx, lines, path, opt, ignoreRevs); err != nil {
+			return nil, err
 		}
 	}
+	hunks := internal.BlameHunks(lines)
+	if err := r.blameCommits(ctx, hunks); err != nil {
+		return nil, err
+	}
 	return hunks, nil
 }
 
+// annotate returns the lines of the file at path in the revision rev
+// (without their contents) and where they came from, according to
+// `hg annotate`.
+func (r *Repository) annotate(ctx context.Context, path, rev string, opt *vcs.BlameOptions, ignoreRevs []vcs.CommitID) ([]internal.BlameLine, error) {
+	args := []string{"annotate", "--changeset", "--file", "--line-number", "--template=json", "--rev=" + rev}
+	if !opt.NoIgnoreWhitespace {
+		args = append(args, "--ignore-all-space")
+	}
+	for _, rev := range ignoreRevs {
+		// Lines from skipped revisions are attributed to the
+		// revisions that previously changed them.
+		args = append(args, "--skip=id("+quoteRevsetString(string(rev))+")")
+	}
+	args = append(args, "--", path)
+
+	cmd := exec.CommandContext(ctx, "hg", args...)
+	cmd.Dir = r.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var stderr []byte
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = bytes.TrimSpace(ee.Stderr)
+		}
+		if isUnknownRevisionError(string(stderr), rev) {
+			return nil, vcs.ErrCommitNotFound
+		}
+		return nil, fmt.Errorf("exec `hg annotate` failed: %s. Output was:\n\n%s", err, stderr)
+	}
+
+	var files []struct {
+		Lines []struct {
+			Node   string `json:"node"`
+			Path   string `json:"path"`
+			Lineno int    `json:"lineno"`
+		} `json:"lines"`
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return nil, fmt.Errorf("parsing output of `hg annotate` failed: %s", err)
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("`hg annotate` returned %d files, want 1", len(files))
+	}
+
+	lines := make([]internal.BlameLine, len(files[0].Lines))
+	for i, l := range files[0].Lines {
+		lines[i] = internal.BlameLine{
+			CommitID: vcs.CommitID(l.Node),
+			Path:     l.Path,
+			Line:     l.Lineno,
+		}
+	}
+	return lines, nil
+}
+
+// blameCommits sets the authors and summaries of the hunks' commits.
+func (r *Repository) blameCommits(ctx context.Context, hunks []*vcs.Hunk) error {
+	if len(hunks) == 0 {
+		return nil
+	}
+	args := []string{"log", `--template={node}\x00{author|person}\x00{author|email}\x00{date|rfc3339date}\x00{desc|firstline}\x00`}
+	seen := map[vcs.CommitID]bool{}
+	for _, hunk := range hunks {
+		if !seen[hunk.CommitID] {
+			seen[hunk.CommitID] = true
+			// Each commit is a separate argument, because a single
+			// argument can't be longer than 128 KiB on Linux.
+			args = append(args, "--rev=id("+string(hunk.CommitID)+")")
+		}
+	}
+	cmd := exec.CommandContext(ctx, "hg", args...)
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("exec `hg log` failed: %s. Output was:\n\n%s", err, out)
+	}
+
+	const partsPerCommit = 5 // number of \x00-separated fields per commit
+	allParts := bytes.Split(out, []byte{'\x00'})
+	type commitInfo struct {
+		author  vcs.Signature
+		summary string
+	}
+	commits := map[vcs.CommitID]commitInfo{}
+	for i := 0; i+partsPerCommit <= len(allParts); i += partsPerCommit {
+		parts := allParts[i : i+partsPerCommit]
+		authorTime, err := time.Parse(time.RFC3339, string(parts[3]))
+		if err != nil {
+			return err
+		}
+		commits[vcs.CommitID(parts[0])] = commitInfo{
+			author: vcs.Signature{
+				Name:  string(parts[1]),
+				Email: string(parts[2]),
+				Date:  pbtypes.NewTimestamp(authorTime.In(time.UTC)),
+			},
+			summary: string(parts[4]),
+		}
+	}
+	for _, hunk := range hunks {
+		c := commits[hunk.CommitID]
+		hunk.Author, hunk.Summary = c.author, c.summary
+	}
+	return nil
+}
+
+// blameBoundary attributes the lines whose commits are
+// opt.OldestCommit or its ancestors to opt.OldestCommit (see
+// internal.BlameBoundary).
+func (r *Repository) blameBoundary(ctx context.Context, lines []internal.BlameLine, path string, opt *vcs.BlameOptions, ignoreRevs []vcs.CommitID) error {
+	oldestID, err := r.ResolveRevisionContext(ctx, string(opt.OldestCommit))
+	if err != nil {
+		return err
+	}
+
+	// List all of oldest's ancestors (instead of asking hg which of
+	// the lines' commits are among them), so that the command line
+	// doesn't get too long for files with many hunks.
+	cmd := exec.CommandContext(ctx, "hg", "log", "--template={node}\n", "--rev=::"+string(oldestID))
+	cmd.Dir = r.Dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("exec `hg log` failed: %s. Output was:\n\n%s", err, out)
+	}
+	boundary := map[vcs.CommitID]bool{}
+	for _, id := range strings.Fields(string(out)) {
+		boundary[vcs.CommitID(id)] = true
+	}
+
+	oldestFS, err := r.FileSystemContext(ctx, oldestID)
+	if err != nil {
+		return err
+	}
+	oldestLines := func(path string) ([]internal.BlameLine, error) {
+		if _, err := oldestFS.Lstat(path); os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return r.annotate(ctx, path, string(oldestID), opt, ignoreRevs)
+	}
+	return internal.BlameBoundary(lines, path, boundary, oldestID, oldestLines)
+}
+
 func (r *Repository) Committers(opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
-	return nil, fmt.Errorf("Committers() not implemented for vcs type: hg")
+	return r.CommittersContext(context.Background(), opt)
+}
+
+func (r *Repository) CommittersContext(ctx context.Context, opt vcs.CommittersOptions) ([]*vcs.Committer, error) {
+	if opt.Rev == "" {
+		opt.Rev = "tip"
+	}
+	head, err := r.ResolveRevisionContext(ctx, opt.Rev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the commits by each author, like `git shortlog -sne`.
+	commits, _, err := r.commitLog(ctx, vcs.CommitsOptions{
+		Head:    head,
+		Since:   opt.Since,
+		Until:   opt.Until,
+		Path:    opt.Path,
+		NoTotal: true,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+	return vcs.CountCommitters(commits, opt.N), nil
+}
+
+func (r *Repository) Search(at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	return r.SearchContext(context.Background(), at, opt)
+}
+
+// SearchContext implements vcs.SearcherContext. hg has no equivalent
+// of `git grep` that searches a commit's tree, so the files in the
+// commit are searched with vcs.SearchFileSystem.
+func (r *Repository) SearchContext(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions) ([]*vcs.SearchResult, error) {
+	fs, err := r.FileSystemContext(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+	return vcs.SearchFileSystem(ctx, fs, opt)
+}
+
+func (r *Repository) SearchStream(ctx context.Context, at vcs.CommitID, opt vcs.SearchOptions, fn func(*vcs.SearchResult) error) (*vcs.SearchStats, error) {
+	fs, err := r.FileSystemContext(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+	return vcs.SearchFileSystemStream(ctx, fs, opt, fn)
 }
 
 func (r *Repository) FileSystem(at vcs.CommitID) (vfs.FileSystem, error) {
+	return r.FileSystemContext(context.Background(), at)
+}
+
+func (r *Repository) FileSystemContext(ctx context.Context, at vcs.CommitID) (vfs.FileSystem, error) {
 	return &hgFSCmd{
+		ctx: ctx,
 		dir: r.Dir,
 		at:  at,
 	}, nil
 }
 
 type hgFSCmd struct {
+	ctx context.Context
 	dir string
 	at  vcs.CommitID
 }
 
 func (fs *hgFSCmd) Open(name string) (vfs.ReadSeekCloser, error) {
 	name = internal.Rel(name)
-	cmd := exec.Command("hg", "cat", "--rev="+string(fs.at), "--", name)
+	cmd := exec.CommandContext(fs.ctx, "hg", "cat", "--rev="+string(fs.at), "--", name)
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		if bytes.Contains(out, []byte("no such file in rev")) {
 			return nil, os.ErrNotExist
 		}
@@ -465,11 +1423,14 @@ func (fs *hgFSCmd) Stat(path string) (os.FileInfo, error) {
 	path = internal.Rel(path)
 	var mtime time.Time
 
-	cmd := exec.Command("hg", "log", "-l1", `--template={date|date}`,
+	cmd := exec.CommandContext(fs.ctx, "hg", "log", "-l1", `--template={date|date}`,
 		"-r "+string(fs.at)+":0", "--", path)
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, err
 	}
 
@@ -481,10 +1442,13 @@ func (fs *hgFSCmd) Stat(path string) (os.FileInfo, error) {
 	}
 
 	// this just determines if the file exists.
-	cmd = exec.Command("hg", "locate", "--rev="+string(fs.at), "--", path)
+	cmd = exec.CommandContext(fs.ctx, "hg", "locate", "--rev="+string(fs.at), "--", path)
 	cmd.Dir = fs.dir
 	err = cmd.Run()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		// hg doesn't track dirs, so use a workaround to see if path is a dir.
 		if _, err := fs.ReadDir(path); err == nil {
 			return &util.FileInfo{Name_: filepath.Base(path), Mode_: os.ModeDir,
@@ -511,10 +1475,13 @@ func (fs *hgFSCmd) ReadDir(path string) ([]os.FileInfo, error) {
 	// the dir specified by path, plus all files one level deeper (but no
 	// deeper). This lets us list the files *and* subdirs in the dir without
 	// needlessly listing recursively.
-	cmd := exec.Command("hg", "locate", "--rev="+string(fs.at), "--include="+path, "--exclude="+filepath.Clean(path)+"/*/*/*")
+	cmd := exec.CommandContext(fs.ctx, "hg", "locate", "--rev="+string(fs.at), "--include="+path, "--exclude="+filepath.Clean(path)+"/*/*/*")
 	cmd.Dir = fs.dir
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		if err := fs.ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("exec `hg cat` failed: %s. Output was:\n\n%s", err, out)
 	}
 
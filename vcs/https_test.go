@@ -0,0 +1,301 @@
+package vcs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/git"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/gitcmd"
+)
+
+// startGitHTTPServer starts an HTTP server (or an HTTPS server, if
+// tlsConfig is non-nil) that serves the git repositories in dir with
+// git http-backend. Requests that authorized (if non-nil) rejects get
+// a 401 response asking for basic authentication.
+func startGitHTTPServer(t *testing.T, dir string, tlsConfig *tls.Config, authorized func(*http.Request) bool) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized != nil && !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-vcs"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	})
+	if tlsConfig == nil {
+		return httptest.NewServer(h)
+	}
+	s := httptest.NewUnstartedServer(h)
+	s.TLS = tlsConfig
+	s.StartTLS()
+	return s
+}
+
+// makeClientCert returns a new self-signed TLS client certificate and
+// its private key, PEM-encoded.
+func makeClientCert(t *testing.T) (cert *x509.Certificate, certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-vcs"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestRepository_Clone_https(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	// TODO: test hgcmd HTTPS support (it needs an hg server).
+	cloners := map[string]func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error){
+		"git libgit2": func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		"git cmd":     func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+	}
+
+	clientCert, clientCertPEM, clientKeyPEM := makeClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	// caCerts returns the PEM-encoded certificate of the test HTTPS
+	// server.
+	caCerts := func(s *httptest.Server) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	}
+	basicAuth := func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "u" && pass == "p"
+	}
+
+	tests := map[string]struct {
+		tls        *tls.Config                               // if non-nil, the server uses HTTPS
+		authorized func(*http.Request) bool                  // if non-nil, the server requires authorization
+		host       string                                    // if set, the URL host (instead of the server's)
+		https      func(s *httptest.Server) *vcs.HTTPSConfig // s is the test server
+		wantErr    bool
+	}{
+		"user and password": {
+			authorized: basicAuth,
+			https:      func(*httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{User: "u", Pass: "p"} },
+		},
+		"wrong password": {
+			authorized: basicAuth,
+			https:      func(*httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{User: "u", Pass: "x"} },
+			wantErr:    true,
+		},
+		"token": {
+			authorized: func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer t0k3n" },
+			https:      func(*httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{Token: "t0k3n"} },
+		},
+		"extra headers": {
+			authorized: func(r *http.Request) bool {
+				return r.Header.Get("X-Token") == "secret" && r.Header.Get("X-Other") == "1"
+			},
+			https: func(*httptest.Server) *vcs.HTTPSConfig {
+				return &vcs.HTTPSConfig{ExtraHeaders: []string{"X-Token: secret", "X-Other: 1"}}
+			},
+		},
+		"CA certificates": {
+			tls:   &tls.Config{},
+			https: func(s *httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{CACerts: caCerts(s)} },
+		},
+		"untrusted server certificate": {
+			tls:     &tls.Config{},
+			https:   func(*httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{} },
+			wantErr: true,
+		},
+		"client certificate": {
+			tls: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs},
+			https: func(s *httptest.Server) *vcs.HTTPSConfig {
+				return &vcs.HTTPSConfig{CACerts: caCerts(s), ClientCert: clientCertPEM, ClientKey: clientKeyPEM}
+			},
+		},
+		"no client certificate": {
+			tls:     &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs},
+			https:   func(s *httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{CACerts: caCerts(s)} },
+			wantErr: true,
+		},
+		"proxy": {
+			// The server acts as the proxy for the unresolvable host.
+			authorized: func(r *http.Request) bool { return r.Host == "git.invalid" },
+			host:       "git.invalid",
+			https:      func(s *httptest.Server) *vcs.HTTPSConfig { return &vcs.HTTPSConfig{Proxy: s.URL} },
+		},
+	}
+
+	for clonerLabel, cloner := range cloners {
+		for label, test := range tests {
+			label = clonerLabel + ": " + label
+			func() {
+				repoDir := initGitRepository(t, gitCommands...)
+				s := startGitHTTPServer(t, filepath.Dir(repoDir), test.tls, test.authorized)
+				defer s.Close()
+
+				url := s.URL + "/" + filepath.Base(repoDir)
+				if test.host != "" {
+					url = "http://" + test.host + "/" + filepath.Base(repoDir)
+				}
+				opt := vcs.CloneOpt{
+					Bare:       true,
+					RemoteOpts: vcs.RemoteOpts{HTTPS: test.https(s)},
+				}
+				r, err := cloner(url, makeTmpDir(t, "https-clone"), opt)
+				if test.wantErr {
+					if err == nil {
+						t.Errorf("%s: Clone: got nil error, want error", label)
+					}
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: Clone: %s", label, err)
+					return
+				}
+
+				tags, err := r.Tags()
+				if err != nil {
+					t.Errorf("%s: Tags: %s", label, err)
+					return
+				}
+				if got, want := tagNames(tags), []string{"t0"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got tags %v, want %v", label, got, want)
+				}
+
+				if _, err := r.(vcs.RemoteUpdater).UpdateEverything(opt.RemoteOpts); err != nil {
+					t.Errorf("%s: UpdateEverything: %s", label, err)
+				}
+			}()
+		}
+	}
+}
+
+func TestRepository_Clone_httpsCredentials(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git tag t0",
+	}
+	cloners := map[string]func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error){
+		"git libgit2": func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return git.Clone(url, dir, opt) },
+		"git cmd":     func(url, dir string, opt vcs.CloneOpt) (vcs.Repository, error) { return gitcmd.Clone(url, dir, opt) },
+	}
+
+	// The server accepts the new token and the user "u" with password
+	// "p".
+	authorized := func(r *http.Request) bool {
+		if r.Header.Get("Authorization") == "Bearer new" {
+			return true
+		}
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "u" && pass == "p"
+	}
+
+	tests := map[string]struct {
+		creds        []*vcs.Credentials
+		wantAttempts []int // attempts that the provider is asked for
+		wantErr      bool
+	}{
+		"token":          {creds: []*vcs.Credentials{{Token: "new"}}, wantAttempts: []int{1}},
+		"rotated token":  {creds: []*vcs.Credentials{{Token: "old"}, {Token: "new"}}, wantAttempts: []int{1, 2}},
+		"password":       {creds: []*vcs.Credentials{{Username: "u", Password: "p"}}, wantAttempts: []int{1}},
+		"wrong password": {creds: []*vcs.Credentials{{Username: "u", Password: "x"}}, wantAttempts: []int{1, 2}, wantErr: true},
+	}
+
+	for clonerLabel, cloner := range cloners {
+		for label, test := range tests {
+			label = clonerLabel + ": " + label
+			func() {
+				repoDir := initGitRepository(t, gitCommands...)
+				s := startGitHTTPServer(t, filepath.Dir(repoDir), nil, authorized)
+				defer s.Close()
+				url := s.URL + "/" + filepath.Base(repoDir)
+
+				var store vcs.MemoryCredentials
+				store.Set(url, test.creds...)
+				var attempts []int
+				provider := vcs.CredentialProviderFunc(func(ctx context.Context, req vcs.CredentialRequest) (*vcs.Credentials, error) {
+					if req.URL != url || req.Protocol != "https" {
+						t.Errorf("%s: got credential request %+v, want URL %q and protocol https", label, req, url)
+					}
+					attempts = append(attempts, req.Attempt)
+					return store.Credentials(ctx, req)
+				})
+
+				opt := vcs.CloneOpt{
+					Bare:       true,
+					RemoteOpts: vcs.RemoteOpts{Credentials: provider},
+				}
+				r, err := cloner(url, makeTmpDir(t, "https-clone"), opt)
+				if !reflect.DeepEqual(attempts, test.wantAttempts) {
+					t.Errorf("%s: Clone: got attempts %v, want %v", label, attempts, test.wantAttempts)
+				}
+				if test.wantErr {
+					if err == nil {
+						t.Errorf("%s: Clone: got nil error, want authentication failure", label)
+					}
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: Clone: %s", label, err)
+					return
+				}
+
+				tags, err := r.Tags()
+				if err != nil {
+					t.Errorf("%s: Tags: %s", label, err)
+					return
+				}
+				if got, want := tagNames(tags), []string{"t0"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got tags %v, want %v", label, got, want)
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// A BlameLine is a line of a blamed file and where it came from: the
+// commit that last changed it, and its path and 1-indexed line number
+// in that commit.
+type BlameLine struct {
+	CommitID vcs.CommitID
+	Path     string
+	Line     int
+	Text     []byte // the line's contents (with or without its newline)
+}
+
+// BlameHunks groups the consecutive lines of a file that came from
+// consecutive lines of the same path and commit into hunks. Each
+// line's byte length includes its newline (even if the file's last
+// line doesn't end with one). Consecutive lines of the same commit
+// whose positions are unknown (with an empty Path) are grouped too.
+// Only the hunks' positions, CommitID, OrigPath, and OrigStartLine
+// are set.
+func BlameHunks(lines []BlameLine) []*vcs.Hunk {
+	var hunks []*vcs.Hunk
+	var hunk *vcs.Hunk
+	byteOffset := 0
+	for i, line := range lines {
+		lineno := i + 1
+		if hunk == nil || line.CommitID != hunk.CommitID || line.Path != hunk.OrigPath || (line.Path != "" && line.Line != hunk.OrigStartLine+(lineno-hunk.StartLine)) {
+			hunk = &vcs.Hunk{
+				StartLine:     lineno,
+				EndLine:       lineno,
+				StartByte:     byteOffset,
+				CommitID:      line.CommitID,
+				OrigPath:      line.Path,
+				OrigStartLine: line.Line,
+			}
+			hunks = append(hunks, hunk)
+		}
+		byteOffset += len(bytes.TrimSuffix(line.Text, []byte("\n"))) + 1
+		hunk.EndLine = lineno + 1
+		hunk.EndByte = byteOffset
+	}
+	return hunks
+}
+
+// BlameBoundary attributes the lines whose commits are in boundary
+// (oldest and its ancestors) to oldest, like `git blame
+// oldest..newest` does, and sets their paths and line numbers to
+// those in oldest. path is the path of the blamed file, and
+// oldestLines returns the blamed lines of a file in oldest (or nil if
+// there is no such file); a line's position in oldest is that of the
+// line with the same origin there. The path and line number of a line
+// that isn't in the file in oldest (for example, because it was merged
+// from a branch that doesn't contain oldest) are cleared.
+func BlameBoundary(lines []BlameLine, path string, boundary map[vcs.CommitID]bool, oldest vcs.CommitID, oldestLines func(path string) ([]BlameLine, error)) error {
+	type origin struct {
+		commitID vcs.CommitID
+		path     string
+		line     int
+	}
+	positions := map[string]map[origin]int{} // path in oldest -> origin -> line number
+	position := func(path string, o origin) (int, error) {
+		pos, ok := positions[path]
+		if !ok {
+			olines, err := oldestLines(path)
+			if err != nil {
+				return 0, err
+			}
+			pos = make(map[origin]int, len(olines))
+			for i, l := range olines {
+				pos[origin{l.CommitID, l.Path, l.Line}] = i + 1
+			}
+			positions[path] = pos
+		}
+		return pos[o], nil
+	}
+
+	for i := range lines {
+		l := &lines[i]
+		if !boundary[l.CommitID] || l.CommitID == oldest {
+			continue
+		}
+		o := origin{l.CommitID, l.Path, l.Line}
+		l.CommitID, l.Path, l.Line = oldest, "", 0
+		// The file is usually at the path it had in the line's
+		// commit, or else at the blamed path.
+		for _, p := range []string{o.path, path} {
+			n, err := position(p, o)
+			if err != nil {
+				return err
+			}
+			if n != 0 {
+				l.Path, l.Line = p, n
+				break
+			}
+		}
+	}
+	return nil
+}
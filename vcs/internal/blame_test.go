@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestBlameBoundary(t *testing.T) {
+	// c1 added 2 lines to f, c2 (oldest) renamed f to g and added a
+	// line before them, and c3 added a line. The line from c0 (an
+	// ancestor of oldest) was removed before oldest, and merged back
+	// from a branch along with the line from m.
+	boundary := map[vcs.CommitID]bool{"c0": true, "c1": true, "c2": true}
+	oldest := map[string][]BlameLine{
+		"g": {
+			{CommitID: "c2", Path: "g", Line: 1},
+			{CommitID: "c1", Path: "f", Line: 1},
+			{CommitID: "c1", Path: "f", Line: 2},
+		},
+	}
+	lines := []BlameLine{
+		{CommitID: "c1", Path: "f", Line: 2},
+		{CommitID: "c2", Path: "g", Line: 1},
+		{CommitID: "c3", Path: "g", Line: 3},
+		{CommitID: "c1", Path: "f", Line: 1},
+		{CommitID: "c0", Path: "f", Line: 1},
+		{CommitID: "m", Path: "g", Line: 7},
+	}
+	err := BlameBoundary(lines, "g", boundary, "c2", func(path string) ([]BlameLine, error) {
+		return oldest[path], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BlameLine{
+		{CommitID: "c2", Path: "g", Line: 3},
+		{CommitID: "c2", Path: "g", Line: 1},
+		{CommitID: "c3", Path: "g", Line: 3},
+		{CommitID: "c2", Path: "g", Line: 2},
+		{CommitID: "c2"},
+		{CommitID: "m", Path: "g", Line: 7},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %+v, want %+v", lines, want)
+	}
+}
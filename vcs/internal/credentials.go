@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// RetryWithCredentials calls run with the credentials that
+// opt.Credentials provides for the remote at url. Each time run fails
+// with an error that isAuthFailure reports is an authentication
+// failure, run is called again with the credentials for the next
+// attempt, until the provider has no more credentials (and the last
+// error is returned) or vcs.MaxCredentialAttempts is reached.
+//
+// If opt.Credentials is nil, if url isn't an SSH or HTTPS URL, or if
+// the provider has no credentials for url, run is called once with nil
+// credentials.
+func RetryWithCredentials(ctx context.Context, url string, opt vcs.RemoteOpts, run func(*vcs.Credentials) error, isAuthFailure func(error) bool) error {
+	protocol := vcs.RemoteProtocol(url)
+	if opt.Credentials == nil || protocol == "" {
+		return run(nil)
+	}
+
+	var err error
+	for attempt := 1; attempt <= vcs.MaxCredentialAttempts; attempt++ {
+		creds, credsErr := opt.Credentials.Credentials(ctx, vcs.CredentialRequest{URL: url, Protocol: protocol, Attempt: attempt})
+		if credsErr == vcs.ErrNoCredentials {
+			if attempt == 1 {
+				return run(nil)
+			}
+			return err
+		} else if credsErr != nil {
+			return credsErr
+		}
+
+		err = run(creds)
+		if err == nil || !isAuthFailure(err) {
+			return err
+		}
+	}
+	return err
+}
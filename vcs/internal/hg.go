@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hgNullID is the ID of Mercurial's null changeset. It is used in
+// tag files to record the removal of a tag.
+const hgNullID = "0000000000000000000000000000000000000000"
+
+// ReadHgRefsFile reads a Mercurial file that maps names to changeset
+// IDs, with one "ID NAME" pair per line (such as .hg/bookmarks or
+// .hg/localtags). Later lines for a name override earlier ones, and
+// a line with the null changeset ID removes the name. A nonexistent
+// file is treated as empty.
+func ReadHgRefsFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		i := strings.Index(line, " ")
+		if i == -1 {
+			continue
+		}
+		id, name := line[:i], strings.TrimSpace(line[i+1:])
+		if id == hgNullID {
+			delete(refs, name)
+		} else {
+			refs[name] = id
+		}
+	}
+	return refs, s.Err()
+}
+
+// ReadHgPhaseRoots reads a Mercurial phaseroots file (.hg/store/phaseroots),
+// which has one "PHASE ID" pair per line, and returns a map of the phase
+// roots' changeset IDs to their phase numbers. A nonexistent file is
+// treated as empty (all changesets are public).
+func ReadHgPhaseRoots(filename string) (map[string]int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return map[string]int{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	roots := map[string]int{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		phase, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad phase in %s: %q", filename, s.Text())
+		}
+		roots[fields[1]] = phase
+	}
+	return roots, s.Err()
+}
@@ -1,6 +1,9 @@
 package internal
 
-import "strings"
+import (
+	"path"
+	"strings"
+)
 
 // Rel strips the leading "/" prefix from the path string, effectively turning
 // an absolute path into one relative to the root directory. A path that is just
@@ -14,3 +17,10 @@ func Rel(path string) string {
 	}
 	return strings.TrimPrefix(path, "/")
 }
+
+// IsCleanRelPath reports whether p is a clean, slash-separated path
+// to a file below the repository root. For example, "a/b" is, but
+// "/a/b", "a//b", "a/../b", "../a" and "." are not.
+func IsCleanRelPath(p string) bool {
+	return p != "" && p != "." && path.Clean(p) == p && !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+}
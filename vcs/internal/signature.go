@@ -0,0 +1,32 @@
+package internal
+
+import "strings"
+
+// pgpSignatureHeaders are the lines that begin the ASCII-armored PGP
+// signature that git appends to a signed tag's message.
+var pgpSignatureHeaders = []string{
+	"-----BEGIN PGP SIGNATURE-----",
+	"-----BEGIN PGP MESSAGE-----",
+}
+
+// SplitTagSignature splits a git tag object's message into the
+// message itself and the PGP signature that follows it (if any).
+func SplitTagSignature(message string) (msg string, sig []byte) {
+	start := -1
+	for _, header := range pgpSignatureHeaders {
+		i := -1
+		if strings.HasPrefix(message, header) {
+			i = 0
+		}
+		if j := strings.LastIndex(message, "\n"+header); j != -1 {
+			i = j + 1
+		}
+		if i > start {
+			start = i
+		}
+	}
+	if start == -1 {
+		return message, nil
+	}
+	return message[:start], []byte(message[start:])
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTagSignature(t *testing.T) {
+	sig := "-----BEGIN PGP SIGNATURE-----\n\niQEc\n-----END PGP SIGNATURE-----\n"
+	tests := []struct {
+		message string
+		wantMsg string
+		wantSig []byte
+	}{
+		{"", "", nil},
+		{"foo\n", "foo\n", nil},
+		{"foo\n" + sig, "foo\n", []byte(sig)},
+		{sig, "", []byte(sig)},
+		{"foo -----BEGIN PGP SIGNATURE-----\n", "foo -----BEGIN PGP SIGNATURE-----\n", nil},
+	}
+	for _, test := range tests {
+		msg, sig := SplitTagSignature(test.message)
+		if msg != test.wantMsg {
+			t.Errorf("%q: got message %q, want %q", test.message, msg, test.wantMsg)
+		}
+		if !reflect.DeepEqual(sig, test.wantSig) {
+			t.Errorf("%q: got signature %q, want %q", test.message, sig, test.wantSig)
+		}
+	}
+}
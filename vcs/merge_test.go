@@ -9,7 +9,6 @@ import (
 func TestMerger_MergeBase(t *testing.T) {
 	t.Parallel()
 
-	// TODO(sqs): implement for hg
 	// TODO(sqs): make a more complex test case
 
 	cmds := []string{
@@ -26,6 +25,17 @@ func TestMerger_MergeBase(t *testing.T) {
 		"git add h",
 		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m qux --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
 	}
+	hgCmds := []string{
+		"echo line1 > f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"echo line2 >> f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg update -q 0",
+		"echo line3 > h",
+		"hg add h",
+		"hg commit -m qux --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
 	tests := map[string]struct {
 		repo interface {
 			vcs.Merger
@@ -45,6 +55,21 @@ func TestMerger_MergeBase(t *testing.T) {
 			a:    "master", b: "b2",
 			wantMergeBase: "testbase",
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, cmds...),
+			a:    "master", b: "b2",
+			wantMergeBase: "testbase",
+		},
+		"hg native": {
+			repo: makeHgRepositoryNative(t, hgCmds...),
+			a:    "2", b: "1",
+			wantMergeBase: "0",
+		},
+		"hg cmd": {
+			repo: makeHgRepositoryCmd(t, hgCmds...),
+			a:    "2", b: "1",
+			wantMergeBase: "0",
+		},
 	}
 
 	for label, test := range tests {
@@ -82,7 +107,6 @@ func TestMerger_MergeBase(t *testing.T) {
 func TestMerger_CrossRepoMergeBase(t *testing.T) {
 	t.Parallel()
 
-	// TODO(sqs): implement for hg
 	// TODO(sqs): make a more complex test case
 
 	cmdsA := []string{
@@ -105,6 +129,21 @@ func TestMerger_CrossRepoMergeBase(t *testing.T) {
 		"git add h",
 		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m qux --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
 	}
+	// The hg changesets are identical in both repos because they have
+	// the same contents, dates and authors.
+	hgCmdsA := []string{
+		"echo line1 > f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	hgCmdsB := append(append([]string(nil), hgCmdsA...),
+		"echo line2 >> f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"hg update -q 0",
+		"echo line3 > h",
+		"hg add h",
+		"hg commit -m qux --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	)
 	tests := map[string]struct {
 		repoA interface {
 			vcs.CrossRepoMerger
@@ -129,6 +168,20 @@ func TestMerger_CrossRepoMergeBase(t *testing.T) {
 			a: "master", b: "b2",
 			wantMergeBase: "testbase",
 		},
+		"hg native": {
+			repoA: makeHgRepositoryNative(t, hgCmdsA...),
+			repoB: makeHgRepositoryNative(t, hgCmdsB...),
+
+			a: "tip", b: "1",
+			wantMergeBase: "0",
+		},
+		"hg cmd": {
+			repoA: makeHgRepositoryCmd(t, hgCmdsA...),
+			repoB: makeHgRepositoryCmd(t, hgCmdsB...),
+
+			a: "tip", b: "1",
+			wantMergeBase: "0",
+		},
 	}
 
 	for label, test := range tests {
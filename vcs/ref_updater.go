@@ -0,0 +1,52 @@
+package vcs
+
+import "errors"
+
+// A RefUpdater is a repository whose branches and tags can be
+// created, updated, and deleted.
+type RefUpdater interface {
+	// CreateBranch creates a branch that points to the commit id. If
+	// the branch already exists, ErrRefConflict is returned.
+	CreateBranch(name string, id CommitID) error
+
+	// DeleteBranch deletes the branch. If no such branch exists,
+	// ErrBranchNotFound is returned.
+	DeleteBranch(name string) error
+
+	// CreateTag creates a tag that points to the commit id. If opt is
+	// nil, a lightweight tag is created; otherwise an annotated tag
+	// is created with opt's tagger and message. If the tag already
+	// exists, ErrRefConflict is returned.
+	CreateTag(name string, id CommitID, opt *CreateTagOptions) error
+
+	// DeleteTag deletes the tag. If no such tag exists,
+	// ErrTagNotFound is returned.
+	DeleteTag(name string) error
+
+	// UpdateRef atomically sets the ref named name (such as
+	// "refs/heads/master") to new, but only if it currently points
+	// to old. An empty old means that the ref must not exist (i.e.,
+	// the ref is created), and an empty new means that the ref is
+	// deleted. If the ref's current value isn't old, the ref is left
+	// unchanged and ErrRefConflict is returned.
+	//
+	// The values are the ref's direct target, which (for an
+	// annotated tag) is the tag object ID, not the commit ID.
+	UpdateRef(name string, old, new CommitID) error
+}
+
+// CreateTagOptions specifies the tagger and message of an annotated
+// tag created with (RefUpdater).CreateTag.
+type CreateTagOptions struct {
+	// Tagger is the person who created the tag. If Tagger.Date is the
+	// zero value, the current time is used.
+	Tagger Signature
+
+	// Message is the tag message.
+	Message string
+}
+
+// ErrRefConflict is returned by RefUpdater methods when a ref's
+// current value isn't the expected value (including when a ref being
+// created already exists).
+var ErrRefConflict = errors.New("ref does not have the expected value")
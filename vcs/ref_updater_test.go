@@ -0,0 +1,123 @@
+package vcs_test
+
+import (
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestRepository_RefUpdater(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m bar --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	}
+	hgCommands := []string{
+		"touch f",
+		"hg add f",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"echo >> f",
+		"hg commit -m bar --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.Repository
+			vcs.RefUpdater
+		}
+		head string
+	}{
+		"git libgit2": {repo: makeGitRepositoryLibGit2(t, gitCommands...), head: "master"},
+		"git cmd":     {repo: makeGitRepositoryCmd(t, gitCommands...), head: "master"},
+		"hg native":   {repo: makeHgRepositoryNative(t, hgCommands...), head: "tip"},
+		"hg cmd":      {repo: makeHgRepositoryCmd(t, hgCommands...), head: "tip"},
+	}
+
+	tagger := vcs.Signature{Name: "b", Email: "b@b.com", Date: mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")}
+
+	for label, test := range tests {
+		c2, err := test.repo.ResolveRevision(test.head)
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+		commit, err := test.repo.GetCommit(c2)
+		if err != nil {
+			t.Errorf("%s: GetCommit: %s", label, err)
+			continue
+		}
+		c1 := commit.Parents[0]
+
+		checkBranch := func(name string, want vcs.CommitID, wantErr error) {
+			id, err := test.repo.ResolveBranch(name)
+			if err != wantErr {
+				t.Errorf("%s: ResolveBranch(%q): got err %v, want %v", label, name, err, wantErr)
+			} else if id != want {
+				t.Errorf("%s: ResolveBranch(%q): got %s, want %s", label, name, id, want)
+			}
+		}
+		hasTag := func(name string) bool {
+			tags, err := test.repo.Tags()
+			if err != nil {
+				t.Fatalf("%s: Tags: %s", label, err)
+			}
+			for _, tag := range tags {
+				if tag.Name == name {
+					return true
+				}
+			}
+			return false
+		}
+
+		// Branches.
+		if err := test.repo.CreateBranch("b", c1); err != nil {
+			t.Errorf("%s: CreateBranch: %s", label, err)
+			continue
+		}
+		checkBranch("b", c1, nil)
+		if err := test.repo.CreateBranch("b", c2); err != vcs.ErrRefConflict {
+			t.Errorf("%s: CreateBranch of existing branch: got err %v, want %v", label, err, vcs.ErrRefConflict)
+		}
+		if err := test.repo.UpdateRef("refs/heads/b", c2, c1); err != vcs.ErrRefConflict {
+			t.Errorf("%s: UpdateRef with stale old value: got err %v, want %v", label, err, vcs.ErrRefConflict)
+		}
+		checkBranch("b", c1, nil)
+		if err := test.repo.UpdateRef("refs/heads/b", c1, c2); err != nil {
+			t.Errorf("%s: UpdateRef: %s", label, err)
+		}
+		checkBranch("b", c2, nil)
+		if err := test.repo.DeleteBranch("b"); err != nil {
+			t.Errorf("%s: DeleteBranch: %s", label, err)
+		}
+		checkBranch("b", "", vcs.ErrBranchNotFound)
+		if err := test.repo.DeleteBranch("b"); err != vcs.ErrBranchNotFound {
+			t.Errorf("%s: DeleteBranch of nonexistent branch: got err %v, want %v", label, err, vcs.ErrBranchNotFound)
+		}
+
+		// Tags.
+		if err := test.repo.CreateTag("t1", c1, nil); err != nil {
+			t.Errorf("%s: CreateTag (lightweight): %s", label, err)
+		}
+		if err := test.repo.CreateTag("t2", c1, &vcs.CreateTagOptions{Tagger: tagger, Message: "baz"}); err != nil {
+			t.Errorf("%s: CreateTag (annotated): %s", label, err)
+		}
+		if err := test.repo.CreateTag("t1", c2, nil); err != vcs.ErrRefConflict {
+			t.Errorf("%s: CreateTag of existing tag: got err %v, want %v", label, err, vcs.ErrRefConflict)
+		}
+		for _, name := range []string{"t1", "t2"} {
+			if !hasTag(name) {
+				t.Errorf("%s: tag %q not found after CreateTag", label, name)
+			}
+			if err := test.repo.DeleteTag(name); err != nil {
+				t.Errorf("%s: DeleteTag(%q): %s", label, name, err)
+			}
+			if hasTag(name) {
+				t.Errorf("%s: tag %q still exists after DeleteTag", label, name)
+			}
+		}
+		if err := test.repo.DeleteTag("t1"); err != vcs.ErrTagNotFound {
+			t.Errorf("%s: DeleteTag of nonexistent tag: got err %v, want %v", label, err, vcs.ErrTagNotFound)
+		}
+	}
+}
@@ -1,21 +1,111 @@
 package vcs
 
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
 // RemoteOpts configures interactions with a remote repository.
 type RemoteOpts struct {
 	SSH *SSHConfig // ssh configuration for communication with the remote
 
 	HTTPS *HTTPSConfig // Optional HTTPS configuration for communication with the remote.
+
+	// Credentials, if set, provides the credentials for the remote
+	// (see CredentialProvider).
+	Credentials CredentialProvider `json:"-"`
 }
 
+// SSHConfig configures SSH for communication with remotes. The
+// client authenticates with PrivateKey (if set) and the keys of the ssh
+// agent (if any).
 type SSHConfig struct {
 	User       string `json:",omitempty"` // ssh user (if empty, inferred from URL)
 	PublicKey  []byte `json:",omitempty"` // ssh public key (if nil, inferred from PrivateKey)
-	PrivateKey []byte // ssh private key, usually passed to ssh.ParsePrivateKey (passphrases currently unsupported)
+	PrivateKey []byte // ssh private key in PEM or OpenSSH format, usually passed to ssh.ParsePrivateKey
+	Passphrase []byte `json:",omitempty"` // passphrase of PrivateKey (if it is encrypted)
+
+	// AgentSocket is the path of the Unix socket of an ssh-agent to
+	// authenticate with, such as the value of $SSH_AUTH_SOCK.
+	AgentSocket string `json:",omitempty"`
+
+	// Agent is an in-process ssh agent to authenticate with (such as
+	// one created by agent.NewKeyring). It is served on a temporary
+	// Unix socket for the duration of each remote operation. If Agent
+	// is set, AgentSocket is ignored.
+	Agent agent.Agent `json:"-"`
+
+	// HostKeyPolicy is how the remote's host key is verified.
+	HostKeyPolicy HostKeyPolicy `json:",omitempty"`
+
+	// KnownHosts is the contents of a known_hosts file to verify host
+	// keys with (for HostKeyKnownHosts and HostKeyTOFU). If nil, the
+	// standard known_hosts files are used.
+	KnownHosts []byte `json:",omitempty"`
+
+	// HostKeys are the pinned host keys (for HostKeyPinned), each in
+	// authorized_keys format ("ssh-rsa AAAA...").
+	HostKeys [][]byte `json:",omitempty"`
+
+	// TrustHostKey is called (for HostKeyTOFU) with the host key of a
+	// host that has no known host keys. The host key is accepted if it
+	// returns nil. It can record the key so that it is known the next
+	// time. The hostname is in known_hosts form: "host", or
+	// "[host]:port" for a port other than 22.
+	TrustHostKey func(hostname string, key ssh.PublicKey) error `json:"-"`
 }
 
-// HTTPSConfig configures HTTPS for communication with remotes.
+// HostKeyPolicy is a policy for verifying the host keys of SSH
+// remotes.
+type HostKeyPolicy int
+
+const (
+	// HostKeyDefault verifies host keys using the standard known_hosts
+	// files, unless the implementation's InsecureSkipCheckVerifySSH
+	// is set.
+	HostKeyDefault HostKeyPolicy = iota
+
+	// HostKeyKnownHosts only accepts the host keys listed for the host
+	// in SSHConfig.KnownHosts (or the standard known_hosts files).
+	HostKeyKnownHosts
+
+	// HostKeyPinned only accepts the host keys in SSHConfig.HostKeys,
+	// whatever the host.
+	HostKeyPinned
+
+	// HostKeyTOFU ("trust on first use") is like HostKeyKnownHosts,
+	// except that the host key of a host that isn't listed is accepted
+	// if SSHConfig.TrustHostKey accepts it.
+	HostKeyTOFU
+)
+
+// HTTPSConfig configures HTTPS (and HTTP) for communication with
+// remotes.
 type HTTPSConfig struct {
+	User string `json:",omitempty"` // User is the username (if empty, inferred from URL).
 	Pass string // Pass is the password provided to the vcs.
+
+	// Token is a bearer token (such as an OAuth access token) that is
+	// sent in an "Authorization: Bearer" header.
+	Token string `json:",omitempty"`
+
+	// ExtraHeaders are additional HTTP headers ("Name: value") that
+	// are sent with each request.
+	ExtraHeaders []string `json:",omitempty"`
+
+	// ClientCert is a PEM-encoded TLS client certificate, and
+	// ClientKey is its PEM-encoded private key (if it isn't in
+	// ClientCert).
+	ClientCert []byte `json:",omitempty"`
+	ClientKey  []byte `json:",omitempty"`
+
+	// CACerts are PEM-encoded CA certificates to verify the server's
+	// certificate with, instead of the system's.
+	CACerts []byte `json:",omitempty"`
+
+	// Proxy is the URL of the HTTP proxy to use
+	// ("http://[user:pass@]host:port").
+	Proxy string `json:",omitempty"`
 }
 
 // A RemoteUpdater is a repository that can fetch updates to itself
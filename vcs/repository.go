@@ -2,6 +2,7 @@ package vcs
 
 import (
 	"errors"
+	"time"
 
 	"golang.org/x/tools/godoc/vfs"
 )
@@ -69,6 +70,34 @@ type BlameOptions struct {
 
 	StartLine int `json:",omitempty" url:",omitempty"` // 1-indexed start byte (or 0 for beginning of file)
 	EndLine   int `json:",omitempty" url:",omitempty"` // 1-indexed end byte (or 0 for end of file)
+
+	// DetectMoves attributes lines that were moved or copied within
+	// the file to the commit that originally added them, instead of
+	// the commit that moved them (like `git blame -M`).
+	DetectMoves bool `json:",omitempty" url:",omitempty"`
+
+	// DetectCopies also follows lines that were moved or copied from
+	// other files that were modified in the same commit (like `git
+	// blame -C`). The hunks' OrigPath is the file that they came
+	// from.
+	DetectCopies bool `json:",omitempty" url:",omitempty"`
+
+	// NoIgnoreWhitespace attributes lines to changes that only add or
+	// remove whitespace. By default, such changes are ignored (like
+	// `git blame -w`).
+	NoIgnoreWhitespace bool `json:",omitempty" url:",omitempty"`
+
+	// IgnoreRevs are commits whose changes are ignored: the lines
+	// that they changed are attributed to the commits that previously
+	// changed them (like `git blame --ignore-rev`).
+	IgnoreRevs []CommitID `json:",omitempty" url:",omitempty"`
+
+	// IgnoreRevsFile is the path of a file in the repository at
+	// NewestCommit (such as ".git-blame-ignore-revs") that lists more
+	// commits to ignore, one full commit ID per line. Blank lines and
+	// "#" comments are skipped. It is not an error if the file
+	// doesn't exist.
+	IgnoreRevsFile string `json:",omitempty" url:",omitempty"`
 }
 
 // A Hunk is a contiguous portion of a file associated with a commit.
@@ -78,7 +107,28 @@ type Hunk struct {
 	StartByte int // 0-indexed start byte position (inclusive)
 	EndByte   int // 0-indexed end byte position (exclusive)
 	CommitID
-	Author Signature
+	Author    Signature
+	Committer *Signature // or nil if the VCS has no committers
+	Summary   string     // the first line of the commit message
+
+	// OrigPath and OrigStartLine are the path of the file and the
+	// 1-indexed start line of the hunk in CommitID. They differ from
+	// the blamed path and StartLine if the lines were moved or copied
+	// (or the file was renamed) since CommitID. For lines attributed
+	// to BlameOptions.OldestCommit (a boundary commit), they are the
+	// lines' position in it, or empty if it isn't known (for example,
+	// for lines that were merged from a branch that doesn't contain
+	// the boundary commit).
+	OrigPath      string
+	OrigStartLine int
+
+	// PreviousCommitID and PreviousPath are the parent of CommitID
+	// and the path of the file in it, which are where to continue
+	// blaming to see the hunk's lines before CommitID changed them.
+	// They are empty if CommitID added the lines' file (or is a
+	// boundary commit).
+	PreviousCommitID CommitID
+	PreviousPath     string
 }
 
 // A Differ is a repository that can compute diffs between two
@@ -125,20 +175,98 @@ type CommitsOptions struct {
 	Head CommitID // include all commits reachable from this commit (required)
 	Base CommitID // exlude all commits reachable from this commit (optional, like `git log Base..Head`)
 
-	N    uint // limit the number of returned commits to this many (0 means no limit)
-	Skip uint // skip this many commits at the beginning
+	// Heads and Bases are more commits to include and exclude the
+	// commits reachable from, along with Head and Base (optional,
+	// like `git log Head Heads... ^Base ^Bases...`).
+	Heads []CommitID
+	Bases []CommitID
 
-	Path string // only commits modifying the given path are selected (optional)
+	N    uint // limit the number of returned commits to this many (0 means no limit)
+	Skip uint // skip this many commits at the beginning (after Cursor, if set)
+
+	// Cursor, if set, is the CommitsPage.NextCursor returned by a
+	// previous call to (CommitsPager).CommitsPage with the same
+	// options (other than N and Skip). The commits start where that
+	// page ended, which is cheaper than skipping the earlier pages'
+	// commits with Skip.
+	Cursor string
+
+	// Path, if set, selects only the commits that changed the file
+	// or directory at the path. The history of a file is followed
+	// through renames, as described by (FileHistoryLister).FileHistory.
+	Path string
+
+	// Order is the order of the returned commits: DateOrder,
+	// AuthorDateOrder, TopoOrder, or "" for the VCS's default order
+	// (newest first, by commit date for git and by revision number
+	// for hg).
+	Order string
+
+	FirstParent bool // only follow the first parent of merge commits (like `git log --first-parent`)
+	NoMerges    bool // omit merge commits (like `git log --no-merges`)
+	MergesOnly  bool // only include merge commits (like `git log --merges`)
+
+	// Author, Committer and Message are extended regexps that the
+	// commits' author ("Name <email>"), committer and message must
+	// match (optional, like `git log -E --author --committer
+	// --grep`). The message is matched line by line. For VCSs that
+	// don't record committers (such as hg), Committer is matched
+	// against the author.
+	Author    string
+	Committer string
+	Message   string
+
+	// Since and Until limit the commits to those committed in the
+	// time range (optional, like `git log --since --until`).
+	Since time.Time
+	Until time.Time
 
 	NoTotal bool // avoid counting the total number of commits
 }
 
+const (
+	// DateOrder is a value for CommitsOptions.Order that orders
+	// commits by their commit date (newest first), but doesn't show
+	// a commit before all of its children (like `git log
+	// --date-order`).
+	DateOrder = "date"
+
+	// AuthorDateOrder is a value for CommitsOptions.Order that is
+	// like DateOrder, but orders commits by their author date (like
+	// `git log --author-date-order`).
+	AuthorDateOrder = "author-date"
+
+	// TopoOrder is a value for CommitsOptions.Order that doesn't
+	// show a commit before all of its children, and avoids
+	// interleaving commits from multiple lines of history (like `git
+	// log --topo-order`).
+	TopoOrder = "topo"
+)
+
+// The values of Commit.Phase for Mercurial commits (see `hg help
+// phases`).
+const (
+	PhasePublic = "public" // the commit has been published and is immutable
+	PhaseDraft  = "draft"  // the commit hasn't been published yet
+	PhaseSecret = "secret" // the commit won't be pushed or pulled
+)
+
 // CommittersOptions specifies limits on the list of committers returned by
 // (Repository).Committers.
 type CommittersOptions struct {
 	N int // limit the number of returned committers, ordered by decreasing number of commits (0 means no limit)
 
 	Rev string // the rev for which committer stats will be fetched ("" means use the current revision)
+
+	// Since and Until limit the counted commits to those committed
+	// in the time range (optional, like CommitsOptions.Since and
+	// Until).
+	Since time.Time
+	Until time.Time
+
+	// Path, if set, only counts the commits that changed the file or
+	// directory at the path (like CommitsOptions.Path).
+	Path string
 }
 
 // DiffOptions configures a diff.
@@ -150,11 +278,6 @@ type DiffOptions struct {
 	ExcludeReachableFromBoth bool // like "<rev1>...<rev2>" (see `git rev-parse --help`)
 }
 
-// A Diff represents changes between two commits.
-type Diff struct {
-	Raw string // the raw diff output
-}
-
 type Branches []*Branch
 
 func (p Branches) Len() int           { return len(p) }
@@ -16,6 +16,7 @@ import (
 	"sourcegraph.com/sourcegraph/go-vcs/vcs"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/git"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/gitcmd"
+	"sourcegraph.com/sourcegraph/go-vcs/vcs/gitgo"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/hg"
 	"sourcegraph.com/sourcegraph/go-vcs/vcs/hgcmd"
 	"sourcegraph.com/sqs/pbtypes"
@@ -41,6 +42,7 @@ func TestRepository_ResolveBranch(t *testing.T) {
 		// Some versions of Mercurial don't create .hg/cache until another command
 		// is ran that uses branches. Ran into this on Mercurial 2.0.2.
 		"hg branches >/dev/null",
+		"hg bookmark bm",
 	}
 	tests := map[string]struct {
 		repo interface {
@@ -59,6 +61,11 @@ func TestRepository_ResolveBranch(t *testing.T) {
 			branch:       "master",
 			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
 		},
+		"git go": {
+			repo:         makeGitRepositoryGo(t, gitCommands...),
+			branch:       "master",
+			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+		},
 		"hg native": {
 			repo:         makeHgRepositoryNative(t, hgCommands...),
 			branch:       "default",
@@ -69,6 +76,16 @@ func TestRepository_ResolveBranch(t *testing.T) {
 			branch:       "default",
 			wantCommitID: "e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf",
 		},
+		"hg native bookmark": {
+			repo:         makeHgRepositoryNative(t, hgCommands...),
+			branch:       "bm",
+			wantCommitID: "e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf",
+		},
+		"hg cmd bookmark": {
+			repo:         makeHgRepositoryCmd(t, hgCommands...),
+			branch:       "bm",
+			wantCommitID: "e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf",
+		},
 	}
 
 	for label, test := range tests {
@@ -112,6 +129,11 @@ func TestRepository_ResolveBranch_error(t *testing.T) {
 			branch:  "doesntexist",
 			wantErr: vcs.ErrBranchNotFound,
 		},
+		"git go": {
+			repo:    makeGitRepositoryGo(t, gitCommands...),
+			branch:  "doesntexist",
+			wantErr: vcs.ErrBranchNotFound,
+		},
 		"hg": {
 			repo:    makeHgRepositoryNative(t, hgCommands...),
 			branch:  "doesntexist",
@@ -165,6 +187,11 @@ func TestRepository_ResolveRevision(t *testing.T) {
 			spec:         "master",
 			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
 		},
+		"git go": {
+			repo:         makeGitRepositoryGo(t, gitCommands...),
+			spec:         "master",
+			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+		},
 		"hg": {
 			repo:         makeHgRepositoryNative(t, hgCommands...),
 			spec:         "tip",
@@ -218,6 +245,11 @@ func TestRepository_ResolveRevision_error(t *testing.T) {
 			spec:    "doesntexist",
 			wantErr: vcs.ErrRevisionNotFound,
 		},
+		"git go testcase1": {
+			repo:    makeGitRepositoryGo(t, gitCommands...),
+			spec:    "doesntexist",
+			wantErr: vcs.ErrRevisionNotFound,
+		},
 		"hg testcase1": {
 			repo:    makeHgRepositoryNative(t, hgCommands...),
 			spec:    "doesntexist",
@@ -241,6 +273,11 @@ func TestRepository_ResolveRevision_error(t *testing.T) {
 			spec:    "2874b2ef9be165966e5620fc29b592c041262721",
 			wantErr: vcs.ErrRevisionNotFound,
 		},
+		"git go testcase2": {
+			repo:    makeGitRepositoryGo(t, gitCommands...),
+			spec:    "2874b2ef9be165966e5620fc29b592c041262721",
+			wantErr: vcs.ErrRevisionNotFound,
+		},
 		"hg testcase2": {
 			repo:    makeHgRepositoryNative(t, hgCommands...),
 			spec:    "2874b2ef9be165966e5620fc29b592c041262721",
@@ -296,6 +333,11 @@ func TestRepository_ResolveTag(t *testing.T) {
 			tag:          "t",
 			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
 		},
+		"git go": {
+			repo:         makeGitRepositoryGo(t, gitCommands...),
+			tag:          "t",
+			wantCommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+		},
 		"hg": {
 			repo:         makeHgRepositoryNative(t, hgCommands...),
 			tag:          "t",
@@ -349,6 +391,11 @@ func TestRepository_ResolveTag_error(t *testing.T) {
 			tag:     "doesntexist",
 			wantErr: vcs.ErrTagNotFound,
 		},
+		"git go": {
+			repo:    makeGitRepositoryGo(t, gitCommands...),
+			tag:     "doesntexist",
+			wantErr: vcs.ErrTagNotFound,
+		},
 		"hg": {
 			repo:    makeHgRepositoryNative(t, hgCommands...),
 			tag:     "doesntexist",
@@ -391,6 +438,7 @@ func TestRepository_Branches(t *testing.T) {
 		"hg branch b1",
 		"hg add g",
 		"hg commit -m foo --date '2006-12-09 15:19:44 UTC' --user 'a <a@a.com>'",
+		"hg bookmark -r 0 bm",
 	}
 	tests := map[string]struct {
 		repo interface {
@@ -406,13 +454,17 @@ func TestRepository_Branches(t *testing.T) {
 			repo:         makeGitRepositoryCmd(t, gitCommands...),
 			wantBranches: []*vcs.Branch{{Name: "b0", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "b1", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "master", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}},
 		},
+		"git go": {
+			repo:         makeGitRepositoryGo(t, gitCommands...),
+			wantBranches: []*vcs.Branch{{Name: "b0", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "b1", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "master", Head: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}},
+		},
 		"hg": {
 			repo:         makeHgRepositoryNative(t, hgCommands...),
-			wantBranches: []*vcs.Branch{{Name: "b0", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}, {Name: "b1", Head: "843c6421bd707b885cc3849b8eb0b5b2b9298e8b"}},
+			wantBranches: []*vcs.Branch{{Name: "b0", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}, {Name: "b1", Head: "843c6421bd707b885cc3849b8eb0b5b2b9298e8b"}, {Name: "bm", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}},
 		},
 		"hg cmd": {
 			repo:         makeHgRepositoryCmd(t, hgCommands...),
-			wantBranches: []*vcs.Branch{{Name: "b0", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}, {Name: "b1", Head: "843c6421bd707b885cc3849b8eb0b5b2b9298e8b"}},
+			wantBranches: []*vcs.Branch{{Name: "b0", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}, {Name: "b1", Head: "843c6421bd707b885cc3849b8eb0b5b2b9298e8b"}, {Name: "bm", Head: "4edb70f7b9dd1ce8e95242525377098f477a89c3"}},
 		},
 	}
 
@@ -458,6 +510,15 @@ func TestRepository_Branches_MergedInto(t *testing.T) {
 				},
 			},
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			wantBranches: map[string][]*vcs.Branch{
+				"b1": {
+					{Name: "b0", Head: "6520a4539a4cb664537c712216a53d80dd79bbdc"},
+					{Name: "b1", Head: "6520a4539a4cb664537c712216a53d80dd79bbdc"},
+				},
+			},
+		},
 	} {
 		for branch, mergedInto := range test.wantBranches {
 			branches, err := test.repo.Branches(vcs.BranchesOptions{MergedInto: branch})
@@ -496,6 +557,14 @@ func TestRepository_Branches_ContainsCommit(t *testing.T) {
 				"2816a72df28f699722156e545d038a5203b959de": {{Name: "master", Head: "1224d334dfe08f4693968ea618ad63ae86ec16ca"}, {Name: "branch2", Head: "920c0e9d7b287b030ac9770fd7ba3ee9dc1760d9"}},
 			},
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			commitToWantBranches: map[string][]*vcs.Branch{
+				"920c0e9d7b287b030ac9770fd7ba3ee9dc1760d9": {{Name: "branch2", Head: "920c0e9d7b287b030ac9770fd7ba3ee9dc1760d9"}},
+				"1224d334dfe08f4693968ea618ad63ae86ec16ca": {{Name: "master", Head: "1224d334dfe08f4693968ea618ad63ae86ec16ca"}},
+				"2816a72df28f699722156e545d038a5203b959de": {{Name: "master", Head: "1224d334dfe08f4693968ea618ad63ae86ec16ca"}, {Name: "branch2", Head: "920c0e9d7b287b030ac9770fd7ba3ee9dc1760d9"}},
+			},
+		},
 	}
 
 	for label, test := range tests {
@@ -545,6 +614,14 @@ func TestRepository_Branches_BehindAheadCounts(t *testing.T) {
 				{Counts: &vcs.BehindAhead{Behind: 0, Ahead: 0}, Name: "master", Head: "8ea26e077a8fb9aa502c3fe2cfa3ce4e052d1a76"},
 			},
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			wantBranches: []*vcs.Branch{
+				{Counts: &vcs.BehindAhead{Behind: 5, Ahead: 1}, Name: "old_work", Head: "26692c614c59ddaef4b57926810aac7d5f0e94f0"},
+				{Counts: &vcs.BehindAhead{Behind: 0, Ahead: 3}, Name: "dev", Head: "6724953367f0cd9a7755bac46ee57f4ab0c1aad8"},
+				{Counts: &vcs.BehindAhead{Behind: 0, Ahead: 0}, Name: "master", Head: "8ea26e077a8fb9aa502c3fe2cfa3ce4e052d1a76"},
+			},
+		},
 	}
 
 	for label, test := range tests {
@@ -599,6 +676,31 @@ func TestRepository_Branches_IncludeCommit(t *testing.T) {
 				},
 			},
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			wantBranches: []*vcs.Branch{
+				{
+					Name: "master", Head: "a3c1537db9797215208eec56f8e7c9c37f8358ca",
+					Commit: &vcs.Commit{
+						ID:        "a3c1537db9797215208eec56f8e7c9c37f8358ca",
+						Author:    vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+						Committer: &vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-01-02T15:04:05Z")},
+						Message:   "foo0",
+						Parents:   nil,
+					},
+				},
+				{
+					Name: "b0", Head: "c4a53701494d1d788b1ceeb8bf32e90224962473",
+					Commit: &vcs.Commit{
+						ID:        "c4a53701494d1d788b1ceeb8bf32e90224962473",
+						Author:    vcs.Signature{"b", "b@b.com", mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")},
+						Committer: &vcs.Signature{"b", "b@b.com", mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")},
+						Message:   "foo1",
+						Parents:   []vcs.CommitID{"a3c1537db9797215208eec56f8e7c9c37f8358ca"},
+					},
+				},
+			},
+		},
 	}
 
 	for label, test := range tests {
@@ -643,6 +745,10 @@ func TestRepository_Tags(t *testing.T) {
 			repo:     makeGitRepositoryCmd(t, gitCommands...),
 			wantTags: []*vcs.Tag{{Name: "t0", CommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "t1", CommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}},
 		},
+		"git go": {
+			repo:     makeGitRepositoryGo(t, gitCommands...),
+			wantTags: []*vcs.Tag{{Name: "t0", CommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}, {Name: "t1", CommitID: "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8"}},
+		},
 		"hg": {
 			repo:     makeHgRepositoryNative(t, hgCommands...),
 			wantTags: []*vcs.Tag{{Name: "t0", CommitID: "e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf"}, {Name: "t1", CommitID: "6a6ae0da9d7c3bf48de61e5584d6eb5dcba0750c"}, {Name: "tip", CommitID: "217f213c2dbe4ce6573ec0b0dbd3e7abafaf8fba"}},
@@ -666,6 +772,73 @@ func TestRepository_Tags(t *testing.T) {
 	}
 }
 
+func TestRepository_Tags_annotated(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"GIT_COMMITTER_NAME=b GIT_COMMITTER_EMAIL=b@b.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git tag -a -m bar t1",
+		"GIT_COMMITTER_NAME=b GIT_COMMITTER_EMAIL=b@b.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git tag -a -m baz t2 t1",
+		"git tag t3 'HEAD^{tree}'",
+	}
+	tagger := &vcs.Signature{"b", "b@b.com", mustParseTime(time.RFC3339, "2006-01-02T15:04:06Z")}
+	wantGitTags := []*vcs.Tag{
+		{
+			Name:       "t1",
+			CommitID:   "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+			Annotated:  true,
+			ObjectID:   "c2a56d49784f2bc7c4542a98691c883672905e8e",
+			Tagger:     tagger,
+			Message:    "bar",
+			TargetType: vcs.ObjectType_COMMIT,
+		},
+		{
+			Name:       "t2",
+			CommitID:   "ea167fe3d76b1e5fd3ed8ca44cbd2fe3897684f8",
+			Annotated:  true,
+			ObjectID:   "3af7b5e0a2cfbd3432f2ce2ba5f32613aeae62a5",
+			Tagger:     tagger,
+			Message:    "baz",
+			TargetType: vcs.ObjectType_TAG,
+		},
+		{
+			Name:       "t3",
+			TargetType: vcs.ObjectType_TREE,
+		},
+	}
+	tests := map[string]struct {
+		repo interface {
+			Tags() ([]*vcs.Tag, error)
+		}
+		wantTags []*vcs.Tag
+	}{
+		"git libgit2": {
+			repo:     makeGitRepositoryLibGit2(t, gitCommands...),
+			wantTags: wantGitTags,
+		},
+		"git cmd": {
+			repo:     makeGitRepositoryCmd(t, gitCommands...),
+			wantTags: wantGitTags,
+		},
+		"git go": {
+			repo:     makeGitRepositoryGo(t, gitCommands...),
+			wantTags: wantGitTags,
+		},
+	}
+
+	for label, test := range tests {
+		tags, err := test.repo.Tags()
+		if err != nil {
+			t.Errorf("%s: Tags: %s", label, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(tags, test.wantTags) {
+			t.Errorf("%s: got tags == %v, want %v", label, asJSON(tags), asJSON(test.wantTags))
+		}
+	}
+}
+
 func TestRepository_GetCommit(t *testing.T) {
 	t.Parallel()
 
@@ -693,6 +866,7 @@ func TestRepository_GetCommit(t *testing.T) {
 		Author:  vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-12-06T13:18:30Z")},
 		Message: "bar",
 		Parents: []vcs.CommitID{"e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf"},
+		Phase:   "draft",
 	}
 	tests := map[string]struct {
 		repo interface {
@@ -711,6 +885,11 @@ func TestRepository_GetCommit(t *testing.T) {
 			id:         "b266c7e3ca00b1a17ad0b1449825d0854225c007",
 			wantCommit: wantGitCommit,
 		},
+		"git go": {
+			repo:       makeGitRepositoryGo(t, gitCommands...),
+			id:         "b266c7e3ca00b1a17ad0b1449825d0854225c007",
+			wantCommit: wantGitCommit,
+		},
 		"hg": {
 			repo:       makeHgRepositoryNative(t, hgCommands...),
 			id:         "c6320cdba5ebc6933bd7c94751dcd633d6aa0759",
@@ -780,12 +959,14 @@ func TestRepository_Commits(t *testing.T) {
 			Author:  vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-12-06T13:18:30Z")},
 			Message: "bar",
 			Parents: []vcs.CommitID{"e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf"},
+			Phase:   "draft",
 		},
 		{
 			ID:      "e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf",
 			Author:  vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-12-06T13:18:29Z")},
 			Message: "foo",
 			Parents: nil,
+			Phase:   "draft",
 		},
 	}
 	tests := map[string]struct {
@@ -808,6 +989,12 @@ func TestRepository_Commits(t *testing.T) {
 			wantCommits: wantGitCommits,
 			wantTotal:   2,
 		},
+		"git go": {
+			repo:        makeGitRepositoryGo(t, gitCommands...),
+			id:          "b266c7e3ca00b1a17ad0b1449825d0854225c007",
+			wantCommits: wantGitCommits,
+			wantTotal:   2,
+		},
 		"hg native": {
 			repo:        makeHgRepositoryNative(t, hgCommands...),
 			id:          "c6320cdba5ebc6933bd7c94751dcd633d6aa0759",
@@ -900,6 +1087,7 @@ func TestRepository_Commits_options(t *testing.T) {
 			Author:  vcs.Signature{"a", "a@a.com", mustParseTime(time.RFC3339, "2006-12-06T13:18:30Z")},
 			Message: "bar",
 			Parents: []vcs.CommitID{"e8e11ff1be92a7be71b9b5cdb4cc674b7dc9facf"},
+			Phase:   "draft",
 		},
 	}
 	tests := map[string]struct {
@@ -922,6 +1110,12 @@ func TestRepository_Commits_options(t *testing.T) {
 			wantCommits: wantGitCommits,
 			wantTotal:   3,
 		},
+		"git go": {
+			repo:        makeGitRepositoryGo(t, gitCommands...),
+			opt:         vcs.CommitsOptions{Head: "ade564eba4cf904492fb56dcd287ac633e6e082c", N: 1, Skip: 1},
+			wantCommits: wantGitCommits,
+			wantTotal:   3,
+		},
 		"git libgit2 Head": {
 			repo: makeGitRepositoryLibGit2(t, gitCommands...),
 			opt: vcs.CommitsOptions{
@@ -940,6 +1134,15 @@ func TestRepository_Commits_options(t *testing.T) {
 			wantCommits: wantGitCommits2,
 			wantTotal:   1,
 		},
+		"git go Head": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			opt: vcs.CommitsOptions{
+				Head: "ade564eba4cf904492fb56dcd287ac633e6e082c",
+				Base: "b266c7e3ca00b1a17ad0b1449825d0854225c007",
+			},
+			wantCommits: wantGitCommits2,
+			wantTotal:   1,
+		},
 		"hg native": {
 			repo:        makeHgRepositoryNative(t, hgCommands...),
 			opt:         vcs.CommitsOptions{Head: "443def46748a0c02c312bb4fdc6231d6ede45f49", N: 1, Skip: 1},
@@ -984,6 +1187,160 @@ func TestRepository_Commits_options(t *testing.T) {
 	}
 }
 
+func TestRepository_Commits_hgPhases(t *testing.T) {
+	t.Parallel()
+
+	hgCommands := []string{
+		"touch f",
+		"hg add f",
+		"hg commit -m 0 --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+		"echo 1 > f",
+		"hg commit -m 1 --date '2006-12-06 13:18:30 UTC' --user 'a <a@a.com>'",
+		"echo 2 > f",
+		"hg commit -m 2 --date '2006-12-06 13:18:31 UTC' --user 'a <a@a.com>'",
+		"echo 3 > f",
+		"hg commit -m 3 --date '2006-12-06 13:18:32 UTC' --user 'a <a@a.com>'",
+		"hg phase --public -r 1",
+		"hg phase --force --secret -r 3",
+	}
+	tests := map[string]struct {
+		repo interface {
+			Commits(vcs.CommitsOptions) ([]*vcs.Commit, uint, error)
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+	}{
+		"hg native": {repo: makeHgRepositoryNative(t, hgCommands...)},
+		"hg cmd":    {repo: makeHgRepositoryCmd(t, hgCommands...)},
+	}
+	want := []string{"3 secret", "2 draft", "1 public", "0 public"}
+
+	for label, test := range tests {
+		head, err := test.repo.ResolveRevision("tip")
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+		commits, _, err := test.repo.Commits(vcs.CommitsOptions{Head: head})
+		if err != nil {
+			t.Errorf("%s: Commits: %s", label, err)
+			continue
+		}
+		var got []string
+		for _, c := range commits {
+			got = append(got, c.Message+" "+c.Phase)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got commit phases %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestRepository_Commits_filters(t *testing.T) {
+	t.Parallel()
+
+	gitCommands := []string{
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit --allow-empty -m initial --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+		"git checkout -b b",
+		"GIT_COMMITTER_NAME=b GIT_COMMITTER_EMAIL=b@b.com GIT_COMMITTER_DATE=2006-01-02T15:04:07Z git commit --allow-empty -m $'feature\n\nfixes #1' --author='b <b@b.com>' --date 2006-01-02T15:04:06Z",
+		"git checkout master",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:06Z git commit --allow-empty -m 'master work' --author='a <a@a.com>' --date 2006-01-02T15:04:10Z",
+		"GIT_COMMITTER_NAME=c GIT_COMMITTER_EMAIL=c@c.com GIT_COMMITTER_DATE=2006-01-02T15:04:08Z GIT_AUTHOR_NAME=a GIT_AUTHOR_EMAIL=a@a.com GIT_AUTHOR_DATE=2006-01-02T15:04:08Z git merge --no-ff -m 'merge b' b",
+		"GIT_COMMITTER_NAME=b GIT_COMMITTER_EMAIL=b@b.com GIT_COMMITTER_DATE=2006-01-02T15:04:09Z git commit --allow-empty -m 'fix typo' --author='b <b@b.com>' --date 2006-01-02T15:04:09Z",
+	}
+	const (
+		initial    = "5b4c37dfddaac980474059b21ea8fb5d79a89e12"
+		feature    = "389edfaafa976ee085f6d47e50ae77d298f65e04"
+		masterWork = "b2a61237e9ecba0282dbcb01f993964d0247de3e"
+		merge      = "9476f11c7b6460c88f4f18198e337b2930a8e1f2"
+		fixTypo    = "a6b9d9f371308a74e31645c7317aac6393f264ae"
+	)
+	repos := map[string]interface {
+		Commits(opt vcs.CommitsOptions) ([]*vcs.Commit, uint, error)
+	}{
+		"git libgit2": makeGitRepositoryLibGit2(t, gitCommands...),
+		"git cmd":     makeGitRepositoryCmd(t, gitCommands...),
+		"git go":      makeGitRepositoryGo(t, gitCommands...),
+	}
+	tests := map[string]struct {
+		opt  vcs.CommitsOptions
+		want []vcs.CommitID
+	}{
+		"default order": {
+			opt:  vcs.CommitsOptions{Head: fixTypo},
+			want: []vcs.CommitID{fixTypo, merge, feature, masterWork, initial},
+		},
+		"author date order": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, Order: vcs.AuthorDateOrder},
+			want: []vcs.CommitID{fixTypo, merge, masterWork, feature, initial},
+		},
+		"topo order": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, Order: vcs.TopoOrder, Skip: 1, N: 2},
+			want: []vcs.CommitID{merge, feature},
+		},
+		"first parent": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, FirstParent: true},
+			want: []vcs.CommitID{fixTypo, merge, masterWork, initial},
+		},
+		"no merges": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, NoMerges: true},
+			want: []vcs.CommitID{fixTypo, feature, masterWork, initial},
+		},
+		"merges only": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, MergesOnly: true},
+			want: []vcs.CommitID{merge},
+		},
+		"author": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, Author: "^b <"},
+			want: []vcs.CommitID{fixTypo, feature},
+		},
+		"committer": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, Committer: `c@c\.com`},
+			want: []vcs.CommitID{merge},
+		},
+		"message": {
+			opt:  vcs.CommitsOptions{Head: fixTypo, Message: "^fixes #[0-9]+$"},
+			want: []vcs.CommitID{feature},
+		},
+		"since and until": {
+			opt: vcs.CommitsOptions{
+				Head:  fixTypo,
+				Since: mustParseTime(time.RFC3339, "2006-01-02T15:04:07Z").Time(),
+				Until: mustParseTime(time.RFC3339, "2006-01-02T15:04:08Z").Time(),
+			},
+			want: []vcs.CommitID{merge, feature},
+		},
+		"heads and bases": {
+			opt:  vcs.CommitsOptions{Head: masterWork, Heads: []vcs.CommitID{feature}, Bases: []vcs.CommitID{initial}},
+			want: []vcs.CommitID{feature, masterWork},
+		},
+	}
+
+	for label, repo := range repos {
+		for name, test := range tests {
+			commits, total, err := repo.Commits(test.opt)
+			if err != nil {
+				t.Errorf("%s: %s: Commits(): %s", label, name, err)
+				continue
+			}
+
+			var ids []vcs.CommitID
+			for _, c := range commits {
+				ids = append(ids, c.ID)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("%s: %s: got commits %v, want %v", label, name, ids, test.want)
+			}
+			if test.opt.N == 0 && total != uint(len(test.want)) {
+				t.Errorf("%s: %s: got %d total commits, want %d", label, name, total, len(test.want))
+			}
+		}
+
+		if _, _, err := repo.Commits(vcs.CommitsOptions{Head: fixTypo, Order: "foo"}); err == nil {
+			t.Errorf("%s: for invalid order: got err == nil", label)
+		}
+	}
+}
+
 func TestRepository_Commits_options_path(t *testing.T) {
 	t.Parallel()
 
@@ -1012,6 +1369,15 @@ func TestRepository_Commits_options_path(t *testing.T) {
 		wantCommits []*vcs.Commit
 		wantTotal   uint
 	}{
+		"git libgit2 Path 0": {
+			repo: makeGitRepositoryLibGit2(t, gitCommands...),
+			opt: vcs.CommitsOptions{
+				Head: "master",
+				Path: "doesnt-exist",
+			},
+			wantCommits: nil,
+			wantTotal:   0,
+		},
 		"git cmd Path 0": {
 			repo: makeGitRepositoryCmd(t, gitCommands...),
 			opt: vcs.CommitsOptions{
@@ -1021,6 +1387,24 @@ func TestRepository_Commits_options_path(t *testing.T) {
 			wantCommits: nil,
 			wantTotal:   0,
 		},
+		"git go Path 0": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			opt: vcs.CommitsOptions{
+				Head: "master",
+				Path: "doesnt-exist",
+			},
+			wantCommits: nil,
+			wantTotal:   0,
+		},
+		"git libgit2 Path 1": {
+			repo: makeGitRepositoryLibGit2(t, gitCommands...),
+			opt: vcs.CommitsOptions{
+				Head: "master",
+				Path: "file1",
+			},
+			wantCommits: wantGitCommits,
+			wantTotal:   1,
+		},
 		"git cmd Path 1": {
 			repo: makeGitRepositoryCmd(t, gitCommands...),
 			opt: vcs.CommitsOptions{
@@ -1030,6 +1414,15 @@ func TestRepository_Commits_options_path(t *testing.T) {
 			wantCommits: wantGitCommits,
 			wantTotal:   1,
 		},
+		"git go Path 1": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+			opt: vcs.CommitsOptions{
+				Head: "master",
+				Path: "file1",
+			},
+			wantCommits: wantGitCommits,
+			wantTotal:   1,
+		},
 	}
 
 	for label, test := range tests {
@@ -1062,6 +1455,231 @@ func TestRepository_Commits_options_path(t *testing.T) {
 	}
 }
 
+func TestRepository_FileHistory(t *testing.T) {
+	t.Parallel()
+
+	gitCommit := func(msg string) string {
+		return "GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m " + msg + " --author='a <a@a.com>' --date 2006-01-02T15:04:05Z"
+	}
+	gitCommands := []string{
+		"seq 1 20 > f",
+		"git add f",
+		gitCommit("add"),
+		"echo g > g",
+		"git add g",
+		gitCommit("other"),
+		"git mv f f2",
+		gitCommit("rename"),
+		"mkdir dir",
+		"git mv f2 dir/f3",
+		"echo 21 >> dir/f3",
+		"git add dir/f3",
+		gitCommit("move-and-change"),
+		"echo 22 >> dir/f3",
+		"git add dir/f3",
+		gitCommit("change"),
+		"echo new > f",
+		"git add f",
+		gitCommit("re-add"),
+		"cp dir/f3 copy",
+		"git add copy",
+		gitCommit("copy"),
+	}
+	hgCommit := func(msg string) string {
+		return "hg commit -m " + msg + " --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'"
+	}
+	hgCommands := []string{
+		"seq 1 20 > f",
+		"hg add f",
+		hgCommit("add"),
+		"echo g > g",
+		"hg add g",
+		hgCommit("other"),
+		"hg mv f f2",
+		hgCommit("rename"),
+		"mkdir dir",
+		"hg mv f2 dir/f3",
+		"echo 21 >> dir/f3",
+		hgCommit("move-and-change"),
+		"echo 22 >> dir/f3",
+		hgCommit("change"),
+		"hg cp dir/f3 copy",
+		hgCommit("copy"),
+	}
+
+	// Each commit is "message path".
+	gitWant := map[string][]string{
+		"dir/f3": {"change dir/f3", "move-and-change dir/f3", "rename f2", "add f"},
+		"f":      {"re-add f", "rename f", "add f"}, // the new f isn't a rename
+		"dir":    {"change dir", "move-and-change dir"},
+		"copy":   {"copy copy", "change dir/f3", "move-and-change dir/f3", "rename f2", "add f"},
+	}
+	hgWant := map[string][]string{
+		"dir/f3": {"change dir/f3", "move-and-change dir/f3", "rename f2", "add f"},
+		"copy":   {"copy copy", "change dir/f3", "move-and-change dir/f3", "rename f2", "add f"},
+	}
+	tests := map[string]struct {
+		repo interface {
+			vcs.FileHistoryLister
+			Commits(vcs.CommitsOptions) ([]*vcs.Commit, uint, error)
+			ResolveRevision(spec string) (vcs.CommitID, error)
+		}
+		head string
+		want map[string][]string // path -> history
+	}{
+		"git libgit2": {repo: makeGitRepositoryLibGit2(t, gitCommands...), head: "master", want: gitWant},
+		"git cmd":     {repo: makeGitRepositoryCmd(t, gitCommands...), head: "master", want: gitWant},
+		"git go":      {repo: makeGitRepositoryGo(t, gitCommands...), head: "master", want: gitWant},
+		"hg native":   {repo: makeHgRepositoryNative(t, hgCommands...), head: "tip", want: hgWant},
+		"hg cmd":      {repo: makeHgRepositoryCmd(t, hgCommands...), head: "tip", want: hgWant},
+	}
+
+	for label, test := range tests {
+		head, err := test.repo.ResolveRevision(test.head)
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+
+		for path, want := range test.want {
+			for _, opt := range []vcs.CommitsOptions{
+				{Head: head, Path: path},
+				{Head: head, Path: path, Skip: 1, N: 2},
+				{Head: head, Path: path, N: 1, NoTotal: true},
+			} {
+				history, total, err := test.repo.FileHistory(opt)
+				if err != nil {
+					t.Errorf("%s: FileHistory(%+v): %s", label, opt, err)
+					continue
+				}
+				var got []string
+				for _, fc := range history {
+					got = append(got, fc.Commit.Message+" "+fc.Path)
+				}
+				wantPage := want[opt.Skip:]
+				if opt.N != 0 && uint(len(wantPage)) > opt.N {
+					wantPage = wantPage[:opt.N]
+				}
+				if !reflect.DeepEqual(got, wantPage) {
+					t.Errorf("%s: FileHistory(%+v): got %q, want %q", label, opt, got, wantPage)
+				}
+				wantTotal := uint(len(want))
+				if opt.NoTotal {
+					wantTotal = 0
+				}
+				if total != wantTotal {
+					t.Errorf("%s: FileHistory(%+v): got total %d, want %d", label, opt, total, wantTotal)
+				}
+
+				// Commits returns the same commits.
+				commits, commitsTotal, err := test.repo.Commits(opt)
+				if err != nil {
+					t.Errorf("%s: Commits(%+v): %s", label, opt, err)
+					continue
+				}
+				for i, c := range commits {
+					if i >= len(history) || c.ID != history[i].Commit.ID {
+						t.Errorf("%s: Commits(%+v): got %s, want the commits in %s", label, opt, asJSON(commits), asJSON(history))
+						break
+					}
+				}
+				if len(commits) != len(history) || commitsTotal != total {
+					t.Errorf("%s: Commits(%+v): got %d commits (total %d), want %d (total %d)", label, opt, len(commits), commitsTotal, len(history), total)
+				}
+			}
+		}
+
+		if _, _, err := test.repo.FileHistory(vcs.CommitsOptions{Head: head}); err == nil {
+			t.Errorf("%s: FileHistory without path: want error", label)
+		}
+	}
+}
+
+func TestRepository_Committers(t *testing.T) {
+	t.Parallel()
+
+	gitCommit := func(author, date string) string {
+		return "GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=" + date + " git commit -m foo --author='" + author + "' --date " + date
+	}
+	gitCommands := []string{
+		"echo 1 > f",
+		"git add f",
+		gitCommit("alice <alice@example.com>", "2006-01-02T15:04:05Z"),
+		"echo other > g",
+		"git add g",
+		gitCommit("bob <bob@example.com>", "2006-01-03T15:04:05Z"),
+		"echo 2 > f",
+		"git add f",
+		gitCommit("alice <alice@example.com>", "2006-01-04T15:04:05Z"),
+	}
+	hgCommit := func(author, date string) string {
+		return "hg commit -m foo --user '" + author + "' --date '" + date + "'"
+	}
+	hgCommands := []string{
+		"echo 1 > f",
+		"hg add f",
+		hgCommit("alice <alice@example.com>", "2006-01-02 15:04:05 UTC"),
+		"echo other > g",
+		"hg add g",
+		hgCommit("bob <bob@example.com>", "2006-01-03 15:04:05 UTC"),
+		"echo 2 > f",
+		hgCommit("alice <alice@example.com>", "2006-01-04 15:04:05 UTC"),
+	}
+	repos := map[string]vcs.Repository{
+		"git libgit2": makeGitRepositoryLibGit2(t, gitCommands...),
+		"git cmd":     makeGitRepositoryCmd(t, gitCommands...),
+		"git go":      makeGitRepositoryGo(t, gitCommands...),
+		"hg native":   makeHgRepositoryNative(t, hgCommands...),
+		"hg cmd":      makeHgRepositoryCmd(t, hgCommands...),
+	}
+
+	alice2 := &vcs.Committer{Name: "alice", Email: "alice@example.com", Commits: 2}
+	alice1 := &vcs.Committer{Name: "alice", Email: "alice@example.com", Commits: 1}
+	bob1 := &vcs.Committer{Name: "bob", Email: "bob@example.com", Commits: 1}
+	tests := map[string]struct {
+		opt  vcs.CommittersOptions
+		want []*vcs.Committer
+	}{
+		"all": {
+			opt:  vcs.CommittersOptions{},
+			want: []*vcs.Committer{alice2, bob1},
+		},
+		"N": {
+			opt:  vcs.CommittersOptions{N: 1},
+			want: []*vcs.Committer{alice2},
+		},
+		"since": {
+			opt:  vcs.CommittersOptions{Since: mustParseTime(time.RFC3339, "2006-01-03T00:00:00Z").Time()},
+			want: []*vcs.Committer{alice1, bob1},
+		},
+		"until": {
+			opt:  vcs.CommittersOptions{Until: mustParseTime(time.RFC3339, "2006-01-02T16:00:00Z").Time()},
+			want: []*vcs.Committer{alice1},
+		},
+		"path": {
+			opt:  vcs.CommittersOptions{Path: "g"},
+			want: []*vcs.Committer{bob1},
+		},
+	}
+
+	for label, repo := range repos {
+		for name, test := range tests {
+			committers, err := repo.Committers(test.opt)
+			if err != nil {
+				t.Errorf("%s: %s: Committers(): %s", label, name, err)
+				continue
+			}
+			if !reflect.DeepEqual(committers, test.want) {
+				t.Errorf("%s: %s: got committers %s, want %s", label, name, asJSON(committers), asJSON(test.want))
+			}
+		}
+
+		if _, err := repo.Committers(vcs.CommittersOptions{Rev: "doesntexist"}); err == nil {
+			t.Errorf("%s: Committers with nonexistent rev: want error", label)
+		}
+	}
+}
+
 func TestRepository_FileSystem_Symlinks(t *testing.T) {
 
 	t.Parallel()
@@ -1117,6 +1735,12 @@ func TestRepository_FileSystem_Symlinks(t *testing.T) {
 			testFileInfoSys: true,
 			git:             true,
 		},
+		"git go": {
+			repo:            makeGitRepositoryGo(t, gitCommands...),
+			commitID:        gitCommitID,
+			testFileInfoSys: true,
+			git:             true,
+		},
 		"hg native": {
 			repo:     makeHgRepositoryNative(t, hgCommands...),
 			commitID: hgCommitID,
@@ -1265,6 +1889,11 @@ func TestRepository_FileSystem(t *testing.T) {
 			first:  "b6602ca96bdc0ab647278577a3c6edcb8fe18fb0",
 			second: "ace35f1597e087fe2d302ed6cb2763174e6b9660",
 		},
+		"git go": {
+			repo:   makeGitRepositoryGo(t, gitCommands...),
+			first:  "b6602ca96bdc0ab647278577a3c6edcb8fe18fb0",
+			second: "ace35f1597e087fe2d302ed6cb2763174e6b9660",
+		},
 		"hg native": {
 			repo:   makeHgRepositoryNative(t, hgCommands...),
 			first:  "0b3260387c55ff0834b520fd7f5d4f4a15c22827",
@@ -1440,6 +2069,24 @@ func TestRepository_FileLister(t *testing.T) {
 		"git add file2 file3 file0 dirA/dirB/dirC/fileZ",
 		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com git commit -m commit3 --author='a <a@a.com>'",
 	}
+	// hg can't commit an empty changeset, so the hg commits are the
+	// git ones after the first.
+	hgCommands := []string{
+		"echo -n > file0",
+		"hg add file0",
+		"hg commit -m commit1 --user 'a <a@a.com>'",
+		"mkdir dir1",
+		"echo -n > dir1/file1",
+		"hg add dir1/file1",
+		"hg commit -m commit2 --user 'a <a@a.com>'",
+		"echo -n > file2",
+		"echo -n > file3",
+		"mkdir -p dirA/dirB/dirC",
+		"echo -n > dirA/dirB/dirC/fileZ",
+		"ln -s file0 link",
+		"hg add file2 file3 dirA/dirB/dirC/fileZ link",
+		"hg commit -m commit3 --user 'a <a@a.com>'",
+	}
 	tests := map[string]struct {
 		repo interface {
 			ListFiles(vcs.CommitID) ([]string, error)
@@ -1452,21 +2099,56 @@ func TestRepository_FileLister(t *testing.T) {
 			commit:    "master@{3}",
 			wantFiles: []string{},
 		},
+		"git go Commit 0": {
+			repo:      makeGitRepositoryGo(t, gitCommands...),
+			commit:    "master@{3}",
+			wantFiles: []string{},
+		},
 		"git cmd Commit 1": {
 			repo:      makeGitRepositoryCmd(t, gitCommands...),
 			commit:    "master@{2}",
 			wantFiles: []string{"file0"},
 		},
+		"git go Commit 1": {
+			repo:      makeGitRepositoryGo(t, gitCommands...),
+			commit:    "master@{2}",
+			wantFiles: []string{"file0"},
+		},
 		"git cmd Commit 2": {
 			repo:      makeGitRepositoryCmd(t, gitCommands...),
 			commit:    "master@{1}",
 			wantFiles: []string{"dir1/file1", "file0"},
 		},
+		"git go Commit 2": {
+			repo:      makeGitRepositoryGo(t, gitCommands...),
+			commit:    "master@{1}",
+			wantFiles: []string{"dir1/file1", "file0"},
+		},
 		"git cmd Commit 3": {
 			repo:      makeGitRepositoryCmd(t, gitCommands...),
 			commit:    "master",
 			wantFiles: []string{"dir1/file1", "dirA/dirB/dirC/fileZ", "file0", "file2", "file3"},
 		},
+		"git go Commit 3": {
+			repo:      makeGitRepositoryGo(t, gitCommands...),
+			commit:    "master",
+			wantFiles: []string{"dir1/file1", "dirA/dirB/dirC/fileZ", "file0", "file2", "file3"},
+		},
+		"hg native Commit 1": {
+			repo:      makeHgRepositoryNative(t, hgCommands...),
+			commit:    "0",
+			wantFiles: []string{"file0"},
+		},
+		"hg native Commit 2": {
+			repo:      makeHgRepositoryNative(t, hgCommands...),
+			commit:    "1",
+			wantFiles: []string{"dir1/file1", "file0"},
+		},
+		"hg native Commit 3": {
+			repo:      makeHgRepositoryNative(t, hgCommands...),
+			commit:    "tip",
+			wantFiles: []string{"dir1/file1", "dirA/dirB/dirC/fileZ", "file0", "file2", "file3", "link"},
+		},
 	}
 
 	for label, test := range tests {
@@ -1508,6 +2190,9 @@ func TestRepository_FileSystem_gitSubmodules(t *testing.T) {
 		"git cmd": {
 			repo: makeGitRepositoryCmd(t, gitCommands...),
 		},
+		"git go": {
+			repo: makeGitRepositoryGo(t, gitCommands...),
+		},
 	}
 
 	for label, test := range tests {
@@ -1575,6 +2260,7 @@ func TestOpen(t *testing.T) {
 	t.Parallel()
 	tests := []struct{ vcs, dir string }{
 		{"git", initGitRepository(t)},
+		{"gitgo", initGitRepository(t)},
 		{"hg", initHgRepository(t, "touch x", "hg add x", "hg commit -m foo")},
 	}
 
@@ -1759,6 +2445,18 @@ func makeGitRepositoryLibGit2(t testing.TB, cmds ...string) *git.Repository {
 	return r
 }
 
+// makeGitRepositoryGo calls initGitRepository to create a new Git
+// repository and run cmds in it, and then returns the pure-Go
+// repository.
+func makeGitRepositoryGo(t testing.TB, cmds ...string) *gitgo.Repository {
+	dir := initGitRepository(t, cmds...)
+	r, err := gitgo.Open(dir)
+	if err != nil {
+		t.Fatalf("gitgo.Open(%q) failed: %s", dir, err)
+	}
+	return r
+}
+
 // initHgRepository initializes a new Hg repository and runs cmds in a new
 // temporary directory (returned as dir).
 func initHgRepository(t testing.TB, cmds ...string) (dir string) {
@@ -1,5 +1,17 @@
 package vcs
 
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
 type Searcher interface {
 	// Search searches the text of a repository at the given commit
 	// ID.
@@ -11,5 +23,391 @@ const (
 	// indicates the query is a fixed string, not a regex.
 	FixedQuery = "fixed"
 
-	// TODO(sqs): allow regexp searches, extended regexp searches, etc.
+	// RegexpQuery is a value for SearchOptions.QueryType that
+	// indicates the query is a POSIX basic regexp (as used by `git
+	// grep --basic-regexp`).
+	RegexpQuery = "regexp"
+
+	// ExtendedRegexpQuery is a value for SearchOptions.QueryType that
+	// indicates the query is a POSIX extended regexp (as used by `git
+	// grep --extended-regexp`).
+	ExtendedRegexpQuery = "extended"
+
+	// PerlRegexpQuery is a value for SearchOptions.QueryType that
+	// indicates the query is a Perl-compatible regexp (as used by
+	// `git grep --perl-regexp`, which requires git to be built with
+	// PCRE support).
+	PerlRegexpQuery = "perl"
 )
+
+// SearchFileSystem searches the regular files in fs (usually a
+// repository's FileSystem at a commit) for opt.Query. It is for use
+// by Searcher implementations that can't use `git grep`, and returns
+// the same results as `git grep` would: binary files are skipped,
+// files are searched in path order, and matches in a file whose
+// context lines are adjacent or overlap are merged into a single
+// result.
+//
+// Regexps are evaluated with Go's regexp package, so Perl-style
+// features that it doesn't support (such as backreferences and
+// lookaround assertions) can't be used.
+func SearchFileSystem(ctx context.Context, fs vfs.FileSystem, opt SearchOptions) ([]*SearchResult, error) {
+	var res []*SearchResult
+	_, err := SearchFileSystemStream(ctx, fs, opt, func(r *SearchResult) error {
+		res = append(res, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SearchFileSystemStream is like SearchFileSystem, but it streams
+// the results to fn (see StreamSearcher).
+func SearchFileSystemStream(ctx context.Context, fs vfs.FileSystem, opt SearchOptions, fn func(*SearchResult) error) (*SearchStats, error) {
+	re, err := compileSearchQuery(opt)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewSearchResultFilter(opt, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't list directories whose files all come before the
+	// cursor.
+	cursorFile := filter.CursorFile()
+	skipDir := func(dir string) bool {
+		return dir+"/" < cursorFile && !strings.HasPrefix(cursorFile, dir+"/")
+	}
+	var files []string
+	if err := walkRegularFiles(fs, ".", skipDir, &files); err != nil {
+		return nil, err
+	}
+	readFile := func(file string) ([]byte, error) { return vfs.ReadFile(fs, file) }
+	return searchFiles(ctx, files, readFile, re, filter, opt)
+}
+
+// SearchFiles is like SearchFileSystemStream, but it searches the
+// regular files with the given paths, reading them with readFile. It
+// is for use by Searcher implementations that can list and read a
+// commit's files more cheaply than through a vfs.FileSystem.
+func SearchFiles(ctx context.Context, files []string, readFile func(path string) ([]byte, error), opt SearchOptions, fn func(*SearchResult) error) (*SearchStats, error) {
+	re, err := compileSearchQuery(opt)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewSearchResultFilter(opt, fn)
+	if err != nil {
+		return nil, err
+	}
+	return searchFiles(ctx, append([]string(nil), files...), readFile, re, filter, opt)
+}
+
+// searchFiles searches the files (which it sorts) for matches of re
+// and adds the results to filter.
+func searchFiles(ctx context.Context, files []string, readFile func(string) ([]byte, error), re *regexp.Regexp, filter *SearchResultFilter, opt SearchOptions) (*SearchStats, error) {
+	sort.Strings(files)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if filter.SkipFile(file) || !SearchPathMatches(file, opt.IncludePaths, opt.ExcludePaths) {
+			continue
+		}
+
+		data, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if isBinary(data) {
+			continue
+		}
+		for _, r := range searchFile(file, data, re, opt) {
+			done, err := filter.Add(r)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return filter.Close()
+			}
+		}
+	}
+	return filter.Close()
+}
+
+// walkRegularFiles appends the paths of all regular files in the
+// directory dir in fs (and its subdirectories, except those for which
+// skipDir returns true) to files.
+func walkRegularFiles(fs vfs.FileSystem, dir string, skipDir func(string) bool, files *[]string) error {
+	fis, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := path.Join(dir, fi.Name())
+		switch {
+		case fi.Mode().IsDir():
+			if skipDir(name) {
+				continue
+			}
+			if err := walkRegularFiles(fs, name, skipDir, files); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			*files = append(*files, name)
+		}
+	}
+	return nil
+}
+
+// isBinary reports whether data looks like the contents of a binary
+// file, using the same heuristic as git (a NUL byte in the first 8000
+// bytes).
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
+
+// searchFile returns the results for the matches of re in a file's
+// data.
+func searchFile(file string, data []byte, re *regexp.Regexp, opt SearchOptions) []*SearchResult {
+	lines := bytes.Split(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1] // ignore the empty "line" after a trailing newline
+	}
+	lineStarts := make([]int, len(lines)+1) // byte offset of each line, and of the end of the last line
+	for i, line := range lines {
+		lineStarts[i+1] = lineStarts[i] + len(line) + 1
+	}
+
+	var res []*SearchResult
+	var cur *SearchResult
+	curEnd := -1 // index of the last line in cur
+	for i, line := range lines {
+		selected, matches := findMatches(re, line, opt.Word)
+		if !selected {
+			continue
+		}
+		start, end := i-int(opt.ContextLines), i+int(opt.ContextLines)
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines)-1 {
+			end = len(lines) - 1
+		}
+
+		if cur != nil && start <= curEnd+1 {
+			// Extend the current result to include this match.
+			for j := curEnd + 1; j <= end; j++ {
+				cur.Match = append(append(cur.Match, '\n'), lines[j]...)
+			}
+		} else {
+			cur = &SearchResult{
+				File:      file,
+				StartByte: uint32(lineStarts[start]),
+				StartLine: uint32(start + 1),
+				Match:     bytes.Join(lines[start:end+1], []byte("\n")),
+			}
+			res = append(res, cur)
+		}
+		if end > curEnd {
+			curEnd = end
+		}
+		cur.EndLine = uint32(curEnd + 1)
+		cur.EndByte = cur.StartByte + uint32(len(cur.Match))
+
+		for _, m := range matches {
+			cur.Matches = append(cur.Matches, &SearchMatch{
+				Line:      uint32(i + 1),
+				Column:    uint32(m[0]),
+				StartByte: uint32(lineStarts[i] + m[0]),
+				EndByte:   uint32(lineStarts[i] + m[1]),
+			})
+		}
+	}
+	return res
+}
+
+// findMatches reports whether re selects the line and returns the
+// byte ranges of the matches in it. If word is true, only matches
+// that are whole words are considered. Like `git grep`, it stops
+// reporting matches at the first empty match.
+func findMatches(re *regexp.Regexp, line []byte, word bool) (selected bool, matches [][]int) {
+	for _, m := range re.FindAllIndex(line, -1) {
+		if word && !isWordBounded(line, m[0], m[1]) {
+			continue
+		}
+		selected = true
+		if m[0] == m[1] {
+			break
+		}
+		matches = append(matches, m)
+	}
+	return selected, matches
+}
+
+// isWordBounded reports whether line[start:end] is preceded and
+// followed by a non-word character (or the start or end of the
+// line).
+func isWordBounded(line []byte, start, end int) bool {
+	return (start == 0 || !isWordChar(line[start-1])) && (end == len(line) || !isWordChar(line[end]))
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// compileSearchQuery returns a regexp that matches opt's query. It
+// doesn't take opt.Word into account.
+func compileSearchQuery(opt SearchOptions) (*regexp.Regexp, error) {
+	var expr string
+	switch opt.QueryType {
+	case FixedQuery:
+		expr = regexp.QuoteMeta(opt.Query)
+	case RegexpQuery:
+		expr = basicToGoRegexp(opt.Query)
+	case ExtendedRegexpQuery, PerlRegexpQuery:
+		expr = opt.Query
+	default:
+		return nil, fmt.Errorf("unrecognized QueryType: %q", opt.QueryType)
+	}
+	if opt.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if opt.QueryType == RegexpQuery || opt.QueryType == ExtendedRegexpQuery {
+		// POSIX regexps match the leftmost-longest text (as in git
+		// grep), not the leftmost-first.
+		re.Longest()
+	}
+	return re, nil
+}
+
+// basicToGoRegexp converts a POSIX basic regexp (including the GNU
+// extensions that git supports, such as "\+" and "\|") to Go's regexp
+// syntax.
+func basicToGoRegexp(bre string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(bre); i++ {
+		c := bre[i]
+		switch {
+		case c == '\\' && i+1 < len(bre):
+			i++
+			switch bre[i] {
+			case '(', ')', '{', '}', '|', '+', '?':
+				buf.WriteByte(bre[i])
+			case '<', '>':
+				buf.WriteString(`\b`)
+			default:
+				buf.WriteByte('\\')
+				buf.WriteByte(bre[i])
+			}
+
+		case c == '[':
+			// Copy bracket expressions (which have no special
+			// characters in common with the rest of the regexp)
+			// verbatim.
+			j := i + 1
+			if j < len(bre) && bre[j] == '^' {
+				j++
+			}
+			if j < len(bre) && bre[j] == ']' {
+				j++
+			}
+			for j < len(bre) && bre[j] != ']' {
+				if bre[j] == '[' && j+1 < len(bre) && strings.IndexByte(":.=", bre[j+1]) != -1 {
+					// Skip character classes such as "[:alpha:]".
+					if k := strings.Index(bre[j+2:], string(bre[j+1])+"]"); k != -1 {
+						j += k + 3
+					}
+				}
+				j++
+			}
+			if j >= len(bre) {
+				// Unterminated; let regexp.Compile report the error.
+				buf.WriteString(bre[i:])
+				return buf.String()
+			}
+			buf.WriteString(bre[i : j+1])
+			i = j
+
+		case strings.IndexByte("(){}|+?", c) != -1:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+
+		case c == '*' && (buf.Len() == 0 || bytes.HasSuffix(buf.Bytes(), []byte("^")) || bytes.HasSuffix(buf.Bytes(), []byte("("))):
+			// A "*" at the start of a regexp or group is literal.
+			buf.WriteString(`\*`)
+
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// SearchPathMatches reports whether the slash-separated file path name
+// matches the SearchOptions.IncludePaths and ExcludePaths globs.
+func SearchPathMatches(name string, include, exclude []string) bool {
+	for _, glob := range exclude {
+		if matchPathOrParentGlob(glob, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, glob := range include {
+		if matchPathOrParentGlob(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathOrParentGlob reports whether the glob matches name or any
+// of its parent directories.
+func matchPathOrParentGlob(glob, name string) bool {
+	globParts, nameParts := strings.Split(glob, "/"), strings.Split(name, "/")
+	for n := len(nameParts); n > 0; n-- {
+		if matchGlobParts(globParts, nameParts[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlobParts reports whether the path components name match the
+// glob components glob, in which "**" matches zero or more components
+// (or, at the end of the glob, one or more components).
+func matchGlobParts(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			min := 0
+			if len(glob) == 1 {
+				min = 1
+			}
+			for i := min; i <= len(name); i++ {
+				if matchGlobParts(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,160 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A StreamSearcher is a Searcher that can stream results as they are
+// found, which is cheaper than Search when only some of the results
+// are needed.
+type StreamSearcher interface {
+	// SearchStream searches the text of a repository at the given
+	// commit ID, calling fn with each result in order. If fn returns
+	// an error, the search stops and SearchStream returns that
+	// error.
+	SearchStream(ctx context.Context, at CommitID, opt SearchOptions, fn func(*SearchResult) error) (*SearchStats, error)
+}
+
+// endOfFile is the line of a search cursor that resumes the search
+// after all of the results in the cursor's file.
+const endOfFile = math.MaxUint32
+
+// A searchCursor is the position of a result in a search's results.
+// Results are ordered by file, and then by line.
+type searchCursor struct {
+	file string
+	line uint32 // the last line of the result
+}
+
+func (c searchCursor) String() string {
+	return strconv.FormatUint(uint64(c.line), 10) + ":" + c.file
+}
+
+func parseSearchCursor(s string) (searchCursor, error) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return searchCursor{}, fmt.Errorf("invalid search cursor: %q", s)
+	}
+	line, err := strconv.ParseUint(s[:i], 10, 32)
+	if err != nil {
+		return searchCursor{}, fmt.Errorf("invalid search cursor: %q", s)
+	}
+	return searchCursor{file: s[i+1:], line: uint32(line)}, nil
+}
+
+// A SearchResultFilter applies the Cursor, Offset, N and
+// MaxResultsPerFile SearchOptions to a stream of search results (in
+// the order that they are found), and sets the results' Cursor and
+// FileLimitHit fields. It is for use by StreamSearcher
+// implementations.
+type SearchResultFilter struct {
+	opt   SearchOptions
+	fn    func(*SearchResult) error
+	after *searchCursor // resume after this position (if set)
+
+	file      string        // the file of the last result added
+	fileCount int32         // the number of results added for file
+	skipFile  string        // the file that hit the per-file limit
+	pending   *SearchResult // held back until the next result (if any) is known
+	sent      int32
+	stats     SearchStats
+}
+
+// NewSearchResultFilter returns a filter that passes results that
+// meet opt's criteria to fn.
+func NewSearchResultFilter(opt SearchOptions, fn func(*SearchResult) error) (*SearchResultFilter, error) {
+	f := &SearchResultFilter{opt: opt, fn: fn}
+	if opt.Cursor != "" {
+		after, err := parseSearchCursor(opt.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		f.after = &after
+	}
+	return f, nil
+}
+
+// CursorFile returns the file that the search resumes in (or after),
+// or "" if the search starts at the beginning. Files that come before
+// it in byte-wise order don't need to be searched.
+func (f *SearchResultFilter) CursorFile() string {
+	if f.after == nil {
+		return ""
+	}
+	return f.after.file
+}
+
+// SkipFile reports whether all of the results in file would be
+// discarded, so the caller doesn't need to search it.
+func (f *SearchResultFilter) SkipFile(file string) bool {
+	if f.after != nil && (file < f.after.file || file == f.after.file && f.after.line == endOfFile) {
+		return true
+	}
+	return file == f.skipFile
+}
+
+// Add adds the next result of the search. It returns true if no more
+// results are needed, in which case the caller should stop searching
+// and call Close.
+func (f *SearchResultFilter) Add(r *SearchResult) (done bool, err error) {
+	if f.SkipFile(r.File) || f.after != nil && r.File == f.after.file && r.StartLine <= f.after.line {
+		return false, nil
+	}
+
+	if r.File != f.file {
+		f.file, f.fileCount = r.File, 0
+	}
+	if f.opt.MaxResultsPerFile > 0 && f.fileCount == f.opt.MaxResultsPerFile {
+		if f.pending != nil && f.pending.File == r.File {
+			f.pending.FileLimitHit = true
+		}
+		f.skipFile = r.File
+		return false, nil
+	}
+	f.fileCount++
+
+	if f.opt.Offset > 0 {
+		f.opt.Offset--
+		return false, nil
+	}
+
+	if err := f.flush(); err != nil {
+		return true, err
+	}
+	if f.opt.N > 0 && f.sent == f.opt.N {
+		f.stats.LimitHit = true
+		return true, nil
+	}
+	f.pending = r
+	return false, nil
+}
+
+// Close passes the last result (if any) to fn, and returns the
+// search's stats.
+func (f *SearchResultFilter) Close() (*SearchStats, error) {
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	return &f.stats, nil
+}
+
+// flush passes the pending result (if any) to fn.
+func (f *SearchResultFilter) flush() error {
+	if f.pending == nil {
+		return nil
+	}
+	r := f.pending
+	f.pending = nil
+
+	cursor := searchCursor{file: r.File, line: r.EndLine}
+	if r.FileLimitHit {
+		cursor.line = endOfFile
+	}
+	r.Cursor = cursor.String()
+	f.sent++
+	return f.fn(r)
+}
@@ -2,6 +2,9 @@ package vcs_test
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -14,7 +17,6 @@ import (
 
 func TestRepository_Search_LongLine(t *testing.T) {
 	t.Parallel()
-	// TODO(sqs): implement hg Searcher
 
 	tmp, longline, err := createLongFile()
 	if err != nil {
@@ -30,9 +32,13 @@ func TestRepository_Search_LongLine(t *testing.T) {
 	wantRes := []*vcs.SearchResult{
 		{
 			File:      "f1",
+			StartByte: 0,
+			EndByte:   uint32(len(longline)),
 			StartLine: 1,
 			EndLine:   1,
 			Match:     longline,
+			Matches:   []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 2}},
+			Cursor:    "1:f1",
 		},
 	}
 
@@ -41,13 +47,17 @@ func TestRepository_Search_LongLine(t *testing.T) {
 		"git add f1",
 		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit f1 -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
 	}
+	hgCommands := []string{
+		"cp " + filepath.ToSlash(tmp) + " f1",
+		"hg add f1",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
 
-	testGitRepositorySearch(t, gitCommands, searchOpt, wantRes)
+	testRepositorySearch(t, gitCommands, hgCommands, searchOpt, wantRes)
 }
 
 func TestRepository_Search(t *testing.T) {
 	t.Parallel()
-	// TODO(sqs): implement hg Searcher
 
 	searchOpt := vcs.SearchOptions{
 		Query:        "xy",
@@ -57,15 +67,23 @@ func TestRepository_Search(t *testing.T) {
 	wantRes := []*vcs.SearchResult{
 		{
 			File:      "f1",
+			StartByte: 4,
+			EndByte:   11,
 			StartLine: 2,
 			EndLine:   3,
 			Match:     []byte("def\nxyz"),
+			Matches:   []*vcs.SearchMatch{{Line: 3, Column: 0, StartByte: 8, EndByte: 10}},
+			Cursor:    "3:f1",
 		},
 		{
 			File:      "f2",
+			StartByte: 0,
+			EndByte:   3,
 			StartLine: 1,
 			EndLine:   1,
 			Match:     []byte("xyz"),
+			Matches:   []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 2}},
+			Cursor:    "1:f2",
 		},
 	}
 
@@ -77,36 +95,253 @@ func TestRepository_Search(t *testing.T) {
 		"git add f1 f2",
 		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit f1 f2 -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
 	}
+	hgCommands := []string{
+		"echo abc > f1",
+		"echo def >> f1",
+		"echo xyz >> f1",
+		"echo xyz > f2",
+		"hg add f1 f2",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	}
 
-	testGitRepositorySearch(t, gitCommands, searchOpt, wantRes)
+	testRepositorySearch(t, gitCommands, hgCommands, searchOpt, wantRes)
 }
 
-// testGitRepositorySearch is a helper that tests repository search
-// over a git repository specified by the initializtion in
-// repoInitCommands
-func testGitRepositorySearch(t *testing.T, repoInitCmds []string, searchOpt vcs.SearchOptions, wantRes []*vcs.SearchResult) {
+func TestRepository_Search_options(t *testing.T) {
+	t.Parallel()
+
+	files := []string{
+		"echo abc > f1",
+		"echo def >> f1",
+		"echo xyz >> f1",
+		"echo xyz > f2",
+		"mkdir -p sub/dir",
+		"echo 'Foo bar' > sub/f3.go",
+		"echo foobar >> sub/f3.go",
+		"echo 'foo(1)' > sub/dir/f4.go",
+	}
+	gitCommands := append(files,
+		"git add --all",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	)
+	hgCommands := append(files[:len(files):len(files)],
+		"hg add",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	)
+
 	tests := map[string]struct {
-		repo        vcs.Searcher
-		spec        vcs.CommitID
+		opt         vcs.SearchOptions
+		wantResults []*vcs.SearchResult
+	}{
+		"basic regexp": {
+			opt: vcs.SearchOptions{Query: `x\(y\)z\|^a`, QueryType: vcs.RegexpQuery},
+			wantResults: []*vcs.SearchResult{
+				{File: "f1", StartByte: 0, EndByte: 3, StartLine: 1, EndLine: 1, Match: []byte("abc"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 1}}, Cursor: "1:f1"},
+				{File: "f1", StartByte: 8, EndByte: 11, StartLine: 3, EndLine: 3, Match: []byte("xyz"), Matches: []*vcs.SearchMatch{{Line: 3, Column: 0, StartByte: 8, EndByte: 11}}, Cursor: "3:f1"},
+				{File: "f2", StartByte: 0, EndByte: 3, StartLine: 1, EndLine: 1, Match: []byte("xyz"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 3}}, Cursor: "1:f2"},
+			},
+		},
+		"extended regexp": {
+			opt: vcs.SearchOptions{Query: `fo+\(`, QueryType: vcs.ExtendedRegexpQuery},
+			wantResults: []*vcs.SearchResult{
+				{File: "sub/dir/f4.go", StartByte: 0, EndByte: 6, StartLine: 1, EndLine: 1, Match: []byte("foo(1)"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 4}}, Cursor: "1:sub/dir/f4.go"},
+			},
+		},
+		"extended regexp leftmost-longest": {
+			opt: vcs.SearchOptions{Query: `de|def`, QueryType: vcs.ExtendedRegexpQuery},
+			wantResults: []*vcs.SearchResult{
+				{File: "f1", StartByte: 4, EndByte: 7, StartLine: 2, EndLine: 2, Match: []byte("def"), Matches: []*vcs.SearchMatch{{Line: 2, Column: 0, StartByte: 4, EndByte: 7}}, Cursor: "2:f1"},
+			},
+		},
+		"ignore case": {
+			opt: vcs.SearchOptions{Query: "FOO", QueryType: vcs.FixedQuery, IgnoreCase: true},
+			wantResults: []*vcs.SearchResult{
+				{File: "sub/dir/f4.go", StartByte: 0, EndByte: 6, StartLine: 1, EndLine: 1, Match: []byte("foo(1)"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 3}}, Cursor: "1:sub/dir/f4.go"},
+				{
+					File: "sub/f3.go", StartByte: 0, EndByte: 14, StartLine: 1, EndLine: 2, Match: []byte("Foo bar\nfoobar"), Cursor: "2:sub/f3.go",
+					Matches: []*vcs.SearchMatch{
+						{Line: 1, Column: 0, StartByte: 0, EndByte: 3},
+						{Line: 2, Column: 0, StartByte: 8, EndByte: 11},
+					},
+				},
+			},
+		},
+		"word": {
+			opt: vcs.SearchOptions{Query: "foo", QueryType: vcs.FixedQuery, Word: true},
+			wantResults: []*vcs.SearchResult{
+				{File: "sub/dir/f4.go", StartByte: 0, EndByte: 6, StartLine: 1, EndLine: 1, Match: []byte("foo(1)"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 3}}, Cursor: "1:sub/dir/f4.go"},
+			},
+		},
+		"include and exclude paths": {
+			opt: vcs.SearchOptions{Query: "o", QueryType: vcs.FixedQuery, IncludePaths: []string{"**/*.go"}, ExcludePaths: []string{"sub/dir"}},
+			wantResults: []*vcs.SearchResult{
+				{
+					File: "sub/f3.go", StartByte: 0, EndByte: 14, StartLine: 1, EndLine: 2, Match: []byte("Foo bar\nfoobar"), Cursor: "2:sub/f3.go",
+					Matches: []*vcs.SearchMatch{
+						{Line: 1, Column: 1, StartByte: 1, EndByte: 2},
+						{Line: 1, Column: 2, StartByte: 2, EndByte: 3},
+						{Line: 2, Column: 1, StartByte: 9, EndByte: 10},
+						{Line: 2, Column: 2, StartByte: 10, EndByte: 11},
+					},
+				},
+			},
+		},
+		"exclude paths only": {
+			opt: vcs.SearchOptions{Query: "xyz", QueryType: vcs.FixedQuery, ExcludePaths: []string{"f1"}},
+			wantResults: []*vcs.SearchResult{
+				{File: "f2", StartByte: 0, EndByte: 3, StartLine: 1, EndLine: 1, Match: []byte("xyz"), Matches: []*vcs.SearchMatch{{Line: 1, Column: 0, StartByte: 0, EndByte: 3}}, Cursor: "1:f2"},
+			},
+		},
+	}
+
+	for label, test := range tests {
+		t.Logf("case %s", label)
+		testRepositorySearch(t, gitCommands, hgCommands, test.opt, test.wantResults)
+	}
+}
+
+func TestRepository_SearchStream(t *testing.T) {
+	t.Parallel()
+
+	files := []string{
+		"mkdir a",
+		"printf 'x\\n-\\nx\\n-\\nx\\n' > a/f1",
+		"echo x > a/f2",
+		"echo x > b",
+	}
+	gitCommands := append(files,
+		"git add --all",
+		"GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@a.com GIT_COMMITTER_DATE=2006-01-02T15:04:05Z git commit -m foo --author='a <a@a.com>' --date 2006-01-02T15:04:05Z",
+	)
+	hgCommands := append(files[:len(files):len(files)],
+		"hg add",
+		"hg commit -m foo --date '2006-12-06 13:18:29 UTC' --user 'a <a@a.com>'",
+	)
+	tests := map[string]struct {
+		repo interface {
+			vcs.StreamSearcher
+			ResolveRevision(string) (vcs.CommitID, error)
+		}
+		spec string
+	}{
+		"git libgit2": {repo: makeGitRepositoryLibGit2(t, gitCommands...), spec: "master"},
+		"git cmd":     {repo: makeGitRepositoryCmd(t, gitCommands...), spec: "master"},
+		"hg native":   {repo: makeHgRepositoryNative(t, hgCommands...), spec: "tip"},
+		"hg cmd":      {repo: makeHgRepositoryCmd(t, hgCommands...), spec: "tip"},
+	}
+
+	// searchPages pages through the results using cursors, and
+	// returns the "file:line" of the results in each page.
+	searchPages := func(repo vcs.StreamSearcher, at vcs.CommitID, opt vcs.SearchOptions) ([][]string, error) {
+		var pages [][]string
+		for {
+			var page []string
+			stats, err := repo.SearchStream(context.Background(), at, opt, func(r *vcs.SearchResult) error {
+				s := fmt.Sprintf("%s:%d", r.File, r.StartLine)
+				if r.FileLimitHit {
+					s += "+"
+				}
+				page = append(page, s)
+				opt.Cursor = r.Cursor
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, page)
+			if !stats.LimitHit {
+				return pages, nil
+			}
+		}
+	}
+
+	for label, test := range tests {
+		commitID, err := test.repo.ResolveRevision(test.spec)
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+
+		opt := vcs.SearchOptions{Query: "x", QueryType: vcs.FixedQuery, N: 2}
+		pages, err := searchPages(test.repo, commitID, opt)
+		if err != nil {
+			t.Errorf("%s: SearchStream: %s", label, err)
+			continue
+		}
+		if want := [][]string{{"a/f1:1", "a/f1:3"}, {"a/f1:5", "a/f2:1"}, {"b:1"}}; !reflect.DeepEqual(pages, want) {
+			t.Errorf("%s: got pages %v, want %v", label, pages, want)
+		}
+
+		opt.MaxResultsPerFile = 2
+		pages, err = searchPages(test.repo, commitID, opt)
+		if err != nil {
+			t.Errorf("%s: SearchStream with MaxResultsPerFile: %s", label, err)
+			continue
+		}
+		if want := [][]string{{"a/f1:1", "a/f1:3+"}, {"a/f2:1", "b:1"}}; !reflect.DeepEqual(pages, want) {
+			t.Errorf("%s: with MaxResultsPerFile: got pages %v, want %v", label, pages, want)
+		}
+
+		// Returning an error from the callback stops the search.
+		errStop := errors.New("stop")
+		calls := 0
+		_, err = test.repo.SearchStream(context.Background(), commitID, vcs.SearchOptions{Query: "x", QueryType: vcs.FixedQuery}, func(*vcs.SearchResult) error {
+			calls++
+			return errStop
+		})
+		if err != errStop || calls != 1 {
+			t.Errorf("%s: got err == %v after %d calls, want %v after 1 call", label, err, calls, errStop)
+		}
+	}
+}
+
+// testRepositorySearch is a helper that tests repository search over
+// git and hg repositories specified by the initialization in
+// gitCommands and hgCommands.
+func testRepositorySearch(t *testing.T, gitCommands, hgCommands []string, searchOpt vcs.SearchOptions, wantRes []*vcs.SearchResult) {
+	tests := map[string]struct {
+		repo interface {
+			vcs.Searcher
+			ResolveRevision(string) (vcs.CommitID, error)
+		}
+		spec        string
 		opt         vcs.SearchOptions
 		wantResults []*vcs.SearchResult
 	}{
 		"git libgit2": {
-			repo:        makeGitRepositoryLibGit2(t, repoInitCmds...),
+			repo:        makeGitRepositoryLibGit2(t, gitCommands...),
 			spec:        "master",
 			opt:         searchOpt,
 			wantResults: wantRes,
 		},
 		"git cmd": {
-			repo:        makeGitRepositoryCmd(t, repoInitCmds...),
+			repo:        makeGitRepositoryCmd(t, gitCommands...),
 			spec:        "master",
 			opt:         searchOpt,
 			wantResults: wantRes,
 		},
+		"hg native": {
+			repo:        makeHgRepositoryNative(t, hgCommands...),
+			spec:        "tip",
+			opt:         searchOpt,
+			wantResults: wantRes,
+		},
+		"hg cmd": {
+			repo:        makeHgRepositoryCmd(t, hgCommands...),
+			spec:        "tip",
+			opt:         searchOpt,
+			wantResults: wantRes,
+		},
 	}
 
 	for label, test := range tests {
-		res, err := test.repo.Search(test.spec, test.opt)
+		commitID, err := test.repo.ResolveRevision(test.spec)
+		if err != nil {
+			t.Errorf("%s: ResolveRevision: %s", label, err)
+			continue
+		}
+
+		res, err := test.repo.Search(commitID, test.opt)
 		if err != nil {
 			t.Errorf("%s: Search: %s", label, err)
 			continue
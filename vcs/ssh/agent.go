@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ParseRawPrivateKey parses a PEM-encoded (PKCS#1, PKCS#8, SEC 1 or
+// DSA) or OpenSSH-format private key. If the key is encrypted, it is
+// decrypted with passphrase.
+func ParseRawPrivateKey(pemBytes, passphrase []byte) (interface{}, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if len(passphrase) == 0 {
+			return nil, errors.New("ssh: private key is encrypted but no passphrase was given")
+		}
+		return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
+	return key, err
+}
+
+// IsEncryptedPrivateKey reports whether the private key is encrypted
+// (and needs a passphrase to be used).
+func IsEncryptedPrivateKey(pemBytes []byte) bool {
+	_, err := ssh.ParseRawPrivateKey(pemBytes)
+	_, ok := err.(*ssh.PassphraseMissingError)
+	return ok
+}
+
+// NewKeyAgent returns an in-process ssh agent that holds the private
+// key (see ParseRawPrivateKey).
+func NewKeyAgent(pemBytes, passphrase []byte) (agent.Agent, error) {
+	key, err := ParseRawPrivateKey(pemBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// ServeAgent serves the ssh agent on a new Unix socket in a temporary
+// directory, so that ssh subprocesses can use it (by setting
+// SSH_AUTH_SOCK to socket). Call stop to stop serving it and remove
+// the socket.
+func ServeAgent(a agent.Agent) (socket string, stop func() error, err error) {
+	dir, err := ioutil.TempDir("", "go-vcs-agent")
+	if err != nil {
+		return "", nil, err
+	}
+	socket = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // l was closed
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(a, conn)
+			}()
+		}
+	}()
+
+	stop = func() error {
+		err := l.Close()
+		if err2 := os.RemoveAll(dir); err == nil {
+			err = err2
+		}
+		return err
+	}
+	return socket, stop, nil
+}
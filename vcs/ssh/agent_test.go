@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseRawPrivateKey_encrypted(t *testing.T) {
+	block, _ := pem.Decode(SamplePrivKey)
+	encBlock, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("p"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey := pem.EncodeToMemory(encBlock)
+
+	if IsEncryptedPrivateKey(SamplePrivKey) {
+		t.Error("SamplePrivKey: got encrypted, want not encrypted")
+	}
+	if !IsEncryptedPrivateKey(encKey) {
+		t.Error("encrypted key: got not encrypted, want encrypted")
+	}
+
+	if _, err := ParseRawPrivateKey(encKey, nil); err == nil {
+		t.Error("no passphrase: got nil error, want error")
+	}
+	if _, err := ParseRawPrivateKey(encKey, []byte("x")); err == nil {
+		t.Error("wrong passphrase: got nil error, want error")
+	}
+	if _, err := ParseRawPrivateKey(encKey, []byte("p")); err != nil {
+		t.Errorf("passphrase: %s", err)
+	}
+	if _, err := ParseRawPrivateKey(SamplePrivKey, []byte("p")); err != nil {
+		t.Errorf("unencrypted key with passphrase: %s", err)
+	}
+}
+
+func TestServeAgent(t *testing.T) {
+	a, err := NewKeyAgent(SamplePrivKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, stop, err := ServeAgent(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(SamplePrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("got agent keys %v, want the public key of SamplePrivKey", keys)
+	}
+}
@@ -19,10 +19,12 @@ package ssh
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -39,32 +41,78 @@ const (
 	sshHashPrefix = "|1|"
 )
 
+// Markers of known_hosts lines (see sshd(8)).
+const (
+	// MarkerCertAuthority marks a line whose key is a certificate
+	// authority that is trusted to sign the host certificates of the
+	// matching hosts.
+	MarkerCertAuthority = "@cert-authority"
+
+	// MarkerRevoked marks a line whose key is revoked for the
+	// matching hosts: it must never be accepted.
+	MarkerRevoked = "@revoked"
+)
+
 // A KnownHost is a hostname and a known host key associated with that
 // hostname. The hostname can be either unhashed or hashed.
 type KnownHost struct {
-	Hostnames []string // unhashed hostnames (represented as comma-separated names in the original file)
+	Marker string // MarkerCertAuthority, MarkerRevoked or "" (no marker)
+
+	// Hostnames are unhashed hostname patterns (represented as
+	// comma-separated patterns in the original file). A pattern may
+	// contain the wildcards '*' and '?' and may be negated with a
+	// leading '!'. A host on a port other than 22 is written
+	// "[host]:port".
+	Hostnames []string
 
 	Salt, Hash []byte // hashed hostname
 
 	Key ssh.PublicKey
 }
 
-// Match returns whether hostname matches this known host entry's
-// unhashed hostnames (separated by comma) or the hashed hostname.
-func (h *KnownHost) Match(hostname string) bool {
-	// TODO(sqs): lowercase before comparing? will that break hashed hostname lookups?
+// NewHashedKnownHost returns a known host entry for hostname (in
+// known_hosts form; see KnownHostname) and key, with the hostname
+// hashed with a random salt (like `ssh-keygen -H`).
+func NewHashedKnownHost(hostname string, key ssh.PublicKey) (*KnownHost, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &KnownHost{Salt: salt, Hash: hashHostname(salt, hostname), Key: key}, nil
+}
 
-	for _, hn := range h.Hostnames {
-		if hn == hostname {
-			return true
+// hashHostname returns the salted hash of hostname that known_hosts
+// hashed hostnames contain.
+func hashHostname(salt []byte, hostname string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(strings.ToLower(hostname)))
+	return mac.Sum(nil)
+}
+
+// Match returns whether hostname (in known_hosts form; see
+// KnownHostname) matches this known host entry's unhashed hostname
+// patterns or the hashed hostname. The hostname matches the patterns
+// if it matches any of them and none of the negated patterns.
+func (h *KnownHost) Match(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+
+	var matched bool
+	for _, pat := range h.Hostnames {
+		pat = strings.ToLower(pat)
+		if strings.HasPrefix(pat, "!") {
+			if matchPattern(hostname, pat[1:]) {
+				return false
+			}
+		} else if matchPattern(hostname, pat) {
+			matched = true
 		}
 	}
+	if matched {
+		return true
+	}
 
 	if h.Salt != nil && h.Hash != nil {
-		mac := hmac.New(sha1.New, h.Salt)
-		mac.Write([]byte(hostname))
-		hash := mac.Sum(nil)
-		if bytes.Equal(h.Hash, hash) {
+		if hmac.Equal(h.Hash, hashHostname(h.Salt, hostname)) {
 			return true
 		}
 	}
@@ -72,19 +120,68 @@ func (h *KnownHost) Match(hostname string) bool {
 	return false
 }
 
+// matchPattern reports whether s matches pattern, in which '*'
+// matches any sequence of characters and '?' matches any single
+// character.
+func matchPattern(s, pattern string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return s == ""
+}
+
+// String returns the known host entry as a line of a known_hosts
+// file (without a trailing newline).
+func (h *KnownHost) String() string {
+	var buf bytes.Buffer
+	if h.Marker != "" {
+		buf.WriteString(h.Marker)
+		buf.WriteByte(' ')
+	}
+	if h.Salt != nil && h.Hash != nil {
+		buf.WriteString(sshHashPrefix)
+		buf.WriteString(base64.StdEncoding.EncodeToString(h.Salt))
+		buf.WriteString(sshHashDelim)
+		buf.WriteString(base64.StdEncoding.EncodeToString(h.Hash))
+	} else {
+		buf.WriteString(strings.Join(h.Hostnames, ","))
+	}
+	buf.WriteByte(' ')
+	buf.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(h.Key)))
+	return buf.String()
+}
+
 // KnownHosts is a collection of known hosts and their host
 // keys. Because hostname key may be hashed, use Lookup to get the
 // host keys for a hostname instead of simply iterating over them and
 // checking the Hostname field.
 type KnownHosts []*KnownHost
 
-// Lookup looks up hostname (which must be an unhashed hostname) in
-// the known hosts collection. It returns host keys that match the
-// unhashed hostname and the hashed variant of it. If any host keys
-// are found, found is true; otherwise it is false.
+// Lookup looks up hostname (which must be an unhashed hostname, in
+// known_hosts form; see KnownHostname) in the known hosts collection.
+// It returns host keys that match the unhashed hostname and the hashed
+// variant of it, except for revoked keys. If any host keys are found,
+// found is true; otherwise it is false.
 func (khs KnownHosts) Lookup(hostname string) (hostKeys []ssh.PublicKey, found bool) {
 	for _, h := range khs {
-		if h.Match(hostname) {
+		if h.Marker == "" && h.Match(hostname) && !khs.IsRevoked(hostname, h.Key) {
 			hostKeys = append(hostKeys, h.Key)
 			found = true
 		}
@@ -92,6 +189,160 @@ func (khs KnownHosts) Lookup(hostname string) (hostKeys []ssh.PublicKey, found b
 	return hostKeys, found
 }
 
+// CertAuthorities returns the keys of the certificate authorities
+// that are trusted to sign host certificates for hostname (in
+// known_hosts form; see KnownHostname), except for revoked keys.
+func (khs KnownHosts) CertAuthorities(hostname string) []ssh.PublicKey {
+	var cas []ssh.PublicKey
+	for _, h := range khs {
+		if h.Marker == MarkerCertAuthority && h.Match(hostname) && !khs.IsRevoked(hostname, h.Key) {
+			cas = append(cas, h.Key)
+		}
+	}
+	return cas
+}
+
+// IsRevoked reports whether key is revoked for hostname (in
+// known_hosts form; see KnownHostname). A host certificate is revoked
+// if the certificate's key or its signing key is revoked.
+func (khs KnownHosts) IsRevoked(hostname string, key ssh.PublicKey) bool {
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = append(keys, cert.Key, cert.SignatureKey)
+	}
+	for _, h := range khs {
+		if h.Marker != MarkerRevoked || !h.Match(hostname) {
+			continue
+		}
+		for _, k := range keys {
+			if bytes.Equal(h.Key.Marshal(), k.Marshal()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsKnown reports whether the known hosts collection has any host keys
+// or certificate authorities for hostname (in known_hosts form; see
+// KnownHostname).
+func (khs KnownHosts) IsKnown(hostname string) bool {
+	_, found := khs.Lookup(hostname)
+	return found || len(khs.CertAuthorities(hostname)) > 0
+}
+
+// UnknownHostError is returned by KnownHosts.Check when there are no
+// known host keys or certificate authorities for the host.
+type UnknownHostError struct {
+	Hostname string
+	Key      ssh.PublicKey
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("ssh: no known host key for %s (got %s %s)", e.Hostname, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// Check returns an error unless key is an acceptable host key for
+// hostname (in known_hosts form; see KnownHostname): a key that isn't
+// revoked and is either a known host key of hostname or a valid host
+// certificate for hostname signed by one of its certificate
+// authorities. If hostname has no known host keys or certificate
+// authorities, the error is an *UnknownHostError.
+func (khs KnownHosts) Check(hostname string, key ssh.PublicKey) error {
+	if khs.IsRevoked(hostname, key) {
+		return fmt.Errorf("ssh: host key for %s (%s %s) is revoked", hostname, key.Type(), ssh.FingerprintSHA256(key))
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		cas := khs.CertAuthorities(hostname)
+		if len(cas) > 0 {
+			checker := &ssh.CertChecker{
+				IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+					for _, ca := range cas {
+						if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+							return true
+						}
+					}
+					return false
+				},
+			}
+			host, port := splitKnownHostname(hostname)
+			if err := checker.CheckHostKey(net.JoinHostPort(host, port), nil, cert); err != nil {
+				return fmt.Errorf("ssh: invalid host certificate for %s: %s", hostname, err)
+			}
+			return nil
+		}
+	}
+
+	keys, found := khs.Lookup(hostname)
+	if !found {
+		if len(khs.CertAuthorities(hostname)) > 0 {
+			return fmt.Errorf("ssh: host key for %s (%s %s) isn't a certificate signed by a known certificate authority", hostname, key.Type(), ssh.FingerprintSHA256(key))
+		}
+		return &UnknownHostError{Hostname: hostname, Key: key}
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ssh: host key for %s (%s %s) doesn't match any known host key", hostname, key.Type(), ssh.FingerprintSHA256(key))
+}
+
+// splitKnownHostname splits a hostname in known_hosts form (see
+// KnownHostname) into the host and port.
+func splitKnownHostname(hostname string) (host, port string) {
+	if strings.HasPrefix(hostname, "[") {
+		if h, p, err := net.SplitHostPort(hostname); err == nil {
+			return h, p
+		}
+	}
+	return hostname, "22"
+}
+
+// WriteKnownHosts writes the known hosts collection in known_hosts
+// format to w.
+func WriteKnownHosts(w io.Writer, khs KnownHosts) error {
+	for _, h := range khs {
+		if _, err := io.WriteString(w, h.String()+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendKnownHostsFile appends the known host entries to the
+// known_hosts file at path, creating it if it doesn't exist.
+func AppendKnownHostsFile(path string, khs ...*KnownHost) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Start on a new line if the file doesn't end with a newline.
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := WriteKnownHosts(f, khs); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // ReadStandardKnownHostsFiles reads and parses the known_hosts files
 // at /etc/ssh/ssh_known_hosts and ~/.ssh/known_hosts.
 func ReadStandardKnownHostsFiles() (KnownHosts, error) {
@@ -176,9 +427,21 @@ func parseKnownHostsLine(line []byte) (*KnownHost, error) {
 		return nil, nil
 	}
 
-	// Skip markers.
+	kh := &KnownHost{}
+
+	// Check for a marker.
 	if bytes.HasPrefix(line, []byte("@")) {
-		return nil, errors.New("marker functionality not implemented")
+		end := bytes.IndexAny(line, "\t ")
+		if end <= 0 {
+			return nil, errors.New("bad format (insufficient fields)")
+		}
+		switch marker := string(line[:end]); marker {
+		case MarkerCertAuthority, MarkerRevoked:
+			kh.Marker = marker
+		default:
+			return nil, fmt.Errorf("unknown marker %q", marker)
+		}
+		line = bytes.TrimLeft(line[end:], "\t ")
 	}
 
 	// Find the end of the hostname(s) portion.
@@ -189,8 +452,6 @@ func parseKnownHostsLine(line []byte) (*KnownHost, error) {
 	hosts := line[:end]
 	keyBytes := line[end+1:]
 
-	kh := &KnownHost{}
-
 	// Check for hashed hostnames.
 	if bytes.HasPrefix(hosts, []byte(sshHashPrefix)) {
 		hosts = bytes.TrimPrefix(hosts, []byte(sshHashPrefix))
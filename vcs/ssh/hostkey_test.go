@@ -1,8 +1,17 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func TestParseKnownHosts_ok(t *testing.T) {
@@ -40,3 +49,208 @@ bad format
 		t.Fatal("got err == nil, want non-nil err")
 	}
 }
+
+func TestParseKnownHosts_unknownMarker(t *testing.T) {
+	data := `@foo example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl`
+
+	if _, err := ParseKnownHosts(strings.NewReader(data)); err == nil {
+		t.Fatal("got err == nil, want non-nil err")
+	}
+}
+
+// newTestKey returns a new ed25519 key pair.
+func newTestKey(t *testing.T) (ssh.Signer, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, signer.PublicKey()
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestKnownHosts_Lookup_patterns(t *testing.T) {
+	_, key := newTestKey(t)
+	kh, err := ParseKnownHosts(strings.NewReader(`
+*.example.com,!bad.example.com ` + authorizedKey(key) + `
+[git.example.org]:2222 ` + authorizedKey(key) + `
+host?.example.net ` + authorizedKey(key) + `
+Mixed.Example.Info ` + authorizedKey(key) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"a.example.com":          true,
+		"A.EXAMPLE.COM":          true,
+		"example.com":            false,
+		"bad.example.com":        false,
+		"[a.example.com]:2222":   false,
+		"[git.example.org]:2222": true,
+		"git.example.org":        false,
+		"[git.example.org]:22":   false,
+		"host1.example.net":      true,
+		"host12.example.net":     false,
+		"mixed.example.info":     true,
+	}
+	for hostname, want := range tests {
+		if _, found := kh.Lookup(hostname); found != want {
+			t.Errorf("%s: got found == %v, want %v", hostname, found, want)
+		}
+	}
+}
+
+func TestKnownHosts_Check(t *testing.T) {
+	_, hostKey := newTestKey(t)
+	_, otherKey := newTestKey(t)
+	_, revokedKey := newTestKey(t)
+	caSigner, caKey := newTestKey(t)
+	revokedCASigner, revokedCAKey := newTestKey(t)
+
+	kh, err := ParseKnownHosts(strings.NewReader(`
+a.example.com ` + authorizedKey(hostKey) + `
+a.example.com ` + authorizedKey(revokedKey) + `
+@revoked * ` + authorizedKey(revokedKey) + `
+@cert-authority *.example.org,[*.example.org]:2222 ` + authorizedKey(caKey) + `
+@cert-authority *.example.org ` + authorizedKey(revokedCAKey) + `
+@revoked *.example.org ` + authorizedKey(revokedCAKey) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostCert := func(signer ssh.Signer, certType uint32, principals []string, validBefore uint64) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             hostKey,
+			CertType:        certType,
+			ValidPrincipals: principals,
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+
+	tests := map[string]struct {
+		hostname    string
+		key         ssh.PublicKey
+		wantErr     bool
+		wantUnknown bool
+	}{
+		"known key":             {hostname: "a.example.com", key: hostKey},
+		"other key":             {hostname: "a.example.com", key: otherKey, wantErr: true},
+		"revoked key":           {hostname: "a.example.com", key: revokedKey, wantErr: true},
+		"unknown host":          {hostname: "b.example.com", key: hostKey, wantErr: true, wantUnknown: true},
+		"revoked unknown host":  {hostname: "b.example.com", key: revokedKey, wantErr: true},
+		"certificate":           {hostname: "b.example.org", key: hostCert(caSigner, ssh.HostCert, []string{"b.example.org"}, ssh.CertTimeInfinity)},
+		"certificate with port": {hostname: "[b.example.org]:2222", key: hostCert(caSigner, ssh.HostCert, []string{"b.example.org"}, ssh.CertTimeInfinity)},
+		"certificate other principal": {
+			hostname: "b.example.org",
+			key:      hostCert(caSigner, ssh.HostCert, []string{"c.example.org"}, ssh.CertTimeInfinity),
+			wantErr:  true,
+		},
+		"expired certificate": {
+			hostname: "b.example.org",
+			key:      hostCert(caSigner, ssh.HostCert, []string{"b.example.org"}, expired),
+			wantErr:  true,
+		},
+		"user certificate": {
+			hostname: "b.example.org",
+			key:      hostCert(caSigner, ssh.UserCert, []string{"b.example.org"}, ssh.CertTimeInfinity),
+			wantErr:  true,
+		},
+		"certificate signed by revoked CA": {
+			hostname: "b.example.org",
+			key:      hostCert(revokedCASigner, ssh.HostCert, []string{"b.example.org"}, ssh.CertTimeInfinity),
+			wantErr:  true,
+		},
+		"plain key of CA host": {hostname: "b.example.org", key: hostKey, wantErr: true},
+	}
+	for label, test := range tests {
+		err := kh.Check(test.hostname, test.key)
+		if test.wantErr && err == nil {
+			t.Errorf("%s: got nil error, want error", label)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: %s", label, err)
+		}
+		if _, unknown := err.(*UnknownHostError); unknown != test.wantUnknown {
+			t.Errorf("%s: got unknown host == %v, want %v (error: %v)", label, unknown, test.wantUnknown, err)
+		}
+	}
+}
+
+func TestWriteKnownHosts(t *testing.T) {
+	_, key := newTestKey(t)
+	hashed, err := NewHashedKnownHost("[a.example.com]:2222", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	khs := KnownHosts{
+		{Hostnames: []string{"a.example.com", "!b.example.com"}, Key: key},
+		{Marker: MarkerRevoked, Hostnames: []string{"*"}, Key: key},
+		hashed,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteKnownHosts(&buf, khs); err != nil {
+		t.Fatal(err)
+	}
+	khs2, err := ParseKnownHosts(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(khs2) != len(khs) {
+		t.Fatalf("got %d known hosts, want %d", len(khs2), len(khs))
+	}
+	for i := range khs {
+		if got, want := khs2[i].String(), khs[i].String(); got != want {
+			t.Errorf("known host %d: got %q, want %q", i, got, want)
+		}
+	}
+	if !khs2[2].Match("[a.example.com]:2222") || khs2[2].Match("a.example.com") {
+		t.Error("hashed known host doesn't match only [a.example.com]:2222")
+	}
+}
+
+func TestRecordHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	// Append to a file without a trailing newline.
+	_, key1 := newTestKey(t)
+	if err := ioutil.WriteFile(path, []byte("a.example.com "+authorizedKey(key1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, key2 := newTestKey(t)
+	_, key3 := newTestKey(t)
+	if err := RecordHostKeys(path, false)("b.example.com", key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordHostKeys(path, true)("[c.example.com]:2222", key3); err != nil {
+		t.Fatal(err)
+	}
+
+	kh, err := ReadKnownHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hostname, key := range map[string]ssh.PublicKey{"a.example.com": key1, "b.example.com": key2, "[c.example.com]:2222": key3} {
+		if err := kh.Check(hostname, key); err != nil {
+			t.Errorf("%s: %s", hostname, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+// KnownHostname returns the name of the SSH server at host and port
+// as it appears in known_hosts files: host for port 22, and
+// "[host]:port" otherwise.
+func KnownHostname(host, port string) string {
+	if port == "" || port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// RemoteHost returns the host and port of the SSH server of a remote
+// URL, which is either of the form "ssh://[user@]host[:port]/path" or
+// the scp-like "[user@]host:path". If url isn't an SSH URL, ok is
+// false.
+func RemoteHost(url string) (host, port string, ok bool) {
+	_, hostport, ok := remoteUserHost(url)
+	if !ok {
+		return "", "", false
+	}
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p, h != ""
+	}
+	return strings.Trim(hostport, "[]"), "22", hostport != ""
+}
+
+// RemoteUser returns the user in a remote SSH URL (see RemoteHost), or
+// "" if the URL has no user or isn't an SSH URL.
+func RemoteUser(url string) string {
+	user, _, _ := remoteUserHost(url)
+	return user
+}
+
+// remoteUserHost splits the "[user@]host[:port]" part of a remote SSH
+// URL into the user and the "host[:port]".
+func remoteUserHost(url string) (user, hostport string, ok bool) {
+	if i := strings.Index(url, "://"); i != -1 {
+		switch url[:i] {
+		case "ssh", "git+ssh", "ssh+git":
+		default:
+			return "", "", false
+		}
+		hostport = url[i+len("://"):]
+		if i := strings.Index(hostport, "/"); i != -1 {
+			hostport = hostport[:i]
+		}
+	} else {
+		i := strings.Index(url, ":")
+		if i <= 0 || strings.Contains(url[:i], "/") {
+			return "", "", false // local path
+		}
+		hostport = url[:i]
+	}
+	if i := strings.LastIndex(hostport, "@"); i != -1 {
+		user, hostport = hostport[:i], hostport[i+1:]
+	}
+	return user, hostport, true
+}
+
+// PolicyKnownHosts returns the known hosts that opt's host key policy
+// accepts. For HostKeyPinned, they are the pinned host keys for all
+// hosts.
+func PolicyKnownHosts(opt *vcs.SSHConfig) (KnownHosts, error) {
+	if opt.HostKeyPolicy == vcs.HostKeyPinned {
+		var kh KnownHosts
+		for _, b := range opt.HostKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("parsing pinned host key: %s", err)
+			}
+			kh = append(kh, &KnownHost{Hostnames: []string{"*"}, Key: key})
+		}
+		return kh, nil
+	}
+
+	if opt.KnownHosts != nil {
+		return ParseKnownHosts(bytes.NewReader(opt.KnownHosts))
+	}
+	return ReadStandardKnownHostsFiles()
+}
+
+// HostKeys returns the host keys that opt's host key policy accepts
+// for hostname (in known_hosts form; see KnownHostname). If the policy
+// doesn't list any host keys for hostname, found is false.
+func HostKeys(opt *vcs.SSHConfig, hostname string) (keys []ssh.PublicKey, found bool, err error) {
+	kh, err := PolicyKnownHosts(opt)
+	if err != nil {
+		return nil, false, err
+	}
+	keys, found = kh.Lookup(hostname)
+	return keys, found, nil
+}
+
+// CheckHostKey returns an error unless opt's host key policy accepts
+// key as the host key of hostname (in known_hosts form; see
+// KnownHostname).
+func CheckHostKey(opt *vcs.SSHConfig, hostname string, key ssh.PublicKey) error {
+	kh, err := PolicyKnownHosts(opt)
+	if err != nil {
+		return err
+	}
+	err = kh.Check(hostname, key)
+	if _, unknown := err.(*UnknownHostError); unknown && opt.HostKeyPolicy == vcs.HostKeyTOFU && opt.TrustHostKey != nil {
+		if err := opt.TrustHostKey(hostname, key); err != nil {
+			return fmt.Errorf("ssh: host key for %s (%s %s) not trusted: %s", hostname, key.Type(), ssh.FingerprintSHA256(key), err)
+		}
+		return nil
+	}
+	return err
+}
+
+// RecordHostKeys returns a TrustHostKey func (for HostKeyTOFU) that
+// trusts the host key of every host it is called with and appends it
+// to the known_hosts file at path, so that it is known the next time
+// the file is used. If hash is true, the hostnames are hashed.
+func RecordHostKeys(path string, hash bool) func(hostname string, key ssh.PublicKey) error {
+	return func(hostname string, key ssh.PublicKey) error {
+		kh := &KnownHost{Hostnames: []string{hostname}, Key: key}
+		if hash {
+			var err error
+			kh, err = NewHashedKnownHost(hostname, key)
+			if err != nil {
+				return err
+			}
+		}
+		return AppendKnownHostsFile(path, kh)
+	}
+}
+
+// errHostKeyScanned aborts the SSH handshake in scanHostKey once the
+// host key has been received.
+var errHostKeyScanned = errors.New("host key scanned")
+
+// scanHostKeyAlgos are the host key algorithms that ScanHostKey
+// negotiates. Host certificates are left out because they can't be
+// pinned in known_hosts files.
+var scanHostKeyAlgos = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// scanHostKeyTypes are scanHostKeyAlgos grouped by the type of key
+// that they negotiate.
+var scanHostKeyTypes = [][]string{
+	{ssh.KeyAlgoED25519},
+	{ssh.KeyAlgoECDSA256}, {ssh.KeyAlgoECDSA384}, {ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+// ScanHostKey connects to the SSH server at addr ("host:port") and
+// returns its host key, without authenticating (like ssh-keyscan).
+func ScanHostKey(addr string) (ssh.PublicKey, error) {
+	return scanHostKey(addr, scanHostKeyAlgos)
+}
+
+// ScanHostKeys is like ScanHostKey, but it returns all of the
+// server's host keys (one of each type), for when the caller needs
+// the key that another client negotiated.
+func ScanHostKeys(addr string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	var err error
+	for _, algos := range scanHostKeyTypes {
+		var key ssh.PublicKey
+		// The server doesn't have keys of most types, so only fail
+		// if it has none.
+		if key, err = scanHostKey(addr, algos); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// scanHostKey returns the host key of the SSH server at addr that is
+// negotiated with the given host key algorithms.
+func scanHostKey(addr string, algos []string) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	conf := &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyScanned
+		},
+		HostKeyAlgorithms: algos,
+		Timeout:           30 * time.Second,
+	}
+	c, err := ssh.Dial("tcp", addr, conf)
+	if c != nil {
+		c.Close()
+	}
+	if hostKey != nil {
+		return hostKey, nil
+	}
+	if err == nil {
+		err = errors.New("no host key received")
+	}
+	return nil, fmt.Errorf("ssh: scanning host key of %s: %s", addr, err)
+}
@@ -0,0 +1,183 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"sourcegraph.com/sourcegraph/go-vcs/vcs"
+)
+
+func TestRemoteHost(t *testing.T) {
+	tests := map[string]struct {
+		host, port string
+		ok         bool
+	}{
+		"ssh://git@example.com/a/b":       {"example.com", "22", true},
+		"ssh://git@example.com:2222/a/b":  {"example.com", "2222", true},
+		"git+ssh://example.com:2222":      {"example.com", "2222", true},
+		"ssh://[::1]:2222/a":              {"::1", "2222", true},
+		"ssh://[::1]/a":                   {"::1", "22", true},
+		"git@example.com:a/b.git":         {"example.com", "22", true},
+		"example.com:a":                   {"example.com", "22", true},
+		"https://example.com/a/b":         {"", "", false},
+		"file:///a/b":                     {"", "", false},
+		"/a/b":                            {"", "", false},
+		"./a:b":                           {"", "", false},
+		"ssh://go-vcs@127.0.0.1:1234/abc": {"127.0.0.1", "1234", true},
+	}
+	for url, test := range tests {
+		host, port, ok := RemoteHost(url)
+		if host != test.host || port != test.port || ok != test.ok {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q, %v)", url, host, port, ok, test.host, test.port, test.ok)
+		}
+	}
+}
+
+func TestRemoteUser(t *testing.T) {
+	tests := map[string]string{
+		"ssh://git@example.com/a/b":      "git",
+		"ssh://example.com:2222/a/b":     "",
+		"git+ssh://a@b@example.com:2222": "a@b",
+		"git@example.com:a/b.git":        "git",
+		"example.com:a":                  "",
+		"https://u@example.com/a/b":      "",
+		"/a/b":                           "",
+	}
+	for url, want := range tests {
+		if got := RemoteUser(url); got != want {
+			t.Errorf("%s: got user %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestCheckHostKey(t *testing.T) {
+	signer, err := ssh.ParsePrivateKey(SamplePrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := signer.PublicKey()
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knownHosts := func(hostname string, key ssh.PublicKey) []byte {
+		return append([]byte(hostname+" "), ssh.MarshalAuthorizedKey(key)...)
+	}
+	trust := func(hostname string, key ssh.PublicKey) error {
+		if hostname != "[example.com]:2222" || !bytes.Equal(key.Marshal(), hostKey.Marshal()) {
+			return errors.New("not trusted")
+		}
+		return nil
+	}
+
+	tests := map[string]struct {
+		opt     *vcs.SSHConfig
+		wantErr bool
+	}{
+		"pinned": {
+			opt: &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyPinned, HostKeys: [][]byte{ssh.MarshalAuthorizedKey(otherKey), ssh.MarshalAuthorizedKey(hostKey)}},
+		},
+		"pinned other key": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyPinned, HostKeys: [][]byte{ssh.MarshalAuthorizedKey(otherKey)}},
+			wantErr: true,
+		},
+		"pinned no keys": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyPinned},
+			wantErr: true,
+		},
+		"known_hosts": {
+			opt: &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyKnownHosts, KnownHosts: knownHosts("[example.com]:2222", hostKey)},
+		},
+		"known_hosts other port": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyKnownHosts, KnownHosts: knownHosts("example.com", hostKey)},
+			wantErr: true,
+		},
+		"known_hosts other key": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyKnownHosts, KnownHosts: knownHosts("[example.com]:2222", otherKey)},
+			wantErr: true,
+		},
+		"known_hosts ignores TrustHostKey": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyKnownHosts, KnownHosts: []byte{}, TrustHostKey: trust},
+			wantErr: true,
+		},
+		"TOFU trusted": {
+			opt: &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyTOFU, KnownHosts: []byte{}, TrustHostKey: trust},
+		},
+		"TOFU not trusted": {
+			opt: &vcs.SSHConfig{
+				HostKeyPolicy: vcs.HostKeyTOFU,
+				KnownHosts:    []byte{},
+				TrustHostKey:  func(string, ssh.PublicKey) error { return errors.New("no") },
+			},
+			wantErr: true,
+		},
+		"TOFU known host with other key": {
+			opt:     &vcs.SSHConfig{HostKeyPolicy: vcs.HostKeyTOFU, KnownHosts: knownHosts("[example.com]:2222", otherKey), TrustHostKey: trust},
+			wantErr: true,
+		},
+	}
+	for label, test := range tests {
+		err := CheckHostKey(test.opt, KnownHostname("example.com", "2222"), hostKey)
+		if test.wantErr && err == nil {
+			t.Errorf("%s: got nil error, want error", label)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: %s", label, err)
+		}
+	}
+}
+
+func TestScanHostKey(t *testing.T) {
+	s, err := NewServer("/bin/false", "", PrivateKey(SamplePrivKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key, err := ScanHostKey(s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(SamplePrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("got host key %s, want %s", ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+}
+
+func TestScanHostKeys(t *testing.T) {
+	s, err := NewServer("/bin/false", "", PrivateKey(SamplePrivKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	keys, err := ScanHostKeys(s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(SamplePrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("got %d host keys, want only %s", len(keys), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+}
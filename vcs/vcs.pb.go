@@ -15,8 +15,15 @@ It has these top-level messages:
 	BehindAhead
 	BranchesOptions
 	Tag
+	Diff
+	FileDiff
+	CommitFiles
+	ChangedFile
+	FileCommit
 	SearchOptions
 	SearchResult
+	SearchStats
+	SearchMatch
 	Committer
 */
 package vcs
@@ -25,10 +32,73 @@ import proto "github.com/gogo/protobuf/proto"
 
 // discarding unused import gogoproto "github.com/gogo/protobuf/gogoproto/gogo.pb"
 import pbtypes "sourcegraph.com/sqs/pbtypes"
+import diff "sourcegraph.com/sourcegraph/go-diff/diff"
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 
+// ObjectType is the type of a git object.
+type ObjectType int32
+
+const (
+	ObjectType_COMMIT ObjectType = 0
+	ObjectType_TREE   ObjectType = 1
+	ObjectType_BLOB   ObjectType = 2
+	ObjectType_TAG    ObjectType = 3
+)
+
+var ObjectType_name = map[int32]string{
+	0: "COMMIT",
+	1: "TREE",
+	2: "BLOB",
+	3: "TAG",
+}
+var ObjectType_value = map[string]int32{
+	"COMMIT": 0,
+	"TREE":   1,
+	"BLOB":   2,
+	"TAG":    3,
+}
+
+func (x ObjectType) String() string {
+	return proto.EnumName(ObjectType_name, int32(x))
+}
+
+// FileChangeType is the kind of change made to a file in a diff.
+type FileChangeType int32
+
+const (
+	FileChangeType_MODIFIED FileChangeType = 0
+	FileChangeType_ADDED    FileChangeType = 1
+	FileChangeType_DELETED  FileChangeType = 2
+	FileChangeType_RENAMED  FileChangeType = 3
+	FileChangeType_COPIED   FileChangeType = 4
+	// MODE_CHANGED means that only the file's mode changed (e.g.,
+	// it was made executable).
+	FileChangeType_MODE_CHANGED FileChangeType = 5
+)
+
+var FileChangeType_name = map[int32]string{
+	0: "MODIFIED",
+	1: "ADDED",
+	2: "DELETED",
+	3: "RENAMED",
+	4: "COPIED",
+	5: "MODE_CHANGED",
+}
+var FileChangeType_value = map[string]int32{
+	"MODIFIED":     0,
+	"ADDED":        1,
+	"DELETED":      2,
+	"RENAMED":      3,
+	"COPIED":       4,
+	"MODE_CHANGED": 5,
+}
+
+func (x FileChangeType) String() string {
+	return proto.EnumName(FileChangeType_name, int32(x))
+}
+
 type Commit struct {
 	ID        CommitID   `protobuf:"bytes,1,opt,name=id,proto3,customtype=CommitID" json:"id,omitempty"`
 	Author    Signature  `protobuf:"bytes,2,opt,name=author" json:"author"`
@@ -36,6 +106,10 @@ type Commit struct {
 	Message   string     `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"`
 	// Parents are the commit IDs of this commit's parent commits.
 	Parents []CommitID `protobuf:"bytes,5,rep,name=parents,customtype=CommitID" json:"parents,omitempty"`
+	// Phase is the commit's Mercurial phase (PhasePublic, PhaseDraft
+	// or PhaseSecret), or empty for VCSs that don't have phases (such
+	// as git).
+	Phase string `protobuf:"bytes,6,opt,name=phase,proto3" json:"phase,omitempty"`
 }
 
 func (m *Commit) Reset()         { *m = Commit{} }
@@ -138,26 +212,205 @@ func (*BranchesOptions) ProtoMessage()    {}
 
 // A Tag is a VCS tag.
 type Tag struct {
-	Name     string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// CommitID is the commit that the tag points to, after peeling
+	// any annotated tag objects. It is empty if the tag doesn't
+	// point to a commit (e.g., it points to a tree or blob).
 	CommitID CommitID `protobuf:"bytes,2,opt,name=commit_id,proto3,customtype=CommitID" json:"commit_id,omitempty"`
+	// Annotated is whether the tag is an annotated tag, which points
+	// to a tag object that has its own tagger and message. Mercurial
+	// tags are never annotated.
+	Annotated bool `protobuf:"varint,3,opt,name=annotated,proto3" json:"annotated,omitempty"`
+	// ObjectID is the ID of the annotated tag's tag object. It is
+	// empty for lightweight tags.
+	ObjectID string `protobuf:"bytes,4,opt,name=object_id,proto3" json:"object_id,omitempty"`
+	// Tagger is the person who created the annotated tag.
+	Tagger *Signature `protobuf:"bytes,5,opt,name=tagger" json:"tagger,omitempty"`
+	// Message is the annotated tag's message, without its signature
+	// (if any).
+	Message string `protobuf:"bytes,6,opt,name=message,proto3" json:"message,omitempty"`
+	// TargetType is the type of object that the tag (or, for an
+	// annotated tag, its tag object) points to directly.
+	TargetType ObjectType `protobuf:"varint,7,opt,name=target_type,proto3,enum=vcs.ObjectType" json:"target_type,omitempty"`
+	// Signature is the annotated tag's ASCII-armored PGP signature,
+	// if it is signed.
+	Signature []byte `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
 }
 
 func (m *Tag) Reset()         { *m = Tag{} }
 func (m *Tag) String() string { return proto.CompactTextString(m) }
 func (*Tag) ProtoMessage()    {}
 
+func (m *Tag) GetTagger() *Signature {
+	if m != nil {
+		return m.Tagger
+	}
+	return nil
+}
+
+// A Diff represents changes between two commits.
+type Diff struct {
+	// Raw is the raw diff output.
+	Raw string `protobuf:"bytes,1,opt,name=raw,proto3" json:"raw,omitempty"`
+	// Files contains an entry for each file changed in the diff, in
+	// the order they appear in Raw.
+	Files []*FileDiff `protobuf:"bytes,2,rep,name=files" json:"files,omitempty"`
+}
+
+func (m *Diff) Reset()         { *m = Diff{} }
+func (m *Diff) String() string { return proto.CompactTextString(m) }
+func (*Diff) ProtoMessage()    {}
+
+func (m *Diff) GetFiles() []*FileDiff {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+// A FileDiff is the portion of a Diff that applies to a single file.
+type FileDiff struct {
+	// OrigPath is the file's path in the base commit, without the
+	// DiffOptions.OrigPrefix. It is empty if the file was added.
+	OrigPath string `protobuf:"bytes,1,opt,name=orig_path,proto3" json:"orig_path,omitempty"`
+	// NewPath is the file's path in the head commit, without the
+	// DiffOptions.NewPrefix. It is empty if the file was deleted.
+	NewPath string `protobuf:"bytes,2,opt,name=new_path,proto3" json:"new_path,omitempty"`
+	// ChangeType is the kind of change made to the file.
+	ChangeType FileChangeType `protobuf:"varint,3,opt,name=change_type,proto3,enum=vcs.FileChangeType" json:"change_type,omitempty"`
+	// Binary is whether the file's contents are binary. Binary files
+	// have no Hunks.
+	Binary bool `protobuf:"varint,4,opt,name=binary,proto3" json:"binary,omitempty"`
+	// OrigMode and NewMode are the file's (git-style, octal) modes in
+	// the base and head commits, such as 0100644. They are 0 if the
+	// file doesn't exist on that side or if the mode is unknown.
+	OrigMode uint32 `protobuf:"varint,5,opt,name=orig_mode,proto3" json:"orig_mode,omitempty"`
+	NewMode  uint32 `protobuf:"varint,6,opt,name=new_mode,proto3" json:"new_mode,omitempty"`
+	// OrigBlob and NewBlob are the IDs of the file's contents in the
+	// base and head commits. They are empty if the file doesn't exist
+	// on that side or if the VCS doesn't report them (hg doesn't).
+	OrigBlob string `protobuf:"bytes,7,opt,name=orig_blob,proto3" json:"orig_blob,omitempty"`
+	NewBlob  string `protobuf:"bytes,8,opt,name=new_blob,proto3" json:"new_blob,omitempty"`
+	// Hunks are the changed regions of the file.
+	Hunks []*diff.Hunk `protobuf:"bytes,9,rep,name=hunks" json:"hunks,omitempty"`
+	// Added and Deleted are the number of lines added and deleted.
+	Added   int32 `protobuf:"varint,10,opt,name=added,proto3" json:"added,omitempty"`
+	Deleted int32 `protobuf:"varint,11,opt,name=deleted,proto3" json:"deleted,omitempty"`
+}
+
+func (m *FileDiff) Reset()         { *m = FileDiff{} }
+func (m *FileDiff) String() string { return proto.CompactTextString(m) }
+func (*FileDiff) ProtoMessage()    {}
+
+func (m *FileDiff) GetHunks() []*diff.Hunk {
+	if m != nil {
+		return m.Hunks
+	}
+	return nil
+}
+
+// CommitFiles are the files that a commit changed, compared with one
+// of its parents.
+type CommitFiles struct {
+	// Parent is the parent commit that the files are compared with.
+	// It is empty for a root commit, whose files are compared with an
+	// empty tree.
+	Parent CommitID `protobuf:"bytes,1,opt,name=parent,proto3,customtype=CommitID" json:"parent,omitempty"`
+	// Files are the files that changed, in the order that the VCS
+	// lists them.
+	Files []*ChangedFile `protobuf:"bytes,2,rep,name=files" json:"files,omitempty"`
+}
+
+func (m *CommitFiles) Reset()         { *m = CommitFiles{} }
+func (m *CommitFiles) String() string { return proto.CompactTextString(m) }
+func (*CommitFiles) ProtoMessage()    {}
+
+func (m *CommitFiles) GetFiles() []*ChangedFile {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+// A ChangedFile is a file that a commit changed.
+type ChangedFile struct {
+	// Path is the file's path in the commit, or in the parent if the
+	// file was deleted.
+	Path string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	// OrigPath is the file's path in the parent if it was renamed or
+	// copied. It is empty otherwise.
+	OrigPath string `protobuf:"bytes,2,opt,name=orig_path,proto3" json:"orig_path,omitempty"`
+	// ChangeType is the kind of change made to the file. It is never
+	// MODE_CHANGED; mode changes are reported as MODIFIED.
+	ChangeType FileChangeType `protobuf:"varint,3,opt,name=change_type,proto3,enum=vcs.FileChangeType" json:"change_type,omitempty"`
+	// Binary is whether the file's contents are binary. Lines aren't
+	// counted in binary files.
+	Binary bool `protobuf:"varint,4,opt,name=binary,proto3" json:"binary,omitempty"`
+	// Added and Deleted are the number of lines added and deleted.
+	Added   int32 `protobuf:"varint,5,opt,name=added,proto3" json:"added,omitempty"`
+	Deleted int32 `protobuf:"varint,6,opt,name=deleted,proto3" json:"deleted,omitempty"`
+}
+
+func (m *ChangedFile) Reset()         { *m = ChangedFile{} }
+func (m *ChangedFile) String() string { return proto.CompactTextString(m) }
+func (*ChangedFile) ProtoMessage()    {}
+
+// A FileCommit is a commit in the history of a file.
+type FileCommit struct {
+	Commit *Commit `protobuf:"bytes,1,opt,name=commit" json:"commit,omitempty"`
+	// Path is the file's path in the commit (or in the commit's parent,
+	// if the commit deleted the file). It differs from the path in
+	// later commits if the file was renamed.
+	Path string `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+}
+
+func (m *FileCommit) Reset()         { *m = FileCommit{} }
+func (m *FileCommit) String() string { return proto.CompactTextString(m) }
+func (*FileCommit) ProtoMessage()    {}
+
+func (m *FileCommit) GetCommit() *Commit {
+	if m != nil {
+		return m.Commit
+	}
+	return nil
+}
+
 // SearchOptions specifies options for a repository search.
 type SearchOptions struct {
 	// the query string
 	Query string `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
-	// currently only FixedQuery ("fixed") is supported
+	// the type of query: FixedQuery, RegexpQuery,
+	// ExtendedRegexpQuery, or PerlRegexpQuery
 	QueryType string `protobuf:"bytes,2,opt,name=query_type,proto3" json:"query_type,omitempty"`
 	// the number of lines before and after each hit to display
 	ContextLines int32 `protobuf:"varint,3,opt,name=context_lines,proto3" json:"context_lines,omitempty"`
 	// max number of matches to return
 	N int32 `protobuf:"varint,4,opt,name=n,proto3" json:"n,omitempty"`
-	// starting offset for matches (use with N for pagination)
+	// starting offset for matches (use with N for pagination, or
+	// use Cursor, which avoids searching the skipped matches again)
 	Offset int32 `protobuf:"varint,5,opt,name=offset,proto3" json:"offset,omitempty"`
+	// IgnoreCase makes the query match case-insensitively.
+	IgnoreCase bool `protobuf:"varint,6,opt,name=ignore_case,proto3" json:"ignore_case,omitempty"`
+	// Word makes the query only match whole words: a match must be
+	// at the beginning of a line or preceded by a non-word character,
+	// and at the end of a line or followed by a non-word character.
+	Word bool `protobuf:"varint,7,opt,name=word,proto3" json:"word,omitempty"`
+	// IncludePaths, if set, restricts the search to files whose paths
+	// match at least one of these globs. Globs are matched against
+	// the slash-separated file path and each of its parent
+	// directories. "*" matches any sequence of characters other than
+	// "/", and "**" matches zero or more directories.
+	IncludePaths []string `protobuf:"bytes,8,rep,name=include_paths" json:"include_paths,omitempty"`
+	// ExcludePaths excludes files whose paths match any of these
+	// globs (using the same syntax as IncludePaths) from the search.
+	ExcludePaths []string `protobuf:"bytes,9,rep,name=exclude_paths" json:"exclude_paths,omitempty"`
+	// Cursor, if set, is the Cursor of a result of a previous search
+	// with the same options (other than N), and makes the search
+	// resume after that result.
+	Cursor string `protobuf:"bytes,10,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	// MaxResultsPerFile, if nonzero, is the maximum number of results
+	// to return for each file.
+	MaxResultsPerFile int32 `protobuf:"varint,11,opt,name=max_results_per_file,proto3" json:"max_results_per_file,omitempty"`
 }
 
 func (m *SearchOptions) Reset()         { *m = SearchOptions{} }
@@ -177,12 +430,60 @@ type SearchResult struct {
 	// Match is the matching portion of the file from [StartByte,
 	// EndByte).
 	Match []byte `protobuf:"bytes,6,opt,name=match,proto3" json:"match,omitempty"`
+	// Matches are the individual matches of the query in Match, in
+	// order. Lines in [StartLine, EndLine] that don't contain any of
+	// the matches are context lines.
+	Matches []*SearchMatch `protobuf:"bytes,7,rep,name=matches" json:"matches,omitempty"`
+	// Cursor identifies the position of this result in the search's
+	// results, for use as SearchOptions.Cursor to resume the search
+	// after it.
+	Cursor string `protobuf:"bytes,8,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	// FileLimitHit is set on the last result for a file if the
+	// file has more results that were omitted because of the
+	// SearchOptions.MaxResultsPerFile limit.
+	FileLimitHit bool `protobuf:"varint,9,opt,name=file_limit_hit,proto3" json:"file_limit_hit,omitempty"`
 }
 
 func (m *SearchResult) Reset()         { *m = SearchResult{} }
 func (m *SearchResult) String() string { return proto.CompactTextString(m) }
 func (*SearchResult) ProtoMessage()    {}
 
+func (m *SearchResult) GetMatches() []*SearchMatch {
+	if m != nil {
+		return m.Matches
+	}
+	return nil
+}
+
+// SearchStats describes a completed search.
+type SearchStats struct {
+	// LimitHit is whether the search stopped because it found
+	// SearchOptions.N results and there were more results. Use the
+	// last result's Cursor to get the next results.
+	LimitHit bool `protobuf:"varint,1,opt,name=limit_hit,proto3" json:"limit_hit,omitempty"`
+}
+
+func (m *SearchStats) Reset()         { *m = SearchStats{} }
+func (m *SearchStats) String() string { return proto.CompactTextString(m) }
+func (*SearchStats) ProtoMessage()    {}
+
+// A SearchMatch is a single match of a search query in a file.
+type SearchMatch struct {
+	// Line is the line number of the line that contains the match.
+	Line uint32 `protobuf:"varint,1,opt,name=line,proto3" json:"line,omitempty"`
+	// Column is the byte offset of the start of the match from the
+	// start of its line (0 is the first byte of the line).
+	Column uint32 `protobuf:"varint,2,opt,name=column,proto3" json:"column,omitempty"`
+	// The byte range [start,end) of the match in the file. Subtract
+	// the SearchResult's StartByte to get the range in its Match.
+	StartByte uint32 `protobuf:"varint,3,opt,name=start_byte,proto3" json:"start_byte,omitempty"`
+	EndByte   uint32 `protobuf:"varint,4,opt,name=end_byte,proto3" json:"end_byte,omitempty"`
+}
+
+func (m *SearchMatch) Reset()         { *m = SearchMatch{} }
+func (m *SearchMatch) String() string { return proto.CompactTextString(m) }
+func (*SearchMatch) ProtoMessage()    {}
+
 // A Committer is a contributor to a repository.
 type Committer struct {
 	Name    string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -195,4 +496,6 @@ func (m *Committer) String() string { return proto.CompactTextString(m) }
 func (*Committer) ProtoMessage()    {}
 
 func init() {
+	proto.RegisterEnum("vcs.ObjectType", ObjectType_name, ObjectType_value)
+	proto.RegisterEnum("vcs.FileChangeType", FileChangeType_name, FileChangeType_value)
 }